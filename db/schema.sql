@@ -22,7 +22,10 @@ CREATE TABLE public.accounts (
     created timestamp without time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
     name text NOT NULL,
     "apiKey" text,
-    password text
+    password text,
+    version bigint DEFAULT 1 NOT NULL,
+    deleted timestamp without time zone,
+    "tokenGeneration" bigint DEFAULT 0 NOT NULL
 );
 
 
@@ -39,6 +42,90 @@ CREATE TABLE public."accountsFields" (
 );
 
 
+--
+-- Name: accountsNameHistory; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public."accountsNameHistory" (
+    id uuid NOT NULL,
+    "accountId" uuid NOT NULL,
+    name text NOT NULL,
+    renamed timestamp without time zone DEFAULT CURRENT_TIMESTAMP NOT NULL,
+    "reservedUntil" timestamp without time zone NOT NULL
+);
+
+
+--
+-- Name: auditCheckpoints; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public."auditCheckpoints" (
+    id bigint NOT NULL,
+    created timestamp without time zone NOT NULL,
+    "eventId" bigint NOT NULL,
+    "eventHash" text NOT NULL,
+    "keyId" text NOT NULL,
+    signature text NOT NULL
+);
+
+
+--
+-- Name: auditCheckpoints_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public."auditCheckpoints_id_seq"
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: auditCheckpoints_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public."auditCheckpoints_id_seq" OWNED BY public."auditCheckpoints".id;
+
+
+--
+-- Name: auditEvents; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public."auditEvents" (
+    id bigint NOT NULL,
+    created timestamp without time zone NOT NULL,
+    action text NOT NULL,
+    "actorId" uuid,
+    "targetId" uuid,
+    ip text DEFAULT ''::text NOT NULL,
+    "userAgent" text DEFAULT ''::text NOT NULL,
+    outcome text NOT NULL,
+    diff text,
+    "prevHash" text,
+    hash text
+);
+
+
+--
+-- Name: auditEvents_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+CREATE SEQUENCE public."auditEvents_id_seq"
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+--
+-- Name: auditEvents_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: -
+--
+
+ALTER SEQUENCE public."auditEvents_id_seq" OWNED BY public."auditEvents".id;
+
+
 --
 -- Name: renewalTokens; Type: TABLE; Schema: public; Owner: -
 --
@@ -46,7 +133,23 @@ CREATE TABLE public."accountsFields" (
 CREATE TABLE public."renewalTokens" (
     "accountId" uuid NOT NULL,
     exp timestamp without time zone DEFAULT (CURRENT_TIMESTAMP + '24:00:00'::interval) NOT NULL,
-    token character(60) NOT NULL
+    token character(60) NOT NULL,
+    "sessionId" uuid
+);
+
+
+--
+-- Name: sessions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.sessions (
+    id uuid NOT NULL,
+    "accountId" uuid NOT NULL,
+    method text NOT NULL,
+    ip text DEFAULT ''::text NOT NULL,
+    "userAgent" text DEFAULT ''::text NOT NULL,
+    created timestamp without time zone NOT NULL,
+    renewed timestamp without time zone NOT NULL
 );
 
 
@@ -59,6 +162,20 @@ CREATE TABLE public.schema_migrations (
 );
 
 
+--
+-- Name: auditCheckpoints id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public."auditCheckpoints" ALTER COLUMN id SET DEFAULT nextval('public."auditCheckpoints_id_seq"'::regclass);
+
+
+--
+-- Name: auditEvents id; Type: DEFAULT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public."auditEvents" ALTER COLUMN id SET DEFAULT nextval('public."auditEvents_id_seq"'::regclass);
+
+
 --
 -- Name: accountsFields accountsFields_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -67,6 +184,14 @@ ALTER TABLE ONLY public."accountsFields"
     ADD CONSTRAINT "accountsFields_pkey" PRIMARY KEY (id);
 
 
+--
+-- Name: accountsNameHistory accountsNameHistory_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public."accountsNameHistory"
+    ADD CONSTRAINT "accountsNameHistory_pkey" PRIMARY KEY (id);
+
+
 --
 -- Name: accounts accounts_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -75,6 +200,22 @@ ALTER TABLE ONLY public.accounts
     ADD CONSTRAINT accounts_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: auditCheckpoints auditCheckpoints_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public."auditCheckpoints"
+    ADD CONSTRAINT "auditCheckpoints_pkey" PRIMARY KEY (id);
+
+
+--
+-- Name: auditEvents auditEvents_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public."auditEvents"
+    ADD CONSTRAINT "auditEvents_pkey" PRIMARY KEY (id);
+
+
 --
 -- Name: schema_migrations schema_migrations_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -83,6 +224,14 @@ ALTER TABLE ONLY public.schema_migrations
     ADD CONSTRAINT schema_migrations_pkey PRIMARY KEY (version);
 
 
+--
+-- Name: sessions sessions_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.sessions
+    ADD CONSTRAINT sessions_pkey PRIMARY KEY (id);
+
+
 --
 -- Name: idx_accountname; Type: INDEX; Schema: public; Owner: -
 --
@@ -90,6 +239,20 @@ ALTER TABLE ONLY public.schema_migrations
 CREATE UNIQUE INDEX idx_accountname ON public.accounts USING btree (name);
 
 
+--
+-- Name: idx_accountsapikey; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX idx_accountsapikey ON public.accounts USING btree ("apiKey");
+
+
+--
+-- Name: idx_accountsdeleted; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX idx_accountsdeleted ON public.accounts USING btree (deleted) WHERE (deleted IS NOT NULL);
+
+
 --
 -- Name: idx_accountsfields; Type: INDEX; Schema: public; Owner: -
 --
@@ -97,6 +260,41 @@ CREATE UNIQUE INDEX idx_accountname ON public.accounts USING btree (name);
 CREATE UNIQUE INDEX idx_accountsfields ON public."accountsFields" USING btree ("accountId", name);
 
 
+--
+-- Name: idx_accountsnamehistoryaccountid; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX idx_accountsnamehistoryaccountid ON public."accountsNameHistory" USING btree ("accountId");
+
+
+--
+-- Name: idx_accountsnamehistoryname; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX idx_accountsnamehistoryname ON public."accountsNameHistory" USING btree (name);
+
+
+--
+-- Name: idx_auditeventsactorid; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX idx_auditeventsactorid ON public."auditEvents" USING btree ("actorId");
+
+
+--
+-- Name: idx_auditeventscreated; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX idx_auditeventscreated ON public."auditEvents" USING btree (created);
+
+
+--
+-- Name: idx_auditeventstargetid; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX idx_auditeventstargetid ON public."auditEvents" USING btree ("targetId");
+
+
 --
 -- Name: idx_renewaltokensaccountid; Type: INDEX; Schema: public; Owner: -
 --
@@ -111,6 +309,13 @@ CREATE INDEX idx_renewaltokensaccountid ON public."renewalTokens" USING btree ("
 CREATE INDEX idx_renewaltokensexp ON public."renewalTokens" USING btree (exp);
 
 
+--
+-- Name: idx_renewaltokenssessionid; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX idx_renewaltokenssessionid ON public."renewalTokens" USING btree ("sessionId");
+
+
 --
 -- Name: idx_renewaltokenstoken; Type: INDEX; Schema: public; Owner: -
 --
@@ -118,6 +323,13 @@ CREATE INDEX idx_renewaltokensexp ON public."renewalTokens" USING btree (exp);
 CREATE INDEX idx_renewaltokenstoken ON public."renewalTokens" USING btree (token);
 
 
+--
+-- Name: idx_sessionsaccountid; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX idx_sessionsaccountid ON public.sessions USING btree ("accountId", created);
+
+
 --
 -- Name: accountsFields accountsFields_accountId_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
 --
@@ -126,6 +338,14 @@ ALTER TABLE ONLY public."accountsFields"
     ADD CONSTRAINT "accountsFields_accountId_fkey" FOREIGN KEY ("accountId") REFERENCES public.accounts(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
 
 
+--
+-- Name: accountsNameHistory accountsNameHistory_accountId_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public."accountsNameHistory"
+    ADD CONSTRAINT "accountsNameHistory_accountId_fkey" FOREIGN KEY ("accountId") REFERENCES public.accounts(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
+
+
 --
 -- Name: renewalTokens renewalTokens_accountId_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
 --
@@ -134,6 +354,22 @@ ALTER TABLE ONLY public."renewalTokens"
     ADD CONSTRAINT "renewalTokens_accountId_fkey" FOREIGN KEY ("accountId") REFERENCES public.accounts(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
 
 
+--
+-- Name: renewalTokens renewalTokens_sessionId_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public."renewalTokens"
+    ADD CONSTRAINT "renewalTokens_sessionId_fkey" FOREIGN KEY ("sessionId") REFERENCES public.sessions(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
+
+
+--
+-- Name: sessions sessions_accountId_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.sessions
+    ADD CONSTRAINT "sessions_accountId_fkey" FOREIGN KEY ("accountId") REFERENCES public.accounts(id) ON UPDATE RESTRICT ON DELETE RESTRICT;
+
+
 --
 -- PostgreSQL database dump complete
 --
@@ -144,4 +380,12 @@ ALTER TABLE ONLY public."renewalTokens"
 --
 
 INSERT INTO public.schema_migrations (version) VALUES
-    ('20201207191913');
+    ('20201207191913'),
+    ('20261019120000'),
+    ('20261019130000'),
+    ('20261019140000'),
+    ('20261019160000'),
+    ('20261019170000'),
+    ('20261019180000'),
+    ('20261019190000'),
+    ('20261019200000');
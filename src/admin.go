@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/config"
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"gitea.larvit.se/pwrpln/go_log"
+	"github.com/google/uuid"
+)
+
+// adminAccountName is the name of the account managed by ADMIN_BOOTSTRAP
+const adminAccountName = "admin"
+
+// adminReconcile makes the "admin" account match the config, it is run on every start
+// The API key is set to ADMIN_API_KEY, the password to ADMIN_PASSWORD if it is set and "admin" is added to the "role" field.
+// Other fields, and the password when ADMIN_PASSWORD is not set, are left as they are.
+func adminReconcile(ctx context.Context, store db.Store, log go_log.Log, cfg config.Config) error {
+	if !cfg.AdminBootstrap {
+		log.Verbose("ADMIN_BOOTSTRAP is false, not touching the admin account")
+		return nil
+	}
+
+	account, err := store.AccountGet(ctx, "", "", adminAccountName)
+	if errors.Is(err, db.ErrNotFound) {
+		return adminCreate(ctx, store, log, cfg)
+	} else if err != nil {
+		return err
+	}
+
+	accountID := account.ID.String()
+
+	apiKeyHash := adminAPIKeyHash(cfg)
+	if account.APIKeyHash != apiKeyHash {
+		err = store.AccountAPIKeySet(ctx, accountID, apiKeyHash)
+		audit(ctx, store, log, auditSourceAdmin, db.AuditEvent{Action: db.AuditAPIKeySet, TargetID: accountID, Diff: db.AuditDiff(map[string]interface{}{"apiKey": db.AuditRedacted})}, err)
+		if err != nil {
+			return err
+		}
+		log.Info("Admin API key changed to ADMIN_API_KEY, the old key no longer works", "accountID", accountID)
+	}
+
+	if cfg.AdminPassword != "" && !utils.CheckPasswordHash(ctx, cfg.AdminPassword, account.Password) {
+		hashedPwd, err := utils.HashPassword(ctx, cfg.AdminPassword)
+		if err != nil {
+			return err
+		}
+
+		err = store.AccountPasswordSet(ctx, accountID, hashedPwd)
+		audit(ctx, store, log, auditSourceAdmin, db.AuditEvent{Action: db.AuditPasswordSet, TargetID: accountID, Diff: db.AuditDiff(map[string]interface{}{"password": db.AuditRedacted})}, err)
+		if err != nil {
+			return err
+		}
+		log.Info("Admin password changed to ADMIN_PASSWORD", "accountID", accountID)
+	}
+
+	if !utils.Contains(account.Fields["role"], "admin") {
+		ops := []db.AccountFieldsPatchOp{{Op: db.AccountFieldsPatchOpAddValues, Name: "role", Values: []string{"admin"}}}
+		_, err = store.AccountPatchFields(ctx, accountID, ops, 0)
+		audit(ctx, store, log, auditSourceAdmin, db.AuditEvent{Action: db.AuditFieldsUpdate, TargetID: accountID, Diff: db.AuditDiff(map[string]interface{}{"ops": ops})}, err)
+		if err != nil {
+			return err
+		}
+		log.Info("Added \"admin\" to the role field of the admin account", "accountID", accountID)
+	}
+
+	log.Verbose("Admin account matches the config", "accountID", accountID)
+
+	return nil
+}
+
+// adminCreate creates the admin account, with no password unless ADMIN_PASSWORD is set
+func adminCreate(ctx context.Context, store db.Store, log go_log.Log, cfg config.Config) error {
+	hashedPwd := ""
+	if cfg.AdminPassword != "" {
+		var err error
+		hashedPwd, err = utils.HashPassword(ctx, cfg.AdminPassword)
+		if err != nil {
+			return err
+		}
+	}
+
+	input := db.AccountCreateInput{
+		ID:         uuid.New(),
+		Name:       adminAccountName,
+		APIKeyHash: adminAPIKeyHash(cfg),
+		Password:   hashedPwd,
+		Fields:     []db.AccountCreateInputFields{{Name: "role", Values: []string{"admin"}}},
+	}
+	account, err := store.AccountCreate(ctx, input)
+	audit(ctx, store, log, auditSourceAdmin, accountCreateAuditEvent(input), err)
+	if errors.Is(err, db.ErrConflict) {
+		// A deleted account, or the old name of a renamed one, keeps the name from being used
+		return errors.New("the name \"" + adminAccountName + "\" is taken by a deleted or renamed account, restore it or set ADMIN_BOOTSTRAP=false")
+	} else if err != nil {
+		return err
+	}
+
+	log.Info("Created admin account", "accountID", account.ID)
+
+	return nil
+}
+
+// adminAPIKeyHash hashes ADMIN_API_KEY, an empty key gives no hash so the admin account can not auth by API key
+// The hash of an empty string is a fixed value, storing it would let anyone in with an empty key.
+func adminAPIKeyHash(cfg config.Config) string {
+	if cfg.AdminAPIKey == "" {
+		return ""
+	}
+
+	return utils.HashAPIKey(cfg.AdminAPIKey)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/config"
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"gitea.larvit.se/pwrpln/go_log"
+)
+
+func TestAdminReconcile(t *testing.T) {
+	ctx := context.Background()
+	log := go_log.GetLog()
+	log.MinLogLvl = go_log.LogLvlFromStr("Error")
+	store := &db.Memory{DeletedRetention: time.Hour, Log: log, OldNameReservation: time.Hour}
+
+	cfg := config.Default()
+	cfg.AdminAPIKey = "first-key"
+
+	err := adminReconcile(ctx, store, log, cfg)
+	if err != nil {
+		t.Fatalf("Could not create admin account: %v", err)
+	}
+
+	admin := adminGet(t, store)
+	if admin.APIKeyHash != utils.HashAPIKey("first-key") || admin.Password != "" || strings.Join(admin.Fields["role"], ",") != "admin" {
+		t.Fatalf("Unexpected admin account after create: %+v", admin)
+	}
+
+	// Somebody removed the role and the key changed in the config
+	_, err = store.AccountPatchFields(ctx, admin.ID.String(), []db.AccountFieldsPatchOp{{Op: db.AccountFieldsPatchOpSet, Name: "role", Values: []string{"user"}}}, 0)
+	if err != nil {
+		t.Fatalf("Could not set role: %v", err)
+	}
+	cfg.AdminAPIKey = "second-key"
+	cfg.AdminPassword = "secret"
+
+	err = adminReconcile(ctx, store, log, cfg)
+	if err != nil {
+		t.Fatalf("Could not reconcile admin account: %v", err)
+	}
+
+	reconciled := adminGet(t, store)
+	if reconciled.ID != admin.ID {
+		t.Fatalf("Expected the same admin account to be kept, got %s and %s", admin.ID, reconciled.ID)
+	}
+	if reconciled.APIKeyHash != utils.HashAPIKey("second-key") {
+		t.Fatalf("Expected the API key to follow ADMIN_API_KEY")
+	}
+	if !utils.CheckPasswordHash(ctx, "secret", reconciled.Password) {
+		t.Fatalf("Expected the password to be set from ADMIN_PASSWORD")
+	}
+	if strings.Join(reconciled.Fields["role"], ",") != "user,admin" {
+		t.Fatalf("Expected \"admin\" to be added to the other roles, got %v", reconciled.Fields["role"])
+	}
+
+	// Every change is in the audit log, with no actor and without the secrets
+	events, err := store.AuditEventsGet(ctx, db.AuditEventsGetInput{TargetID: admin.ID.String()})
+	if err != nil {
+		t.Fatalf("Could not get audit events: %v", err)
+	}
+	var actions []string
+	for _, event := range events.Events {
+		if event.ActorID != "" || event.UserAgent != auditSourceAdmin || event.Outcome != db.AuditOutcomeSuccess {
+			t.Fatalf("Unexpected audit event: %+v", event)
+		}
+		if strings.Contains(string(event.Diff), "second-key") || strings.Contains(string(event.Diff), "secret") {
+			t.Fatalf("Expected secrets to be redacted in audit event: %s", event.Diff)
+		}
+		actions = append(actions, event.Action)
+	}
+	if strings.Join(actions, ",") != "fields.update,password.set,apiKey.set,account.create" {
+		t.Fatalf("Unexpected audit events, newest first: %v", actions)
+	}
+
+	// Nothing changes when bootstrap is off
+	cfg.AdminBootstrap = false
+	cfg.AdminAPIKey = "third-key"
+	err = adminReconcile(ctx, store, log, cfg)
+	if err != nil {
+		t.Fatalf("Expected reconcile to do nothing, got %v", err)
+	}
+	if adminGet(t, store).APIKeyHash != utils.HashAPIKey("second-key") {
+		t.Fatalf("Expected the API key to be left alone with ADMIN_BOOTSTRAP=false")
+	}
+
+	// An empty key removes the API key instead of storing the hash of an empty string
+	cfg.AdminBootstrap = true
+	cfg.AdminAPIKey = ""
+	err = adminReconcile(ctx, store, log, cfg)
+	if err != nil {
+		t.Fatalf("Could not reconcile admin account: %v", err)
+	}
+	if adminGet(t, store).APIKeyHash != "" {
+		t.Fatalf("Expected no API key hash with an empty ADMIN_API_KEY")
+	}
+	_, err = store.AccountGet(ctx, "", utils.HashAPIKey(""), "")
+	if err == nil {
+		t.Fatalf("Expected no account to match an empty API key")
+	}
+
+	// A deleted admin account is not silently recreated
+	err = store.AccountDel(ctx, admin.ID.String(), 0)
+	if err != nil {
+		t.Fatalf("Could not delete admin account: %v", err)
+	}
+	err = adminReconcile(ctx, store, log, cfg)
+	if err == nil || !strings.Contains(err.Error(), "ADMIN_BOOTSTRAP") {
+		t.Fatalf("Expected an error about the deleted admin account, got %v", err)
+	}
+}
+
+func adminGet(t *testing.T, store db.Store) db.Account {
+	t.Helper()
+
+	account, err := store.AccountGet(context.Background(), "", "", adminAccountName)
+	if err != nil {
+		t.Fatalf("Could not get admin account: %v", err)
+	}
+
+	return account
+}
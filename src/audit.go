@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/config"
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"gitea.larvit.se/pwrpln/go_log"
+)
+
+// Where changes not made through the API come from, stored as the user agent of their audit events
+const (
+	auditSourceAdmin  = "auth-api ADMIN_BOOTSTRAP"
+	auditSourceCLI    = "auth-api cli"
+	auditSourceImport = "auth-api import"
+	auditSourceSeed   = "auth-api seed file"
+)
+
+// audit writes the audit event of a change made from the command line or at startup, with the outcome from err
+// These events have no actor or IP. A failed write is logged, the change is already made.
+func audit(ctx context.Context, store db.Store, log go_log.Log, source string, event db.AuditEvent, err error) {
+	event.Outcome = db.AuditOutcomeSuccess
+	if errors.Is(err, db.ErrConflict) || errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrValidation) || errors.Is(err, db.ErrVersionMismatch) {
+		event.Outcome = db.AuditOutcomeInvalid
+	} else if err != nil {
+		event.Outcome = db.AuditOutcomeError
+	}
+	event.UserAgent = source
+
+	_, auditErr := store.AuditEventCreate(ctx, event)
+	if auditErr != nil {
+		log.Error("Could not write audit event", "err", auditErr.Error(), "action", event.Action, "outcome", event.Outcome, "targetId", event.TargetID)
+	}
+}
+
+// accountCreateAuditEvent is the audit event of creating an account, with the same diff as POST /accounts
+func accountCreateAuditEvent(input db.AccountCreateInput) db.AuditEvent {
+	diff := map[string]interface{}{"name": input.Name, "fields": db.AuditFields(input.Fields)}
+	if input.Password != "" {
+		diff["password"] = db.AuditRedacted
+	}
+
+	return db.AuditEvent{Action: db.AuditAccountCreate, TargetID: input.ID.String(), Diff: db.AuditDiff(diff)}
+}
+
+// auditSign makes a checkpoint of the audit chain, errors are only logged and it is tried again on the next interval
+func auditSign(ctx context.Context, store db.Store, log go_log.Log, secret []byte) {
+	checkpoint, signed, err := db.AuditSign(ctx, store, secret)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Error("Could not sign audit chain", "err", err.Error())
+		}
+		return
+	}
+	if signed {
+		log.Verbose("Signed audit chain", "eventID", checkpoint.EventID, "checkpointID", checkpoint.ID)
+	}
+}
+
+// auditCmd runs "audit verify", it exits with 1 if the chain is broken
+// The checkpoints are checked with JWT_SHARED_SECRET, and with the secrets it had before given with --old-secret.
+func auditCmd(ctx context.Context, store db.Store, log go_log.Log, cfg config.Config, args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	var oldSecrets stringsFlag
+	flags := newFlagSet("audit verify")
+	flags.Var(&oldSecrets, "old-secret", "A JWT_SHARED_SECRET used before, can be repeated")
+	if flags.Parse(args[1:]) != nil {
+		return 2
+	}
+
+	secrets := [][]byte{[]byte(cfg.JWTSharedSecret)}
+	for _, oldSecret := range oldSecrets {
+		secrets = append(secrets, []byte(oldSecret))
+	}
+
+	result, err := db.AuditVerify(ctx, store, secrets)
+	if err != nil {
+		log.Error("Could not verify audit chain", "err", err.Error())
+		return 1
+	}
+
+	if result.Broken != "" {
+		fmt.Printf("Audit chain is broken at event %d: %s\n", result.BrokenEventID, result.Broken)
+		fmt.Printf("%d events before it are intact\n", result.Events)
+		return 1
+	}
+
+	fmt.Printf("Audit chain is intact: %d events up to event %d and %d checkpoints verified\n", result.Events, result.LastEventID, result.Checkpoints)
+	if result.Unchained != 0 {
+		fmt.Printf("%d events from before the chain started are not covered\n", result.Unchained)
+	}
+	if result.Unsigned != 0 {
+		fmt.Printf("%d events after the last checkpoint could be removed from the end without it showing\n", result.Unsigned)
+	}
+
+	return 0
+}
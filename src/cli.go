@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/config"
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"gitea.larvit.se/pwrpln/go_log"
+	"github.com/google/uuid"
+)
+
+const usage = `Usage: main [flags] [command]
+
+Commands:
+  serve                                  Run the web server, this is the default
+  migrate up|down|status                 Apply, roll back or list the schema migrations
+  account create --name NAME [--password PASSWORD] [--field NAME=VALUE,VALUE]...
+  account get --id ID | --name NAME
+  account list [--prefix PREFIX] [--field NAME=VALUE,VALUE]... [--deleted]
+  account delete --id ID | --name NAME
+  account set-password --id ID | --name NAME --password PASSWORD
+  apikey rotate --id ID | --name NAME    Give an account a new API key
+  audit verify [--old-secret SECRET]...  Check that the audit log has not been changed
+  tokens revoke --account ID             Remove all renewal tokens of an account
+  keys generate                          Print a new random secret to use as JWT_SHARED_SECRET
+  export [--file FILE]                   Write all accounts as JSON lines
+  import [--file FILE]                   Create the accounts from an export
+  seed [--file FILE] [--dry-run]         Create or update the accounts in a seed file, defaults to SEED_FILE
+
+Use "--password -" to read the password from the first line of stdin instead.
+All commands use the same config as the web server. Every ENV can also be given as a flag
+before the command, like --database-url for DATABASE_URL, and in a file with --config.
+`
+
+// runCmd runs a command with its arguments and returns the exit code
+func runCmd(cfg config.Config, log go_log.Log, cmd string, args []string) int {
+	switch cmd {
+	case "serve":
+		return serve(cfg, log, args)
+	case "keys":
+		return keysCmd(args)
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	case "account", "apikey", "audit", "export", "import", "migrate", "seed", "tokens":
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	if !configValidate(cfg, log, false) {
+		return 1
+	}
+
+	store, closeStore := openStore(cfg, log)
+	defer closeStore()
+
+	if cmd == "migrate" {
+		return migrateCmd(store, log, args)
+	}
+
+	// Like the web server, refuse to touch data if the schema does not match
+	migrationsEnsure(store, log, cfg.DBAutoMigrate)
+
+	ctx := context.Background()
+
+	switch cmd {
+	case "account":
+		return accountCmd(ctx, store, log, args)
+	case "apikey":
+		return apikeyCmd(ctx, store, log, args)
+	case "audit":
+		return auditCmd(ctx, store, log, cfg, args)
+	case "export":
+		return exportCmd(ctx, store, log, args)
+	case "import":
+		return importCmd(ctx, store, log, args)
+	case "seed":
+		return seedCmd(ctx, store, log, cfg, args)
+	default:
+		return tokensCmd(ctx, store, log, args)
+	}
+}
+
+// configValidate logs the problems with the config and returns false if it is invalid, server adds the checks for the web server
+func configValidate(cfg config.Config, log go_log.Log, server bool) bool {
+	warnings, err := cfg.Validate(server)
+	for _, warning := range warnings {
+		log.Warn("Insecure config: " + warning)
+	}
+	if err != nil {
+		log.Error("Invalid config, refusing to start", "err", err.Error(), "mode", cfg.Mode)
+		return false
+	}
+
+	return true
+}
+
+// keysCmd runs "keys generate"
+// JWTs are signed with the shared secret from the JWT_SHARED_SECRET ENV, so it only prints a new one, changing the ENV is up to the operator.
+func keysCmd(args []string) int {
+	if len(args) != 1 || args[0] != "generate" {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	secret := make([]byte, 48)
+	_, err := rand.Read(secret)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not generate a new secret: "+err.Error())
+		return 1
+	}
+
+	fmt.Println(base64.RawURLEncoding.EncodeToString(secret))
+	fmt.Fprintln(os.Stderr, "Nothing has been changed, set this as JWT_SHARED_SECRET for auth-api and every service that verifies its JWTs, then restart them.")
+	fmt.Fprintln(os.Stderr, "WARNING: changing JWT_SHARED_SECRET invalidates every JWT that has been handed out, clients must get new ones with their renewal tokens.")
+	fmt.Fprintln(os.Stderr, "WARNING: it also invalidates the signatures of the audit checkpoints, keep the old secret for \"audit verify --old-secret\".")
+
+	return 0
+}
+
+// newFlagSet returns a flag set for a command, it prints its own errors to stderr
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ContinueOnError)
+}
+
+// fieldsFlag collects repeated --field flags like "role=admin,user"
+type fieldsFlag []db.AccountCreateInputFields
+
+func (f *fieldsFlag) String() string { return "" }
+
+func (f *fieldsFlag) Set(value string) error {
+	name, values, found := strings.Cut(value, "=")
+	if !found || name == "" {
+		return errors.New("must be like name=value1,value2")
+	}
+
+	field := db.AccountCreateInputFields{Name: name, Values: []string{}}
+	if values != "" {
+		field.Values = strings.Split(values, ",")
+	}
+	*f = append(*f, field)
+
+	return nil
+}
+
+// stringsFlag collects a flag that can be repeated
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return "" }
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// accountIDResolve returns the id of the account given by --id or --name
+func accountIDResolve(ctx context.Context, store db.Store, id string, name string) (string, error) {
+	if id != "" && name != "" {
+		return "", errors.New("give either --id or --name, not both")
+	}
+
+	if id != "" {
+		_, err := uuid.Parse(id)
+		if err != nil {
+			return "", db.ValidationError{Field: "id", Msg: "invalid account ID"}
+		}
+
+		return id, nil
+	}
+
+	if name != "" {
+		account, err := store.AccountGet(ctx, "", "", name)
+		if err != nil {
+			return "", err
+		}
+
+		return account.ID.String(), nil
+	}
+
+	return "", errors.New("--id or --name is required")
+}
+
+// passwordRead returns the password flag, or the first line of stdin if it is "-"
+func passwordRead(password string) (string, error) {
+	if password != "-" {
+		return password, nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", errors.New("could not read password from stdin")
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// printJSON writes v as indented JSON to stdout
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v) // Can not fail for the structs from db
+}
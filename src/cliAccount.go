@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"gitea.larvit.se/pwrpln/go_log"
+	"github.com/google/uuid"
+)
+
+// accountCmd runs "account create/get/list/delete/set-password"
+func accountCmd(ctx context.Context, store db.Store, log go_log.Log, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "create":
+		return accountCreateCmd(ctx, store, log, args[1:])
+	case "delete":
+		return accountDelCmd(ctx, store, log, args[1:])
+	case "get":
+		return accountGetCmd(ctx, store, log, args[1:])
+	case "list":
+		return accountsListCmd(ctx, store, log, args[1:])
+	case "set-password":
+		return accountPasswordSetCmd(ctx, store, log, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+}
+
+func accountCreateCmd(ctx context.Context, store db.Store, log go_log.Log, args []string) int {
+	var fields fieldsFlag
+	flags := newFlagSet("account create")
+	name := flags.String("name", "", "Account name")
+	password := flags.String("password", "", "Password, \"-\" to read it from stdin")
+	flags.Var(&fields, "field", "Field like \"role=admin,user\", can be repeated")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	if *name == "" {
+		log.Error("--name can not be empty")
+		return 2
+	}
+
+	plainPassword, err := passwordRead(*password)
+	if err != nil {
+		log.Error("Could not get password", "err", err.Error())
+		return 1
+	}
+
+	hashedPwd, err := utils.HashPassword(ctx, plainPassword)
+	if err != nil {
+		log.Error("Could not hash password", "err", err.Error())
+		return 1
+	}
+
+	apiKey := utils.RandString(60)
+	input := db.AccountCreateInput{
+		ID:         uuid.New(),
+		Name:       *name,
+		APIKeyHash: utils.HashAPIKey(apiKey),
+		Fields:     fields,
+		Password:   hashedPwd,
+	}
+	createdAccount, err := store.AccountCreate(ctx, input)
+	audit(ctx, store, log, auditSourceCLI, accountCreateAuditEvent(input), err)
+	if err != nil {
+		log.Error("Could not create account", "err", err.Error())
+		return 1
+	}
+	createdAccount.APIKey = apiKey
+
+	printJSON(createdAccount)
+
+	return 0
+}
+
+func accountDelCmd(ctx context.Context, store db.Store, log go_log.Log, args []string) int {
+	flags := newFlagSet("account delete")
+	id := flags.String("id", "", "Account ID")
+	name := flags.String("name", "", "Account name")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	accountID, err := accountIDResolve(ctx, store, *id, *name)
+	if err != nil {
+		log.Error("Could not find account", "err", err.Error())
+		return 1
+	}
+
+	err = store.AccountDel(ctx, accountID, 0)
+	audit(ctx, store, log, auditSourceCLI, db.AuditEvent{Action: db.AuditAccountDelete, TargetID: accountID}, err)
+	if err != nil {
+		log.Error("Could not delete account", "err", err.Error(), "accountID", accountID)
+		return 1
+	}
+
+	fmt.Println("Deleted account " + accountID)
+
+	return 0
+}
+
+func accountGetCmd(ctx context.Context, store db.Store, log go_log.Log, args []string) int {
+	flags := newFlagSet("account get")
+	id := flags.String("id", "", "Account ID")
+	name := flags.String("name", "", "Account name")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	accountID, err := accountIDResolve(ctx, store, *id, *name)
+	if err != nil {
+		log.Error("Could not find account", "err", err.Error())
+		return 1
+	}
+
+	account, err := store.AccountGetIncludingDeleted(ctx, accountID)
+	if err != nil {
+		log.Error("Could not get account", "err", err.Error(), "accountID", accountID)
+		return 1
+	}
+
+	printJSON(account)
+
+	return 0
+}
+
+func accountsListCmd(ctx context.Context, store db.Store, log go_log.Log, args []string) int {
+	var fields fieldsFlag
+	flags := newFlagSet("account list")
+	includeDeleted := flags.Bool("deleted", false, "Include deleted accounts")
+	prefix := flags.String("prefix", "", "Only accounts with names starting with this")
+	flags.Var(&fields, "field", "Only accounts with all these values in a field, like \"role=admin\", can be repeated")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	input := db.AccountsGetInput{
+		FieldFilters:   make(map[string][]string, len(fields)),
+		IncludeDeleted: *includeDeleted,
+		Limit:          100,
+		NamePrefix:     *prefix,
+		SortBy:         "name",
+	}
+	for _, field := range fields {
+		input.FieldFilters[field.Name] = append(input.FieldFilters[field.Name], field.Values...)
+	}
+
+	// One account per line, so the output can be piped to other tools
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		accountsList, err := store.AccountsGet(ctx, input)
+		if err != nil {
+			log.Error("Could not list accounts", "err", err.Error())
+			return 1
+		}
+
+		for _, account := range accountsList.Accounts {
+			encoder.Encode(account)
+		}
+
+		if accountsList.NextCursor == "" {
+			return 0
+		}
+		input.Cursor = accountsList.NextCursor
+	}
+}
+
+func accountPasswordSetCmd(ctx context.Context, store db.Store, log go_log.Log, args []string) int {
+	flags := newFlagSet("account set-password")
+	id := flags.String("id", "", "Account ID")
+	name := flags.String("name", "", "Account name")
+	password := flags.String("password", "", "New password, \"-\" to read it from stdin")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	accountID, err := accountIDResolve(ctx, store, *id, *name)
+	if err != nil {
+		log.Error("Could not find account", "err", err.Error())
+		return 1
+	}
+
+	plainPassword, err := passwordRead(*password)
+	if err != nil {
+		log.Error("Could not get password", "err", err.Error())
+		return 1
+	}
+	if plainPassword == "" {
+		log.Error("--password can not be empty")
+		return 2
+	}
+
+	hashedPwd, err := utils.HashPassword(ctx, plainPassword)
+	if err != nil {
+		log.Error("Could not hash password", "err", err.Error())
+		return 1
+	}
+
+	err = store.AccountPasswordSet(ctx, accountID, hashedPwd)
+	audit(ctx, store, log, auditSourceCLI, db.AuditEvent{Action: db.AuditPasswordSet, TargetID: accountID, Diff: db.AuditDiff(map[string]interface{}{"password": db.AuditRedacted})}, err)
+	if err != nil {
+		log.Error("Could not set password", "err", err.Error(), "accountID", accountID)
+		return 1
+	}
+
+	fmt.Println("Password set for account " + accountID)
+
+	return 0
+}
+
+// apikeyCmd runs "apikey rotate", the old API key stops working right away
+func apikeyCmd(ctx context.Context, store db.Store, log go_log.Log, args []string) int {
+	if len(args) == 0 || args[0] != "rotate" {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	flags := newFlagSet("apikey rotate")
+	id := flags.String("id", "", "Account ID")
+	name := flags.String("name", "", "Account name")
+	if flags.Parse(args[1:]) != nil {
+		return 2
+	}
+
+	accountID, err := accountIDResolve(ctx, store, *id, *name)
+	if err != nil {
+		log.Error("Could not find account", "err", err.Error())
+		return 1
+	}
+
+	newAPIKey := utils.RandString(60)
+	err = store.AccountAPIKeySet(ctx, accountID, utils.HashAPIKey(newAPIKey))
+	audit(ctx, store, log, auditSourceCLI, db.AuditEvent{Action: db.AuditAPIKeySet, TargetID: accountID, Diff: db.AuditDiff(map[string]interface{}{"apiKey": db.AuditRedacted})}, err)
+	if err != nil {
+		log.Error("Could not set API key", "err", err.Error(), "accountID", accountID)
+		return 1
+	}
+
+	fmt.Println(newAPIKey)
+
+	return 0
+}
+
+// tokensCmd runs "tokens revoke", JWTs already handed out stay valid until they expire
+func tokensCmd(ctx context.Context, store db.Store, log go_log.Log, args []string) int {
+	if len(args) == 0 || args[0] != "revoke" {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	flags := newFlagSet("tokens revoke")
+	id := flags.String("account", "", "Account ID")
+	if flags.Parse(args[1:]) != nil {
+		return 2
+	}
+
+	if *id == "" {
+		log.Error("--account is required")
+		return 2
+	}
+
+	accountID, err := accountIDResolve(ctx, store, *id, "")
+	if err != nil {
+		log.Error("Could not find account", "err", err.Error())
+		return 1
+	}
+
+	removed, err := store.RenewalTokensRm(ctx, accountID)
+	audit(ctx, store, log, auditSourceCLI, db.AuditEvent{Action: db.AuditTokensRevoke, TargetID: accountID}, err)
+	if err != nil {
+		log.Error("Could not revoke renewal tokens", "err", err.Error(), "accountID", accountID)
+		return 1
+	}
+
+	fmt.Printf("Revoked %d renewal tokens of account %s\n", removed, accountID)
+
+	return 0
+}
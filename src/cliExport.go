@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"gitea.larvit.se/pwrpln/go_log"
+	"github.com/google/uuid"
+)
+
+// accountExport is an account in the export format, one JSON object per line
+// Deleted accounts, renewal tokens, creation times and versions are not exported.
+type accountExport struct {
+	APIKey     string              `json:"apiKey,omitempty"` // Only in exports from before API keys were hashed, it is hashed on import
+	APIKeyHash string              `json:"apiKeyHash"`
+	Fields     map[string][]string `json:"fields"`
+	ID         uuid.UUID           `json:"id"`
+	Name       string              `json:"name"`
+	Password   string              `json:"password"` // bcrypt hash
+}
+
+// exportCmd writes all accounts that are not deleted, with their API key and password hashes
+func exportCmd(ctx context.Context, store db.Store, log go_log.Log, args []string) int {
+	flags := newFlagSet("export")
+	fileName := flags.String("file", "", "Write to this file instead of stdout")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	var out io.Writer = os.Stdout
+	if *fileName != "" {
+		// Only readable by the owner, it contains credentials
+		file, err := os.OpenFile(*fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			log.Error("Could not create export file", "err", err.Error())
+			return 1
+		}
+		defer file.Close()
+		out = file
+	}
+
+	encoder := json.NewEncoder(out)
+	exported := 0
+	input := db.AccountsGetInput{Limit: 100}
+	for {
+		accountsList, err := store.AccountsGet(ctx, input)
+		if err != nil {
+			log.Error("Could not list accounts", "err", err.Error())
+			return 1
+		}
+
+		for _, listed := range accountsList.Accounts {
+			// The list does not include credentials
+			account, err := store.AccountGet(ctx, listed.ID.String(), "", "")
+			if errors.Is(err, db.ErrNotFound) {
+				continue // Deleted since it was listed
+			} else if err != nil {
+				log.Error("Could not get account", "err", err.Error(), "accountID", listed.ID)
+				return 1
+			}
+
+			err = encoder.Encode(accountExport{
+				APIKeyHash: account.APIKeyHash,
+				Fields:     account.Fields,
+				ID:         account.ID,
+				Name:       account.Name,
+				Password:   account.Password,
+			})
+			if err != nil {
+				log.Error("Could not write export", "err", err.Error())
+				return 1
+			}
+			exported++
+		}
+
+		if accountsList.NextCursor == "" {
+			break
+		}
+		input.Cursor = accountsList.NextCursor
+	}
+
+	fmt.Fprintf(os.Stderr, "Exported %d accounts\n", exported)
+
+	return 0
+}
+
+// importCmd creates the accounts from an export, accounts with an id that already exists are skipped
+func importCmd(ctx context.Context, store db.Store, log go_log.Log, args []string) int {
+	flags := newFlagSet("import")
+	fileName := flags.String("file", "", "Read from this file instead of stdin")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	var in io.Reader = os.Stdin
+	if *fileName != "" {
+		file, err := os.Open(*fileName)
+		if err != nil {
+			log.Error("Could not open import file", "err", err.Error())
+			return 1
+		}
+		defer file.Close()
+		in = file
+	}
+
+	decoder := json.NewDecoder(in)
+	decoder.DisallowUnknownFields()
+
+	imported := 0
+	skipped := 0
+	for {
+		var account accountExport
+		err := decoder.Decode(&account)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			log.Error("Could not read account from import", "err", err.Error(), "imported", imported)
+			return 1
+		}
+
+		_, err = store.AccountGetIncludingDeleted(ctx, account.ID.String())
+		if err == nil {
+			log.Verbose("Account already exists, skipping it", "accountID", account.ID)
+			skipped++
+			continue
+		} else if !errors.Is(err, db.ErrNotFound) {
+			log.Error("Could not check if account exists", "err", err.Error(), "accountID", account.ID, "imported", imported)
+			return 1
+		}
+
+		fieldNames := make([]string, 0, len(account.Fields))
+		for fieldName := range account.Fields {
+			fieldNames = append(fieldNames, fieldName)
+		}
+		sort.Strings(fieldNames)
+
+		fields := make([]db.AccountCreateInputFields, 0, len(fieldNames))
+		for _, fieldName := range fieldNames {
+			fields = append(fields, db.AccountCreateInputFields{Name: fieldName, Values: account.Fields[fieldName]})
+		}
+
+		if account.APIKeyHash == "" && account.APIKey != "" {
+			account.APIKeyHash = utils.HashAPIKey(account.APIKey)
+		}
+
+		input := db.AccountCreateInput{
+			ID:         account.ID,
+			Name:       account.Name,
+			APIKeyHash: account.APIKeyHash,
+			Fields:     fields,
+			Password:   account.Password,
+		}
+		_, err = store.AccountCreate(ctx, input)
+		audit(ctx, store, log, auditSourceImport, accountCreateAuditEvent(input), err)
+		if err != nil {
+			log.Error("Could not import account", "err", err.Error(), "accountID", account.ID, "imported", imported)
+			return 1
+		}
+		imported++
+	}
+
+	fmt.Printf("Imported %d accounts, skipped %d that already existed\n", imported, skipped)
+
+	return 0
+}
@@ -0,0 +1,343 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitea.larvit.se/pwrpln/go_log"
+	"gopkg.in/yaml.v3"
+)
+
+// Modes the server can run in
+const (
+	ModeDevelopment = "development"
+	ModeProduction  = "production" // Refuses to start with default or weak secrets
+)
+
+// minSecretLen is the shortest JWT_SHARED_SECRET and ADMIN_API_KEY allowed in production mode
+const minSecretLen = 32
+
+// insecureDefault is the placeholder for secrets in .env_example
+const insecureDefault = "changeMe"
+
+// Config is the configuration of auth-api
+// It is read, with the later ones taking precedence, from defaults, a config file, ENVs and command line flags.
+type Config struct {
+	AdminAPIKey        string
+	AdminBootstrap     bool          // Keep the "admin" account in sync with AdminAPIKey and AdminPassword on every start
+	AdminPassword      string        // Empty leaves the password of the admin account as it is
+	AuditCheckpoints   time.Duration // How often the end of the audit chain is signed, 0 means never
+	DatabaseURL        string
+	DBAutoMigrate      bool
+	DBQueryTimeout     time.Duration // Max time for each SQL statement, 0 means no limit
+	DeletedRetention   time.Duration // How long deleted accounts can be restored before they are purged
+	JWTSharedSecret    string
+	LogMinLvl          string // Empty means the default of the command
+	Mode               string
+	OldNameReservation time.Duration // How long the old name of a renamed account is kept from others
+	RequestTimeout     time.Duration // Max time for each HTTP request, 0 means no limit
+	SeedFile           string        // Accounts to create or update on every start, empty means none
+	ShutdownDrainDelay time.Duration // How long readiness fails before new connections are refused on shutdown
+	ShutdownGrace      time.Duration // Max time to wait for requests to finish on shutdown, 0 means no limit
+	TracesExporter     string        // Where spans are sent, "none", "otlp" or "stdout"
+	WebBindHost        string
+}
+
+// Default returns the config used for everything not set in a file, ENV or flag
+func Default() Config {
+	return Config{
+		AdminBootstrap:     true,
+		AuditCheckpoints:   time.Hour,
+		DBQueryTimeout:     10 * time.Second,
+		DeletedRetention:   30 * 24 * time.Hour,
+		Mode:               ModeDevelopment,
+		OldNameReservation: 30 * 24 * time.Hour,
+		RequestTimeout:     30 * time.Second,
+		ShutdownDrainDelay: 5 * time.Second,
+		ShutdownGrace:      20 * time.Second,
+		TracesExporter:     "none",
+	}
+}
+
+// setting is one configuration value
+// name is the ENV, it is also the key in the config file and, lower case with dashes, the command line flag.
+type setting struct {
+	name   string
+	secret bool // Can also be read from the file in NAME_FILE, like a docker or kubernetes secret
+	set    func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{name: "ADMIN_API_KEY", secret: true, set: func(c *Config, value string) error { c.AdminAPIKey = value; return nil }},
+	{name: "ADMIN_BOOTSTRAP", set: func(c *Config, value string) error { return parseBool(&c.AdminBootstrap, value) }},
+	{name: "ADMIN_PASSWORD", secret: true, set: func(c *Config, value string) error { c.AdminPassword = value; return nil }},
+	{name: "AUDIT_CHECKPOINT_INTERVAL", set: func(c *Config, value string) error { return parseDuration(&c.AuditCheckpoints, value) }},
+	{name: "DATABASE_URL", secret: true, set: func(c *Config, value string) error { c.DatabaseURL = value; return nil }},
+	{name: "DB_AUTO_MIGRATE", set: func(c *Config, value string) error { return parseBool(&c.DBAutoMigrate, value) }},
+	{name: "DB_QUERY_TIMEOUT", set: func(c *Config, value string) error { return parseDuration(&c.DBQueryTimeout, value) }},
+	{name: "DELETED_ACCOUNT_RETENTION", set: func(c *Config, value string) error { return parseDuration(&c.DeletedRetention, value) }},
+	{name: "JWT_SHARED_SECRET", secret: true, set: func(c *Config, value string) error { c.JWTSharedSecret = value; return nil }},
+	{name: "LOG_MIN_LVL", set: func(c *Config, value string) error { c.LogMinLvl = value; return nil }},
+	{name: "MODE", set: func(c *Config, value string) error { c.Mode = value; return nil }},
+	{name: "OLD_NAME_RESERVATION", set: func(c *Config, value string) error { return parseDuration(&c.OldNameReservation, value) }},
+	{name: "REQUEST_TIMEOUT", set: func(c *Config, value string) error { return parseDuration(&c.RequestTimeout, value) }},
+	{name: "SEED_FILE", set: func(c *Config, value string) error { c.SeedFile = value; return nil }},
+	{name: "SHUTDOWN_DRAIN_DELAY", set: func(c *Config, value string) error { return parseDuration(&c.ShutdownDrainDelay, value) }},
+	{name: "SHUTDOWN_GRACE_PERIOD", set: func(c *Config, value string) error { return parseDuration(&c.ShutdownGrace, value) }},
+	{name: "TRACES_EXPORTER", set: func(c *Config, value string) error { c.TracesExporter = value; return nil }},
+	{name: "WEB_BIND_HOST", set: func(c *Config, value string) error { c.WebBindHost = value; return nil }},
+}
+
+// Load reads the config and returns it with the arguments left after the flags, like the command to run
+// The config file is given with --config or the CONFIG_FILE ENV, it can be YAML or JSON.
+func Load(args []string, getenv func(string) string) (Config, []string, error) {
+	flags := flag.NewFlagSet("main", flag.ContinueOnError)
+	configFile := flags.String("config", "", "Config file, YAML or JSON, with the ENV names as keys")
+	for _, s := range settings {
+		flags.String(flagName(s.name), "", "Same as the "+s.name+" ENV")
+		if s.secret {
+			flags.String(flagName(s.name+"_FILE"), "", "Same as the "+s.name+"_FILE ENV")
+		}
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return Config{}, nil, err
+	}
+
+	flagValues := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			flagValues[strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))] = f.Value.String()
+		}
+	})
+
+	envValues := map[string]string{}
+	for _, s := range settings {
+		for _, name := range []string{s.name, s.name + "_FILE"} {
+			if value := getenv(name); value != "" {
+				envValues[name] = value
+			}
+		}
+	}
+
+	fileValues := map[string]string{}
+	if *configFile == "" {
+		*configFile = getenv("CONFIG_FILE")
+	}
+	if *configFile != "" {
+		fileValues, err = readFile(*configFile)
+		if err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	cfg := Default()
+	for _, layer := range []struct {
+		source string
+		values map[string]string
+	}{
+		{"config file", fileValues},
+		{"ENV", envValues},
+		{"flag", flagValues},
+	} {
+		err := cfg.apply(layer.source, layer.values)
+		if err != nil {
+			return Config{}, nil, err
+		}
+	}
+
+	return cfg, flags.Args(), nil
+}
+
+// apply sets the values from one source, NAME_FILE values are read from the file they point to
+func (c *Config) apply(source string, values map[string]string) error {
+	for _, s := range settings {
+		value, hasValue := values[s.name]
+		fileName, hasFile := values[s.name+"_FILE"]
+
+		if hasValue && hasFile {
+			return errors.New("both " + s.name + " and " + s.name + "_FILE are set in " + source)
+		}
+
+		if hasFile {
+			content, err := os.ReadFile(fileName)
+			if err != nil {
+				return errors.New("could not read " + s.name + "_FILE from " + source + ": " + err.Error())
+			}
+			value = strings.TrimRight(string(content), "\r\n")
+			hasValue = true
+		}
+
+		if !hasValue {
+			continue
+		}
+
+		err := s.set(c, value)
+		if err != nil {
+			return errors.New("invalid " + s.name + " in " + source + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the config, server adds the checks needed by the web server
+// Problems that are fine outside of production mode are returned as warnings.
+func (c Config) Validate(server bool) ([]string, error) {
+	var warnings []string
+	var errs []error
+
+	if c.Mode != ModeDevelopment && c.Mode != ModeProduction {
+		errs = append(errs, errors.New("MODE must be \""+ModeDevelopment+"\" or \""+ModeProduction+"\""))
+	}
+	production := c.Mode == ModeProduction
+
+	if c.LogMinLvl != "" && go_log.LogLvlFromStr(c.LogMinLvl) == 0 {
+		errs = append(errs, errors.New("LOG_MIN_LVL must be one of Error, Warn, Info, Verbose or Debug"))
+	}
+
+	switch {
+	case c.DatabaseURL == "":
+		errs = append(errs, errors.New("DATABASE_URL is required"))
+	case strings.HasPrefix(c.DatabaseURL, "memory:"):
+		if production {
+			errs = append(errs, errors.New("DATABASE_URL can not be \"memory://\" in production mode, all data would be lost on restart"))
+		}
+	case strings.HasPrefix(c.DatabaseURL, "sqlite:"), strings.HasPrefix(c.DatabaseURL, "postgres://"), strings.HasPrefix(c.DatabaseURL, "postgresql://"):
+	default:
+		errs = append(errs, errors.New("DATABASE_URL must start with postgres://, postgresql://, sqlite: or memory:"))
+	}
+
+	switch c.TracesExporter {
+	case "none", "otlp", "stdout":
+	default:
+		errs = append(errs, errors.New("TRACES_EXPORTER must be none, otlp or stdout"))
+	}
+
+	for name, duration := range map[string]time.Duration{
+		"AUDIT_CHECKPOINT_INTERVAL": c.AuditCheckpoints,
+		"DB_QUERY_TIMEOUT":          c.DBQueryTimeout,
+		"DELETED_ACCOUNT_RETENTION": c.DeletedRetention,
+		"OLD_NAME_RESERVATION":      c.OldNameReservation,
+		"REQUEST_TIMEOUT":           c.RequestTimeout,
+		"SHUTDOWN_DRAIN_DELAY":      c.ShutdownDrainDelay,
+		"SHUTDOWN_GRACE_PERIOD":     c.ShutdownGrace,
+	} {
+		if duration < 0 {
+			errs = append(errs, errors.New(name+" can not be negative"))
+		}
+	}
+
+	if server {
+		if c.WebBindHost == "" {
+			errs = append(errs, errors.New("WEB_BIND_HOST is required, like \":4000\""))
+		}
+
+		secrets := map[string]string{"JWT_SHARED_SECRET": c.JWTSharedSecret}
+		if c.AdminBootstrap {
+			secrets["ADMIN_API_KEY"] = c.AdminAPIKey
+
+			if c.AdminPassword == insecureDefault {
+				if production {
+					errs = append(errs, errors.New("ADMIN_PASSWORD is the insecure default \""+insecureDefault+"\""))
+				} else {
+					warnings = append(warnings, "ADMIN_PASSWORD is the insecure default \""+insecureDefault+"\", this is not allowed in production mode")
+				}
+			}
+		}
+
+		for name, secret := range secrets {
+			problem := secretProblem(secret)
+			if problem == "" {
+				continue
+			}
+			if production || secret == "" {
+				errs = append(errs, errors.New(name+" "+problem))
+			} else {
+				warnings = append(warnings, name+" "+problem+", this is not allowed in production mode")
+			}
+		}
+	}
+
+	// Map iteration order is random, keep the messages in the same order every time
+	sort.Strings(warnings)
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+
+	return warnings, errors.Join(errs...)
+}
+
+// secretProblem tells what is wrong with a secret, or returns an empty string if nothing is
+func secretProblem(secret string) string {
+	switch {
+	case secret == "":
+		return "is not set"
+	case secret == insecureDefault:
+		return "is the insecure default \"" + insecureDefault + "\""
+	case len(secret) < minSecretLen:
+		return "is shorter than " + strconv.Itoa(minSecretLen) + " characters"
+	}
+
+	return ""
+}
+
+// readFile reads a YAML or JSON config file, JSON is valid YAML
+func readFile(fileName string) (map[string]string, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, errors.New("could not read config file: " + err.Error())
+	}
+
+	raw := map[string]interface{}{}
+	err = yaml.Unmarshal(content, &raw)
+	if err != nil {
+		return nil, errors.New("invalid config file " + fileName + ": " + err.Error())
+	}
+
+	known := map[string]bool{}
+	for _, s := range settings {
+		known[s.name] = true
+		known[s.name+"_FILE"] = s.secret
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		if !known[key] {
+			return nil, errors.New("unknown key " + key + " in config file " + fileName)
+		}
+		values[key] = fmt.Sprint(value)
+	}
+
+	return values, nil
+}
+
+// flagName turns an ENV name like "WEB_BIND_HOST" into a flag name like "web-bind-host"
+func flagName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+func parseBool(target *bool, value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return errors.New("must be true or false")
+	}
+	*target = parsed
+
+	return nil
+}
+
+func parseDuration(target *time.Duration, value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return errors.New("must be a duration like \"30s\" or \"720h\"")
+	}
+	*target = parsed
+
+	return nil
+}
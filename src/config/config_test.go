@@ -0,0 +1,168 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	dir := t.TempDir()
+
+	configFile := filepath.Join(dir, "config.yaml")
+	writeFile(t, configFile, "DATABASE_URL: sqlite:file.db\nREQUEST_TIMEOUT: 5s\nWEB_BIND_HOST: \":3000\"\nDB_AUTO_MIGRATE: true\n")
+
+	secretFile := filepath.Join(dir, "jwt")
+	writeFile(t, secretFile, "from-secret-file\n")
+
+	env := map[string]string{
+		"CONFIG_FILE":            configFile,
+		"JWT_SHARED_SECRET_FILE": secretFile,
+		"REQUEST_TIMEOUT":        "7s",
+		"WEB_BIND_HOST":          ":3001",
+	}
+
+	cfg, args, err := Load([]string{"--web-bind-host", ":3002", "account", "list"}, func(name string) string { return env[name] })
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if strings.Join(args, " ") != "account list" {
+		t.Fatalf("Expected the command to be left in args, got %v", args)
+	}
+	if cfg.DatabaseURL != "sqlite:file.db" || !cfg.DBAutoMigrate {
+		t.Fatalf("Expected DATABASE_URL and DB_AUTO_MIGRATE from the config file, got %q and %v", cfg.DatabaseURL, cfg.DBAutoMigrate)
+	}
+	if cfg.RequestTimeout != 7*time.Second {
+		t.Fatalf("Expected REQUEST_TIMEOUT from the ENV to override the config file, got %v", cfg.RequestTimeout)
+	}
+	if cfg.WebBindHost != ":3002" {
+		t.Fatalf("Expected WEB_BIND_HOST from the flag to override the ENV, got %q", cfg.WebBindHost)
+	}
+	if cfg.JWTSharedSecret != "from-secret-file" {
+		t.Fatalf("Expected JWT_SHARED_SECRET from the _FILE without the newline, got %q", cfg.JWTSharedSecret)
+	}
+	if cfg.OldNameReservation != Default().OldNameReservation {
+		t.Fatalf("Expected the default OLD_NAME_RESERVATION, got %v", cfg.OldNameReservation)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	unknownKeyFile := filepath.Join(dir, "unknown.json")
+	writeFile(t, unknownKeyFile, `{"DATABASE_URL": "memory://", "NOT_A_SETTING": "x"}`)
+
+	for name, env := range map[string]map[string]string{
+		"invalid duration":  {"REQUEST_TIMEOUT": "soon"},
+		"invalid bool":      {"DB_AUTO_MIGRATE": "maybe"},
+		"value and file":    {"JWT_SHARED_SECRET": "x", "JWT_SHARED_SECRET_FILE": "/x"},
+		"missing file":      {"JWT_SHARED_SECRET_FILE": filepath.Join(dir, "missing")},
+		"unknown file key":  {"CONFIG_FILE": unknownKeyFile},
+		"missing conf file": {"CONFIG_FILE": filepath.Join(dir, "missing.yaml")},
+	} {
+		_, _, err := Load(nil, func(name string) string { return env[name] })
+		if err == nil {
+			t.Errorf("%s: expected Load to fail", name)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	strong := strings.Repeat("s", minSecretLen)
+
+	valid := Default()
+	valid.AdminAPIKey = strong
+	valid.DatabaseURL = "postgres://localhost/auth"
+	valid.JWTSharedSecret = strong
+	valid.Mode = ModeProduction
+	valid.WebBindHost = ":4000"
+
+	warnings, err := valid.Validate(true)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("Expected a valid production config, got %v, %v", warnings, err)
+	}
+
+	weak := valid
+	weak.JWTSharedSecret = insecureDefault
+	weak.AdminAPIKey = "short"
+	_, err = weak.Validate(true)
+	if err == nil || !strings.Contains(err.Error(), "JWT_SHARED_SECRET") || !strings.Contains(err.Error(), "ADMIN_API_KEY") {
+		t.Fatalf("Expected weak secrets to be refused in production mode, got %v", err)
+	}
+
+	// The CLI does not use the secrets
+	_, err = weak.Validate(false)
+	if err != nil {
+		t.Fatalf("Expected weak secrets to be fine for the CLI, got %v", err)
+	}
+
+	weak.Mode = ModeDevelopment
+	warnings, err = weak.Validate(true)
+	if err != nil || len(warnings) != 2 {
+		t.Fatalf("Expected weak secrets to only warn in development mode, got %v, %v", warnings, err)
+	}
+
+	// An empty ADMIN_API_KEY is refused even in development mode while the admin account is bootstrapped
+	noAdminKey := weak
+	noAdminKey.AdminAPIKey = ""
+	_, err = noAdminKey.Validate(true)
+	if err == nil || !strings.Contains(err.Error(), "ADMIN_API_KEY is not set") {
+		t.Fatalf("Expected a missing ADMIN_API_KEY to be refused, got %v", err)
+	}
+
+	noBootstrap := weak
+	noBootstrap.AdminBootstrap = false
+	warnings, err = noBootstrap.Validate(true)
+	if err != nil || len(warnings) != 1 || strings.Contains(warnings[0], "ADMIN_API_KEY") {
+		t.Fatalf("Expected ADMIN_API_KEY to be ignored with ADMIN_BOOTSTRAP=false, got %v, %v", warnings, err)
+	}
+
+	weakPassword := valid
+	weakPassword.AdminPassword = insecureDefault
+	_, err = weakPassword.Validate(true)
+	if err == nil || !strings.Contains(err.Error(), "ADMIN_PASSWORD") {
+		t.Fatalf("Expected the default ADMIN_PASSWORD to be refused in production mode, got %v", err)
+	}
+
+	missing := Default()
+	missing.DatabaseURL = "mysql://localhost"
+	_, err = missing.Validate(true)
+	for _, name := range []string{"DATABASE_URL", "JWT_SHARED_SECRET", "WEB_BIND_HOST"} {
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Fatalf("Expected an error for %s, got %v", name, err)
+		}
+	}
+
+	memory := valid
+	memory.DatabaseURL = "memory://"
+	_, err = memory.Validate(false)
+	if err == nil {
+		t.Fatalf("Expected memory:// to be refused in production mode")
+	}
+
+	invalidMode := valid
+	invalidMode.Mode = "prod"
+	_, err = invalidMode.Validate(false)
+	if err == nil || !strings.Contains(err.Error(), "MODE") {
+		t.Fatalf("Expected an invalid MODE to be refused, got %v", err)
+	}
+
+	invalidExporter := valid
+	invalidExporter.TracesExporter = "jaeger"
+	_, err = invalidExporter.Validate(false)
+	if err == nil || !strings.Contains(err.Error(), "TRACES_EXPORTER") {
+		t.Fatalf("Expected an unknown TRACES_EXPORTER to be refused, got %v", err)
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) {
+	t.Helper()
+
+	err := os.WriteFile(name, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", name, err)
+	}
+}
@@ -3,134 +3,370 @@ package db
 import (
 	"context"
 	"errors"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 )
 
 // AccountCreate writes a user to database
-func (d Db) AccountCreate(input AccountCreateInput) (CreatedAccount, error) {
-	d.Log.Context = []interface{}{
+func (d Db) AccountCreate(ctx context.Context, input AccountCreateInput) (CreatedAccount, error) {
+	log := d.log(ctx,
 		"accountName", input.Name,
 		"id", input.ID,
+	)
+
+	err := validateFields(input.Fields)
+	if err != nil {
+		log.Debug("Invalid account fields", "err", err.Error())
+		return CreatedAccount{}, err
 	}
-	accountSQL := "INSERT INTO accounts (id, name, \"apiKey\", password) VALUES($1,$2,$3,$4);"
 
-	_, err := d.DbPool.Exec(context.Background(), accountSQL, input.ID, input.Name, input.APIKey, input.Password)
+	tx, err := d.pool().Begin(ctx)
 	if err != nil {
-		if strings.HasPrefix(err.Error(), "ERROR: duplicate key") {
-			d.Log.Debug("Duplicate name in accounts database")
-		} else {
-			d.Log.Warn("Database error when trying to add account", "err", err.Error())
-		}
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return CreatedAccount{}, err
+	}
 
+	// Rollback is safe to call even if the tx is already closed, so if
+	// the tx commits successfully, this is a no-op
+	defer tx.Rollback(ctx)
+
+	err = d.accountNamesLock(ctx, tx, input.Name)
+	if err != nil {
 		return CreatedAccount{}, err
 	}
 
-	d.Log.Verbose("Added account to database", "id", input.ID)
+	// Names recently used by renamed accounts are reserved, so nobody else can take them over
+	accountSQL := "INSERT INTO accounts (id, name, \"apiKey\", password) SELECT $1,$2,$3,$4 " +
+		"WHERE NOT EXISTS (SELECT 1 FROM \"accountsNameHistory\" WHERE name = $2 AND \"reservedUntil\" > now());"
 
-	accountFieldsSQL := "INSERT INTO \"accountsFields\" (id, \"accountId\", name, value) VALUES($1,$2,$3,$4);"
-	for _, field := range input.Fields {
-		newFieldID, uuidErr := uuid.NewRandom()
-		if uuidErr != nil {
-			d.Log.Warn("Could not create new Uuid", "err", uuidErr.Error())
-			return CreatedAccount{}, uuidErr
+	res, err := tx.Exec(ctx, accountSQL, input.ID, input.Name, input.APIKeyHash, input.Password)
+	if err != nil {
+		err = translateErr(err)
+		if errors.Is(err, ErrConflict) {
+			log.Debug("Duplicate name in accounts database")
+		} else {
+			log.Warn("Database error when trying to add account", "err", err.Error())
 		}
 
-		_, err := d.DbPool.Exec(context.Background(), accountFieldsSQL, newFieldID, input.ID, field.Name, field.Values)
-		if err != nil {
-			//if strings.HasPrefix(err.Error(), "ERROR: duplicate key") {
-			d.Log.Warn("Database error when trying to add account field", "err", err.Error(), "accountID", input.ID, "fieldName", field.Name, "fieldvalues", field.Values)
-			// }
-		}
+		return CreatedAccount{}, err
+	}
+
+	if res.RowsAffected() == 0 {
+		log.Debug("Name is reserved by a renamed account")
+		return CreatedAccount{}, errNameReserved
+	}
+
+	err = d.accountFieldsInsert(ctx, tx, input.ID.String(), input.Fields)
+	if err != nil {
+		return CreatedAccount{}, err
+	}
 
-		d.Log.Debug("Added account field", "accountID", input.ID, "fieldName", field.Name, "fieldValues", field.Values)
+	err = tx.Commit(ctx)
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return CreatedAccount{}, err
 	}
 
+	log.Verbose("Added account to database", "id", input.ID)
+
 	return CreatedAccount{
-		ID:     input.ID,
-		Name:   input.Name,
-		APIKey: input.APIKey,
+		ID:   input.ID,
+		Name: input.Name,
 	}, nil
 }
 
-func (d Db) AccountDel(accountID string) error {
-	d.Log.Context = []interface{}{
+// AccountDel marks an account as deleted and removes its renewal tokens. ifVersion 0 skips the version check
+// The account is kept until purged by AccountsPurge(), and can be brought back with AccountRestore() until then
+func (d Db) AccountDel(ctx context.Context, accountID string, ifVersion int64) error {
+	log := d.log(ctx,
 		"accountID", accountID,
+		"ifVersion", ifVersion,
+	)
+	log.Verbose("Trying to delete account")
+
+	tx, err := d.pool().Begin(ctx)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return err
 	}
-	d.Log.Verbose("Trying to delete account")
 
-	_, renewalTokensErr := d.DbPool.Exec(context.Background(), "DELETE FROM \"renewalTokens\" WHERE \"accountId\" = $1;", accountID)
-	if renewalTokensErr != nil {
-		d.Log.Error("Could not remove renewal tokens for account", "err", renewalTokensErr.Error())
-		return renewalTokensErr
+	// Rollback is safe to call even if the tx is already closed, so if
+	// the tx commits successfully, this is a no-op
+	defer tx.Rollback(ctx)
+
+	err = d.accountVersionBump(ctx, tx, accountID, ifVersion)
+	if err != nil {
+		return err
 	}
 
-	_, fieldsErr := d.DbPool.Exec(context.Background(), "DELETE FROM \"accountsFields\" WHERE \"accountId\" = $1;", accountID)
-	if fieldsErr != nil {
-		d.Log.Error("Could not remove account fields", "err", fieldsErr.Error())
-		return fieldsErr
+	_, err = tx.Exec(ctx, "DELETE FROM \"renewalTokens\" WHERE \"accountId\" = $1;", accountID)
+	if err != nil {
+		log.Error("Could not remove renewal tokens for account", "err", err.Error())
+		return err
 	}
 
-	res, err := d.DbPool.Exec(context.Background(), "DELETE FROM accounts WHERE id = $1", accountID)
+	_, err = tx.Exec(ctx, "UPDATE accounts SET deleted = now() WHERE id = $1;", accountID)
 	if err != nil {
-		d.Log.Error("Could not remove account", "err", err.Error())
+		log.Error("Could not mark account as deleted", "err", err.Error())
 		return err
 	}
 
-	if string(res) == "DELETE 0" {
-		d.Log.Debug("Tried to delete account, but none exists")
-		err := errors.New("no account found for given accountID")
+	err = tx.Commit(ctx)
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
 		return err
 	}
 
+	log.Verbose("Account marked as deleted")
+
 	return nil
 }
 
-// AccountGet fetches an account from the database
-func (d Db) AccountGet(accountID string, APIKey string, name string) (Account, error) {
-	d.Log.Context = []interface{}{
+// AccountLogoutAll bumps the token generation of an account, so its JWTs stop working, and removes all its renewal tokens
+// Returns how many renewal tokens were removed. ifVersion 0 skips the version check
+func (d Db) AccountLogoutAll(ctx context.Context, accountID string, ifVersion int64) (int, error) {
+	log := d.log(ctx,
 		"accountID", accountID,
-		"len(APIKey)", len(APIKey),
-		"name", name,
+		"ifVersion", ifVersion,
+	)
+	log.Verbose("Trying to log out account everywhere")
+
+	tx, err := d.pool().Begin(ctx)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return 0, err
+	}
+
+	// Rollback is safe to call even if the tx is already closed, so if
+	// the tx commits successfully, this is a no-op
+	defer tx.Rollback(ctx)
+
+	logoutSQL := "UPDATE accounts SET \"tokenGeneration\" = \"tokenGeneration\" + 1, version = version + 1 " +
+		"WHERE id = $1 AND deleted IS NULL AND ($2 = 0 OR version = $2);"
+	res, err := tx.Exec(ctx, logoutSQL, accountID, ifVersion)
+	if err != nil {
+		log.Error("Could not bump token generation of account", "err", err.Error())
+		return 0, err
+	}
+	if res.RowsAffected() == 0 {
+		var exists bool
+		err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND deleted IS NULL)", accountID).Scan(&exists)
+		if err != nil {
+			log.Error("Database error when checking if account exists", "err", err.Error())
+			return 0, err
+		}
+		if exists {
+			log.Debug("Account version mismatch")
+			return 0, ErrVersionMismatch
+		}
+
+		return 0, NotFoundError{Msg: "no account found for given accountID"}
+	}
+
+	res, err = tx.Exec(ctx, "DELETE FROM \"renewalTokens\" WHERE \"accountId\" = $1;", accountID)
+	if err != nil {
+		log.Error("Could not remove renewal tokens for account", "err", err.Error())
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return 0, err
+	}
+
+	log.Verbose("Account logged out everywhere")
+
+	return int(res.RowsAffected()), nil
+}
+
+// AccountRestore brings back a deleted account that is still within the retention period. ifVersion 0 skips the version check
+func (d Db) AccountRestore(ctx context.Context, accountID string, ifVersion int64) (Account, error) {
+	log := d.log(ctx,
+		"accountID", accountID,
+		"ifVersion", ifVersion,
+	)
+	log.Verbose("Trying to restore account")
+
+	restorableWhere := "id = $1 AND deleted > now() - $2 * interval '1 second'"
+	restoreSQL := "UPDATE accounts SET deleted = NULL, version = version + 1 WHERE " + restorableWhere + " AND ($3 = 0 OR version = $3);"
+	res, err := d.pool().Exec(ctx, restoreSQL, accountID, d.DeletedRetention.Seconds(), ifVersion)
+	if err != nil {
+		log.Error("Database error when trying to restore account", "err", err.Error())
+		return Account{}, err
+	}
+
+	if res.RowsAffected() == 0 {
+		var restorable bool
+		err = d.pool().QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM accounts WHERE "+restorableWhere+")", accountID, d.DeletedRetention.Seconds()).Scan(&restorable)
+		if err != nil {
+			log.Error("Database error when checking if account is restorable", "err", err.Error())
+			return Account{}, err
+		}
+		if restorable {
+			log.Debug("Account version mismatch")
+			return Account{}, ErrVersionMismatch
+		}
+
+		log.Debug("No deleted account within the retention period found")
+		return Account{}, NotFoundError{Msg: "no restorable deleted account found for given accountID"}
+	}
+
+	return d.AccountGet(ctx, accountID, "", "")
+}
+
+// AccountsPurge permanently removes all accounts that have been deleted for longer than the retention period
+func (d Db) AccountsPurge(ctx context.Context) (int, error) {
+	log := d.log(ctx,
+		"deletedRetention", d.DeletedRetention.String(),
+	)
+	log.Debug("Trying to purge deleted accounts")
+
+	tx, err := d.pool().Begin(ctx)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return 0, err
+	}
+
+	// Rollback is safe to call even if the tx is already closed, so if
+	// the tx commits successfully, this is a no-op
+	defer tx.Rollback(ctx)
+
+	// Lock the rows so a concurrent restore either happens before the purge or fails
+	purgeIDsSQL := "SELECT id FROM accounts WHERE deleted <= now() - $1 * interval '1 second' FOR UPDATE"
+	rows, err := tx.Query(ctx, purgeIDsSQL, d.DeletedRetention.Seconds())
+	if err != nil {
+		log.Error("Database error when fetching accounts to purge", "err", err.Error())
+		return 0, err
+	}
+
+	var accountIDs []string
+	for rows.Next() {
+		var accountID uuid.UUID
+		err := rows.Scan(&accountID)
+		if err != nil {
+			rows.Close()
+			log.Error("Could not get id from database row", "err", err.Error())
+			return 0, err
+		}
+		accountIDs = append(accountIDs, accountID.String())
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		log.Error("Database error when reading accounts to purge", "err", rows.Err().Error())
+		return 0, rows.Err()
+	}
+
+	if len(accountIDs) == 0 {
+		return 0, nil
+	}
+
+	for _, table := range []string{"renewalTokens", "sessions", "accountsFields", "accountsNameHistory"} {
+		_, err := tx.Exec(ctx, "DELETE FROM \""+table+"\" WHERE \"accountId\" = ANY($1::uuid[]);", accountIDs)
+		if err != nil {
+			log.Error("Could not purge from "+table, "err", err.Error())
+			return 0, err
+		}
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM accounts WHERE id = ANY($1::uuid[]);", accountIDs)
+	if err != nil {
+		log.Error("Could not purge accounts", "err", err.Error())
+		return 0, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return 0, err
 	}
-	d.Log.Debug("Trying to get account")
+
+	log.Info("Purged deleted accounts", "count", len(accountIDs))
+
+	return len(accountIDs), nil
+}
+
+// AccountTokenGeneration returns the token generation of an account that exists and is not deleted
+func (d Db) AccountTokenGeneration(ctx context.Context, accountID string) (int64, error) {
+	var generation int64
+	err := d.pool().QueryRow(ctx, "SELECT \"tokenGeneration\" FROM accounts WHERE id = $1 AND deleted IS NULL", accountID).Scan(&generation)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return 0, NotFoundError{Msg: "no account found for given accountID"}
+		}
+
+		d.log(ctx).Error("Database error when fetching token generation of account", "err", err.Error(), "accountID", accountID)
+		return 0, err
+	}
+
+	return generation, nil
+}
+
+// AccountGet fetches an account from the database, deleted accounts are not included
+func (d Db) AccountGet(ctx context.Context, accountID string, APIKeyHash string, name string) (Account, error) {
+	return d.accountGet(ctx, accountID, APIKeyHash, name, false)
+}
+
+// AccountGetIncludingDeleted fetches an account from the database, even if it is deleted
+func (d Db) AccountGetIncludingDeleted(ctx context.Context, accountID string) (Account, error) {
+	return d.accountGet(ctx, accountID, "", "", true)
+}
+
+func (d Db) accountGet(ctx context.Context, accountID string, APIKeyHash string, name string, includeDeleted bool) (Account, error) {
+	log := d.log(ctx,
+		"accountID", accountID,
+		"includeDeleted", includeDeleted,
+		"len(APIKeyHash)", len(APIKeyHash),
+		"name", name,
+	)
+	log.Debug("Trying to get account")
 
 	var account Account
 	var searchParam string
-	accountSQL := "SELECT id, created, name, \"password\" FROM accounts WHERE "
+	accountSQL := "SELECT coalesce(\"apiKey\", ''), id, created, deleted, name, \"password\", version FROM accounts WHERE "
+	if !includeDeleted {
+		accountSQL = accountSQL + "deleted IS NULL AND "
+	}
 	if accountID != "" {
 		accountSQL = accountSQL + "id = $1"
 		searchParam = accountID
-	} else if APIKey != "" {
+	} else if APIKeyHash != "" {
 		accountSQL = accountSQL + "\"apiKey\" = $1"
-		searchParam = APIKey
+		searchParam = APIKeyHash
 	} else if name != "" {
 		accountSQL = accountSQL + "name = $1"
 		searchParam = name
 	} else {
-		d.Log.Debug("No get criteria entered, returning empty response without calling the database")
+		log.Debug("No get criteria entered, returning empty response without calling the database")
 
-		return Account{}, errors.New("no rows in result set")
+		return Account{}, NotFoundError{Msg: "no account found"}
 	}
 
-	accountErr := d.DbPool.QueryRow(context.Background(), accountSQL, searchParam).Scan(&account.ID, &account.Created, &account.Name, &account.Password)
+	accountErr := d.pool().QueryRow(ctx, accountSQL, searchParam).Scan(&account.APIKeyHash, &account.ID, &account.Created, &account.Deleted, &account.Name, &account.Password, &account.Version)
 	if accountErr != nil {
-		if accountErr.Error() == "no rows in result set" {
-			d.Log.Debug("No account found")
-			return Account{}, accountErr
+		if errors.Is(accountErr, pgx.ErrNoRows) {
+			log.Debug("No account found")
+			if accountID != "" {
+				return Account{}, NotFoundError{Msg: "no account found for given accountID"}
+			}
+			return Account{}, NotFoundError{Msg: "no account found"}
 		}
 
-		d.Log.Error("Database error when fetching account", "err", accountErr.Error())
+		log.Error("Database error when fetching account", "err", accountErr.Error())
 		return Account{}, accountErr
 	}
 
 	fieldsSQL := "SELECT name, value FROM \"accountsFields\" WHERE \"accountId\" = $1"
-	rows, fieldsErr := d.DbPool.Query(context.Background(), fieldsSQL, account.ID)
+	rows, fieldsErr := d.pool().Query(ctx, fieldsSQL, account.ID)
 	if fieldsErr != nil {
-		d.Log.Error("Database error when fetching account fields", "err", accountErr.Error())
+		log.Error("Database error when fetching account fields", "err", fieldsErr.Error())
 		return Account{}, fieldsErr
 	}
+	defer rows.Close()
 
 	account.Fields = make(map[string][]string)
 	for rows.Next() {
@@ -138,7 +374,7 @@ func (d Db) AccountGet(accountID string, APIKey string, name string) (Account, e
 		var value []string
 		err := rows.Scan(&name, &value)
 		if err != nil {
-			d.Log.Error("Could not get name or value from database row", "err", err.Error())
+			log.Error("Could not get name or value from database row", "err", err.Error())
 			return Account{}, err
 		}
 		account.Fields[name] = value
@@ -147,110 +383,540 @@ func (d Db) AccountGet(accountID string, APIKey string, name string) (Account, e
 	return account, nil
 }
 
-// func (d Db) AccountsGet() ([]Account, error) {
-// 	d.Log.Debug("Trying to get accounts", "name", name)
-
-// 	var account Account
-// 	var searchParam string
-// 	accountSQL := "SELECT id, created, name, \"password\" FROM accounts WHERE "
-// 	if accountID != "" {
-// 		accountSQL = accountSQL + "id = $1"
-// 		searchParam = accountID
-// 	} else if APIKey != "" {
-// 		accountSQL = accountSQL + "\"apiKey\" = $1"
-// 		searchParam = APIKey
-// 	} else if name != "" {
-// 		accountSQL = accountSQL + "name = $1"
-// 		searchParam = name
-// 	} else {
-// 		d.Log.Debug("No get criteria entered, returning empty response without calling the database")
-
-// 		return Account{}, errors.New("no rows in result set")
-// 	}
-
-// 	accountErr := d.DbPool.QueryRow(context.Background(), accountSQL, searchParam).Scan(&account.ID, &account.Created, &account.Name, &account.Password)
-// 	if accountErr != nil {
-// 		if accountErr.Error() == "no rows in result set" {
-// 			d.Log.Debug("No account found", "accountID", accountID, "APIKey", len(APIKey))
-// 			return Account{}, accountErr
-// 		}
-
-// 		d.Log.Error("Database error when fetching account", "err", accountErr.Error(), "accountID", accountID, "APIKey", len(APIKey))
-// 		return Account{}, accountErr
-// 	}
-
-// 	fieldsSQL := "SELECT name, value FROM \"accountsFields\" WHERE \"accountId\" = $1"
-// 	rows, fieldsErr := d.DbPool.Query(context.Background(), fieldsSQL, account.ID)
-// 	if fieldsErr != nil {
-// 		d.Log.Error("Database error when fetching account fields", "err", accountErr.Error(), "accountID", accountID, "APIKey", len(APIKey))
-// 		return Account{}, fieldsErr
-// 	}
-
-// 	account.Fields = make(map[string][]string)
-// 	for rows.Next() {
-// 		var name string
-// 		var value []string
-// 		err := rows.Scan(&name, &value)
-// 		if err != nil {
-// 			d.Log.Error("Could not get name or value from database row", "err", err.Error(), "accountID", accountID, "APIKey", len(APIKey))
-// 			return Account{}, err
-// 		}
-// 		account.Fields[name] = value
-// 	}
-
-// 	return account, nil
-// }
-
-func (d Db) AccountUpdateFields(accountID string, fields []AccountCreateInputFields) (Account, error) {
-	d.Log.Context = []interface{}{
+// AccountsGet fetches a page of accounts from the database
+func (d Db) AccountsGet(ctx context.Context, input AccountsGetInput) (AccountsList, error) {
+	log := d.log(ctx,
+		"cursor", input.Cursor,
+		"fieldFilters", input.FieldFilters,
+		"limit", input.Limit,
+		"namePrefix", input.NamePrefix,
+		"sortBy", input.SortBy,
+		"sortDesc", input.SortDesc,
+		"withTotal", input.WithTotal,
+	)
+	log.Debug("Trying to get accounts")
+
+	if input.SortBy == "" {
+		input.SortBy = "created"
+	}
+	if input.SortBy != "created" && input.SortBy != "name" {
+		log.Debug("Invalid sort column")
+		return AccountsList{}, ValidationError{Field: "sort", Msg: "must be \"created\" or \"name\""}
+	}
+	if input.Limit < 1 {
+		input.Limit = AccountsDefaultLimit
+	}
+
+	var where []string
+	var params []interface{}
+	addParam := func(value interface{}) string {
+		params = append(params, value)
+		return "$" + strconv.Itoa(len(params))
+	}
+
+	if !input.IncludeDeleted {
+		where = append(where, "deleted IS NULL")
+	}
+
+	if input.NamePrefix != "" {
+		where = append(where, "name LIKE "+addParam(likeEscape(input.NamePrefix)+"%"))
+	}
+
+	// Sort the field names to always get the same SQL for the same filters
+	fieldNames := make([]string, 0, len(input.FieldFilters))
+	for fieldName := range input.FieldFilters {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	for _, fieldName := range fieldNames {
+		where = append(where, "EXISTS (SELECT 1 FROM \"accountsFields\" WHERE \"accountId\" = accounts.id AND name = "+addParam(fieldName)+" AND value @> "+addParam(input.FieldFilters[fieldName])+")")
+	}
+
+	var result AccountsList
+
+	if input.WithTotal {
+		countSQL := "SELECT count(*) FROM accounts"
+		if len(where) != 0 {
+			countSQL = countSQL + " WHERE " + strings.Join(where, " AND ")
+		}
+
+		var total int
+		err := d.pool().QueryRow(ctx, countSQL, params...).Scan(&total)
+		if err != nil {
+			log.Error("Database error when counting accounts", "err", err.Error())
+			return AccountsList{}, err
+		}
+		result.Total = &total
+	}
+
+	compareOp := ">"
+	sortDir := "ASC"
+	if input.SortDesc {
+		compareOp = "<"
+		sortDir = "DESC"
+	}
+
+	if input.Cursor != "" {
+		cursor, err := decodeAccountsCursor(input.Cursor)
+		if err != nil || cursor.SortBy != input.SortBy || cursor.SortDesc != input.SortDesc {
+			log.Debug("Invalid cursor")
+			return AccountsList{}, ValidationError{Field: "cursor", Msg: "invalid cursor"}
+		}
+
+		var cursorValue interface{} = cursor.Created
+		if input.SortBy == "name" {
+			cursorValue = cursor.Name
+		}
+		where = append(where, "("+input.SortBy+", id) "+compareOp+" ("+addParam(cursorValue)+", "+addParam(cursor.ID)+")")
+	}
+
+	accountsSQL := "SELECT id, created, deleted, name, version FROM accounts"
+	if len(where) != 0 {
+		accountsSQL = accountsSQL + " WHERE " + strings.Join(where, " AND ")
+	}
+	// Fetch one extra row to know if there is a next page or not
+	accountsSQL = accountsSQL + " ORDER BY " + input.SortBy + " " + sortDir + ", id " + sortDir + " LIMIT " + addParam(input.Limit+1)
+
+	rows, err := d.pool().Query(ctx, accountsSQL, params...)
+	if err != nil {
+		log.Error("Database error when fetching accounts", "err", err.Error())
+		return AccountsList{}, err
+	}
+	defer rows.Close()
+
+	result.Accounts = []Account{}
+	for rows.Next() {
+		var account Account
+		err := rows.Scan(&account.ID, &account.Created, &account.Deleted, &account.Name, &account.Version)
+		if err != nil {
+			log.Error("Could not scan account from database row", "err", err.Error())
+			return AccountsList{}, err
+		}
+		account.Fields = make(map[string][]string)
+		result.Accounts = append(result.Accounts, account)
+	}
+	if rows.Err() != nil {
+		log.Error("Database error when reading account rows", "err", rows.Err().Error())
+		return AccountsList{}, rows.Err()
+	}
+
+	if len(result.Accounts) > input.Limit {
+		result.Accounts = result.Accounts[:input.Limit]
+		last := result.Accounts[input.Limit-1]
+		result.NextCursor = encodeAccountsCursor(accountsCursor{
+			Created:  last.Created,
+			ID:       last.ID,
+			Name:     last.Name,
+			SortBy:   input.SortBy,
+			SortDesc: input.SortDesc,
+		})
+	}
+
+	if len(result.Accounts) == 0 {
+		return result, nil
+	}
+
+	// Fetch the fields for all accounts on this page in one go
+	accountIDs := make([]string, len(result.Accounts))
+	accountsByID := make(map[string]*Account, len(result.Accounts))
+	for i := range result.Accounts {
+		accountIDs[i] = result.Accounts[i].ID.String()
+		accountsByID[accountIDs[i]] = &result.Accounts[i]
+	}
+
+	fieldsSQL := "SELECT \"accountId\", name, value FROM \"accountsFields\" WHERE \"accountId\" = ANY($1::uuid[])"
+	fieldRows, err := d.pool().Query(ctx, fieldsSQL, accountIDs)
+	if err != nil {
+		log.Error("Database error when fetching account fields", "err", err.Error())
+		return AccountsList{}, err
+	}
+	defer fieldRows.Close()
+
+	for fieldRows.Next() {
+		var accountID uuid.UUID
+		var name string
+		var value []string
+		err := fieldRows.Scan(&accountID, &name, &value)
+		if err != nil {
+			log.Error("Could not get accountId, name or value from database row", "err", err.Error())
+			return AccountsList{}, err
+		}
+		accountsByID[accountID.String()].Fields[name] = value
+	}
+	if fieldRows.Err() != nil {
+		log.Error("Database error when reading account field rows", "err", fieldRows.Err().Error())
+		return AccountsList{}, fieldRows.Err()
+	}
+
+	return result, nil
+}
+
+// AccountRename changes the name of an account and reserves the old name. ifVersion 0 skips the version check
+func (d Db) AccountRename(ctx context.Context, accountID string, newName string, ifVersion int64) (Account, error) {
+	log := d.log(ctx,
+		"accountID", accountID,
+		"ifVersion", ifVersion,
+		"newName", newName,
+	)
+
+	tx, err := d.pool().Begin(ctx)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return Account{}, err
+	}
+
+	// Rollback is safe to call even if the tx is already closed, so if
+	// the tx commits successfully, this is a no-op
+	defer tx.Rollback(ctx)
+
+	err = d.accountVersionBump(ctx, tx, accountID, ifVersion)
+	if err != nil {
+		return Account{}, err
+	}
+
+	var oldName string
+	err = tx.QueryRow(ctx, "SELECT name FROM accounts WHERE id = $1", accountID).Scan(&oldName)
+	if err != nil {
+		log.Error("Database error when fetching account name", "err", err.Error())
+		return Account{}, err
+	}
+
+	if oldName == newName {
+		log.Debug("Account already has the given name, nothing to rename")
+		return d.AccountGet(ctx, accountID, "", "")
+	}
+
+	// The old name is reserved and the new one taken, both must be settled before anyone else checks them
+	err = d.accountNamesLock(ctx, tx, oldName, newName)
+	if err != nil {
+		return Account{}, err
+	}
+
+	// The account can always take back its own old names
+	var reservedCount int
+	reservedSQL := "SELECT count(*) FROM \"accountsNameHistory\" WHERE name = $1 AND \"accountId\" != $2 AND \"reservedUntil\" > now()"
+	err = tx.QueryRow(ctx, reservedSQL, newName, accountID).Scan(&reservedCount)
+	if err != nil {
+		log.Error("Database error when checking reserved names", "err", err.Error())
+		return Account{}, err
+	}
+	if reservedCount != 0 {
+		log.Debug("Name is reserved by another renamed account")
+		return Account{}, errNameReserved
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE accounts SET name = $2 WHERE id = $1", accountID, newName)
+	if err != nil {
+		err = translateErr(err)
+		if errors.Is(err, ErrConflict) {
+			log.Debug("Duplicate name in accounts database")
+		} else {
+			log.Error("Database error when trying to rename account", "err", err.Error())
+		}
+
+		return Account{}, err
+	}
+
+	newHistoryID, err := uuid.NewRandom()
+	if err != nil {
+		log.Error("Could not create new Uuid", "err", err.Error())
+		return Account{}, err
+	}
+
+	historySQL := "INSERT INTO \"accountsNameHistory\" (id, \"accountId\", name, \"reservedUntil\") VALUES($1,$2,$3,now() + $4 * interval '1 second');"
+	_, err = tx.Exec(ctx, historySQL, newHistoryID, accountID, oldName, d.OldNameReservation.Seconds())
+	if err != nil {
+		log.Error("Database error when trying to save old account name", "err", err.Error())
+		return Account{}, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return Account{}, err
+	}
+
+	log.Info("Account renamed", "oldName", oldName)
+
+	return d.AccountGet(ctx, accountID, "", "")
+}
+
+// AccountUpdateFields replaces all fields on an account. ifVersion 0 skips the version check
+func (d Db) AccountUpdateFields(ctx context.Context, accountID string, fields []AccountCreateInputFields, ifVersion int64) (Account, error) {
+	log := d.log(ctx,
 		"accountID", accountID,
 		"fields", fields,
+		"ifVersion", ifVersion,
+	)
+
+	err := validateFields(fields)
+	if err != nil {
+		log.Debug("Invalid account fields", "err", err.Error())
+		return Account{}, err
 	}
 
 	// Begin database transaction
-	conn, err := d.DbPool.Acquire(context.Background())
+	tx, err := d.pool().Begin(ctx)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return Account{}, err
+	}
+
+	// Rollback is safe to call even if the tx is already closed, so if
+	// the tx commits successfully, this is a no-op
+	defer tx.Rollback(ctx)
+
+	err = d.accountVersionBump(ctx, tx, accountID, ifVersion)
+	if err != nil {
+		return Account{}, err
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM \"accountsFields\" WHERE \"accountId\" = $1;", accountID)
 	if err != nil {
-		d.Log.Error("Could not acquire database connection", "err", err.Error())
+		log.Error("Could not delete previous fields", "err", err.Error())
 		return Account{}, err
 	}
 
-	tx, err := conn.Begin(context.Background())
+	err = d.accountFieldsInsert(ctx, tx, accountID, fields)
 	if err != nil {
-		d.Log.Error("Could not begin database transaction", "err", err.Error())
+		return Account{}, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return Account{}, err
+	}
+
+	return d.AccountGet(ctx, accountID, "", "")
+}
+
+// AccountFieldGet fetches the values of a single account field
+func (d Db) AccountFieldGet(ctx context.Context, accountID string, fieldName string) ([]string, error) {
+	log := d.log(ctx,
+		"accountID", accountID,
+		"fieldName", fieldName,
+	)
+	log.Debug("Trying to get account field")
+
+	var values []string
+	fieldSQL := "SELECT value FROM \"accountsFields\" WHERE \"accountId\" = $1 AND name = $2 " +
+		"AND EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND deleted IS NULL)"
+	err := d.pool().QueryRow(ctx, fieldSQL, accountID, fieldName).Scan(&values)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			log.Debug("No account field found")
+			return nil, NotFoundError{Msg: "no field found for given accountID and name"}
+		}
+
+		log.Error("Database error when fetching account field", "err", err.Error())
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// AccountPatchFields applies field operations on an account in a single transaction. ifVersion 0 skips the version check
+func (d Db) AccountPatchFields(ctx context.Context, accountID string, ops []AccountFieldsPatchOp, ifVersion int64) (Account, error) {
+	log := d.log(ctx,
+		"accountID", accountID,
+		"ifVersion", ifVersion,
+		"ops", ops,
+	)
+
+	err := validatePatchOps(ops)
+	if err != nil {
+		log.Debug("Invalid patch operations", "err", err.Error())
+		return Account{}, err
+	}
+
+	tx, err := d.pool().Begin(ctx)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
 		return Account{}, err
 	}
 
 	// Rollback is safe to call even if the tx is already closed, so if
 	// the tx commits successfully, this is a no-op
-	defer tx.Rollback(context.Background())
+	defer tx.Rollback(ctx)
 
-	_, err = tx.Exec(context.Background(), "DELETE FROM \"accountsFields\" WHERE \"accountId\" = $1;", accountID)
+	// Locks the account row so concurrent patches on the same account are applied one after the other
+	err = d.accountVersionBump(ctx, tx, accountID, ifVersion)
 	if err != nil {
-		d.Log.Error("Could not delete previous fields", "err", err.Error())
 		return Account{}, err
 	}
 
-	accountFieldsSQL := "INSERT INTO \"accountsFields\" (id, \"accountId\", name, value) VALUES($1,$2,$3,$4);"
-	for _, field := range fields {
-		newFieldID, err := uuid.NewRandom()
+	for _, op := range ops {
+		var opSQL string
+		var params []interface{}
+
+		switch op.Op {
+		case AccountFieldsPatchOpSet:
+			newFieldID, err := uuid.NewRandom()
+			if err != nil {
+				log.Error("Could not create new Uuid", "err", err.Error())
+				return Account{}, err
+			}
+
+			opSQL = "INSERT INTO \"accountsFields\" (id, \"accountId\", name, value) VALUES($1,$2,$3,$4) " +
+				"ON CONFLICT (\"accountId\", name) DO UPDATE SET value = EXCLUDED.value;"
+			params = []interface{}{newFieldID, accountID, op.Name, uniqueValues(op.Values)}
+		case AccountFieldsPatchOpRemove:
+			opSQL = "DELETE FROM \"accountsFields\" WHERE \"accountId\" = $1 AND name = $2;"
+			params = []interface{}{accountID, op.Name}
+		case AccountFieldsPatchOpAddValues:
+			newFieldID, err := uuid.NewRandom()
+			if err != nil {
+				log.Error("Could not create new Uuid", "err", err.Error())
+				return Account{}, err
+			}
+
+			opSQL = "INSERT INTO \"accountsFields\" (id, \"accountId\", name, value) VALUES($1,$2,$3,$4) " +
+				"ON CONFLICT (\"accountId\", name) DO UPDATE SET value = \"accountsFields\".value || " +
+				"ARRAY(SELECT v FROM unnest(EXCLUDED.value) WITH ORDINALITY AS x(v, i) WHERE NOT v = ANY(\"accountsFields\".value) ORDER BY i);"
+			params = []interface{}{newFieldID, accountID, op.Name, uniqueValues(op.Values)}
+		case AccountFieldsPatchOpRemoveValues:
+			opSQL = "UPDATE \"accountsFields\" SET value = " +
+				"ARRAY(SELECT v FROM unnest(value) WITH ORDINALITY AS x(v, i) WHERE NOT v = ANY($3) ORDER BY i) " +
+				"WHERE \"accountId\" = $1 AND name = $2;"
+			params = []interface{}{accountID, op.Name, op.Values}
+		default:
+			log.Debug("Invalid patch operation", "op", op.Op)
+			return Account{}, ValidationError{Field: "op", Msg: "invalid patch operation"}
+		}
+
+		res, err := tx.Exec(ctx, opSQL, params...)
 		if err != nil {
-			d.Log.Error("Could not create new Uuid", "err", err.Error())
+			log.Error("Database error when trying to patch account field", "err", err.Error(), "op", op.Op, "fieldName", op.Name, "fieldValues", op.Values)
 			return Account{}, err
 		}
 
-		_, err = tx.Exec(context.Background(), accountFieldsSQL, newFieldID, accountID, field.Name, field.Values)
-		if err != nil {
-			d.Log.Error("Database error when trying to add account field", "err", err.Error(), "fieldName", field.Name, "fieldvalues", field.Values)
+		if res.RowsAffected() == 0 {
+			log.Debug("Tried to patch a field that does not exist", "op", op.Op, "fieldName", op.Name)
+			return Account{}, NotFoundError{Msg: "no field found for given name"}
 		}
 
-		d.Log.Debug("Added account field", "accountID", accountID, "fieldName", field.Name, "fieldValues", field.Values)
+		log.Debug("Patched account field", "op", op.Op, "fieldName", op.Name, "fieldValues", op.Values)
 	}
 
-	err = tx.Commit(context.Background())
+	err = tx.Commit(ctx)
 	if err != nil {
-		d.Log.Error("Database error when tying to commit", "err", err.Error())
+		log.Error("Database error when tying to commit", "err", err.Error())
 		return Account{}, err
 	}
 
-	return d.AccountGet(accountID, "", "")
+	return d.AccountGet(ctx, accountID, "", "")
+}
+
+// AccountAPIKeySet replaces the API key hash of an account
+func (d Db) AccountAPIKeySet(ctx context.Context, accountID string, APIKeyHash string) error {
+	return d.accountColumnSet(ctx, accountID, "apiKey", APIKeyHash)
+}
+
+// AccountPasswordSet replaces the password hash of an account
+func (d Db) AccountPasswordSet(ctx context.Context, accountID string, password string) error {
+	return d.accountColumnSet(ctx, accountID, "password", password)
+}
+
+// accountColumnSet sets a column on an account that is not deleted and bumps its version
+func (d Db) accountColumnSet(ctx context.Context, accountID string, column string, value string) error {
+	log := d.log(ctx,
+		"accountID", accountID,
+		"column", column,
+	)
+
+	updateSQL := "UPDATE accounts SET \"" + column + "\" = $2, version = version + 1 WHERE id = $1 AND deleted IS NULL"
+	res, err := d.pool().Exec(ctx, updateSQL, accountID, value)
+	if err != nil {
+		log.Error("Database error when trying to update account", "err", err.Error())
+		return err
+	}
+
+	if res.RowsAffected() == 0 {
+		log.Debug("No account found")
+		return NotFoundError{Msg: "no account found for given accountID"}
+	}
+
+	log.Verbose("Account updated")
+
+	return nil
+}
+
+// accountNameLockKey is the first key of the PostgreSQL advisory locks on account names, the second key is the hash of the name
+const accountNameLockKey int32 = 1416586616
+
+// accountNamesLock holds a PostgreSQL advisory lock on each of the names until tx ends
+// The reservation of an old name is not visible until its rename commits, so without the lock a create or rename
+// could check the name before the reservation shows up and take it. The locks are taken in a fixed order, so two
+// renames that swap names can not deadlock.
+func (d Db) accountNamesLock(ctx context.Context, tx pgx.Tx, names ...string) error {
+	lockSQL := "SELECT pg_advisory_xact_lock($1, key) FROM (SELECT DISTINCT hashtext(name) AS key FROM unnest($2::text[]) AS name ORDER BY key) AS keys"
+	_, err := tx.Exec(ctx, lockSQL, accountNameLockKey, names)
+	if err != nil {
+		d.log(ctx).Error("Could not take the account name locks", "err", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// accountVersionBump locks the account row for the rest of the transaction, checks its version and increments it.
+// Deleted accounts are treated as missing.
+// ifVersion 0 skips the version check
+func (d Db) accountVersionBump(ctx context.Context, tx pgx.Tx, accountID string, ifVersion int64) error {
+	log := d.log(ctx)
+
+	var version int64
+	err := tx.QueryRow(ctx, "SELECT version FROM accounts WHERE id = $1 AND deleted IS NULL FOR UPDATE", accountID).Scan(&version)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			log.Debug("No account found")
+			return NotFoundError{Msg: "no account found for given accountID"}
+		}
+
+		log.Error("Database error when locking account", "err", err.Error())
+		return err
+	}
+
+	if ifVersion != 0 && version != ifVersion {
+		log.Debug("Account version mismatch", "version", version)
+		return ErrVersionMismatch
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE accounts SET version = version + 1 WHERE id = $1", accountID)
+	if err != nil {
+		log.Error("Database error when bumping account version", "err", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// accountFieldsInsert writes fields for an account within a transaction
+func (d Db) accountFieldsInsert(ctx context.Context, tx pgx.Tx, accountID string, fields []AccountCreateInputFields) error {
+	log := d.log(ctx)
+
+	accountFieldsSQL := "INSERT INTO \"accountsFields\" (id, \"accountId\", name, value) VALUES($1,$2,$3,$4);"
+	for _, field := range fields {
+		newFieldID, err := uuid.NewRandom()
+		if err != nil {
+			log.Error("Could not create new Uuid", "err", err.Error())
+			return err
+		}
+
+		values := field.Values
+		if values == nil {
+			values = []string{} // The value column is NOT NULL, so store no values as an empty array
+		}
+
+		_, err = tx.Exec(ctx, accountFieldsSQL, newFieldID, accountID, field.Name, values)
+		if err != nil {
+			log.Error("Database error when trying to add account field", "err", err.Error(), "fieldName", field.Name, "fieldValues", field.Values)
+			return translateErr(err)
+		}
+
+		log.Debug("Added account field", "accountID", accountID, "fieldName", field.Name, "fieldValues", field.Values)
+	}
+
+	return nil
 }
@@ -0,0 +1,233 @@
+package db
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// AuditRedacted replaces secrets in audit event diffs, it only tells that they were given
+const AuditRedacted = "[redacted]"
+
+// auditChainPageSize is how many events AuditVerify() reads at a time
+const auditChainPageSize = 1000
+
+// AuditDiff encodes the diff of an audit event, never give it passwords, API keys or tokens
+func AuditDiff(diff map[string]interface{}) json.RawMessage {
+	diffJSON, _ := json.Marshal(diff) // Can not fail, only strings, string slices and maps of them are used
+	return diffJSON
+}
+
+// AuditFields turns fields into a map for the diff, so they read like the fields of an account
+func AuditFields(fields []AccountCreateInputFields) map[string][]string {
+	fieldsMap := make(map[string][]string, len(fields))
+	for _, field := range fields {
+		fieldsMap[field.Name] = field.Values
+	}
+
+	return fieldsMap
+}
+
+// AuditEventHash returns the hash of an event chained to the hash of the event before it, hex encoded SHA-256
+// Everything stored about the event is in it, the diff as the exact bytes written.
+func AuditEventHash(prevHash string, event AuditEvent) string {
+	content, _ := json.Marshal([]string{ // Can not fail, only strings
+		prevHash,
+		strconv.FormatInt(event.ID, 10),
+		event.Created.UTC().Format(time.RFC3339Nano),
+		event.Action,
+		event.ActorID,
+		event.TargetID,
+		event.IP,
+		event.UserAgent,
+		event.Outcome,
+		string(event.Diff),
+	})
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditCheckpointKey derives the key checkpoints are signed with, so the signatures can never be mistaken for JWT signatures
+func auditCheckpointKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("auth-api audit checkpoints"))
+	return mac.Sum(nil)
+}
+
+// AuditKeyID identifies the secret that signed a checkpoint, without giving anything away about it
+func AuditKeyID(secret []byte) string {
+	sum := sha256.Sum256(auditCheckpointKey(secret))
+	return hex.EncodeToString(sum[:8])
+}
+
+// AuditCheckpointSign returns the signature of a checkpoint, an HMAC-SHA256 of the event, its hash and when the checkpoint was made
+func AuditCheckpointSign(secret []byte, checkpoint AuditCheckpoint) string {
+	mac := hmac.New(sha256.New, auditCheckpointKey(secret))
+	mac.Write([]byte(strconv.FormatInt(checkpoint.EventID, 10) + "\n" + checkpoint.EventHash + "\n" + checkpoint.Created.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuditSign makes a checkpoint, it signs the hash of the last audit event with secret, the JWT_SHARED_SECRET
+// Returns false if there is nothing new to sign since the last checkpoint.
+func AuditSign(ctx context.Context, store Store, secret []byte) (AuditCheckpoint, bool, error) {
+	latest, err := store.AuditEventsGet(ctx, AuditEventsGetInput{Limit: 1})
+	if err != nil {
+		return AuditCheckpoint{}, false, err
+	}
+	if len(latest.Events) == 0 || latest.Events[0].Hash == "" {
+		return AuditCheckpoint{}, false, nil
+	}
+	event := latest.Events[0]
+
+	checkpoints, err := store.AuditCheckpointsGet(ctx)
+	if err != nil {
+		return AuditCheckpoint{}, false, err
+	}
+	if len(checkpoints) != 0 && checkpoints[len(checkpoints)-1].EventID == event.ID {
+		return AuditCheckpoint{}, false, nil
+	}
+
+	checkpoint := AuditCheckpoint{
+		Created:   time.Now().UTC().Truncate(time.Microsecond), // The precision of the timestamps in the databases
+		EventID:   event.ID,
+		EventHash: event.Hash,
+		KeyID:     AuditKeyID(secret),
+	}
+	checkpoint.Signature = AuditCheckpointSign(secret, checkpoint)
+
+	checkpoint, err = store.AuditCheckpointCreate(ctx, checkpoint)
+	if err != nil {
+		return AuditCheckpoint{}, false, err
+	}
+
+	return checkpoint, true, nil
+}
+
+// AuditVerifyResult is what AuditVerify() found, the chain is intact if Broken is empty
+type AuditVerifyResult struct {
+	Broken        string // Why the chain is broken at BrokenEventID
+	BrokenEventID int64
+	Checkpoints   int   // Checkpoints with a valid signature and hash
+	Events        int   // Chained events checked
+	LastEventID   int64 // Last event checked
+	Unchained     int   // Events from before the chain started
+	Unsigned      int   // Events after the last checkpoint, they could be cut off without breaking the chain
+}
+
+// AuditVerify checks every link of the audit chain and every checkpoint, and stops at the first broken one
+// secrets are the JWT_SHARED_SECRETs the checkpoints could be signed with, the current one and those rotated out.
+func AuditVerify(ctx context.Context, store Store, secrets [][]byte) (AuditVerifyResult, error) {
+	var result AuditVerifyResult
+
+	keys := make(map[string][]byte, len(secrets))
+	for _, secret := range secrets {
+		keys[AuditKeyID(secret)] = secret
+	}
+
+	checkpoints, err := store.AuditCheckpointsGet(ctx)
+	if err != nil {
+		return result, err
+	}
+	// Checkpoints by the event they sign, and the signed events in order to find the ones that are missing
+	checkpointsByEvent := make(map[int64][]AuditCheckpoint, len(checkpoints))
+	var signedEventIDs []int64
+	for _, checkpoint := range checkpoints {
+		if len(checkpointsByEvent[checkpoint.EventID]) == 0 {
+			signedEventIDs = append(signedEventIDs, checkpoint.EventID)
+		}
+		checkpointsByEvent[checkpoint.EventID] = append(checkpointsByEvent[checkpoint.EventID], checkpoint)
+	}
+	sort.Slice(signedEventIDs, func(i, j int) bool { return signedEventIDs[i] < signedEventIDs[j] })
+	var lastCheckpointEventID int64
+	if len(signedEventIDs) != 0 {
+		lastCheckpointEventID = signedEventIDs[len(signedEventIDs)-1]
+	}
+	missing := func(eventID int64) string {
+		return "event is missing, it is signed by checkpoint " + strconv.FormatInt(checkpointsByEvent[eventID][0].ID, 10)
+	}
+
+	broken := func(eventID int64, reason string) (AuditVerifyResult, error) {
+		result.BrokenEventID = eventID
+		result.Broken = reason
+		return result, nil
+	}
+
+	var prevHash string
+	var afterID int64
+	nextSigned := 0 // Index in signedEventIDs of the next signed event that should come
+	for {
+		events, err := store.AuditChainGet(ctx, afterID, auditChainPageSize)
+		if err != nil {
+			return result, err
+		}
+
+		for _, event := range events {
+			if nextSigned < len(signedEventIDs) && signedEventIDs[nextSigned] < event.ID {
+				return broken(signedEventIDs[nextSigned], missing(signedEventIDs[nextSigned]))
+			}
+			if nextSigned < len(signedEventIDs) && signedEventIDs[nextSigned] == event.ID {
+				nextSigned++
+			}
+			afterID = event.ID
+			result.LastEventID = event.ID
+
+			if event.Hash == "" {
+				if result.Events != 0 {
+					return broken(event.ID, "hash is missing")
+				}
+				if len(checkpointsByEvent[event.ID]) != 0 {
+					return broken(event.ID, "hash is missing, the event is signed by checkpoint "+strconv.FormatInt(checkpointsByEvent[event.ID][0].ID, 10))
+				}
+				result.Unchained++
+				continue
+			}
+
+			if event.PrevHash != prevHash {
+				if result.Events == 0 {
+					return broken(event.ID, "first event of the chain has a previous hash, events before it are missing")
+				}
+				return broken(event.ID, "previous hash does not match the event before it, events are missing or were changed")
+			}
+			if AuditEventHash(event.PrevHash, event) != event.Hash {
+				return broken(event.ID, "event does not match its hash, it was changed")
+			}
+
+			for _, checkpoint := range checkpointsByEvent[event.ID] {
+				checkpointID := strconv.FormatInt(checkpoint.ID, 10)
+				secret, ok := keys[checkpoint.KeyID]
+				if !ok {
+					return broken(event.ID, "checkpoint "+checkpointID+" is signed with key "+checkpoint.KeyID+" that was not given")
+				}
+				if !hmac.Equal([]byte(AuditCheckpointSign(secret, checkpoint)), []byte(checkpoint.Signature)) {
+					return broken(event.ID, "checkpoint "+checkpointID+" has an invalid signature")
+				}
+				if checkpoint.EventHash != event.Hash {
+					return broken(event.ID, "event does not match the hash signed by checkpoint "+checkpointID)
+				}
+				result.Checkpoints++
+			}
+
+			prevHash = event.Hash
+			result.Events++
+			if event.ID > lastCheckpointEventID {
+				result.Unsigned++
+			}
+		}
+
+		if len(events) < auditChainPageSize {
+			break
+		}
+	}
+
+	// The end of the chain was cut off
+	if nextSigned < len(signedEventIDs) {
+		return broken(signedEventIDs[nextSigned], missing(signedEventIDs[nextSigned]))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,235 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// auditChainLockKey is the PostgreSQL advisory lock held while an audit event is chained and written
+const auditChainLockKey = 7326146274
+
+// auditEventColumns are the columns auditEventScan() reads
+const auditEventColumns = "id, created, action, COALESCE(\"actorId\"::text, ''), COALESCE(\"targetId\"::text, ''), ip, \"userAgent\", outcome, COALESCE(diff, ''), COALESCE(\"prevHash\", ''), COALESCE(hash, '')"
+
+func auditEventScan(rows pgx.Rows) (AuditEvent, error) {
+	var event AuditEvent
+	var diff string
+	err := rows.Scan(&event.ID, &event.Created, &event.Action, &event.ActorID, &event.TargetID, &event.IP, &event.UserAgent, &event.Outcome, &diff, &event.PrevHash, &event.Hash)
+	if diff != "" {
+		event.Diff = []byte(diff)
+	}
+
+	return event, err
+}
+
+// AuditEventCreate writes an audit event chained to the last one, see AuditEventHash(), and returns it with its id, time and hashes
+func (d Db) AuditEventCreate(ctx context.Context, event AuditEvent) (AuditEvent, error) {
+	log := d.log(ctx,
+		"action", event.Action,
+		"outcome", event.Outcome,
+	)
+
+	event, err := auditEventPrepare(event)
+	if err != nil {
+		log.Debug("Invalid audit event", "err", err.Error())
+		return AuditEvent{}, err
+	}
+
+	tx, err := d.pool().Begin(ctx)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return AuditEvent{}, err
+	}
+
+	// Rollback is safe to call even if the tx is already closed, so if
+	// the tx commits successfully, this is a no-op
+	defer tx.Rollback(ctx)
+
+	// Events are written one at a time, so each is chained to the one written right before it
+	// The advisory lock only queues the writers of audit events, the table itself is not locked. It is released with the tx.
+	_, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", auditChainLockKey)
+	if err != nil {
+		log.Error("Could not take the audit chain lock", "err", err.Error())
+		return AuditEvent{}, err
+	}
+
+	// The id is part of the hash, so it is taken before the insert
+	chainSQL := "SELECT COALESCE((SELECT hash FROM \"auditEvents\" ORDER BY id DESC LIMIT 1), ''), nextval(pg_get_serial_sequence('\"auditEvents\"', 'id'))"
+	err = tx.QueryRow(ctx, chainSQL).Scan(&event.PrevHash, &event.ID)
+	if err != nil {
+		log.Error("Could not get last audit event hash and next id", "err", err.Error())
+		return AuditEvent{}, err
+	}
+	event.Hash = AuditEventHash(event.PrevHash, event)
+
+	insertSQL := "INSERT INTO \"auditEvents\" (id, created, action, \"actorId\", \"targetId\", ip, \"userAgent\", outcome, diff, \"prevHash\", hash) " +
+		"VALUES($1,$2,$3,NULLIF($4, '')::uuid,NULLIF($5, '')::uuid,$6,$7,$8,NULLIF($9, ''),NULLIF($10, ''),$11)"
+	_, err = tx.Exec(ctx, insertSQL, event.ID, event.Created, event.Action, event.ActorID, event.TargetID, event.IP, event.UserAgent, event.Outcome, string(event.Diff), event.PrevHash, event.Hash)
+	if err != nil {
+		log.Error("Could not insert into database table \"auditEvents\"", "err", err.Error())
+		return AuditEvent{}, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		log.Error("Could not commit audit event", "err", err.Error())
+		return AuditEvent{}, err
+	}
+
+	return event, nil
+}
+
+// AuditChainGet returns up to limit audit events after the one with afterID, oldest first, to verify the chain
+func (d Db) AuditChainGet(ctx context.Context, afterID int64, limit int) ([]AuditEvent, error) {
+	log := d.log(ctx, "afterID", afterID)
+
+	rows, err := d.pool().Query(ctx, "SELECT "+auditEventColumns+" FROM \"auditEvents\" WHERE id > $1 ORDER BY id LIMIT $2", afterID, limit)
+	if err != nil {
+		log.Error("Database error when fetching audit chain", "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		event, err := auditEventScan(rows)
+		if err != nil {
+			log.Error("Could not scan audit event from database row", "err", err.Error())
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if rows.Err() != nil {
+		log.Error("Database error when reading audit event rows", "err", rows.Err().Error())
+		return nil, rows.Err()
+	}
+
+	return events, nil
+}
+
+// AuditCheckpointCreate writes a signed checkpoint, see AuditSign()
+func (d Db) AuditCheckpointCreate(ctx context.Context, checkpoint AuditCheckpoint) (AuditCheckpoint, error) {
+	insertSQL := "INSERT INTO \"auditCheckpoints\" (created, \"eventId\", \"eventHash\", \"keyId\", signature) VALUES($1,$2,$3,$4,$5) RETURNING id"
+	err := d.pool().QueryRow(ctx, insertSQL, checkpoint.Created, checkpoint.EventID, checkpoint.EventHash, checkpoint.KeyID, checkpoint.Signature).Scan(&checkpoint.ID)
+	if err != nil {
+		d.log(ctx).Error("Could not insert into database table \"auditCheckpoints\"", "err", err.Error(), "eventID", checkpoint.EventID)
+		return AuditCheckpoint{}, err
+	}
+
+	return checkpoint, nil
+}
+
+// AuditCheckpointsGet returns all audit checkpoints, oldest first
+func (d Db) AuditCheckpointsGet(ctx context.Context) ([]AuditCheckpoint, error) {
+	rows, err := d.pool().Query(ctx, "SELECT id, created, \"eventId\", \"eventHash\", \"keyId\", signature FROM \"auditCheckpoints\" ORDER BY id")
+	if err != nil {
+		d.log(ctx).Error("Database error when fetching audit checkpoints", "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := []AuditCheckpoint{}
+	for rows.Next() {
+		var checkpoint AuditCheckpoint
+		err := rows.Scan(&checkpoint.ID, &checkpoint.Created, &checkpoint.EventID, &checkpoint.EventHash, &checkpoint.KeyID, &checkpoint.Signature)
+		if err != nil {
+			d.log(ctx).Error("Could not scan audit checkpoint from database row", "err", err.Error())
+			return nil, err
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	if rows.Err() != nil {
+		d.log(ctx).Error("Database error when reading audit checkpoint rows", "err", rows.Err().Error())
+		return nil, rows.Err()
+	}
+
+	return checkpoints, nil
+}
+
+// AuditEventsGet lists audit events, newest first
+func (d Db) AuditEventsGet(ctx context.Context, input AuditEventsGetInput) (AuditEventsList, error) {
+	log := d.log(ctx,
+		"accountID", input.AccountID,
+		"action", input.Action,
+		"cursor", input.Cursor,
+		"limit", input.Limit,
+	)
+	log.Debug("Trying to get audit events")
+
+	input, beforeID, err := auditEventsPrepare(input)
+	if err != nil {
+		log.Debug("Invalid audit events filter", "err", err.Error())
+		return AuditEventsList{}, err
+	}
+
+	var where []string
+	var params []interface{}
+	addParam := func(value interface{}) string {
+		params = append(params, value)
+		return "$" + strconv.Itoa(len(params))
+	}
+
+	if input.AccountID != "" {
+		param := addParam(input.AccountID)
+		where = append(where, "(\"actorId\" = "+param+" OR \"targetId\" = "+param+")")
+	}
+	if input.Action != "" {
+		where = append(where, "action = "+addParam(input.Action))
+	}
+	if input.ActorID != "" {
+		where = append(where, "\"actorId\" = "+addParam(input.ActorID))
+	}
+	if input.Outcome != "" {
+		where = append(where, "outcome = "+addParam(input.Outcome))
+	}
+	if !input.Since.IsZero() {
+		where = append(where, "created >= "+addParam(input.Since.UTC()))
+	}
+	if input.TargetID != "" {
+		where = append(where, "\"targetId\" = "+addParam(input.TargetID))
+	}
+	if !input.Until.IsZero() {
+		where = append(where, "created < "+addParam(input.Until.UTC()))
+	}
+	if beforeID != 0 {
+		where = append(where, "id < "+addParam(beforeID))
+	}
+
+	eventsSQL := "SELECT " + auditEventColumns + " FROM \"auditEvents\""
+	if len(where) != 0 {
+		eventsSQL = eventsSQL + " WHERE " + strings.Join(where, " AND ")
+	}
+	// Fetch one extra row to know if there is a next page or not
+	eventsSQL = eventsSQL + " ORDER BY id DESC LIMIT " + addParam(input.Limit+1)
+
+	rows, err := d.pool().Query(ctx, eventsSQL, params...)
+	if err != nil {
+		log.Error("Database error when fetching audit events", "err", err.Error())
+		return AuditEventsList{}, err
+	}
+	defer rows.Close()
+
+	result := AuditEventsList{Events: []AuditEvent{}}
+	for rows.Next() {
+		event, err := auditEventScan(rows)
+		if err != nil {
+			log.Error("Could not scan audit event from database row", "err", err.Error())
+			return AuditEventsList{}, err
+		}
+		result.Events = append(result.Events, event)
+	}
+	if rows.Err() != nil {
+		log.Error("Database error when reading audit event rows", "err", rows.Err().Error())
+		return AuditEventsList{}, rows.Err()
+	}
+
+	if len(result.Events) > input.Limit {
+		result.Events = result.Events[:input.Limit]
+		result.NextCursor = strconv.FormatInt(result.Events[input.Limit-1].ID, 10)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jackc/pgconn"
+)
+
+// Sentinel errors, use errors.Is() to check for them. The typed errors below match their sentinel.
+var (
+	ErrConflict        = errors.New("conflict")
+	ErrNotFound        = errors.New("not found")
+	ErrSchemaMismatch  = errors.New("schema mismatch")
+	ErrValidation      = errors.New("validation failed")
+	ErrVersionMismatch = errors.New("version mismatch")
+)
+
+// ConflictError is returned when a write collides with existing data, for example a name that is already taken
+type ConflictError struct {
+	Constraint string // Name of the database constraint or index, like "idx_accountname"
+	Field      string // Input field causing the conflict, like "name"
+	Msg        string
+}
+
+func (e ConflictError) Error() string        { return e.Msg }
+func (e ConflictError) Is(target error) bool { return target == ErrConflict }
+
+// NotFoundError is returned when what was asked for does not exist
+type NotFoundError struct {
+	Msg string
+}
+
+func (e NotFoundError) Error() string        { return e.Msg }
+func (e NotFoundError) Is(target error) bool { return target == ErrNotFound }
+
+// ValidationError is returned when input is rejected before anything is written
+type ValidationError struct {
+	Field string // Input field that is invalid, like "fields"
+	Msg   string
+}
+
+func (e ValidationError) Error() string        { return e.Msg }
+func (e ValidationError) Is(target error) bool { return target == ErrValidation }
+
+// SchemaMismatchError is returned when the migrations applied to the database are not the ones embedded in the binary
+type SchemaMismatchError struct {
+	Pending []string // Embedded migrations that are not applied
+	Unknown []string // Applied migrations that are not embedded, from a newer version of the binary
+}
+
+func (e SchemaMismatchError) Error() string {
+	if len(e.Unknown) != 0 {
+		return "database schema has migrations this binary does not know about (" + strings.Join(e.Unknown, ", ") + "), it was migrated by a newer version"
+	}
+
+	return "database schema is missing migrations (" + strings.Join(e.Pending, ", ") + "), run \"migrate up\" or set DB_AUTO_MIGRATE=true"
+}
+func (e SchemaMismatchError) Is(target error) bool { return target == ErrSchemaMismatch }
+
+// errNameReserved is returned when a name is reserved by an account that was renamed
+var errNameReserved = ConflictError{Constraint: "accountsNameHistory", Field: "name", Msg: "name was recently used by another account"}
+
+// Input fields and messages for the unique indexes that can be violated by user input
+var uniqueViolations = map[string]ConflictError{
+	"idx_accountname":    {Field: "name", Msg: "name is already taken"},
+	"idx_accountsfields": {Field: "fields", Msg: "field names must be unique"},
+}
+
+// uniqueConflict returns the ConflictError for a violated unique constraint or index
+func uniqueConflict(constraint string) ConflictError {
+	conflictErr, ok := uniqueViolations[constraint]
+	if !ok {
+		conflictErr = ConflictError{Msg: "conflict with existing data"}
+	}
+	conflictErr.Constraint = constraint
+
+	return conflictErr
+}
+
+// translateErr turns unique violations from PostgreSQL into a ConflictError, other errors are returned as is
+func translateErr(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" { // unique_violation
+		return uniqueConflict(pgErr.ConstraintName)
+	}
+
+	return err
+}
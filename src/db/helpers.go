@@ -0,0 +1,344 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"gitea.larvit.se/pwrpln/go_log"
+	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// accountsCursor is the position after which the next page of accounts starts
+type accountsCursor struct {
+	Created  time.Time `json:"c"`
+	ID       uuid.UUID `json:"i"`
+	Name     string    `json:"n"`
+	SortBy   string    `json:"s"`
+	SortDesc bool      `json:"d"`
+}
+
+func encodeAccountsCursor(cursor accountsCursor) string {
+	cursorJSON, _ := json.Marshal(cursor) // Can not fail, all fields are plain values
+	return base64.RawURLEncoding.EncodeToString(cursorJSON)
+}
+
+func decodeAccountsCursor(encoded string) (accountsCursor, error) {
+	var cursor accountsCursor
+
+	cursorJSON, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return accountsCursor{}, err
+	}
+
+	err = json.Unmarshal(cursorJSON, &cursor)
+	if err != nil {
+		return accountsCursor{}, err
+	}
+
+	return cursor, nil
+}
+
+// likeEscape escapes the LIKE wildcards so the string can be used as a literal prefix
+func likeEscape(str string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(str)
+}
+
+// uniqueValues removes duplicate values while keeping the order
+func uniqueValues(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+
+	return result
+}
+
+// patchFields applies field operations on fields, it stops at the first failing operation
+// Used by the stores that can not do it in SQL, the result must match AccountPatchFields() of Db
+func patchFields(fields map[string][]string, ops []AccountFieldsPatchOp) error {
+	err := validatePatchOps(ops)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		values, exists := fields[op.Name]
+
+		switch op.Op {
+		case AccountFieldsPatchOpSet:
+			fields[op.Name] = uniqueValues(op.Values)
+		case AccountFieldsPatchOpRemove:
+			if !exists {
+				return NotFoundError{Msg: "no field found for given name"}
+			}
+			delete(fields, op.Name)
+		case AccountFieldsPatchOpAddValues:
+			if !exists {
+				values = []string{}
+			}
+			for _, value := range uniqueValues(op.Values) {
+				if !utils.Contains(values, value) {
+					values = append(values, value)
+				}
+			}
+			fields[op.Name] = values
+		case AccountFieldsPatchOpRemoveValues:
+			if !exists {
+				return NotFoundError{Msg: "no field found for given name"}
+			}
+			keptValues := []string{}
+			for _, value := range values {
+				if !utils.Contains(op.Values, value) {
+					keptValues = append(keptValues, value)
+				}
+			}
+			fields[op.Name] = keptValues
+		default:
+			return ValidationError{Field: "op", Msg: "invalid patch operation"}
+		}
+	}
+
+	return nil
+}
+
+// validateFields makes sure all fields have a name and that no name is given twice
+func validateFields(fields []AccountCreateInputFields) error {
+	seen := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if field.Name == "" {
+			return ValidationError{Field: "fields", Msg: "field names can not be empty"}
+		}
+		if seen[field.Name] {
+			return ValidationError{Field: "fields", Msg: "field names must be unique"}
+		}
+		seen[field.Name] = true
+	}
+
+	return nil
+}
+
+// validatePatchOps checks the operations before any of them are applied
+// A nil slice is sent as NULL to Postgres, and NOT v = ANY(NULL) is never true, so "removeValues" without values would empty the whole field
+func validatePatchOps(ops []AccountFieldsPatchOp) error {
+	for _, op := range ops {
+		switch op.Op {
+		case AccountFieldsPatchOpSet, AccountFieldsPatchOpRemove:
+		case AccountFieldsPatchOpAddValues, AccountFieldsPatchOpRemoveValues:
+			if len(op.Values) == 0 {
+				return ValidationError{Field: "values", Msg: "values can not be empty"}
+			}
+		default:
+			return ValidationError{Field: "op", Msg: "invalid patch operation"}
+		}
+	}
+
+	return nil
+}
+
+// auditEventPrepare validates an event before it is written and sets the time it is created
+func auditEventPrepare(event AuditEvent) (AuditEvent, error) {
+	if event.Action == "" {
+		return AuditEvent{}, ValidationError{Field: "action", Msg: "action can not be empty"}
+	}
+	if event.Outcome == "" {
+		return AuditEvent{}, ValidationError{Field: "outcome", Msg: "outcome can not be empty"}
+	}
+	// Stored the way uuid.UUID.String() returns them, so SQLite and Memory can filter on them as text
+	for field, accountID := range map[string]*string{"actorId": &event.ActorID, "targetId": &event.TargetID} {
+		if *accountID == "" {
+			continue
+		}
+		parsed, err := uuid.Parse(*accountID)
+		if err != nil {
+			return AuditEvent{}, ValidationError{Field: field, Msg: "invalid uuid format"}
+		}
+		*accountID = parsed.String()
+	}
+	if len(event.Diff) != 0 && !json.Valid(event.Diff) {
+		return AuditEvent{}, ValidationError{Field: "diff", Msg: "diff must be JSON"}
+	}
+
+	event.Created = time.Now().UTC().Truncate(time.Microsecond) // The precision of the timestamps in the databases
+	return event, nil
+}
+
+// auditEventsPrepare validates the filters and returns the input with defaults and the id the page starts after, 0 for the first page
+// The cursor is the id of the last event on the previous page, events are listed newest first.
+func auditEventsPrepare(input AuditEventsGetInput) (AuditEventsGetInput, int64, error) {
+	if input.Limit < 1 {
+		input.Limit = AuditEventsDefaultLimit
+	}
+
+	for field, accountID := range map[string]*string{"accountId": &input.AccountID, "actorId": &input.ActorID, "targetId": &input.TargetID} {
+		if *accountID == "" {
+			continue
+		}
+		parsed, err := uuid.Parse(*accountID)
+		if err != nil {
+			return input, 0, ValidationError{Field: field, Msg: "invalid uuid format"}
+		}
+		*accountID = parsed.String()
+	}
+
+	var beforeID int64
+	if input.Cursor != "" {
+		var err error
+		beforeID, err = strconv.ParseInt(input.Cursor, 10, 64)
+		if err != nil || beforeID < 1 {
+			return input, 0, ValidationError{Field: "cursor", Msg: "invalid cursor"}
+		}
+	}
+
+	return input, beforeID, nil
+}
+
+// Ping checks that a connection to the database can be made through the pool
+func (d Db) Ping(ctx context.Context) error {
+	ctx, cancel := timeoutCtx(ctx, d.QueryTimeout)
+	defer cancel()
+
+	return d.DbPool.Ping(ctx)
+}
+
+// pool returns the pool with the query timeout applied to each statement, transactions begun from it get it too
+func (d Db) pool() timedPool {
+	return timedPool{pool: d.DbPool, timeout: d.QueryTimeout}
+}
+
+// timeoutCtx limits ctx to timeout, 0 means no limit besides the one on ctx
+func timeoutCtx(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// log returns the request logger from ctx with the given fields added, d.Log is used outside of requests
+func (d Db) log(ctx context.Context, fields ...interface{}) go_log.Log {
+	return utils.LogFromCtx(ctx, d.Log, fields...)
+}
+
+// pgQueryer is implemented by both *pgxpool.Pool and pgx.Tx
+type pgQueryer interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// timedExec runs a statement that has to finish within timeout
+func timedExec(ctx context.Context, queryer pgQueryer, timeout time.Duration, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	ctx, cancel := timeoutCtx(ctx, timeout)
+	defer cancel()
+
+	return queryer.Exec(ctx, sql, args...)
+}
+
+// timedQuery runs a query that has to be read within timeout, the timeout ends when the rows are closed
+func timedQuery(ctx context.Context, queryer pgQueryer, timeout time.Duration, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, cancel := timeoutCtx(ctx, timeout)
+
+	rows, err := queryer.Query(ctx, sql, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return timedRows{Rows: rows, cancel: cancel}, nil
+}
+
+// timedQueryRow runs a query that has to be scanned within timeout
+func timedQueryRow(ctx context.Context, queryer pgQueryer, timeout time.Duration, sql string, args ...interface{}) pgx.Row {
+	ctx, cancel := timeoutCtx(ctx, timeout)
+
+	return timedRow{row: queryer.QueryRow(ctx, sql, args...), cancel: cancel}
+}
+
+type timedRow struct {
+	row    pgx.Row
+	cancel context.CancelFunc
+}
+
+func (r timedRow) Scan(dest ...interface{}) error {
+	defer r.cancel()
+
+	return r.row.Scan(dest...)
+}
+
+type timedRows struct {
+	pgx.Rows
+	cancel context.CancelFunc
+}
+
+func (r timedRows) Close() {
+	r.Rows.Close()
+	r.cancel()
+}
+
+// timedPool applies a timeout to each statement run on the pool
+type timedPool struct {
+	pool    *pgxpool.Pool
+	timeout time.Duration // 0 means no limit besides the one on ctx
+}
+
+// Begin starts a transaction where each statement gets the timeout of the pool
+func (p timedPool) Begin(ctx context.Context) (pgx.Tx, error) {
+	beginCtx, cancel := timeoutCtx(ctx, p.timeout)
+	defer cancel()
+
+	tx, err := p.pool.Begin(beginCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	return timedTx{Tx: tx, timeout: p.timeout}, nil
+}
+
+func (p timedPool) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return timedExec(ctx, p.pool, p.timeout, sql, args...)
+}
+
+func (p timedPool) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return timedQuery(ctx, p.pool, p.timeout, sql, args...)
+}
+
+func (p timedPool) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return timedQueryRow(ctx, p.pool, p.timeout, sql, args...)
+}
+
+// timedTx is a transaction where each statement, and the commit, gets a timeout of its own
+type timedTx struct {
+	pgx.Tx
+	timeout time.Duration
+}
+
+func (t timedTx) Commit(ctx context.Context) error {
+	ctx, cancel := timeoutCtx(ctx, t.timeout)
+	defer cancel()
+
+	return t.Tx.Commit(ctx)
+}
+
+func (t timedTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return timedExec(ctx, t.Tx, t.timeout, sql, args...)
+}
+
+func (t timedTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	return timedQuery(ctx, t.Tx, t.timeout, sql, args...)
+}
+
+func (t timedTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return timedQueryRow(ctx, t.Tx, t.timeout, sql, args...)
+}
@@ -0,0 +1,979 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"gitea.larvit.se/pwrpln/go_log"
+	"github.com/google/uuid"
+)
+
+// renewalTokenTTL is how long a renewal token is valid in Memory and SQLite, same as the default of renewalTokens.exp in PostgreSQL
+const renewalTokenTTL = 24 * time.Hour
+
+// Memory is a Store that keeps everything in memory, for tests and local development. All data is lost on restart.
+// Names are sorted by byte value, while PostgreSQL sorts them by the collation of the database.
+type Memory struct {
+	DeletedRetention   time.Duration // How long deleted accounts can be restored before they are purged
+	Log                go_log.Log
+	OldNameReservation time.Duration // How long the old name of a renamed account is kept from others
+
+	mu               sync.Mutex
+	accounts         map[uuid.UUID]*memAccount
+	auditCheckpoints []AuditCheckpoint
+	auditEvents      []AuditEvent // Oldest first
+	nameHistory      []memNameHistory
+	renewalTokens    map[string]memRenewalToken
+	sessions         []Session // Oldest first, Active is set when they are listed
+}
+
+type memAccount struct {
+	account         Account
+	tokenGeneration int64
+}
+
+type memNameHistory struct {
+	accountID     uuid.UUID
+	name          string
+	reservedUntil time.Time
+}
+
+type memRenewalToken struct {
+	accountID uuid.UUID
+	exp       time.Time
+	sessionID uuid.UUID // uuid.Nil for no session
+}
+
+// AccountAPIKeySet replaces the API key hash of an account
+func (m *Memory) AccountAPIKeySet(ctx context.Context, accountID string, APIKeyHash string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	account, err := m.activeAccount(accountID, 0)
+	if err != nil {
+		return err
+	}
+
+	account.account.APIKeyHash = APIKeyHash
+	account.account.Version++
+
+	m.log(ctx, "accountID", accountID).Verbose("Account API key replaced")
+
+	return nil
+}
+
+// AccountCreate adds an account
+func (m *Memory) AccountCreate(ctx context.Context, input AccountCreateInput) (CreatedAccount, error) {
+	log := m.log(ctx,
+		"accountName", input.Name,
+		"id", input.ID,
+	)
+
+	err := validateFields(input.Fields)
+	if err != nil {
+		log.Debug("Invalid account fields", "err", err.Error())
+		return CreatedAccount{}, err
+	}
+
+	if err := m.lock(ctx); err != nil {
+		return CreatedAccount{}, err
+	}
+	defer m.mu.Unlock()
+
+	now := memNow()
+
+	if m.nameReserved(input.Name, uuid.Nil, now) {
+		log.Debug("Name is reserved by a renamed account")
+		return CreatedAccount{}, errNameReserved
+	}
+	if m.accounts[input.ID] != nil {
+		return CreatedAccount{}, uniqueConflict("accounts_pkey")
+	}
+	if m.nameTaken(input.Name) {
+		log.Debug("Duplicate name")
+		return CreatedAccount{}, uniqueConflict("idx_accountname")
+	}
+
+	fields := make(map[string][]string, len(input.Fields))
+	for _, field := range input.Fields {
+		fields[field.Name] = copyValues(field.Values)
+	}
+
+	m.accounts[input.ID] = &memAccount{
+		account: Account{
+			APIKeyHash: input.APIKeyHash,
+			ID:         input.ID,
+			Created:    now,
+			Fields:     fields,
+			Name:       input.Name,
+			Password:   input.Password,
+			Version:    1,
+		},
+	}
+
+	log.Verbose("Added account", "id", input.ID)
+
+	return CreatedAccount{
+		ID:   input.ID,
+		Name: input.Name,
+	}, nil
+}
+
+// AccountDel marks an account as deleted and removes its renewal tokens. ifVersion 0 skips the version check
+func (m *Memory) AccountDel(ctx context.Context, accountID string, ifVersion int64) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	account, err := m.activeAccount(accountID, ifVersion)
+	if err != nil {
+		return err
+	}
+
+	m.accountRenewalTokensRm(account.account.ID)
+
+	now := memNow()
+	account.account.Deleted = &now
+	account.account.Version++
+
+	m.log(ctx, "accountID", accountID).Verbose("Account marked as deleted")
+
+	return nil
+}
+
+// AccountFieldGet fetches the values of a single account field
+func (m *Memory) AccountFieldGet(ctx context.Context, accountID string, fieldName string) ([]string, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	account := m.account(accountID)
+	if account == nil || account.account.Deleted != nil {
+		return nil, NotFoundError{Msg: "no field found for given accountID and name"}
+	}
+
+	values, ok := account.account.Fields[fieldName]
+	if !ok {
+		return nil, NotFoundError{Msg: "no field found for given accountID and name"}
+	}
+
+	return copyValues(values), nil
+}
+
+// AccountGet fetches an account by id, API key or name, deleted accounts are not included
+func (m *Memory) AccountGet(ctx context.Context, accountID string, APIKeyHash string, name string) (Account, error) {
+	if err := m.lock(ctx); err != nil {
+		return Account{}, err
+	}
+	defer m.mu.Unlock()
+
+	if accountID != "" {
+		account := m.account(accountID)
+		if account == nil || account.account.Deleted != nil {
+			return Account{}, NotFoundError{Msg: "no account found for given accountID"}
+		}
+
+		return copyAccount(account.account), nil
+	}
+
+	if APIKeyHash == "" && name == "" {
+		return Account{}, NotFoundError{Msg: "no account found"}
+	}
+
+	for _, account := range m.accounts {
+		if account.account.Deleted != nil {
+			continue
+		}
+		if (APIKeyHash != "" && account.account.APIKeyHash == APIKeyHash) || (APIKeyHash == "" && account.account.Name == name) {
+			return copyAccount(account.account), nil
+		}
+	}
+
+	return Account{}, NotFoundError{Msg: "no account found"}
+}
+
+// AccountGetIncludingDeleted fetches an account, even if it is deleted
+func (m *Memory) AccountGetIncludingDeleted(ctx context.Context, accountID string) (Account, error) {
+	if err := m.lock(ctx); err != nil {
+		return Account{}, err
+	}
+	defer m.mu.Unlock()
+
+	account := m.account(accountID)
+	if account == nil {
+		return Account{}, NotFoundError{Msg: "no account found for given accountID"}
+	}
+
+	return copyAccount(account.account), nil
+}
+
+// AccountLogoutAll bumps the token generation of an account, so its JWTs stop working, and removes all its renewal tokens
+// Returns how many renewal tokens were removed. ifVersion 0 skips the version check
+func (m *Memory) AccountLogoutAll(ctx context.Context, accountID string, ifVersion int64) (int, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+
+	account, err := m.activeAccount(accountID, ifVersion)
+	if err != nil {
+		return 0, err
+	}
+	account.tokenGeneration++
+	account.account.Version++
+
+	return m.accountRenewalTokensRm(account.account.ID), nil
+}
+
+// AccountPasswordSet replaces the password hash of an account
+func (m *Memory) AccountPasswordSet(ctx context.Context, accountID string, password string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	account, err := m.activeAccount(accountID, 0)
+	if err != nil {
+		return err
+	}
+
+	account.account.Password = password
+	account.account.Version++
+
+	m.log(ctx, "accountID", accountID).Verbose("Account password replaced")
+
+	return nil
+}
+
+// AccountPatchFields applies field operations on an account, either all of them or none. ifVersion 0 skips the version check
+func (m *Memory) AccountPatchFields(ctx context.Context, accountID string, ops []AccountFieldsPatchOp, ifVersion int64) (Account, error) {
+	if err := m.lock(ctx); err != nil {
+		return Account{}, err
+	}
+	defer m.mu.Unlock()
+
+	account, err := m.activeAccount(accountID, ifVersion)
+	if err != nil {
+		return Account{}, err
+	}
+
+	// Work on a copy, so nothing is changed if one of the operations fails
+	fields := copyAccount(account.account).Fields
+	err = patchFields(fields, ops)
+	if err != nil {
+		return Account{}, err
+	}
+
+	account.account.Fields = fields
+	account.account.Version++
+
+	return copyAccount(account.account), nil
+}
+
+// AccountRename changes the name of an account and reserves the old name. ifVersion 0 skips the version check
+func (m *Memory) AccountRename(ctx context.Context, accountID string, newName string, ifVersion int64) (Account, error) {
+	if err := m.lock(ctx); err != nil {
+		return Account{}, err
+	}
+	defer m.mu.Unlock()
+
+	account, err := m.activeAccount(accountID, ifVersion)
+	if err != nil {
+		return Account{}, err
+	}
+
+	oldName := account.account.Name
+	if oldName == newName {
+		return copyAccount(account.account), nil
+	}
+
+	now := memNow()
+
+	// The account can always take back its own old names
+	if m.nameReserved(newName, account.account.ID, now) {
+		return Account{}, errNameReserved
+	}
+	if m.nameTaken(newName) {
+		return Account{}, uniqueConflict("idx_accountname")
+	}
+
+	account.account.Name = newName
+	account.account.Version++
+	m.nameHistory = append(m.nameHistory, memNameHistory{
+		accountID:     account.account.ID,
+		name:          oldName,
+		reservedUntil: now.Add(m.OldNameReservation),
+	})
+
+	m.log(ctx, "accountID", accountID, "newName", newName).Info("Account renamed", "oldName", oldName)
+
+	return copyAccount(account.account), nil
+}
+
+// AccountRestore brings back a deleted account that is still within the retention period. ifVersion 0 skips the version check
+func (m *Memory) AccountRestore(ctx context.Context, accountID string, ifVersion int64) (Account, error) {
+	if err := m.lock(ctx); err != nil {
+		return Account{}, err
+	}
+	defer m.mu.Unlock()
+
+	account := m.account(accountID)
+	if account == nil || account.account.Deleted == nil || !account.account.Deleted.After(memNow().Add(-m.DeletedRetention)) {
+		return Account{}, NotFoundError{Msg: "no restorable deleted account found for given accountID"}
+	}
+	if ifVersion != 0 && account.account.Version != ifVersion {
+		return Account{}, ErrVersionMismatch
+	}
+
+	account.account.Deleted = nil
+	account.account.Version++
+
+	return copyAccount(account.account), nil
+}
+
+// AccountTokenGeneration returns the token generation of an account that exists and is not deleted
+func (m *Memory) AccountTokenGeneration(ctx context.Context, accountID string) (int64, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+
+	account, err := m.activeAccount(accountID, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return account.tokenGeneration, nil
+}
+
+// AccountUpdateFields replaces all fields on an account. ifVersion 0 skips the version check
+func (m *Memory) AccountUpdateFields(ctx context.Context, accountID string, fields []AccountCreateInputFields, ifVersion int64) (Account, error) {
+	err := validateFields(fields)
+	if err != nil {
+		return Account{}, err
+	}
+
+	if err := m.lock(ctx); err != nil {
+		return Account{}, err
+	}
+	defer m.mu.Unlock()
+
+	account, err := m.activeAccount(accountID, ifVersion)
+	if err != nil {
+		return Account{}, err
+	}
+
+	account.account.Fields = make(map[string][]string, len(fields))
+	for _, field := range fields {
+		account.account.Fields[field.Name] = copyValues(field.Values)
+	}
+	account.account.Version++
+
+	return copyAccount(account.account), nil
+}
+
+// AccountsGet fetches a page of accounts
+func (m *Memory) AccountsGet(ctx context.Context, input AccountsGetInput) (AccountsList, error) {
+	if input.SortBy == "" {
+		input.SortBy = "created"
+	}
+	if input.SortBy != "created" && input.SortBy != "name" {
+		return AccountsList{}, ValidationError{Field: "sort", Msg: "must be \"created\" or \"name\""}
+	}
+	if input.Limit < 1 {
+		input.Limit = AccountsDefaultLimit
+	}
+
+	var cursor *accountsCursor
+	if input.Cursor != "" {
+		decoded, err := decodeAccountsCursor(input.Cursor)
+		if err != nil || decoded.SortBy != input.SortBy || decoded.SortDesc != input.SortDesc {
+			return AccountsList{}, ValidationError{Field: "cursor", Msg: "invalid cursor"}
+		}
+		cursor = &decoded
+	}
+
+	if err := m.lock(ctx); err != nil {
+		return AccountsList{}, err
+	}
+	defer m.mu.Unlock()
+
+	var matching []Account
+	for _, account := range m.accounts {
+		if account.account.Deleted != nil && !input.IncludeDeleted {
+			continue
+		}
+		if !strings.HasPrefix(account.account.Name, input.NamePrefix) {
+			continue
+		}
+		if !fieldsMatch(account.account.Fields, input.FieldFilters) {
+			continue
+		}
+		matching = append(matching, account.account)
+	}
+
+	// Same order as "ORDER BY <sortBy>, id" in PostgreSQL
+	compare := func(a accountsCursor, b accountsCursor) int {
+		var result int
+		if input.SortBy == "name" {
+			result = strings.Compare(a.Name, b.Name)
+		} else if a.Created.Before(b.Created) {
+			result = -1
+		} else if a.Created.After(b.Created) {
+			result = 1
+		}
+		if result == 0 {
+			result = bytes.Compare(a.ID[:], b.ID[:])
+		}
+		if input.SortDesc {
+			result = -result
+		}
+
+		return result
+	}
+	sortKey := func(account Account) accountsCursor {
+		return accountsCursor{Created: account.Created, ID: account.ID, Name: account.Name}
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		return compare(sortKey(matching[i]), sortKey(matching[j])) < 0
+	})
+
+	var result AccountsList
+	if input.WithTotal {
+		total := len(matching)
+		result.Total = &total
+	}
+
+	result.Accounts = []Account{}
+	for _, account := range matching {
+		if cursor != nil && compare(sortKey(account), *cursor) <= 0 {
+			continue
+		}
+		if len(result.Accounts) == input.Limit {
+			last := result.Accounts[input.Limit-1]
+			result.NextCursor = encodeAccountsCursor(accountsCursor{
+				Created:  last.Created,
+				ID:       last.ID,
+				Name:     last.Name,
+				SortBy:   input.SortBy,
+				SortDesc: input.SortDesc,
+			})
+			break
+		}
+		// Like the other stores, do not include credentials in lists
+		listed := copyAccount(account)
+		listed.APIKeyHash = ""
+		listed.Password = ""
+		result.Accounts = append(result.Accounts, listed)
+	}
+
+	return result, nil
+}
+
+// AccountsPurge permanently removes all accounts that have been deleted for longer than the retention period
+func (m *Memory) AccountsPurge(ctx context.Context) (int, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+
+	cutoff := memNow().Add(-m.DeletedRetention)
+
+	purged := 0
+	for accountID, account := range m.accounts {
+		if account.account.Deleted == nil || account.account.Deleted.After(cutoff) {
+			continue
+		}
+
+		m.accountRenewalTokensRm(accountID)
+		delete(m.accounts, accountID)
+		purged++
+	}
+
+	keptSessions := m.sessions[:0]
+	for _, session := range m.sessions {
+		if m.accounts[session.AccountID] != nil {
+			keptSessions = append(keptSessions, session)
+		}
+	}
+	m.sessions = keptSessions
+
+	keptHistory := m.nameHistory[:0]
+	for _, history := range m.nameHistory {
+		if m.accounts[history.accountID] != nil {
+			keptHistory = append(keptHistory, history)
+		}
+	}
+	m.nameHistory = keptHistory
+
+	if purged != 0 {
+		m.log(ctx).Info("Purged deleted accounts", "count", purged)
+	}
+
+	return purged, nil
+}
+
+// RenewalTokenCreate obtain a new renewal token for a session, with an empty sessionID it belongs to no session
+func (m *Memory) RenewalTokenCreate(ctx context.Context, accountID string, sessionID string) (string, error) {
+	if err := m.lock(ctx); err != nil {
+		return "", err
+	}
+	defer m.mu.Unlock()
+
+	account := m.account(accountID)
+	if account == nil {
+		return "", NotFoundError{Msg: "no account found for given accountID"}
+	}
+
+	renewalToken := memRenewalToken{accountID: account.account.ID, exp: memNow().Add(renewalTokenTTL)}
+	if sessionID != "" {
+		session := m.session(sessionID)
+		if session == nil {
+			return "", NotFoundError{Msg: "no session found for given sessionID"}
+		}
+		renewalToken.sessionID = session.ID
+	}
+
+	newToken := utils.RandString(60)
+	m.renewalTokens[newToken] = renewalToken
+
+	return newToken, nil
+}
+
+// RenewalTokenGet checks if a valid renewal token exists and returns its account and session IDs
+func (m *Memory) RenewalTokenGet(ctx context.Context, token string) (RenewalToken, error) {
+	if err := m.lock(ctx); err != nil {
+		return RenewalToken{}, err
+	}
+	defer m.mu.Unlock()
+
+	renewalToken, ok := m.renewalTokens[token]
+	if !ok || renewalToken.exp.Before(memNow()) {
+		return RenewalToken{}, NotFoundError{Msg: "no valid renewal token found"}
+	}
+
+	found := RenewalToken{AccountID: renewalToken.accountID.String()}
+	if renewalToken.sessionID != uuid.Nil {
+		found.SessionID = renewalToken.sessionID.String()
+	}
+
+	return found, nil
+}
+
+// RenewalTokenRm removes a renewal token, a token that is already removed gives a NotFoundError
+func (m *Memory) RenewalTokenRm(ctx context.Context, token string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	if _, ok := m.renewalTokens[token]; !ok {
+		return NotFoundError{Msg: "no renewal token found"}
+	}
+	delete(m.renewalTokens, token)
+
+	return nil
+}
+
+// RenewalTokenUse removes a valid renewal token and creates a new one for the same session, a token can only be used once
+// Tokens from before sessions were recorded start newSession, its account is taken from the token.
+func (m *Memory) RenewalTokenUse(ctx context.Context, token string, newSession Session) (Renewal, error) {
+	if err := m.lock(ctx); err != nil {
+		return Renewal{}, err
+	}
+	defer m.mu.Unlock()
+
+	renewalToken, ok := m.renewalTokens[token]
+	if !ok || renewalToken.exp.Before(memNow()) {
+		return Renewal{}, NotFoundError{Msg: "no valid renewal token found"}
+	}
+
+	account, err := m.activeAccount(renewalToken.accountID.String(), 0)
+	if err != nil {
+		return Renewal{}, err
+	}
+
+	if renewalToken.sessionID == uuid.Nil {
+		newSession.ID = uuid.New()
+		newSession.AccountID = renewalToken.accountID
+		newSession.Active = true
+		newSession.Created = memNow()
+		newSession.Renewed = newSession.Created
+		m.sessions = append(m.sessions, newSession)
+		renewalToken.sessionID = newSession.ID
+	} else {
+		m.session(renewalToken.sessionID.String()).Renewed = memNow()
+	}
+
+	delete(m.renewalTokens, token)
+	renewalToken.exp = memNow().Add(renewalTokenTTL)
+	newToken := utils.RandString(60)
+	m.renewalTokens[newToken] = renewalToken
+
+	return Renewal{
+		AccountID:    renewalToken.accountID.String(),
+		Generation:   account.tokenGeneration,
+		RenewalToken: newToken,
+		SessionID:    renewalToken.sessionID.String(),
+	}, nil
+}
+
+// RenewalTokensCount returns how many renewal tokens have not expired
+func (m *Memory) RenewalTokensCount(ctx context.Context) (int, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+
+	now := memNow()
+	count := 0
+	for _, renewalToken := range m.renewalTokens {
+		if !renewalToken.exp.Before(now) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// RenewalTokensRm removes all renewal tokens of an account and returns how many they were
+func (m *Memory) RenewalTokensRm(ctx context.Context, accountID string) (int, error) {
+	if err := m.lock(ctx); err != nil {
+		return 0, err
+	}
+	defer m.mu.Unlock()
+
+	account := m.account(accountID)
+	if account == nil {
+		return 0, nil
+	}
+
+	return m.accountRenewalTokensRm(account.account.ID), nil
+}
+
+// AuditEventCreate writes an audit event and returns it with its id and time
+func (m *Memory) AuditEventCreate(ctx context.Context, event AuditEvent) (AuditEvent, error) {
+	event, err := auditEventPrepare(event)
+	if err != nil {
+		return AuditEvent{}, err
+	}
+	event.Diff = append([]byte(nil), event.Diff...)
+
+	if err := m.lock(ctx); err != nil {
+		return AuditEvent{}, err
+	}
+	defer m.mu.Unlock()
+
+	event.ID = 1
+	if len(m.auditEvents) != 0 {
+		last := m.auditEvents[len(m.auditEvents)-1]
+		event.ID = last.ID + 1
+		event.PrevHash = last.Hash
+	}
+	event.Hash = AuditEventHash(event.PrevHash, event)
+	m.auditEvents = append(m.auditEvents, event)
+
+	return event, nil
+}
+
+// AuditChainGet returns up to limit audit events after the one with afterID, oldest first, to verify the chain
+func (m *Memory) AuditChainGet(ctx context.Context, afterID int64, limit int) ([]AuditEvent, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	events := []AuditEvent{}
+	for _, event := range m.auditEvents {
+		if event.ID <= afterID {
+			continue
+		}
+		if len(events) == limit {
+			break
+		}
+		event.Diff = append([]byte(nil), event.Diff...)
+		events = append(events, event)
+	}
+
+	return events, nil
+}
+
+// AuditCheckpointCreate writes a signed checkpoint, see AuditSign()
+func (m *Memory) AuditCheckpointCreate(ctx context.Context, checkpoint AuditCheckpoint) (AuditCheckpoint, error) {
+	if err := m.lock(ctx); err != nil {
+		return AuditCheckpoint{}, err
+	}
+	defer m.mu.Unlock()
+
+	checkpoint.ID = int64(len(m.auditCheckpoints) + 1)
+	m.auditCheckpoints = append(m.auditCheckpoints, checkpoint)
+
+	return checkpoint, nil
+}
+
+// AuditCheckpointsGet returns all audit checkpoints, oldest first
+func (m *Memory) AuditCheckpointsGet(ctx context.Context) ([]AuditCheckpoint, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	return append([]AuditCheckpoint{}, m.auditCheckpoints...), nil
+}
+
+// AuditEventsGet lists audit events, newest first
+func (m *Memory) AuditEventsGet(ctx context.Context, input AuditEventsGetInput) (AuditEventsList, error) {
+	input, beforeID, err := auditEventsPrepare(input)
+	if err != nil {
+		return AuditEventsList{}, err
+	}
+
+	if err := m.lock(ctx); err != nil {
+		return AuditEventsList{}, err
+	}
+	defer m.mu.Unlock()
+
+	result := AuditEventsList{Events: []AuditEvent{}}
+	for i := len(m.auditEvents) - 1; i >= 0; i-- {
+		event := m.auditEvents[i]
+
+		switch {
+		case beforeID != 0 && event.ID >= beforeID:
+		case input.AccountID != "" && event.ActorID != input.AccountID && event.TargetID != input.AccountID:
+		case input.Action != "" && event.Action != input.Action:
+		case input.ActorID != "" && event.ActorID != input.ActorID:
+		case input.Outcome != "" && event.Outcome != input.Outcome:
+		case !input.Since.IsZero() && event.Created.Before(input.Since):
+		case input.TargetID != "" && event.TargetID != input.TargetID:
+		case !input.Until.IsZero() && !event.Created.Before(input.Until):
+		default:
+			if len(result.Events) == input.Limit {
+				result.NextCursor = strconv.FormatInt(result.Events[input.Limit-1].ID, 10)
+				return result, nil
+			}
+			event.Diff = append([]byte(nil), event.Diff...)
+			result.Events = append(result.Events, event)
+		}
+	}
+
+	return result, nil
+}
+
+// SessionCreate records a new session of an account that is not deleted, the id and times are set here
+func (m *Memory) SessionCreate(ctx context.Context, session Session) (Session, error) {
+	if err := m.lock(ctx); err != nil {
+		return Session{}, err
+	}
+	defer m.mu.Unlock()
+
+	account := m.accounts[session.AccountID]
+	if account == nil || account.account.Deleted != nil {
+		return Session{}, NotFoundError{Msg: "no account found for given accountID"}
+	}
+
+	session.ID = uuid.New()
+	session.Active = true
+	session.Created = memNow()
+	session.Renewed = session.Created
+	m.sessions = append(m.sessions, session)
+
+	return session, nil
+}
+
+// SessionRm revokes a session of an account by removing its renewal tokens, the session is kept in the login history
+// JWTs already handed out in the session stay valid until they expire.
+func (m *Memory) SessionRm(ctx context.Context, accountID string, sessionID string) error {
+	if err := m.lock(ctx); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	session := m.session(sessionID)
+	if session == nil || session.AccountID.String() != accountID {
+		return NotFoundError{Msg: "no session found for given accountID and sessionID"}
+	}
+
+	for token, renewalToken := range m.renewalTokens {
+		if renewalToken.sessionID == session.ID {
+			delete(m.renewalTokens, token)
+		}
+	}
+
+	return nil
+}
+
+// SessionsGet lists the sessions of an account, newest first, up to SessionsLimit
+func (m *Memory) SessionsGet(ctx context.Context, accountID string) ([]Session, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.mu.Unlock()
+
+	now := memNow()
+	active := map[uuid.UUID]bool{}
+	for _, renewalToken := range m.renewalTokens {
+		if renewalToken.sessionID != uuid.Nil && !renewalToken.exp.Before(now) {
+			active[renewalToken.sessionID] = true
+		}
+	}
+
+	sessions := []Session{}
+	for i := len(m.sessions) - 1; i >= 0 && len(sessions) < SessionsLimit; i-- {
+		session := m.sessions[i]
+		if session.AccountID.String() != accountID {
+			continue
+		}
+		session.Active = active[session.ID]
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// Ping always succeeds, unless ctx is already done, since there is no database to reach
+func (m *Memory) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+// lock takes the lock on all data, unless ctx is already done. m.mu.Unlock() must be called if no error is returned
+func (m *Memory) lock(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if m.accounts == nil {
+		m.accounts = make(map[uuid.UUID]*memAccount)
+		m.renewalTokens = make(map[string]memRenewalToken)
+	}
+
+	return nil
+}
+
+// log returns the request logger from ctx with the given fields added, m.Log is used outside of requests
+func (m *Memory) log(ctx context.Context, fields ...interface{}) go_log.Log {
+	return utils.LogFromCtx(ctx, m.Log, fields...)
+}
+
+// account returns the account with the given id, or nil
+func (m *Memory) account(accountID string) *memAccount {
+	id, err := uuid.Parse(accountID)
+	if err != nil {
+		return nil
+	}
+
+	return m.accounts[id]
+}
+
+// activeAccount returns an account that is not deleted and has the expected version. ifVersion 0 skips the version check
+func (m *Memory) activeAccount(accountID string, ifVersion int64) (*memAccount, error) {
+	account := m.account(accountID)
+	if account == nil || account.account.Deleted != nil {
+		return nil, NotFoundError{Msg: "no account found for given accountID"}
+	}
+
+	if ifVersion != 0 && account.account.Version != ifVersion {
+		return nil, ErrVersionMismatch
+	}
+
+	return account, nil
+}
+
+// nameReserved checks if a name is reserved by a renamed account other than exceptAccountID
+func (m *Memory) nameReserved(name string, exceptAccountID uuid.UUID, now time.Time) bool {
+	for _, history := range m.nameHistory {
+		if history.name == name && history.accountID != exceptAccountID && history.reservedUntil.After(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nameTaken checks if any account, deleted or not, has the name
+func (m *Memory) nameTaken(name string) bool {
+	for _, account := range m.accounts {
+		if account.account.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// session returns the session with the given id, or nil
+func (m *Memory) session(sessionID string) *Session {
+	for i := range m.sessions {
+		if m.sessions[i].ID.String() == sessionID {
+			return &m.sessions[i]
+		}
+	}
+
+	return nil
+}
+
+// accountRenewalTokensRm removes all renewal tokens of an account and returns how many they were
+func (m *Memory) accountRenewalTokensRm(accountID uuid.UUID) int {
+	removed := 0
+	for token, renewalToken := range m.renewalTokens {
+		if renewalToken.accountID == accountID {
+			delete(m.renewalTokens, token)
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// memNow returns the current time with the same precision as a PostgreSQL timestamp
+func memNow() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// copyAccount returns a copy of the account that shares no maps or slices with it
+func copyAccount(account Account) Account {
+	fields := make(map[string][]string, len(account.Fields))
+	for name, values := range account.Fields {
+		fields[name] = copyValues(values)
+	}
+	account.Fields = fields
+
+	if account.Deleted != nil {
+		deleted := *account.Deleted
+		account.Deleted = &deleted
+	}
+
+	return account
+}
+
+// copyValues returns a copy of the values, never nil
+func copyValues(values []string) []string {
+	return append([]string{}, values...)
+}
+
+// fieldsMatch checks that the fields have all the filter values, like the "@>" operator in PostgreSQL
+func fieldsMatch(fields map[string][]string, filters map[string][]string) bool {
+	for name, filterValues := range filters {
+		values, ok := fields[name]
+		if !ok {
+			return false
+		}
+		for _, filterValue := range filterValues {
+			if !utils.Contains(values, filterValue) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
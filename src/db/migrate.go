@@ -0,0 +1,331 @@
+package db
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// The SQL migrations in the dbmate format, so databases migrated with dbmate before are recognized
+//
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// migrationsLockKey is the PostgreSQL advisory lock held while migrating, so only one instance migrates at a time
+const migrationsLockKey = 7326146273
+
+// Migration is one embedded schema migration
+type Migration struct {
+	Down    string
+	Name    string // File name, like "20201207191913_first.sql"
+	Up      string
+	Version string // Timestamp in the file name, like "20201207191913"
+}
+
+// MigrationStatus tells if a migration is applied to the database
+// Applied migrations that are not embedded in the binary have only Version set.
+type MigrationStatus struct {
+	Applied bool
+	Migration
+}
+
+// Migrator applies the embedded migrations to a database, Db and SQLite implement it
+type Migrator interface {
+	MigrateDown(ctx context.Context) (Migration, error)
+	MigrateStatus(ctx context.Context) ([]MigrationStatus, error)
+	MigrateUp(ctx context.Context) ([]Migration, error)
+}
+
+var (
+	_ Migrator = Db{}
+	_ Migrator = SQLite{}
+)
+
+// MigrationsCheck returns a SchemaMismatchError if the database schema does not match the embedded migrations
+func MigrationsCheck(ctx context.Context, migrator Migrator) error {
+	statuses, err := migrator.MigrateStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	return migrationsMismatch(statuses)
+}
+
+func migrationsMismatch(statuses []MigrationStatus) error {
+	var mismatchErr SchemaMismatchError
+	for _, status := range statuses {
+		if !status.Applied {
+			mismatchErr.Pending = append(mismatchErr.Pending, status.Version)
+		} else if status.Name == "" {
+			mismatchErr.Unknown = append(mismatchErr.Unknown, status.Version)
+		}
+	}
+
+	if len(mismatchErr.Pending) != 0 || len(mismatchErr.Unknown) != 0 {
+		return mismatchErr
+	}
+
+	return nil
+}
+
+// loadMigrations reads the embedded migrations in dir, sorted by version
+func loadMigrations(dir string) ([]Migration, error) {
+	fileNames, err := fs.Glob(migrationFiles, path.Join("migrations", dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(fileNames)
+
+	migrations := make([]Migration, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		content, err := migrationFiles.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+
+		migration := Migration{Name: path.Base(fileName)}
+		migration.Version, _, _ = strings.Cut(migration.Name, "_")
+
+		_, upAndDown, found := strings.Cut(string(content), "-- migrate:up")
+		if !found {
+			return nil, errors.New("no \"-- migrate:up\" in migration " + migration.Name)
+		}
+		migration.Up, migration.Down, _ = strings.Cut(upAndDown, "-- migrate:down")
+
+		migrations = append(migrations, migration)
+	}
+
+	return migrations, nil
+}
+
+// migrationStatuses matches the embedded migrations with the applied versions
+func migrationStatuses(migrations []Migration, appliedVersions []string) []MigrationStatus {
+	applied := make(map[string]bool, len(appliedVersions))
+	for _, version := range appliedVersions {
+		applied[version] = true
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		statuses = append(statuses, MigrationStatus{Applied: applied[migration.Version], Migration: migration})
+		delete(applied, migration.Version)
+	}
+	for version := range applied {
+		statuses = append(statuses, MigrationStatus{Applied: true, Migration: Migration{Version: version}})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses
+}
+
+// lastApplied returns the last applied migration, a SchemaMismatchError if it is not embedded or false if none is applied
+func lastApplied(statuses []MigrationStatus) (Migration, bool, error) {
+	for i := len(statuses) - 1; i >= 0; i-- {
+		if !statuses[i].Applied {
+			continue
+		}
+		if statuses[i].Name == "" {
+			return Migration{}, false, SchemaMismatchError{Unknown: []string{statuses[i].Version}}
+		}
+
+		return statuses[i].Migration, true, nil
+	}
+
+	return Migration{}, false, nil
+}
+
+// MigrateStatus lists the embedded migrations and the applied ones that are not embedded
+func (d Db) MigrateStatus(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := d.DbPool.Acquire(ctx)
+	if err != nil {
+		d.log(ctx).Error("Could not acquire database connection", "err", err.Error())
+		return nil, err
+	}
+	defer conn.Release()
+
+	return d.migrateStatus(ctx, conn.Conn())
+}
+
+func (d Db) migrateStatus(ctx context.Context, conn *pgx.Conn) ([]MigrationStatus, error) {
+	log := d.log(ctx)
+
+	migrations, err := loadMigrations("postgres")
+	if err != nil {
+		log.Error("Could not load embedded migrations", "err", err.Error())
+		return nil, err
+	}
+
+	var tableExists bool
+	err = conn.QueryRow(ctx, "SELECT to_regclass('schema_migrations') IS NOT NULL").Scan(&tableExists)
+	if err != nil {
+		log.Error("Database error when checking for schema_migrations", "err", err.Error())
+		return nil, err
+	}
+	if !tableExists {
+		return migrationStatuses(migrations, nil), nil
+	}
+
+	rows, err := conn.Query(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		log.Error("Database error when fetching applied migrations", "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	var appliedVersions []string
+	for rows.Next() {
+		var version string
+		err := rows.Scan(&version)
+		if err != nil {
+			log.Error("Could not get version from database row", "err", err.Error())
+			return nil, err
+		}
+		appliedVersions = append(appliedVersions, version)
+	}
+	if rows.Err() != nil {
+		log.Error("Database error when reading applied migrations", "err", rows.Err().Error())
+		return nil, rows.Err()
+	}
+
+	return migrationStatuses(migrations, appliedVersions), nil
+}
+
+// MigrateUp applies all pending migrations, each in its own transaction, and returns them
+func (d Db) MigrateUp(ctx context.Context) ([]Migration, error) {
+	log := d.log(ctx)
+
+	conn, unlock, err := d.migrationsLock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	_, err = conn.Exec(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version character varying(255) PRIMARY KEY)")
+	if err != nil {
+		log.Error("Could not create schema_migrations", "err", err.Error())
+		return nil, err
+	}
+
+	statuses, err := d.migrateStatus(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	mismatchErr, _ := migrationsMismatch(statuses).(SchemaMismatchError)
+	if len(mismatchErr.Unknown) != 0 {
+		log.Error("Refusing to migrate a database with unknown migrations", "err", mismatchErr.Error())
+		return nil, mismatchErr
+	}
+
+	var applied []Migration
+	for _, status := range statuses {
+		if status.Applied {
+			continue
+		}
+
+		log.Info("Applying migration", "migration", status.Name)
+		err := d.migrationRun(ctx, conn, status.Up, "INSERT INTO schema_migrations (version) VALUES ($1)", status.Version)
+		if err != nil {
+			log.Error("Could not apply migration", "err", err.Error(), "migration", status.Name)
+			return applied, err
+		}
+		applied = append(applied, status.Migration)
+	}
+
+	return applied, nil
+}
+
+// MigrateDown rolls back the last applied migration and returns it
+func (d Db) MigrateDown(ctx context.Context) (Migration, error) {
+	log := d.log(ctx)
+
+	conn, unlock, err := d.migrationsLock(ctx)
+	if err != nil {
+		return Migration{}, err
+	}
+	defer unlock()
+
+	statuses, err := d.migrateStatus(ctx, conn)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	migration, found, err := lastApplied(statuses)
+	if err != nil {
+		log.Error("Can not roll back a migration that is not embedded", "err", err.Error())
+		return Migration{}, err
+	}
+	if !found {
+		return Migration{}, NotFoundError{Msg: "no applied migration to roll back"}
+	}
+
+	log.Info("Rolling back migration", "migration", migration.Name)
+	err = d.migrationRun(ctx, conn, migration.Down, "DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+	if err != nil {
+		log.Error("Could not roll back migration", "err", err.Error(), "migration", migration.Name)
+		return Migration{}, err
+	}
+
+	return migration, nil
+}
+
+// migrationsLock takes the migrations advisory lock on a connection of its own, the returned unlock func must always be called
+func (d Db) migrationsLock(ctx context.Context) (*pgx.Conn, func(), error) {
+	log := d.log(ctx)
+
+	poolConn, err := d.DbPool.Acquire(ctx)
+	if err != nil {
+		log.Error("Could not acquire database connection", "err", err.Error())
+		return nil, nil, err
+	}
+
+	log.Debug("Waiting for the migrations lock")
+	_, err = poolConn.Exec(ctx, "SELECT pg_advisory_lock($1)", migrationsLockKey)
+	if err != nil {
+		poolConn.Release()
+		log.Error("Could not take the migrations lock", "err", err.Error())
+		return nil, nil, err
+	}
+
+	unlock := func() {
+		// Use a new context, the lock must be released even if ctx is canceled
+		_, err := poolConn.Exec(context.Background(), "SELECT pg_advisory_unlock($1)", migrationsLockKey)
+		if err != nil {
+			log.Error("Could not release the migrations lock", "err", err.Error())
+		}
+		poolConn.Release()
+	}
+
+	return poolConn.Conn(), unlock, nil
+}
+
+// migrationRun runs the SQL of a migration and the schema_migrations change in one transaction
+func (d Db) migrationRun(ctx context.Context, conn *pgx.Conn, migrationSQL string, versionSQL string, version string) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback(ctx)
+
+	// Without arguments the simple protocol is used, so the migration can have several statements
+	_, err = tx.Exec(ctx, migrationSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, versionSQL, version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	for _, dir := range []string{"postgres", "sqlite"} {
+		migrations, err := loadMigrations(dir)
+		if err != nil {
+			t.Fatalf("Could not load %s migrations: %v", dir, err)
+		}
+		if len(migrations) == 0 {
+			t.Fatalf("No embedded %s migrations", dir)
+		}
+
+		for i, migration := range migrations {
+			if migration.Version == "" || strings.TrimSpace(migration.Up) == "" {
+				t.Fatalf("Migration %s/%s is missing its version or up part", dir, migration.Name)
+			}
+			if i > 0 && migration.Version <= migrations[i-1].Version {
+				t.Fatalf("Migration %s/%s is not sorted by version", dir, migration.Name)
+			}
+		}
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	ctx := context.Background()
+
+	sqlDB, err := SQLiteOpen("sqlite:" + filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("Could not open SQLite database: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	migrator := SQLite{DB: sqlDB, Log: testLog()}
+
+	err = MigrationsCheck(ctx, migrator)
+	expectErr(t, err, ErrSchemaMismatch)
+
+	_, err = migrator.MigrateDown(ctx)
+	expectErr(t, err, ErrNotFound)
+
+	applied, err := migrator.MigrateUp(ctx)
+	if err != nil {
+		t.Fatalf("Could not migrate up: %v", err)
+	}
+	if len(applied) == 0 {
+		t.Fatalf("Expected migrations to be applied")
+	}
+
+	err = MigrationsCheck(ctx, migrator)
+	if err != nil {
+		t.Fatalf("Expected the schema to match after migrating up, got %v", err)
+	}
+
+	applied, err = migrator.MigrateUp(ctx)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("Expected nothing to apply the second time, got %v, %v", applied, err)
+	}
+
+	rolledBack, err := migrator.MigrateDown(ctx)
+	if err != nil {
+		t.Fatalf("Could not migrate down: %v", err)
+	}
+
+	var mismatchErr SchemaMismatchError
+	err = MigrationsCheck(ctx, migrator)
+	if !errors.As(err, &mismatchErr) || len(mismatchErr.Pending) != 1 || mismatchErr.Pending[0] != rolledBack.Version {
+		t.Fatalf("Expected %s to be pending after migrating down, got %v", rolledBack.Version, err)
+	}
+
+	_, err = sqlDB.Exec("INSERT INTO schema_migrations (version) VALUES ('99999999999999')")
+	if err != nil {
+		t.Fatalf("Could not add unknown migration: %v", err)
+	}
+
+	_, err = migrator.MigrateUp(ctx)
+	if !errors.As(err, &mismatchErr) || len(mismatchErr.Unknown) != 1 {
+		t.Fatalf("Expected migrating up with an unknown migration to fail, got %v", err)
+	}
+
+	_, err = migrator.MigrateDown(ctx)
+	expectErr(t, err, ErrSchemaMismatch)
+}
@@ -0,0 +1,7 @@
+-- migrate:up
+
+ALTER TABLE "accounts" ADD COLUMN "version" bigint NOT NULL DEFAULT 1;
+
+-- migrate:down
+
+ALTER TABLE "accounts" DROP COLUMN "version";
@@ -0,0 +1,17 @@
+-- migrate:up
+
+CREATE TABLE "accountsNameHistory" (
+  "id" uuid PRIMARY KEY,
+  "accountId" uuid NOT NULL,
+  "name" text NOT NULL,
+  "renamed" timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  "reservedUntil" timestamp NOT NULL
+);
+ALTER TABLE "accountsNameHistory"
+  ADD FOREIGN KEY ("accountId") REFERENCES "accounts" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT;
+CREATE INDEX idx_accountsnamehistoryaccountid ON "accountsNameHistory" ("accountId");
+CREATE INDEX idx_accountsnamehistoryname ON "accountsNameHistory" ("name");
+
+-- migrate:down
+
+DROP TABLE "accountsNameHistory";
@@ -0,0 +1,8 @@
+-- migrate:up
+
+ALTER TABLE "accounts" ADD COLUMN "deleted" timestamp;
+CREATE INDEX idx_accountsdeleted ON accounts ("deleted") WHERE "deleted" IS NOT NULL;
+
+-- migrate:down
+
+ALTER TABLE "accounts" DROP COLUMN "deleted";
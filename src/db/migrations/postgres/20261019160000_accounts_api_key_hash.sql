@@ -0,0 +1,10 @@
+-- migrate:up
+
+-- Only the SHA-256 of API keys is stored from now on, see utils.HashAPIKey()
+UPDATE "accounts" SET "apiKey" = encode(sha256(convert_to("apiKey", 'UTF8')), 'hex') WHERE "apiKey" IS NOT NULL;
+CREATE INDEX idx_accountsapikey ON accounts ("apiKey");
+
+-- migrate:down
+
+-- The API keys can not be restored from their hashes, give the accounts new ones with "apikey rotate" after rolling back
+DROP INDEX idx_accountsapikey;
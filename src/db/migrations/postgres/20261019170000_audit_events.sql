@@ -0,0 +1,22 @@
+-- migrate:up
+
+-- No foreign keys, events are kept when the accounts they are about are purged
+-- "diff" is text and not jsonb, so it is returned exactly as it was written
+CREATE TABLE "auditEvents" (
+  "id" bigserial PRIMARY KEY,
+  "created" timestamp NOT NULL,
+  "action" text NOT NULL,
+  "actorId" uuid,
+  "targetId" uuid,
+  "ip" text NOT NULL DEFAULT '',
+  "userAgent" text NOT NULL DEFAULT '',
+  "outcome" text NOT NULL,
+  "diff" text
+);
+CREATE INDEX idx_auditeventsactorid ON "auditEvents" ("actorId");
+CREATE INDEX idx_auditeventscreated ON "auditEvents" ("created");
+CREATE INDEX idx_auditeventstargetid ON "auditEvents" ("targetId");
+
+-- migrate:down
+
+DROP TABLE "auditEvents";
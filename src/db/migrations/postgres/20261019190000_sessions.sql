@@ -0,0 +1,28 @@
+-- migrate:up
+
+-- Every sign in, kept after it ends as the login history of the account
+-- A session is active as long as it has a renewal token that has not expired
+CREATE TABLE "sessions" (
+  "id" uuid PRIMARY KEY,
+  "accountId" uuid NOT NULL,
+  "method" text NOT NULL,
+  "ip" text NOT NULL DEFAULT '',
+  "userAgent" text NOT NULL DEFAULT '',
+  "created" timestamp NOT NULL,
+  "renewed" timestamp NOT NULL
+);
+ALTER TABLE "sessions"
+  ADD FOREIGN KEY ("accountId") REFERENCES "accounts" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT;
+CREATE INDEX idx_sessionsaccountid ON "sessions" ("accountId", "created");
+
+-- Tokens from before this migration have no session, one is started when they are renewed
+ALTER TABLE "renewalTokens" ADD COLUMN "sessionId" uuid;
+ALTER TABLE "renewalTokens"
+  ADD FOREIGN KEY ("sessionId") REFERENCES "sessions" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT;
+CREATE INDEX idx_renewaltokenssessionid ON "renewalTokens" ("sessionId");
+
+-- migrate:down
+
+DROP INDEX idx_renewaltokenssessionid;
+ALTER TABLE "renewalTokens" DROP COLUMN "sessionId";
+DROP TABLE "sessions";
@@ -0,0 +1,8 @@
+-- migrate:up
+
+-- Bumped when an account logs out everywhere, JWTs carry the generation they were issued in
+ALTER TABLE "accounts" ADD COLUMN "tokenGeneration" bigint NOT NULL DEFAULT 0;
+
+-- migrate:down
+
+ALTER TABLE "accounts" DROP COLUMN "tokenGeneration";
@@ -0,0 +1,51 @@
+-- migrate:up
+
+-- Same tables as in PostgreSQL, but ids are stored as text, field values as a JSON array of strings
+-- and timestamps as UTC text like "2006-01-02 15:04:05.000000", so they sort in time order
+
+CREATE TABLE "accounts" (
+  "id" text PRIMARY KEY NOT NULL,
+  "created" text NOT NULL,
+  "name" text NOT NULL,
+  "apiKey" text,
+  "password" text,
+  "version" integer NOT NULL DEFAULT 1,
+  "deleted" text
+);
+CREATE UNIQUE INDEX idx_accountname ON "accounts" ("name");
+CREATE INDEX idx_accountsdeleted ON "accounts" ("deleted") WHERE "deleted" IS NOT NULL;
+
+CREATE TABLE "accountsFields" (
+  "id" text PRIMARY KEY NOT NULL,
+  "created" text NOT NULL,
+  "accountId" text NOT NULL REFERENCES "accounts" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
+  "name" text NOT NULL,
+  "value" text NOT NULL
+);
+CREATE UNIQUE INDEX idx_accountsfields ON "accountsFields" ("accountId", "name");
+
+CREATE TABLE "accountsNameHistory" (
+  "id" text PRIMARY KEY NOT NULL,
+  "accountId" text NOT NULL REFERENCES "accounts" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
+  "name" text NOT NULL,
+  "renamed" text NOT NULL,
+  "reservedUntil" text NOT NULL
+);
+CREATE INDEX idx_accountsnamehistoryaccountid ON "accountsNameHistory" ("accountId");
+CREATE INDEX idx_accountsnamehistoryname ON "accountsNameHistory" ("name");
+
+CREATE TABLE "renewalTokens" (
+  "accountId" text NOT NULL REFERENCES "accounts" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
+  "exp" text NOT NULL,
+  "token" text NOT NULL
+);
+CREATE INDEX idx_renewaltokensaccountid ON "renewalTokens" ("accountId");
+CREATE INDEX idx_renewaltokensexp ON "renewalTokens" ("exp");
+CREATE INDEX idx_renewaltokenstoken ON "renewalTokens" ("token");
+
+-- migrate:down
+
+DROP TABLE "renewalTokens";
+DROP TABLE "accountsNameHistory";
+DROP TABLE "accountsFields";
+DROP TABLE "accounts";
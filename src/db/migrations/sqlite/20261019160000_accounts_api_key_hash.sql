@@ -0,0 +1,11 @@
+-- migrate:up
+
+-- Only the SHA-256 of API keys is stored from now on, see utils.HashAPIKey()
+-- auth_api_key_hash() is registered by auth-api, so unlike the other migrations this one can not be run by dbmate
+UPDATE "accounts" SET "apiKey" = auth_api_key_hash("apiKey") WHERE "apiKey" IS NOT NULL;
+CREATE INDEX idx_accountsapikey ON "accounts" ("apiKey");
+
+-- migrate:down
+
+-- The API keys can not be restored from their hashes, give the accounts new ones with "apikey rotate" after rolling back
+DROP INDEX idx_accountsapikey;
@@ -0,0 +1,22 @@
+-- migrate:up
+
+-- No foreign keys, events are kept when the accounts they are about are purged
+-- AUTOINCREMENT so ids are never reused, they tell the order of the events
+CREATE TABLE "auditEvents" (
+  "id" integer PRIMARY KEY AUTOINCREMENT,
+  "created" text NOT NULL,
+  "action" text NOT NULL,
+  "actorId" text,
+  "targetId" text,
+  "ip" text NOT NULL DEFAULT '',
+  "userAgent" text NOT NULL DEFAULT '',
+  "outcome" text NOT NULL,
+  "diff" text
+);
+CREATE INDEX idx_auditeventsactorid ON "auditEvents" ("actorId");
+CREATE INDEX idx_auditeventscreated ON "auditEvents" ("created");
+CREATE INDEX idx_auditeventstargetid ON "auditEvents" ("targetId");
+
+-- migrate:down
+
+DROP TABLE "auditEvents";
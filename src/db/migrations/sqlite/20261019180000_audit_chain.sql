@@ -0,0 +1,22 @@
+-- migrate:up
+
+-- Each event has the hash of the one before it, so a changed or removed event breaks the chain
+-- Events written before this migration have no hash, the chain starts at the first event after it
+ALTER TABLE "auditEvents" ADD COLUMN "prevHash" text;
+ALTER TABLE "auditEvents" ADD COLUMN "hash" text;
+
+-- Signed hashes of the last event, so the end of the chain can not be cut off or rewritten
+CREATE TABLE "auditCheckpoints" (
+  "id" integer PRIMARY KEY AUTOINCREMENT,
+  "created" text NOT NULL,
+  "eventId" integer NOT NULL,
+  "eventHash" text NOT NULL,
+  "keyId" text NOT NULL,
+  "signature" text NOT NULL
+);
+
+-- migrate:down
+
+DROP TABLE "auditCheckpoints";
+ALTER TABLE "auditEvents" DROP COLUMN "hash";
+ALTER TABLE "auditEvents" DROP COLUMN "prevHash";
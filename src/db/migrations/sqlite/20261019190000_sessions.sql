@@ -0,0 +1,24 @@
+-- migrate:up
+
+-- Every sign in, kept after it ends as the login history of the account
+-- A session is active as long as it has a renewal token that has not expired
+CREATE TABLE "sessions" (
+  "id" text PRIMARY KEY,
+  "accountId" text NOT NULL REFERENCES "accounts" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT,
+  "method" text NOT NULL,
+  "ip" text NOT NULL DEFAULT '',
+  "userAgent" text NOT NULL DEFAULT '',
+  "created" text NOT NULL,
+  "renewed" text NOT NULL
+);
+CREATE INDEX idx_sessionsaccountid ON "sessions" ("accountId", "created");
+
+-- Tokens from before this migration have no session, one is started when they are renewed
+ALTER TABLE "renewalTokens" ADD COLUMN "sessionId" text REFERENCES "sessions" ("id") ON DELETE RESTRICT ON UPDATE RESTRICT;
+CREATE INDEX idx_renewaltokenssessionid ON "renewalTokens" ("sessionId");
+
+-- migrate:down
+
+DROP INDEX idx_renewaltokenssessionid;
+ALTER TABLE "renewalTokens" DROP COLUMN "sessionId";
+DROP TABLE "sessions";
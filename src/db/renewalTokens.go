@@ -2,60 +2,185 @@ package db
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 )
 
-// RenewalTokenCreate obtain a new renewal token
-func (d Db) RenewalTokenCreate(accountID string) (string, error) {
-	d.Log.Context = []interface{}{
+// RenewalTokenCreate obtain a new renewal token for a session, with an empty sessionID it belongs to no session
+func (d Db) RenewalTokenCreate(ctx context.Context, accountID string, sessionID string) (string, error) {
+	log := d.log(ctx,
 		"accountID", accountID,
-	}
+		"sessionID", sessionID,
+	)
 
-	d.Log.Debug("Creating new renewal token")
+	log.Debug("Creating new renewal token")
 
 	newToken := utils.RandString(60)
 
-	insertSQL := "INSERT INTO \"renewalTokens\" (\"accountId\",token) VALUES($1,$2);"
-	_, insertErr := d.DbPool.Exec(context.Background(), insertSQL, accountID, newToken)
+	insertSQL := "INSERT INTO \"renewalTokens\" (\"accountId\",\"sessionId\",token) VALUES($1,NULLIF($2, '')::uuid,$3);"
+	_, insertErr := d.pool().Exec(ctx, insertSQL, accountID, sessionID, newToken)
 	if insertErr != nil {
-		d.Log.Error("Could not insert into database table \"renewalTokens\"", "err", insertErr.Error())
+		log.Error("Could not insert into database table \"renewalTokens\"", "err", insertErr.Error())
 		return "", insertErr
 	}
 
 	return newToken, nil
 }
 
-// RenewalTokenGet checks if a valid renewal token exists in database
-func (d Db) RenewalTokenGet(token string) (string, error) {
-	d.Log.Debug("Trying to get a renewal token")
+// RenewalTokenGet checks if a valid renewal token exists in database and returns its account and session IDs
+func (d Db) RenewalTokenGet(ctx context.Context, token string) (RenewalToken, error) {
+	log := d.log(ctx)
+
+	log.Debug("Trying to get a renewal token")
 
-	sql := "SELECT \"accountId\" FROM \"renewalTokens\" WHERE exp >= now() AND token = $1"
+	sql := "SELECT \"accountId\", COALESCE(\"sessionId\"::text, '') FROM \"renewalTokens\" WHERE exp >= now() AND token = $1"
 
-	var foundAccountID string
-	err := d.DbPool.QueryRow(context.Background(), sql, token).Scan(&foundAccountID)
+	var found RenewalToken
+	err := d.pool().QueryRow(ctx, sql, token).Scan(&found.AccountID, &found.SessionID)
 	if err != nil {
-		if err.Error() == "no rows in result set" {
-			return "", nil
+		if errors.Is(err, pgx.ErrNoRows) {
+			return RenewalToken{}, NotFoundError{Msg: "no valid renewal token found"}
 		}
 
-		d.Log.Error("Database error when fetching renewal token", "err", err.Error())
-		return "", err
+		log.Error("Database error when fetching renewal token", "err", err.Error())
+		return RenewalToken{}, err
 	}
 
-	return foundAccountID, nil
+	return found, nil
 }
 
-// RenewalTokenRm removes a renewal token from the database
-func (d Db) RenewalTokenRm(token string) error {
-	d.Log.Debug("Trying to remove a renewal token")
+// RenewalTokenRm removes a renewal token from the database, a token that is already removed gives a NotFoundError
+func (d Db) RenewalTokenRm(ctx context.Context, token string) error {
+	log := d.log(ctx)
+
+	log.Debug("Trying to remove a renewal token")
 
 	sql := "DELETE FROM \"renewalTokens\" WHERE token = $1"
-	_, err := d.DbPool.Exec(context.Background(), sql, token)
+	res, err := d.pool().Exec(ctx, sql, token)
 	if err != nil {
-		d.Log.Error("Database error when trying to remove token", "err", err.Error())
+		log.Error("Database error when trying to remove token", "err", err.Error())
 		return err
 	}
+	if res.RowsAffected() == 0 {
+		return NotFoundError{Msg: "no renewal token found"}
+	}
 
 	return nil
 }
+
+// RenewalTokenUse removes a valid renewal token and creates a new one for the same session, in one transaction
+// The account and then the session are locked before the token, in the same order as logging out everywhere and
+// revoking a session do it, so a token is either removed by those or used here. A token can only be used once.
+// Tokens from before sessions were recorded start newSession, its account is taken from the token.
+func (d Db) RenewalTokenUse(ctx context.Context, token string, newSession Session) (Renewal, error) {
+	log := d.log(ctx)
+
+	log.Debug("Trying to use a renewal token")
+
+	tx, err := d.pool().Begin(ctx)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return Renewal{}, err
+	}
+
+	// Rollback is safe to call even if the tx is already closed, so if
+	// the tx commits successfully, this is a no-op
+	defer tx.Rollback(ctx)
+
+	var renewal Renewal
+	tokenSQL := "SELECT \"accountId\", COALESCE(\"sessionId\"::text, '') FROM \"renewalTokens\" WHERE exp >= now() AND token = $1"
+	err = tx.QueryRow(ctx, tokenSQL, token).Scan(&renewal.AccountID, &renewal.SessionID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Renewal{}, NotFoundError{Msg: "no valid renewal token found"}
+		}
+
+		log.Error("Database error when fetching renewal token", "err", err.Error())
+		return Renewal{}, err
+	}
+
+	// Waits for logging out everywhere, that bumps the generation before it removes the tokens
+	generationSQL := "SELECT \"tokenGeneration\" FROM accounts WHERE id = $1 AND deleted IS NULL FOR SHARE"
+	err = tx.QueryRow(ctx, generationSQL, renewal.AccountID).Scan(&renewal.Generation)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Renewal{}, NotFoundError{Msg: "no account found for given accountID"}
+		}
+
+		log.Error("Database error when fetching token generation of account", "err", err.Error())
+		return Renewal{}, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Microsecond) // The precision of the timestamps in the database
+	if renewal.SessionID == "" {
+		renewal.SessionID = uuid.NewString()
+		sessionSQL := "INSERT INTO sessions (id, \"accountId\", method, ip, \"userAgent\", created, renewed) VALUES($1,$2,$3,$4,$5,$6,$6);"
+		_, err = tx.Exec(ctx, sessionSQL, renewal.SessionID, renewal.AccountID, newSession.Method, newSession.IP, newSession.UserAgent, now)
+	} else {
+		// Waits for revoking the session, that locks it before it removes the tokens
+		_, err = tx.Exec(ctx, "UPDATE sessions SET renewed = $1 WHERE id = $2;", now, renewal.SessionID)
+	}
+	if err != nil {
+		log.Error("Database error when trying to renew session", "err", err.Error(), "sessionID", renewal.SessionID)
+		return Renewal{}, err
+	}
+
+	res, err := tx.Exec(ctx, "DELETE FROM \"renewalTokens\" WHERE token = $1 AND exp >= now();", token)
+	if err != nil {
+		log.Error("Database error when trying to remove token", "err", err.Error())
+		return Renewal{}, err
+	}
+	if res.RowsAffected() == 0 {
+		log.Debug("Renewal token was removed while it was used")
+		return Renewal{}, NotFoundError{Msg: "no valid renewal token found"}
+	}
+
+	renewal.RenewalToken = utils.RandString(60)
+	insertSQL := "INSERT INTO \"renewalTokens\" (\"accountId\",\"sessionId\",token) VALUES($1,$2,$3);"
+	_, err = tx.Exec(ctx, insertSQL, renewal.AccountID, renewal.SessionID, renewal.RenewalToken)
+	if err != nil {
+		log.Error("Could not insert into database table \"renewalTokens\"", "err", err.Error())
+		return Renewal{}, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return Renewal{}, err
+	}
+
+	return renewal, nil
+}
+
+// RenewalTokensCount returns how many renewal tokens have not expired
+func (d Db) RenewalTokensCount(ctx context.Context) (int, error) {
+	var count int
+	err := d.pool().QueryRow(ctx, "SELECT count(*) FROM \"renewalTokens\" WHERE exp >= now()").Scan(&count)
+	if err != nil {
+		d.log(ctx).Error("Database error when counting renewal tokens", "err", err.Error())
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// RenewalTokensRm removes all renewal tokens of an account and returns how many they were
+func (d Db) RenewalTokensRm(ctx context.Context, accountID string) (int, error) {
+	log := d.log(ctx,
+		"accountID", accountID,
+	)
+
+	log.Debug("Trying to remove all renewal tokens of an account")
+
+	res, err := d.pool().Exec(ctx, "DELETE FROM \"renewalTokens\" WHERE \"accountId\" = $1", accountID)
+	if err != nil {
+		log.Error("Database error when trying to remove tokens", "err", err.Error())
+		return 0, err
+	}
+
+	return int(res.RowsAffected()), nil
+}
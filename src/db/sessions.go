@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+)
+
+// SessionCreate records a new session of an account that is not deleted, the id and times are set here
+func (d Db) SessionCreate(ctx context.Context, session Session) (Session, error) {
+	log := d.log(ctx,
+		"accountID", session.AccountID,
+		"method", session.Method,
+	)
+
+	log.Debug("Creating new session")
+
+	session.ID = uuid.New()
+	session.Active = true
+	session.Created = time.Now().UTC().Truncate(time.Microsecond) // The precision of the timestamps in the database
+	session.Renewed = session.Created
+
+	insertSQL := "INSERT INTO sessions (id, \"accountId\", method, ip, \"userAgent\", created, renewed) SELECT $1,$2,$3,$4,$5,$6,$6 " +
+		"WHERE EXISTS (SELECT 1 FROM accounts WHERE id = $2 AND deleted IS NULL);"
+	res, err := d.pool().Exec(ctx, insertSQL, session.ID, session.AccountID, session.Method, session.IP, session.UserAgent, session.Created)
+	if err != nil {
+		log.Error("Could not insert into database table \"sessions\"", "err", err.Error())
+		return Session{}, err
+	}
+	if res.RowsAffected() == 0 {
+		return Session{}, NotFoundError{Msg: "no account found for given accountID"}
+	}
+
+	return session, nil
+}
+
+// SessionRm revokes a session of an account by removing its renewal tokens, the session is kept in the login history
+// JWTs already handed out in the session stay valid until they expire.
+func (d Db) SessionRm(ctx context.Context, accountID string, sessionID string) error {
+	log := d.log(ctx,
+		"accountID", accountID,
+		"sessionID", sessionID,
+	)
+
+	log.Debug("Trying to revoke a session")
+
+	tx, err := d.pool().Begin(ctx)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return err
+	}
+
+	// Rollback is safe to call even if the tx is already closed, so if
+	// the tx commits successfully, this is a no-op
+	defer tx.Rollback(ctx)
+
+	// The lock makes a renewal in the session that is under way finish first, so the token it creates is removed too
+	var found string
+	err = tx.QueryRow(ctx, "SELECT id::text FROM sessions WHERE id = $1 AND \"accountId\" = $2 FOR UPDATE", sessionID, accountID).Scan(&found)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return NotFoundError{Msg: "no session found for given accountID and sessionID"}
+		}
+
+		log.Error("Database error when fetching session", "err", err.Error())
+		return err
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM \"renewalTokens\" WHERE \"sessionId\" = $1", sessionID)
+	if err != nil {
+		log.Error("Database error when trying to remove the tokens of a session", "err", err.Error())
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// SessionsGet lists the sessions of an account, newest first, up to SessionsLimit
+func (d Db) SessionsGet(ctx context.Context, accountID string) ([]Session, error) {
+	log := d.log(ctx,
+		"accountID", accountID,
+	)
+
+	log.Debug("Trying to get sessions")
+
+	sessionsSQL := "SELECT id, \"accountId\", method, ip, \"userAgent\", created, renewed, " +
+		"EXISTS (SELECT 1 FROM \"renewalTokens\" WHERE \"sessionId\" = sessions.id AND exp >= now()) " +
+		"FROM sessions WHERE \"accountId\" = $1 ORDER BY created DESC LIMIT $2"
+	rows, err := d.pool().Query(ctx, sessionsSQL, accountID, SessionsLimit)
+	if err != nil {
+		log.Error("Database error when fetching sessions", "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.AccountID, &session.Method, &session.IP, &session.UserAgent, &session.Created, &session.Renewed, &session.Active)
+		if err != nil {
+			log.Error("Could not scan session from database row", "err", err.Error())
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if rows.Err() != nil {
+		log.Error("Database error when reading session rows", "err", rows.Err().Error())
+		return nil, rows.Err()
+	}
+
+	return sessions, nil
+}
@@ -0,0 +1,282 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"gitea.larvit.se/pwrpln/go_log"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLite is a Store using a SQLite database, for small single node deployments
+// The schema is in migrations/sqlite, it is the same as in PostgreSQL but with portable column types.
+type SQLite struct {
+	DB                 *sql.DB
+	DeletedRetention   time.Duration // How long deleted accounts can be restored before they are purged
+	Log                go_log.Log
+	OldNameReservation time.Duration // How long the old name of a renamed account is kept from others
+	QueryTimeout       time.Duration // Max time for each SQL statement, 0 means no limit besides the one on ctx
+}
+
+// sqliteTimeLayout is how timestamps are stored, fixed width so they sort in time order as text
+const sqliteTimeLayout = "2006-01-02 15:04:05.000000"
+
+// Columns in "UNIQUE constraint failed" errors from SQLite, and the matching PostgreSQL constraint names
+var sqliteUniqueConstraints = map[string]string{
+	"accounts.id":   "accounts_pkey",
+	"accounts.name": "idx_accountname",
+	"accountsFields.accountId, accountsFields.name": "idx_accountsfields",
+}
+
+func init() {
+	// SQLite has no hash functions, the migration that hashes the API keys stored before they were hashed uses this
+	sqlite.MustRegisterDeterministicScalarFunction("auth_api_key_hash", 1, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		apiKey, ok := args[0].(string)
+		if !ok {
+			return args[0], nil // NULL, the account has no API key
+		}
+
+		return utils.HashAPIKey(apiKey), nil
+	})
+}
+
+// SQLiteOpen opens the database file in a DATABASE_URL like "sqlite:///var/lib/auth-api/auth.db" (absolute path) or "sqlite:auth.db" (relative path)
+func SQLiteOpen(databaseURL string) (*sql.DB, error) {
+	path := strings.TrimPrefix(strings.TrimPrefix(databaseURL, "sqlite:"), "//")
+	if path == "" {
+		return nil, errors.New("no file path in SQLite DATABASE_URL")
+	}
+
+	// Transactions take the write lock right away, so two writers never both hold a read lock and wait for each other
+	sqlDB, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+
+	err = sqlDB.Ping()
+	if err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+
+	return sqlDB, nil
+}
+
+// Ping checks that the database file can be read
+func (s SQLite) Ping(ctx context.Context) error {
+	ctx, cancel := timeoutCtx(ctx, s.QueryTimeout)
+	defer cancel()
+
+	return s.DB.PingContext(ctx)
+}
+
+// db returns the database with the query timeout applied to each statement, transactions begun from it get it too
+func (s SQLite) db() sqliteDB {
+	return sqliteDB{db: s.DB, timeout: s.QueryTimeout}
+}
+
+// log returns the request logger from ctx with the given fields added, s.Log is used outside of requests
+func (s SQLite) log(ctx context.Context, fields ...interface{}) go_log.Log {
+	return utils.LogFromCtx(ctx, s.Log, fields...)
+}
+
+// translateSQLiteErr turns unique violations from SQLite into a ConflictError, other errors are returned as is
+func translateSQLiteErr(err error) error {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return err
+	}
+	if sqliteErr.Code() != sqlite3.SQLITE_CONSTRAINT_UNIQUE && sqliteErr.Code() != sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+		return err
+	}
+
+	// The message is like "constraint failed: UNIQUE constraint failed: accounts.name (2067)"
+	_, columns, _ := strings.Cut(sqliteErr.Error(), "UNIQUE constraint failed: ")
+	columns, _, _ = strings.Cut(columns, " (")
+
+	constraint, ok := sqliteUniqueConstraints[columns]
+	if !ok {
+		constraint = columns
+	}
+
+	return uniqueConflict(constraint)
+}
+
+// sqliteTime formats a time as stored in SQLite
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+// sqliteNow returns the current time as stored in SQLite
+func sqliteNow() string {
+	return sqliteTime(time.Now())
+}
+
+func parseSQLiteTime(value string) (time.Time, error) {
+	return time.ParseInLocation(sqliteTimeLayout, value, time.UTC)
+}
+
+// sqliteValues encodes field values as stored in SQLite, a JSON array of strings
+func sqliteValues(values []string) string {
+	if values == nil {
+		values = []string{}
+	}
+
+	valuesJSON, _ := json.Marshal(values) // Can not fail for a slice of strings
+	return string(valuesJSON)
+}
+
+func parseSQLiteValues(value string) ([]string, error) {
+	values := []string{}
+	err := json.Unmarshal([]byte(value), &values)
+	return values, err
+}
+
+// sqliteScanner is implemented by both *sql.Row and *sql.Rows
+type sqliteScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSQLiteAccount scans the columns apiKey, id, created, deleted, name, password and version
+func scanSQLiteAccount(row sqliteScanner) (Account, error) {
+	var account Account
+	var apiKey sql.NullString
+	var created string
+	var deleted sql.NullString
+	var password sql.NullString
+
+	err := row.Scan(&apiKey, &account.ID, &created, &deleted, &account.Name, &password, &account.Version)
+	if err != nil {
+		return Account{}, err
+	}
+
+	account.Created, err = parseSQLiteTime(created)
+	if err != nil {
+		return Account{}, err
+	}
+
+	if deleted.Valid {
+		deletedTime, err := parseSQLiteTime(deleted.String)
+		if err != nil {
+			return Account{}, err
+		}
+		account.Deleted = &deletedTime
+	}
+
+	account.APIKeyHash = apiKey.String
+	account.Password = password.String
+	account.Fields = make(map[string][]string)
+
+	return account, nil
+}
+
+// sqlQueryer is implemented by both *sql.DB and *sql.Tx
+type sqlQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// sqliteTimedExec runs a statement that has to finish within timeout
+func sqliteTimedExec(ctx context.Context, queryer sqlQueryer, timeout time.Duration, query string, args ...interface{}) (sql.Result, error) {
+	ctx, cancel := timeoutCtx(ctx, timeout)
+	defer cancel()
+
+	return queryer.ExecContext(ctx, query, args...)
+}
+
+// sqliteTimedQuery runs a query that has to be read within timeout, the timeout ends when the rows are closed
+func sqliteTimedQuery(ctx context.Context, queryer sqlQueryer, timeout time.Duration, query string, args ...interface{}) (*sqliteRows, error) {
+	ctx, cancel := timeoutCtx(ctx, timeout)
+
+	rows, err := queryer.QueryContext(ctx, query, args...)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &sqliteRows{Rows: rows, cancel: cancel}, nil
+}
+
+// sqliteTimedQueryRow runs a query that has to be scanned within timeout
+func sqliteTimedQueryRow(ctx context.Context, queryer sqlQueryer, timeout time.Duration, query string, args ...interface{}) *sqliteRow {
+	ctx, cancel := timeoutCtx(ctx, timeout)
+
+	return &sqliteRow{row: queryer.QueryRowContext(ctx, query, args...), cancel: cancel}
+}
+
+type sqliteRow struct {
+	row    *sql.Row
+	cancel context.CancelFunc
+}
+
+func (r *sqliteRow) Scan(dest ...interface{}) error {
+	defer r.cancel()
+
+	return r.row.Scan(dest...)
+}
+
+type sqliteRows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+func (r *sqliteRows) Close() error {
+	defer r.cancel()
+
+	return r.Rows.Close()
+}
+
+// sqliteDB applies a timeout to each statement run on the database
+type sqliteDB struct {
+	db      *sql.DB
+	timeout time.Duration // 0 means no limit besides the one on ctx
+}
+
+// BeginTx starts a transaction where each statement gets the timeout of the database
+// The transaction itself is bound to ctx, database/sql rolls it back when that is done.
+func (d sqliteDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sqliteTx, error) {
+	tx, err := d.db.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteTx{Tx: tx, timeout: d.timeout}, nil
+}
+
+func (d sqliteDB) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return sqliteTimedExec(ctx, d.db, d.timeout, query, args...)
+}
+
+func (d sqliteDB) QueryContext(ctx context.Context, query string, args ...interface{}) (*sqliteRows, error) {
+	return sqliteTimedQuery(ctx, d.db, d.timeout, query, args...)
+}
+
+func (d sqliteDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sqliteRow {
+	return sqliteTimedQueryRow(ctx, d.db, d.timeout, query, args...)
+}
+
+// sqliteTx is a transaction where each statement gets a timeout of its own
+type sqliteTx struct {
+	*sql.Tx
+	timeout time.Duration
+}
+
+func (t *sqliteTx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return sqliteTimedExec(ctx, t.Tx, t.timeout, query, args...)
+}
+
+func (t *sqliteTx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sqliteRows, error) {
+	return sqliteTimedQuery(ctx, t.Tx, t.timeout, query, args...)
+}
+
+func (t *sqliteTx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sqliteRow {
+	return sqliteTimedQueryRow(ctx, t.Tx, t.timeout, query, args...)
+}
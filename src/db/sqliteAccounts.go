@@ -0,0 +1,894 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// AccountCreate writes a user to database
+func (s SQLite) AccountCreate(ctx context.Context, input AccountCreateInput) (CreatedAccount, error) {
+	log := s.log(ctx,
+		"accountName", input.Name,
+		"id", input.ID,
+	)
+
+	err := validateFields(input.Fields)
+	if err != nil {
+		log.Debug("Invalid account fields", "err", err.Error())
+		return CreatedAccount{}, err
+	}
+
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return CreatedAccount{}, err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback()
+
+	now := sqliteNow()
+
+	// Names recently used by renamed accounts are reserved, so nobody else can take them over
+	accountSQL := "INSERT INTO accounts (id, created, name, \"apiKey\", password) SELECT $1,$2,$3,$4,$5 " +
+		"WHERE NOT EXISTS (SELECT 1 FROM \"accountsNameHistory\" WHERE name = $3 AND \"reservedUntil\" > $2);"
+
+	res, err := tx.ExecContext(ctx, accountSQL, input.ID, now, input.Name, input.APIKeyHash, input.Password)
+	if err != nil {
+		err = translateSQLiteErr(err)
+		if errors.Is(err, ErrConflict) {
+			log.Debug("Duplicate name in accounts database")
+		} else {
+			log.Warn("Database error when trying to add account", "err", err.Error())
+		}
+
+		return CreatedAccount{}, err
+	}
+
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		log.Debug("Name is reserved by a renamed account")
+		return CreatedAccount{}, errNameReserved
+	}
+
+	err = s.accountFieldsInsert(ctx, tx, input.ID.String(), input.Fields)
+	if err != nil {
+		return CreatedAccount{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return CreatedAccount{}, err
+	}
+
+	log.Verbose("Added account to database", "id", input.ID)
+
+	return CreatedAccount{
+		ID:   input.ID,
+		Name: input.Name,
+	}, nil
+}
+
+// AccountDel marks an account as deleted and removes its renewal tokens. ifVersion 0 skips the version check
+func (s SQLite) AccountDel(ctx context.Context, accountID string, ifVersion int64) error {
+	log := s.log(ctx,
+		"accountID", accountID,
+		"ifVersion", ifVersion,
+	)
+	log.Verbose("Trying to delete account")
+
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback()
+
+	err = s.accountVersionBump(ctx, tx, accountID, ifVersion)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM \"renewalTokens\" WHERE \"accountId\" = $1;", accountID)
+	if err != nil {
+		log.Error("Could not remove renewal tokens for account", "err", err.Error())
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE accounts SET deleted = $2 WHERE id = $1;", accountID, sqliteNow())
+	if err != nil {
+		log.Error("Could not mark account as deleted", "err", err.Error())
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return err
+	}
+
+	log.Verbose("Account marked as deleted")
+
+	return nil
+}
+
+// AccountLogoutAll bumps the token generation of an account, so its JWTs stop working, and removes all its renewal tokens
+// Returns how many renewal tokens were removed. ifVersion 0 skips the version check
+func (s SQLite) AccountLogoutAll(ctx context.Context, accountID string, ifVersion int64) (int, error) {
+	log := s.log(ctx,
+		"accountID", accountID,
+		"ifVersion", ifVersion,
+	)
+	log.Verbose("Trying to log out account everywhere")
+
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return 0, err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback()
+
+	logoutSQL := "UPDATE accounts SET \"tokenGeneration\" = \"tokenGeneration\" + 1, version = version + 1 " +
+		"WHERE id = $1 AND deleted IS NULL AND ($2 = 0 OR version = $2);"
+	res, err := tx.ExecContext(ctx, logoutSQL, accountID, ifVersion)
+	if err != nil {
+		log.Error("Could not bump token generation of account", "err", err.Error())
+		return 0, err
+	}
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if updated == 0 {
+		var exists bool
+		err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND deleted IS NULL)", accountID).Scan(&exists)
+		if err != nil {
+			log.Error("Database error when checking if account exists", "err", err.Error())
+			return 0, err
+		}
+		if exists {
+			log.Debug("Account version mismatch")
+			return 0, ErrVersionMismatch
+		}
+
+		return 0, NotFoundError{Msg: "no account found for given accountID"}
+	}
+
+	res, err = tx.ExecContext(ctx, "DELETE FROM \"renewalTokens\" WHERE \"accountId\" = $1;", accountID)
+	if err != nil {
+		log.Error("Could not remove renewal tokens for account", "err", err.Error())
+		return 0, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return 0, err
+	}
+
+	log.Verbose("Account logged out everywhere")
+
+	return int(removed), nil
+}
+
+// AccountRestore brings back a deleted account that is still within the retention period. ifVersion 0 skips the version check
+func (s SQLite) AccountRestore(ctx context.Context, accountID string, ifVersion int64) (Account, error) {
+	log := s.log(ctx,
+		"accountID", accountID,
+		"ifVersion", ifVersion,
+	)
+	log.Verbose("Trying to restore account")
+
+	cutoff := sqliteTime(time.Now().Add(-s.DeletedRetention))
+	restoreSQL := "UPDATE accounts SET deleted = NULL, version = version + 1 WHERE id = $1 AND deleted > $2 AND ($3 = 0 OR version = $3);"
+	res, err := s.db().ExecContext(ctx, restoreSQL, accountID, cutoff, ifVersion)
+	if err != nil {
+		log.Error("Database error when trying to restore account", "err", err.Error())
+		return Account{}, err
+	}
+
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		var restorable bool
+		err = s.db().QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND deleted > $2)", accountID, cutoff).Scan(&restorable)
+		if err != nil {
+			log.Error("Database error when checking if account is restorable", "err", err.Error())
+			return Account{}, err
+		}
+		if restorable {
+			log.Debug("Account version mismatch")
+			return Account{}, ErrVersionMismatch
+		}
+
+		log.Debug("No deleted account within the retention period found")
+		return Account{}, NotFoundError{Msg: "no restorable deleted account found for given accountID"}
+	}
+
+	return s.AccountGet(ctx, accountID, "", "")
+}
+
+// AccountsPurge permanently removes all accounts that have been deleted for longer than the retention period
+func (s SQLite) AccountsPurge(ctx context.Context) (int, error) {
+	log := s.log(ctx,
+		"deletedRetention", s.DeletedRetention.String(),
+	)
+	log.Debug("Trying to purge deleted accounts")
+
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return 0, err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback()
+
+	purgedWhere := "IN (SELECT id FROM accounts WHERE deleted <= $1)"
+	cutoff := sqliteTime(time.Now().Add(-s.DeletedRetention))
+
+	for _, table := range []string{"renewalTokens", "sessions", "accountsFields", "accountsNameHistory"} {
+		_, err := tx.ExecContext(ctx, "DELETE FROM \""+table+"\" WHERE \"accountId\" "+purgedWhere+";", cutoff)
+		if err != nil {
+			log.Error("Could not purge from "+table, "err", err.Error())
+			return 0, err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM accounts WHERE id "+purgedWhere+";", cutoff)
+	if err != nil {
+		log.Error("Could not purge accounts", "err", err.Error())
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return 0, err
+	}
+
+	purged, _ := res.RowsAffected()
+	if purged != 0 {
+		log.Info("Purged deleted accounts", "count", purged)
+	}
+
+	return int(purged), nil
+}
+
+// AccountTokenGeneration returns the token generation of an account that exists and is not deleted
+func (s SQLite) AccountTokenGeneration(ctx context.Context, accountID string) (int64, error) {
+	var generation int64
+	err := s.db().QueryRowContext(ctx, "SELECT \"tokenGeneration\" FROM accounts WHERE id = $1 AND deleted IS NULL", accountID).Scan(&generation)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, NotFoundError{Msg: "no account found for given accountID"}
+		}
+
+		s.log(ctx).Error("Database error when fetching token generation of account", "err", err.Error(), "accountID", accountID)
+		return 0, err
+	}
+
+	return generation, nil
+}
+
+// AccountGet fetches an account from the database, deleted accounts are not included
+func (s SQLite) AccountGet(ctx context.Context, accountID string, APIKeyHash string, name string) (Account, error) {
+	return s.accountGet(ctx, accountID, APIKeyHash, name, false)
+}
+
+// AccountGetIncludingDeleted fetches an account from the database, even if it is deleted
+func (s SQLite) AccountGetIncludingDeleted(ctx context.Context, accountID string) (Account, error) {
+	return s.accountGet(ctx, accountID, "", "", true)
+}
+
+func (s SQLite) accountGet(ctx context.Context, accountID string, APIKeyHash string, name string, includeDeleted bool) (Account, error) {
+	log := s.log(ctx,
+		"accountID", accountID,
+		"includeDeleted", includeDeleted,
+		"len(APIKeyHash)", len(APIKeyHash),
+		"name", name,
+	)
+	log.Debug("Trying to get account")
+
+	var searchParam string
+	accountSQL := "SELECT \"apiKey\", id, created, deleted, name, \"password\", version FROM accounts WHERE "
+	if !includeDeleted {
+		accountSQL = accountSQL + "deleted IS NULL AND "
+	}
+	if accountID != "" {
+		accountSQL = accountSQL + "id = $1"
+		searchParam = accountID
+	} else if APIKeyHash != "" {
+		accountSQL = accountSQL + "\"apiKey\" = $1"
+		searchParam = APIKeyHash
+	} else if name != "" {
+		accountSQL = accountSQL + "name = $1"
+		searchParam = name
+	} else {
+		log.Debug("No get criteria entered, returning empty response without calling the database")
+
+		return Account{}, NotFoundError{Msg: "no account found"}
+	}
+
+	account, err := scanSQLiteAccount(s.db().QueryRowContext(ctx, accountSQL, searchParam))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Debug("No account found")
+			if accountID != "" {
+				return Account{}, NotFoundError{Msg: "no account found for given accountID"}
+			}
+			return Account{}, NotFoundError{Msg: "no account found"}
+		}
+
+		log.Error("Database error when fetching account", "err", err.Error())
+		return Account{}, err
+	}
+
+	err = s.accountsFieldsGet(ctx, map[string]*Account{account.ID.String(): &account})
+	if err != nil {
+		return Account{}, err
+	}
+
+	return account, nil
+}
+
+// AccountsGet fetches a page of accounts from the database
+func (s SQLite) AccountsGet(ctx context.Context, input AccountsGetInput) (AccountsList, error) {
+	log := s.log(ctx,
+		"cursor", input.Cursor,
+		"fieldFilters", input.FieldFilters,
+		"limit", input.Limit,
+		"namePrefix", input.NamePrefix,
+		"sortBy", input.SortBy,
+		"sortDesc", input.SortDesc,
+		"withTotal", input.WithTotal,
+	)
+	log.Debug("Trying to get accounts")
+
+	if input.SortBy == "" {
+		input.SortBy = "created"
+	}
+	if input.SortBy != "created" && input.SortBy != "name" {
+		log.Debug("Invalid sort column")
+		return AccountsList{}, ValidationError{Field: "sort", Msg: "must be \"created\" or \"name\""}
+	}
+	if input.Limit < 1 {
+		input.Limit = AccountsDefaultLimit
+	}
+
+	var where []string
+	var params []interface{}
+	addParam := func(value interface{}) string {
+		params = append(params, value)
+		return "$" + strconv.Itoa(len(params))
+	}
+
+	if !input.IncludeDeleted {
+		where = append(where, "deleted IS NULL")
+	}
+
+	// LIKE is case insensitive in SQLite, so compare the start of the name instead
+	if input.NamePrefix != "" {
+		where = append(where, "substr(name, 1, "+addParam(utf8.RuneCountInString(input.NamePrefix))+") = "+addParam(input.NamePrefix))
+	}
+
+	// Sort the field names to always get the same SQL for the same filters
+	fieldNames := make([]string, 0, len(input.FieldFilters))
+	for fieldName := range input.FieldFilters {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+	for _, fieldName := range fieldNames {
+		// The field must have all the filter values, like "value @> filter" in PostgreSQL
+		filterValues := uniqueValues(input.FieldFilters[fieldName])
+		hasValues := "1"
+		if len(filterValues) != 0 {
+			hasValues = "(SELECT count(DISTINCT v.value) FROM json_each(\"accountsFields\".value) AS v WHERE v.value IN (" + addParam(filterValues[0])
+			for _, filterValue := range filterValues[1:] {
+				hasValues = hasValues + "," + addParam(filterValue)
+			}
+			hasValues = hasValues + ")) = " + strconv.Itoa(len(filterValues))
+		}
+		where = append(where, "EXISTS (SELECT 1 FROM \"accountsFields\" WHERE \"accountId\" = accounts.id AND name = "+addParam(fieldName)+" AND "+hasValues+")")
+	}
+
+	var result AccountsList
+
+	if input.WithTotal {
+		countSQL := "SELECT count(*) FROM accounts"
+		if len(where) != 0 {
+			countSQL = countSQL + " WHERE " + strings.Join(where, " AND ")
+		}
+
+		var total int
+		err := s.db().QueryRowContext(ctx, countSQL, params...).Scan(&total)
+		if err != nil {
+			log.Error("Database error when counting accounts", "err", err.Error())
+			return AccountsList{}, err
+		}
+		result.Total = &total
+	}
+
+	compareOp := ">"
+	sortDir := "ASC"
+	if input.SortDesc {
+		compareOp = "<"
+		sortDir = "DESC"
+	}
+
+	if input.Cursor != "" {
+		cursor, err := decodeAccountsCursor(input.Cursor)
+		if err != nil || cursor.SortBy != input.SortBy || cursor.SortDesc != input.SortDesc {
+			log.Debug("Invalid cursor")
+			return AccountsList{}, ValidationError{Field: "cursor", Msg: "invalid cursor"}
+		}
+
+		cursorValue := sqliteTime(cursor.Created)
+		if input.SortBy == "name" {
+			cursorValue = cursor.Name
+		}
+		where = append(where, "("+input.SortBy+", id) "+compareOp+" ("+addParam(cursorValue)+", "+addParam(cursor.ID)+")")
+	}
+
+	accountsSQL := "SELECT NULL, id, created, deleted, name, NULL, version FROM accounts"
+	if len(where) != 0 {
+		accountsSQL = accountsSQL + " WHERE " + strings.Join(where, " AND ")
+	}
+	// Fetch one extra row to know if there is a next page or not
+	accountsSQL = accountsSQL + " ORDER BY " + input.SortBy + " " + sortDir + ", id " + sortDir + " LIMIT " + addParam(input.Limit+1)
+
+	rows, err := s.db().QueryContext(ctx, accountsSQL, params...)
+	if err != nil {
+		log.Error("Database error when fetching accounts", "err", err.Error())
+		return AccountsList{}, err
+	}
+	defer rows.Close()
+
+	result.Accounts = []Account{}
+	for rows.Next() {
+		account, err := scanSQLiteAccount(rows)
+		if err != nil {
+			log.Error("Could not scan account from database row", "err", err.Error())
+			return AccountsList{}, err
+		}
+		result.Accounts = append(result.Accounts, account)
+	}
+	if rows.Err() != nil {
+		log.Error("Database error when reading account rows", "err", rows.Err().Error())
+		return AccountsList{}, rows.Err()
+	}
+	rows.Close()
+
+	if len(result.Accounts) > input.Limit {
+		result.Accounts = result.Accounts[:input.Limit]
+		last := result.Accounts[input.Limit-1]
+		result.NextCursor = encodeAccountsCursor(accountsCursor{
+			Created:  last.Created,
+			ID:       last.ID,
+			Name:     last.Name,
+			SortBy:   input.SortBy,
+			SortDesc: input.SortDesc,
+		})
+	}
+
+	if len(result.Accounts) == 0 {
+		return result, nil
+	}
+
+	accountsByID := make(map[string]*Account, len(result.Accounts))
+	for i := range result.Accounts {
+		accountsByID[result.Accounts[i].ID.String()] = &result.Accounts[i]
+	}
+
+	err = s.accountsFieldsGet(ctx, accountsByID)
+	if err != nil {
+		return AccountsList{}, err
+	}
+
+	return result, nil
+}
+
+// AccountRename changes the name of an account and reserves the old name. ifVersion 0 skips the version check
+func (s SQLite) AccountRename(ctx context.Context, accountID string, newName string, ifVersion int64) (Account, error) {
+	log := s.log(ctx,
+		"accountID", accountID,
+		"ifVersion", ifVersion,
+		"newName", newName,
+	)
+
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return Account{}, err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback()
+
+	err = s.accountVersionBump(ctx, tx, accountID, ifVersion)
+	if err != nil {
+		return Account{}, err
+	}
+
+	var oldName string
+	err = tx.QueryRowContext(ctx, "SELECT name FROM accounts WHERE id = $1", accountID).Scan(&oldName)
+	if err != nil {
+		log.Error("Database error when fetching account name", "err", err.Error())
+		return Account{}, err
+	}
+
+	if oldName == newName {
+		log.Debug("Account already has the given name, nothing to rename")
+		tx.Rollback()
+		return s.AccountGet(ctx, accountID, "", "")
+	}
+
+	now := time.Now()
+
+	// The account can always take back its own old names
+	var reservedCount int
+	reservedSQL := "SELECT count(*) FROM \"accountsNameHistory\" WHERE name = $1 AND \"accountId\" != $2 AND \"reservedUntil\" > $3"
+	err = tx.QueryRowContext(ctx, reservedSQL, newName, accountID, sqliteTime(now)).Scan(&reservedCount)
+	if err != nil {
+		log.Error("Database error when checking reserved names", "err", err.Error())
+		return Account{}, err
+	}
+	if reservedCount != 0 {
+		log.Debug("Name is reserved by another renamed account")
+		return Account{}, errNameReserved
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE accounts SET name = $2 WHERE id = $1", accountID, newName)
+	if err != nil {
+		err = translateSQLiteErr(err)
+		if errors.Is(err, ErrConflict) {
+			log.Debug("Duplicate name in accounts database")
+		} else {
+			log.Error("Database error when trying to rename account", "err", err.Error())
+		}
+
+		return Account{}, err
+	}
+
+	newHistoryID, err := uuid.NewRandom()
+	if err != nil {
+		log.Error("Could not create new Uuid", "err", err.Error())
+		return Account{}, err
+	}
+
+	historySQL := "INSERT INTO \"accountsNameHistory\" (id, \"accountId\", name, renamed, \"reservedUntil\") VALUES($1,$2,$3,$4,$5);"
+	_, err = tx.ExecContext(ctx, historySQL, newHistoryID, accountID, oldName, sqliteTime(now), sqliteTime(now.Add(s.OldNameReservation)))
+	if err != nil {
+		log.Error("Database error when trying to save old account name", "err", err.Error())
+		return Account{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return Account{}, err
+	}
+
+	log.Info("Account renamed", "oldName", oldName)
+
+	return s.AccountGet(ctx, accountID, "", "")
+}
+
+// AccountUpdateFields replaces all fields on an account. ifVersion 0 skips the version check
+func (s SQLite) AccountUpdateFields(ctx context.Context, accountID string, fields []AccountCreateInputFields, ifVersion int64) (Account, error) {
+	log := s.log(ctx,
+		"accountID", accountID,
+		"fields", fields,
+		"ifVersion", ifVersion,
+	)
+
+	err := validateFields(fields)
+	if err != nil {
+		log.Debug("Invalid account fields", "err", err.Error())
+		return Account{}, err
+	}
+
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return Account{}, err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback()
+
+	err = s.accountVersionBump(ctx, tx, accountID, ifVersion)
+	if err != nil {
+		return Account{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM \"accountsFields\" WHERE \"accountId\" = $1;", accountID)
+	if err != nil {
+		log.Error("Could not delete previous fields", "err", err.Error())
+		return Account{}, err
+	}
+
+	err = s.accountFieldsInsert(ctx, tx, accountID, fields)
+	if err != nil {
+		return Account{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return Account{}, err
+	}
+
+	return s.AccountGet(ctx, accountID, "", "")
+}
+
+// AccountFieldGet fetches the values of a single account field
+func (s SQLite) AccountFieldGet(ctx context.Context, accountID string, fieldName string) ([]string, error) {
+	log := s.log(ctx,
+		"accountID", accountID,
+		"fieldName", fieldName,
+	)
+	log.Debug("Trying to get account field")
+
+	var value string
+	fieldSQL := "SELECT value FROM \"accountsFields\" WHERE \"accountId\" = $1 AND name = $2 " +
+		"AND EXISTS (SELECT 1 FROM accounts WHERE id = $1 AND deleted IS NULL)"
+	err := s.db().QueryRowContext(ctx, fieldSQL, accountID, fieldName).Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Debug("No account field found")
+			return nil, NotFoundError{Msg: "no field found for given accountID and name"}
+		}
+
+		log.Error("Database error when fetching account field", "err", err.Error())
+		return nil, err
+	}
+
+	values, err := parseSQLiteValues(value)
+	if err != nil {
+		log.Error("Could not parse account field values", "err", err.Error())
+		return nil, err
+	}
+
+	return values, nil
+}
+
+// AccountPatchFields applies field operations on an account in a single transaction. ifVersion 0 skips the version check
+func (s SQLite) AccountPatchFields(ctx context.Context, accountID string, ops []AccountFieldsPatchOp, ifVersion int64) (Account, error) {
+	log := s.log(ctx,
+		"accountID", accountID,
+		"ifVersion", ifVersion,
+		"ops", ops,
+	)
+
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return Account{}, err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback()
+
+	err = s.accountVersionBump(ctx, tx, accountID, ifVersion)
+	if err != nil {
+		return Account{}, err
+	}
+
+	// SQLite has no array functions to do the operations in SQL, so apply them on the current fields and write back the changed ones
+	account := Account{Fields: make(map[string][]string)}
+	err = s.accountsFieldsGetTx(ctx, tx, map[string]*Account{accountID: &account})
+	if err != nil {
+		return Account{}, err
+	}
+
+	oldFields := make(map[string]string, len(account.Fields))
+	for name, values := range account.Fields {
+		oldFields[name] = sqliteValues(values)
+	}
+
+	err = patchFields(account.Fields, ops)
+	if err != nil {
+		log.Debug("Could not patch account fields", "err", err.Error())
+		return Account{}, err
+	}
+
+	for name := range oldFields {
+		if _, ok := account.Fields[name]; !ok {
+			_, err = tx.ExecContext(ctx, "DELETE FROM \"accountsFields\" WHERE \"accountId\" = $1 AND name = $2;", accountID, name)
+			if err != nil {
+				log.Error("Database error when trying to remove account field", "err", err.Error(), "fieldName", name)
+				return Account{}, err
+			}
+		}
+	}
+
+	for name, values := range account.Fields {
+		if oldValues, ok := oldFields[name]; ok && oldValues == sqliteValues(values) {
+			continue
+		}
+
+		newFieldID, err := uuid.NewRandom()
+		if err != nil {
+			log.Error("Could not create new Uuid", "err", err.Error())
+			return Account{}, err
+		}
+
+		upsertSQL := "INSERT INTO \"accountsFields\" (id, created, \"accountId\", name, value) VALUES($1,$2,$3,$4,$5) " +
+			"ON CONFLICT (\"accountId\", name) DO UPDATE SET value = excluded.value;"
+		_, err = tx.ExecContext(ctx, upsertSQL, newFieldID, sqliteNow(), accountID, name, sqliteValues(values))
+		if err != nil {
+			log.Error("Database error when trying to patch account field", "err", err.Error(), "fieldName", name, "fieldValues", values)
+			return Account{}, err
+		}
+
+		log.Debug("Patched account field", "fieldName", name, "fieldValues", values)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return Account{}, err
+	}
+
+	return s.AccountGet(ctx, accountID, "", "")
+}
+
+// AccountAPIKeySet replaces the API key hash of an account
+func (s SQLite) AccountAPIKeySet(ctx context.Context, accountID string, APIKeyHash string) error {
+	return s.accountColumnSet(ctx, accountID, "apiKey", APIKeyHash)
+}
+
+// AccountPasswordSet replaces the password hash of an account
+func (s SQLite) AccountPasswordSet(ctx context.Context, accountID string, password string) error {
+	return s.accountColumnSet(ctx, accountID, "password", password)
+}
+
+// accountColumnSet sets a column on an account that is not deleted and bumps its version
+func (s SQLite) accountColumnSet(ctx context.Context, accountID string, column string, value string) error {
+	log := s.log(ctx,
+		"accountID", accountID,
+		"column", column,
+	)
+
+	updateSQL := "UPDATE accounts SET \"" + column + "\" = $2, version = version + 1 WHERE id = $1 AND deleted IS NULL"
+	res, err := s.db().ExecContext(ctx, updateSQL, accountID, value)
+	if err != nil {
+		log.Error("Database error when trying to update account", "err", err.Error())
+		return err
+	}
+
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		log.Debug("No account found")
+		return NotFoundError{Msg: "no account found for given accountID"}
+	}
+
+	log.Verbose("Account updated")
+
+	return nil
+}
+
+// accountVersionBump checks the version of an account and increments it within a transaction
+// Transactions take the write lock when they begin, so nobody else can change the account until it ends.
+// Deleted accounts are treated as missing.
+// ifVersion 0 skips the version check
+func (s SQLite) accountVersionBump(ctx context.Context, tx *sqliteTx, accountID string, ifVersion int64) error {
+	log := s.log(ctx)
+
+	var version int64
+	err := tx.QueryRowContext(ctx, "SELECT version FROM accounts WHERE id = $1 AND deleted IS NULL", accountID).Scan(&version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Debug("No account found")
+			return NotFoundError{Msg: "no account found for given accountID"}
+		}
+
+		log.Error("Database error when fetching account version", "err", err.Error())
+		return err
+	}
+
+	if ifVersion != 0 && version != ifVersion {
+		log.Debug("Account version mismatch", "version", version)
+		return ErrVersionMismatch
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE accounts SET version = version + 1 WHERE id = $1", accountID)
+	if err != nil {
+		log.Error("Database error when bumping account version", "err", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// accountFieldsInsert writes fields for an account within a transaction
+func (s SQLite) accountFieldsInsert(ctx context.Context, tx *sqliteTx, accountID string, fields []AccountCreateInputFields) error {
+	log := s.log(ctx)
+
+	accountFieldsSQL := "INSERT INTO \"accountsFields\" (id, created, \"accountId\", name, value) VALUES($1,$2,$3,$4,$5);"
+	for _, field := range fields {
+		newFieldID, err := uuid.NewRandom()
+		if err != nil {
+			log.Error("Could not create new Uuid", "err", err.Error())
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, accountFieldsSQL, newFieldID, sqliteNow(), accountID, field.Name, sqliteValues(field.Values))
+		if err != nil {
+			log.Error("Database error when trying to add account field", "err", err.Error(), "fieldName", field.Name, "fieldValues", field.Values)
+			return translateSQLiteErr(err)
+		}
+
+		log.Debug("Added account field", "accountID", accountID, "fieldName", field.Name, "fieldValues", field.Values)
+	}
+
+	return nil
+}
+
+// accountsFieldsGet loads the fields of the given accounts, keyed by account id
+func (s SQLite) accountsFieldsGet(ctx context.Context, accountsByID map[string]*Account) error {
+	return s.accountsFieldsGetTx(ctx, s.db(), accountsByID)
+}
+
+// sqliteQueryer is implemented by both sqliteDB and *sqliteTx
+type sqliteQueryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sqliteRows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sqliteRow
+}
+
+func (s SQLite) accountsFieldsGetTx(ctx context.Context, queryer sqliteQueryer, accountsByID map[string]*Account) error {
+	log := s.log(ctx)
+
+	var params []interface{}
+	var placeholders []string
+	for accountID := range accountsByID {
+		params = append(params, accountID)
+		placeholders = append(placeholders, "$"+strconv.Itoa(len(params)))
+	}
+
+	fieldsSQL := "SELECT \"accountId\", name, value FROM \"accountsFields\" WHERE \"accountId\" IN (" + strings.Join(placeholders, ",") + ")"
+	rows, err := queryer.QueryContext(ctx, fieldsSQL, params...)
+	if err != nil {
+		log.Error("Database error when fetching account fields", "err", err.Error())
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var accountID string
+		var name string
+		var value string
+		err := rows.Scan(&accountID, &name, &value)
+		if err != nil {
+			log.Error("Could not get accountId, name or value from database row", "err", err.Error())
+			return err
+		}
+
+		values, err := parseSQLiteValues(value)
+		if err != nil {
+			log.Error("Could not parse account field values", "err", err.Error(), "fieldName", name)
+			return err
+		}
+		accountsByID[accountID].Fields[name] = values
+	}
+	if rows.Err() != nil {
+		log.Error("Database error when reading account field rows", "err", rows.Err().Error())
+		return rows.Err()
+	}
+
+	return nil
+}
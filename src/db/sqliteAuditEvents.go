@@ -0,0 +1,247 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// sqliteAuditEventColumns are the columns sqliteAuditEventScan() reads
+const sqliteAuditEventColumns = "id, created, action, \"actorId\", \"targetId\", ip, \"userAgent\", outcome, diff, \"prevHash\", hash"
+
+func sqliteAuditEventScan(rows sqliteScanner) (AuditEvent, error) {
+	var event AuditEvent
+	var actorID, targetID, diff, prevHash, hash sql.NullString
+	var created string
+	err := rows.Scan(&event.ID, &created, &event.Action, &actorID, &targetID, &event.IP, &event.UserAgent, &event.Outcome, &diff, &prevHash, &hash)
+	if err != nil {
+		return AuditEvent{}, err
+	}
+	event.Created, err = parseSQLiteTime(created)
+	if err != nil {
+		return AuditEvent{}, errors.New("invalid created time of audit event " + strconv.FormatInt(event.ID, 10) + ": " + err.Error())
+	}
+	event.ActorID = actorID.String
+	event.TargetID = targetID.String
+	event.PrevHash = prevHash.String
+	event.Hash = hash.String
+	if diff.Valid {
+		event.Diff = []byte(diff.String)
+	}
+
+	return event, nil
+}
+
+// AuditEventCreate writes an audit event chained to the last one, see AuditEventHash(), and returns it with its id, time and hashes
+func (s SQLite) AuditEventCreate(ctx context.Context, event AuditEvent) (AuditEvent, error) {
+	log := s.log(ctx,
+		"action", event.Action,
+		"outcome", event.Outcome,
+	)
+
+	event, err := auditEventPrepare(event)
+	if err != nil {
+		log.Debug("Invalid audit event", "err", err.Error())
+		return AuditEvent{}, err
+	}
+
+	// Transactions take the write lock right away, so events are written one at a time and each is chained to the one before it
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return AuditEvent{}, err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(hash, '') FROM \"auditEvents\" ORDER BY id DESC LIMIT 1").Scan(&event.PrevHash)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Error("Could not get last audit event", "err", err.Error())
+		return AuditEvent{}, err
+	}
+
+	// The id is part of the hash, so it is taken before the insert. AUTOINCREMENT keeps the highest id ever used in sqlite_sequence
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE((SELECT seq FROM sqlite_sequence WHERE name = 'auditEvents'), 0) + 1").Scan(&event.ID)
+	if err != nil {
+		log.Error("Could not get next audit event id", "err", err.Error())
+		return AuditEvent{}, err
+	}
+	event.Hash = AuditEventHash(event.PrevHash, event)
+
+	insertSQL := "INSERT INTO \"auditEvents\" (id, created, action, \"actorId\", \"targetId\", ip, \"userAgent\", outcome, diff, \"prevHash\", hash) " +
+		"VALUES($1,$2,$3,NULLIF($4, ''),NULLIF($5, ''),$6,$7,$8,NULLIF($9, ''),NULLIF($10, ''),$11)"
+	_, err = tx.ExecContext(ctx, insertSQL, event.ID, sqliteTime(event.Created), event.Action, event.ActorID, event.TargetID, event.IP, event.UserAgent, event.Outcome, string(event.Diff), event.PrevHash, event.Hash)
+	if err != nil {
+		log.Error("Could not insert into database table \"auditEvents\"", "err", err.Error())
+		return AuditEvent{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error("Could not commit audit event", "err", err.Error())
+		return AuditEvent{}, err
+	}
+
+	return event, nil
+}
+
+// AuditChainGet returns up to limit audit events after the one with afterID, oldest first, to verify the chain
+func (s SQLite) AuditChainGet(ctx context.Context, afterID int64, limit int) ([]AuditEvent, error) {
+	log := s.log(ctx, "afterID", afterID)
+
+	rows, err := s.db().QueryContext(ctx, "SELECT "+sqliteAuditEventColumns+" FROM \"auditEvents\" WHERE id > $1 ORDER BY id LIMIT $2", afterID, limit)
+	if err != nil {
+		log.Error("Database error when fetching audit chain", "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		event, err := sqliteAuditEventScan(rows)
+		if err != nil {
+			log.Error("Could not scan audit event from database row", "err", err.Error())
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if rows.Err() != nil {
+		log.Error("Database error when reading audit event rows", "err", rows.Err().Error())
+		return nil, rows.Err()
+	}
+
+	return events, nil
+}
+
+// AuditCheckpointCreate writes a signed checkpoint, see AuditSign()
+func (s SQLite) AuditCheckpointCreate(ctx context.Context, checkpoint AuditCheckpoint) (AuditCheckpoint, error) {
+	insertSQL := "INSERT INTO \"auditCheckpoints\" (created, \"eventId\", \"eventHash\", \"keyId\", signature) VALUES($1,$2,$3,$4,$5) RETURNING id"
+	err := s.db().QueryRowContext(ctx, insertSQL, sqliteTime(checkpoint.Created), checkpoint.EventID, checkpoint.EventHash, checkpoint.KeyID, checkpoint.Signature).Scan(&checkpoint.ID)
+	if err != nil {
+		s.log(ctx).Error("Could not insert into database table \"auditCheckpoints\"", "err", err.Error(), "eventID", checkpoint.EventID)
+		return AuditCheckpoint{}, err
+	}
+
+	return checkpoint, nil
+}
+
+// AuditCheckpointsGet returns all audit checkpoints, oldest first
+func (s SQLite) AuditCheckpointsGet(ctx context.Context) ([]AuditCheckpoint, error) {
+	rows, err := s.db().QueryContext(ctx, "SELECT id, created, \"eventId\", \"eventHash\", \"keyId\", signature FROM \"auditCheckpoints\" ORDER BY id")
+	if err != nil {
+		s.log(ctx).Error("Database error when fetching audit checkpoints", "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := []AuditCheckpoint{}
+	for rows.Next() {
+		var checkpoint AuditCheckpoint
+		var created string
+		err := rows.Scan(&checkpoint.ID, &created, &checkpoint.EventID, &checkpoint.EventHash, &checkpoint.KeyID, &checkpoint.Signature)
+		if err != nil {
+			s.log(ctx).Error("Could not scan audit checkpoint from database row", "err", err.Error())
+			return nil, err
+		}
+		checkpoint.Created, err = parseSQLiteTime(created)
+		if err != nil {
+			s.log(ctx).Error("Invalid created time of audit checkpoint", "err", err.Error(), "id", checkpoint.ID)
+			return nil, err
+		}
+		checkpoints = append(checkpoints, checkpoint)
+	}
+	if rows.Err() != nil {
+		s.log(ctx).Error("Database error when reading audit checkpoint rows", "err", rows.Err().Error())
+		return nil, rows.Err()
+	}
+
+	return checkpoints, nil
+}
+
+// AuditEventsGet lists audit events, newest first
+func (s SQLite) AuditEventsGet(ctx context.Context, input AuditEventsGetInput) (AuditEventsList, error) {
+	log := s.log(ctx,
+		"accountID", input.AccountID,
+		"action", input.Action,
+		"cursor", input.Cursor,
+		"limit", input.Limit,
+	)
+	log.Debug("Trying to get audit events")
+
+	input, beforeID, err := auditEventsPrepare(input)
+	if err != nil {
+		log.Debug("Invalid audit events filter", "err", err.Error())
+		return AuditEventsList{}, err
+	}
+
+	var where []string
+	var params []interface{}
+	addParam := func(value interface{}) string {
+		params = append(params, value)
+		return "$" + strconv.Itoa(len(params))
+	}
+
+	if input.AccountID != "" {
+		param := addParam(input.AccountID)
+		where = append(where, "(\"actorId\" = "+param+" OR \"targetId\" = "+param+")")
+	}
+	if input.Action != "" {
+		where = append(where, "action = "+addParam(input.Action))
+	}
+	if input.ActorID != "" {
+		where = append(where, "\"actorId\" = "+addParam(input.ActorID))
+	}
+	if input.Outcome != "" {
+		where = append(where, "outcome = "+addParam(input.Outcome))
+	}
+	if !input.Since.IsZero() {
+		where = append(where, "created >= "+addParam(sqliteTime(input.Since)))
+	}
+	if input.TargetID != "" {
+		where = append(where, "\"targetId\" = "+addParam(input.TargetID))
+	}
+	if !input.Until.IsZero() {
+		where = append(where, "created < "+addParam(sqliteTime(input.Until)))
+	}
+	if beforeID != 0 {
+		where = append(where, "id < "+addParam(beforeID))
+	}
+
+	eventsSQL := "SELECT " + sqliteAuditEventColumns + " FROM \"auditEvents\""
+	if len(where) != 0 {
+		eventsSQL = eventsSQL + " WHERE " + strings.Join(where, " AND ")
+	}
+	// Fetch one extra row to know if there is a next page or not
+	eventsSQL = eventsSQL + " ORDER BY id DESC LIMIT " + addParam(input.Limit+1)
+
+	rows, err := s.db().QueryContext(ctx, eventsSQL, params...)
+	if err != nil {
+		log.Error("Database error when fetching audit events", "err", err.Error())
+		return AuditEventsList{}, err
+	}
+	defer rows.Close()
+
+	result := AuditEventsList{Events: []AuditEvent{}}
+	for rows.Next() {
+		event, err := sqliteAuditEventScan(rows)
+		if err != nil {
+			log.Error("Could not scan audit event from database row", "err", err.Error())
+			return AuditEventsList{}, err
+		}
+		result.Events = append(result.Events, event)
+	}
+	if rows.Err() != nil {
+		log.Error("Database error when reading audit event rows", "err", rows.Err().Error())
+		return AuditEventsList{}, rows.Err()
+	}
+
+	if len(result.Events) > input.Limit {
+		result.Events = result.Events[:input.Limit]
+		result.NextCursor = strconv.FormatInt(result.Events[input.Limit-1].ID, 10)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+)
+
+// MigrateStatus lists the embedded migrations and the applied ones that are not embedded
+// Migrations use the database without the query timeout, like in PostgreSQL, a migration may take long.
+func (s SQLite) MigrateStatus(ctx context.Context) ([]MigrationStatus, error) {
+	return s.migrateStatus(ctx, sqliteDB{db: s.DB})
+}
+
+func (s SQLite) migrateStatus(ctx context.Context, queryer sqliteQueryer) ([]MigrationStatus, error) {
+	log := s.log(ctx)
+
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		log.Error("Could not load embedded migrations", "err", err.Error())
+		return nil, err
+	}
+
+	var tableCount int
+	err = queryer.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'").Scan(&tableCount)
+	if err != nil {
+		log.Error("Database error when checking for schema_migrations", "err", err.Error())
+		return nil, err
+	}
+	if tableCount == 0 {
+		return migrationStatuses(migrations, nil), nil
+	}
+
+	rows, err := queryer.QueryContext(ctx, "SELECT version FROM schema_migrations")
+	if err != nil {
+		log.Error("Database error when fetching applied migrations", "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	var appliedVersions []string
+	for rows.Next() {
+		var version string
+		err := rows.Scan(&version)
+		if err != nil {
+			log.Error("Could not get version from database row", "err", err.Error())
+			return nil, err
+		}
+		appliedVersions = append(appliedVersions, version)
+	}
+	if rows.Err() != nil {
+		log.Error("Database error when reading applied migrations", "err", rows.Err().Error())
+		return nil, rows.Err()
+	}
+
+	return migrationStatuses(migrations, appliedVersions), nil
+}
+
+// MigrateUp applies all pending migrations in one transaction and returns them
+// Transactions take the write lock when they begin, so only one process migrates at a time.
+func (s SQLite) MigrateUp(ctx context.Context) ([]Migration, error) {
+	log := s.log(ctx)
+
+	tx, err := sqliteDB{db: s.DB}.BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return nil, err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version varchar(255) PRIMARY KEY)")
+	if err != nil {
+		log.Error("Could not create schema_migrations", "err", err.Error())
+		return nil, err
+	}
+
+	statuses, err := s.migrateStatus(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	mismatchErr, _ := migrationsMismatch(statuses).(SchemaMismatchError)
+	if len(mismatchErr.Unknown) != 0 {
+		log.Error("Refusing to migrate a database with unknown migrations", "err", mismatchErr.Error())
+		return nil, mismatchErr
+	}
+
+	var applied []Migration
+	for _, status := range statuses {
+		if status.Applied {
+			continue
+		}
+
+		log.Info("Applying migration", "migration", status.Name)
+		_, err := tx.ExecContext(ctx, status.Up)
+		if err == nil {
+			_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", status.Version)
+		}
+		if err != nil {
+			log.Error("Could not apply migration", "err", err.Error(), "migration", status.Name)
+			return nil, err
+		}
+		applied = append(applied, status.Migration)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return nil, err
+	}
+
+	return applied, nil
+}
+
+// MigrateDown rolls back the last applied migration and returns it
+func (s SQLite) MigrateDown(ctx context.Context) (Migration, error) {
+	log := s.log(ctx)
+
+	tx, err := sqliteDB{db: s.DB}.BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return Migration{}, err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback()
+
+	statuses, err := s.migrateStatus(ctx, tx)
+	if err != nil {
+		return Migration{}, err
+	}
+
+	migration, found, err := lastApplied(statuses)
+	if err != nil {
+		log.Error("Can not roll back a migration that is not embedded", "err", err.Error())
+		return Migration{}, err
+	}
+	if !found {
+		return Migration{}, NotFoundError{Msg: "no applied migration to roll back"}
+	}
+
+	log.Info("Rolling back migration", "migration", migration.Name)
+	_, err = tx.ExecContext(ctx, migration.Down)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = $1", migration.Version)
+	}
+	if err != nil {
+		log.Error("Could not roll back migration", "err", err.Error(), "migration", migration.Name)
+		return Migration{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return Migration{}, err
+	}
+
+	return migration, nil
+}
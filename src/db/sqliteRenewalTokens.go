@@ -0,0 +1,180 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"github.com/google/uuid"
+)
+
+// RenewalTokenCreate obtain a new renewal token for a session, with an empty sessionID it belongs to no session
+func (s SQLite) RenewalTokenCreate(ctx context.Context, accountID string, sessionID string) (string, error) {
+	log := s.log(ctx,
+		"accountID", accountID,
+		"sessionID", sessionID,
+	)
+
+	log.Debug("Creating new renewal token")
+
+	newToken := utils.RandString(60)
+
+	insertSQL := "INSERT INTO \"renewalTokens\" (\"accountId\",\"sessionId\",exp,token) VALUES($1,NULLIF($2, ''),$3,$4);"
+	_, insertErr := s.db().ExecContext(ctx, insertSQL, accountID, sessionID, sqliteTime(time.Now().Add(renewalTokenTTL)), newToken)
+	if insertErr != nil {
+		log.Error("Could not insert into database table \"renewalTokens\"", "err", insertErr.Error())
+		return "", insertErr
+	}
+
+	return newToken, nil
+}
+
+// RenewalTokenGet checks if a valid renewal token exists in database and returns its account and session IDs
+func (s SQLite) RenewalTokenGet(ctx context.Context, token string) (RenewalToken, error) {
+	log := s.log(ctx)
+
+	log.Debug("Trying to get a renewal token")
+
+	tokenSQL := "SELECT \"accountId\", COALESCE(\"sessionId\", '') FROM \"renewalTokens\" WHERE exp >= $1 AND token = $2"
+
+	var found RenewalToken
+	err := s.db().QueryRowContext(ctx, tokenSQL, sqliteNow(), token).Scan(&found.AccountID, &found.SessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return RenewalToken{}, NotFoundError{Msg: "no valid renewal token found"}
+		}
+
+		log.Error("Database error when fetching renewal token", "err", err.Error())
+		return RenewalToken{}, err
+	}
+
+	return found, nil
+}
+
+// RenewalTokenRm removes a renewal token from the database, a token that is already removed gives a NotFoundError
+func (s SQLite) RenewalTokenRm(ctx context.Context, token string) error {
+	log := s.log(ctx)
+
+	log.Debug("Trying to remove a renewal token")
+
+	res, err := s.db().ExecContext(ctx, "DELETE FROM \"renewalTokens\" WHERE token = $1", token)
+	if err != nil {
+		log.Error("Database error when trying to remove token", "err", err.Error())
+		return err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return NotFoundError{Msg: "no renewal token found"}
+	}
+
+	return nil
+}
+
+// RenewalTokenUse removes a valid renewal token and creates a new one for the same session, in one transaction
+// Transactions take the write lock when they begin, so a token is either removed by logging out or used here. A token can only be used once.
+// Tokens from before sessions were recorded start newSession, its account is taken from the token.
+func (s SQLite) RenewalTokenUse(ctx context.Context, token string, newSession Session) (Renewal, error) {
+	log := s.log(ctx)
+
+	log.Debug("Trying to use a renewal token")
+
+	tx, err := s.db().BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("Could not begin database transaction", "err", err.Error())
+		return Renewal{}, err
+	}
+
+	// Rollback is a no-op if the tx is already committed
+	defer tx.Rollback()
+
+	now := sqliteNow()
+
+	var renewal Renewal
+	tokenSQL := "SELECT \"accountId\", COALESCE(\"sessionId\", '') FROM \"renewalTokens\" WHERE exp >= $1 AND token = $2"
+	err = tx.QueryRowContext(ctx, tokenSQL, now, token).Scan(&renewal.AccountID, &renewal.SessionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Renewal{}, NotFoundError{Msg: "no valid renewal token found"}
+		}
+
+		log.Error("Database error when fetching renewal token", "err", err.Error())
+		return Renewal{}, err
+	}
+
+	generationSQL := "SELECT \"tokenGeneration\" FROM accounts WHERE id = $1 AND deleted IS NULL"
+	err = tx.QueryRowContext(ctx, generationSQL, renewal.AccountID).Scan(&renewal.Generation)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Renewal{}, NotFoundError{Msg: "no account found for given accountID"}
+		}
+
+		log.Error("Database error when fetching token generation of account", "err", err.Error())
+		return Renewal{}, err
+	}
+
+	if renewal.SessionID == "" {
+		renewal.SessionID = uuid.NewString()
+		sessionSQL := "INSERT INTO sessions (id, \"accountId\", method, ip, \"userAgent\", created, renewed) VALUES($1,$2,$3,$4,$5,$6,$6);"
+		_, err = tx.ExecContext(ctx, sessionSQL, renewal.SessionID, renewal.AccountID, newSession.Method, newSession.IP, newSession.UserAgent, now)
+	} else {
+		_, err = tx.ExecContext(ctx, "UPDATE sessions SET renewed = $1 WHERE id = $2;", now, renewal.SessionID)
+	}
+	if err != nil {
+		log.Error("Database error when trying to renew session", "err", err.Error(), "sessionID", renewal.SessionID)
+		return Renewal{}, err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM \"renewalTokens\" WHERE token = $1;", token)
+	if err != nil {
+		log.Error("Database error when trying to remove token", "err", err.Error())
+		return Renewal{}, err
+	}
+
+	renewal.RenewalToken = utils.RandString(60)
+	insertSQL := "INSERT INTO \"renewalTokens\" (\"accountId\",\"sessionId\",exp,token) VALUES($1,$2,$3,$4);"
+	_, err = tx.ExecContext(ctx, insertSQL, renewal.AccountID, renewal.SessionID, sqliteTime(time.Now().Add(renewalTokenTTL)), renewal.RenewalToken)
+	if err != nil {
+		log.Error("Could not insert into database table \"renewalTokens\"", "err", err.Error())
+		return Renewal{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		log.Error("Database error when tying to commit", "err", err.Error())
+		return Renewal{}, err
+	}
+
+	return renewal, nil
+}
+
+// RenewalTokensCount returns how many renewal tokens have not expired
+func (s SQLite) RenewalTokensCount(ctx context.Context) (int, error) {
+	var count int
+	err := s.db().QueryRowContext(ctx, "SELECT count(*) FROM \"renewalTokens\" WHERE exp >= $1", sqliteNow()).Scan(&count)
+	if err != nil {
+		s.log(ctx).Error("Database error when counting renewal tokens", "err", err.Error())
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// RenewalTokensRm removes all renewal tokens of an account and returns how many they were
+func (s SQLite) RenewalTokensRm(ctx context.Context, accountID string) (int, error) {
+	log := s.log(ctx,
+		"accountID", accountID,
+	)
+
+	log.Debug("Trying to remove all renewal tokens of an account")
+
+	res, err := s.db().ExecContext(ctx, "DELETE FROM \"renewalTokens\" WHERE \"accountId\" = $1", accountID)
+	if err != nil {
+		log.Error("Database error when trying to remove tokens", "err", err.Error())
+		return 0, err
+	}
+
+	removed, _ := res.RowsAffected()
+
+	return int(removed), nil
+}
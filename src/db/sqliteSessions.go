@@ -0,0 +1,128 @@
+package db
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// SessionCreate records a new session of an account that is not deleted, the id and times are set here
+func (s SQLite) SessionCreate(ctx context.Context, session Session) (Session, error) {
+	log := s.log(ctx,
+		"accountID", session.AccountID,
+		"method", session.Method,
+	)
+
+	log.Debug("Creating new session")
+
+	now := sqliteNow()
+	created, err := parseSQLiteTime(now)
+	if err != nil {
+		return Session{}, err
+	}
+	session.ID = uuid.New()
+	session.Active = true
+	session.Created = created
+	session.Renewed = created
+
+	insertSQL := "INSERT INTO sessions (id, \"accountId\", method, ip, \"userAgent\", created, renewed) SELECT $1,$2,$3,$4,$5,$6,$6 " +
+		"WHERE EXISTS (SELECT 1 FROM accounts WHERE id = $2 AND deleted IS NULL);"
+	res, err := s.db().ExecContext(ctx, insertSQL, session.ID.String(), session.AccountID.String(), session.Method, session.IP, session.UserAgent, now)
+	if err != nil {
+		log.Error("Could not insert into database table \"sessions\"", "err", err.Error())
+		return Session{}, err
+	}
+	if affected, _ := res.RowsAffected(); affected == 0 {
+		return Session{}, NotFoundError{Msg: "no account found for given accountID"}
+	}
+
+	return session, nil
+}
+
+// SessionRm revokes a session of an account by removing its renewal tokens, the session is kept in the login history
+// JWTs already handed out in the session stay valid until they expire.
+func (s SQLite) SessionRm(ctx context.Context, accountID string, sessionID string) error {
+	log := s.log(ctx,
+		"accountID", accountID,
+		"sessionID", sessionID,
+	)
+
+	log.Debug("Trying to revoke a session")
+
+	var exists bool
+	err := s.db().QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sessions WHERE id = $1 AND \"accountId\" = $2)", sessionID, accountID).Scan(&exists)
+	if err != nil {
+		log.Error("Database error when fetching session", "err", err.Error())
+		return err
+	}
+	if !exists {
+		return NotFoundError{Msg: "no session found for given accountID and sessionID"}
+	}
+
+	_, err = s.db().ExecContext(ctx, "DELETE FROM \"renewalTokens\" WHERE \"sessionId\" = $1", sessionID)
+	if err != nil {
+		log.Error("Database error when trying to remove the tokens of a session", "err", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// SessionsGet lists the sessions of an account, newest first, up to SessionsLimit
+func (s SQLite) SessionsGet(ctx context.Context, accountID string) ([]Session, error) {
+	log := s.log(ctx,
+		"accountID", accountID,
+	)
+
+	log.Debug("Trying to get sessions")
+
+	sessionsSQL := "SELECT id, \"accountId\", method, ip, \"userAgent\", created, renewed, " +
+		"EXISTS (SELECT 1 FROM \"renewalTokens\" WHERE \"sessionId\" = sessions.id AND exp >= $2) " +
+		"FROM sessions WHERE \"accountId\" = $1 ORDER BY created DESC LIMIT $3"
+	rows, err := s.db().QueryContext(ctx, sessionsSQL, accountID, sqliteNow(), SessionsLimit)
+	if err != nil {
+		log.Error("Database error when fetching sessions", "err", err.Error())
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := sqliteSessionScan(rows)
+		if err != nil {
+			log.Error("Could not scan session from database row", "err", err.Error())
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if rows.Err() != nil {
+		log.Error("Database error when reading session rows", "err", rows.Err().Error())
+		return nil, rows.Err()
+	}
+
+	return sessions, nil
+}
+
+func sqliteSessionScan(rows sqliteScanner) (Session, error) {
+	var session Session
+	var id, accountID, created, renewed string
+	err := rows.Scan(&id, &accountID, &session.Method, &session.IP, &session.UserAgent, &created, &renewed, &session.Active)
+	if err != nil {
+		return Session{}, err
+	}
+
+	if session.ID, err = uuid.Parse(id); err != nil {
+		return Session{}, err
+	}
+	if session.AccountID, err = uuid.Parse(accountID); err != nil {
+		return Session{}, err
+	}
+	if session.Created, err = parseSQLiteTime(created); err != nil {
+		return Session{}, err
+	}
+	if session.Renewed, err = parseSQLiteTime(renewed); err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
@@ -0,0 +1,44 @@
+package db
+
+import "context"
+
+// Store is the storage for accounts, account fields, renewal tokens, sessions and audit events
+// Db is the PostgreSQL implementation, SQLite uses a single database file and Memory keeps everything in memory
+type Store interface {
+	AccountAPIKeySet(ctx context.Context, accountID string, APIKeyHash string) error
+	AccountCreate(ctx context.Context, input AccountCreateInput) (CreatedAccount, error)
+	AccountDel(ctx context.Context, accountID string, ifVersion int64) error
+	AccountFieldGet(ctx context.Context, accountID string, fieldName string) ([]string, error)
+	AccountGet(ctx context.Context, accountID string, APIKeyHash string, name string) (Account, error)
+	AccountGetIncludingDeleted(ctx context.Context, accountID string) (Account, error)
+	AccountLogoutAll(ctx context.Context, accountID string, ifVersion int64) (int, error)
+	AccountPasswordSet(ctx context.Context, accountID string, password string) error
+	AccountPatchFields(ctx context.Context, accountID string, ops []AccountFieldsPatchOp, ifVersion int64) (Account, error)
+	AccountRename(ctx context.Context, accountID string, newName string, ifVersion int64) (Account, error)
+	AccountRestore(ctx context.Context, accountID string, ifVersion int64) (Account, error)
+	AccountTokenGeneration(ctx context.Context, accountID string) (int64, error)
+	AccountUpdateFields(ctx context.Context, accountID string, fields []AccountCreateInputFields, ifVersion int64) (Account, error)
+	AccountsGet(ctx context.Context, input AccountsGetInput) (AccountsList, error)
+	AccountsPurge(ctx context.Context) (int, error)
+	AuditChainGet(ctx context.Context, afterID int64, limit int) ([]AuditEvent, error)
+	AuditCheckpointCreate(ctx context.Context, checkpoint AuditCheckpoint) (AuditCheckpoint, error)
+	AuditCheckpointsGet(ctx context.Context) ([]AuditCheckpoint, error)
+	AuditEventCreate(ctx context.Context, event AuditEvent) (AuditEvent, error)
+	AuditEventsGet(ctx context.Context, input AuditEventsGetInput) (AuditEventsList, error)
+	Ping(ctx context.Context) error
+	RenewalTokenCreate(ctx context.Context, accountID string, sessionID string) (string, error)
+	RenewalTokenGet(ctx context.Context, token string) (RenewalToken, error)
+	RenewalTokenRm(ctx context.Context, token string) error
+	RenewalTokenUse(ctx context.Context, token string, newSession Session) (Renewal, error)
+	RenewalTokensCount(ctx context.Context) (int, error)
+	RenewalTokensRm(ctx context.Context, accountID string) (int, error)
+	SessionCreate(ctx context.Context, session Session) (Session, error)
+	SessionRm(ctx context.Context, accountID string, sessionID string) error
+	SessionsGet(ctx context.Context, accountID string) ([]Session, error)
+}
+
+var (
+	_ Store = Db{}
+	_ Store = &Memory{}
+	_ Store = SQLite{}
+)
@@ -0,0 +1,983 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"gitea.larvit.se/pwrpln/go_log"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// storeSettings are the settings a Store under test is created with
+type storeSettings struct {
+	DeletedRetention   time.Duration
+	OldNameReservation time.Duration
+}
+
+var defaultStoreSettings = storeSettings{DeletedRetention: time.Hour, OldNameReservation: time.Hour}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T, settings storeSettings) Store {
+		return &Memory{DeletedRetention: settings.DeletedRetention, Log: testLog(), OldNameReservation: settings.OldNameReservation}
+	})
+}
+
+// TestAuditVerifyTampered changes the audit chain behind the back of the store, like somebody with access to the database could
+func TestAuditVerifyTampered(t *testing.T) {
+	ctx := context.Background()
+	secret := []byte("secret")
+
+	newChain := func(t *testing.T) *Memory {
+		store := &Memory{Log: testLog()}
+		for i := 0; i < 5; i++ {
+			_, err := store.AuditEventCreate(ctx, AuditEvent{Action: AuditAuthPassword, Outcome: AuditOutcomeDenied})
+			if err != nil {
+				t.Fatalf("AuditEventCreate failed: %v", err)
+			}
+			if i == 3 {
+				_, _, err = AuditSign(ctx, store, secret)
+				if err != nil {
+					t.Fatalf("AuditSign failed: %v", err)
+				}
+			}
+		}
+		return store
+	}
+
+	for name, test := range map[string]struct {
+		tamper        func(m *Memory)
+		brokenEventID int64
+		reason        string
+	}{
+		"changed event": {
+			tamper:        func(m *Memory) { m.auditEvents[1].Outcome = AuditOutcomeSuccess },
+			brokenEventID: 2,
+			reason:        "does not match its hash",
+		},
+		"changed event with a new hash": {
+			tamper: func(m *Memory) {
+				m.auditEvents[1].Outcome = AuditOutcomeSuccess
+				m.auditEvents[1].Hash = AuditEventHash(m.auditEvents[1].PrevHash, m.auditEvents[1])
+			},
+			brokenEventID: 3,
+			reason:        "previous hash does not match",
+		},
+		"removed event": {
+			tamper:        func(m *Memory) { m.auditEvents = append(m.auditEvents[:2], m.auditEvents[3:]...) },
+			brokenEventID: 4,
+			reason:        "previous hash does not match",
+		},
+		"removed first event": {
+			tamper:        func(m *Memory) { m.auditEvents = m.auditEvents[1:] },
+			brokenEventID: 2,
+			reason:        "events before it are missing",
+		},
+		"cut off end": {
+			tamper:        func(m *Memory) { m.auditEvents = m.auditEvents[:2] },
+			brokenEventID: 4,
+			reason:        "event is missing",
+		},
+		"removed hash": {
+			tamper:        func(m *Memory) { m.auditEvents[2].Hash = "" },
+			brokenEventID: 3,
+			reason:        "hash is missing",
+		},
+		"rewritten chain": {
+			tamper: func(m *Memory) {
+				prevHash := ""
+				for i := range m.auditEvents {
+					m.auditEvents[i].Outcome = AuditOutcomeSuccess
+					m.auditEvents[i].PrevHash = prevHash
+					m.auditEvents[i].Hash = AuditEventHash(prevHash, m.auditEvents[i])
+					prevHash = m.auditEvents[i].Hash
+				}
+			},
+			brokenEventID: 4,
+			reason:        "hash signed by checkpoint",
+		},
+		"forged checkpoint": {
+			tamper:        func(m *Memory) { m.auditCheckpoints[0].EventHash = m.auditEvents[0].Hash },
+			brokenEventID: 4,
+			reason:        "invalid signature",
+		},
+	} {
+		store := newChain(t)
+		test.tamper(store)
+
+		result, err := AuditVerify(ctx, store, [][]byte{secret})
+		if err != nil || result.BrokenEventID != test.brokenEventID || !strings.Contains(result.Broken, test.reason) {
+			t.Errorf("%s: expected chain to be broken at %d with %q, got %+v, %v", name, test.brokenEventID, test.reason, result, err)
+		}
+	}
+
+	result, err := AuditVerify(ctx, newChain(t), [][]byte{secret})
+	if err != nil || result.Broken != "" || result.Events != 5 || result.Checkpoints != 1 || result.Unsigned != 1 {
+		t.Fatalf("Expected an untouched chain to be intact, got %+v, %v", result, err)
+	}
+}
+
+// TestTracedStore runs the conformance tests through Traced, and checks that the spans do not get the arguments
+func TestTracedStore(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	testStore(t, func(t *testing.T, settings storeSettings) Store {
+		return Traced{
+			Store:  &Memory{DeletedRetention: settings.DeletedRetention, Log: testLog(), OldNameReservation: settings.OldNameReservation},
+			System: TracedSystemMemory,
+		}
+	})
+
+	spans := recorder.Ended()
+	if len(spans) == 0 {
+		t.Fatalf("Expected spans to be recorded")
+	}
+
+	notFound := 0
+	for _, span := range spans {
+		for _, attr := range span.Attributes() {
+			switch attr.Key {
+			case "db.system", "db.operation", "db.rows_affected":
+			case "error.type":
+				if attr.Value.AsString() != "unexpected" && span.Status().Code == codes.Error {
+					t.Errorf("Expected %q on span %s to not be marked as a failure", attr.Value.AsString(), span.Name())
+				}
+				if attr.Value.AsString() == ErrNotFound.Error() {
+					notFound++
+				}
+			default:
+				t.Errorf("Unexpected attribute %s on span %s", attr.Key, span.Name())
+			}
+		}
+	}
+	if notFound == 0 {
+		t.Errorf("Expected the not found errors of the conformance tests on the spans")
+	}
+}
+
+// TestPostgresStore runs against the database in TEST_DATABASE_URL after migrating it, it is skipped if that is not set
+func TestPostgresStore(t *testing.T) {
+	databaseURL := os.Getenv("TEST_DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	dbPool, err := pgxpool.Connect(context.Background(), databaseURL)
+	if err != nil {
+		t.Fatalf("Could not connect to TEST_DATABASE_URL: %v", err)
+	}
+	t.Cleanup(dbPool.Close)
+
+	_, err = Db{DbPool: dbPool, Log: testLog()}.MigrateUp(context.Background())
+	if err != nil {
+		t.Fatalf("Could not migrate TEST_DATABASE_URL: %v", err)
+	}
+
+	testStore(t, func(t *testing.T, settings storeSettings) Store {
+		return Db{DbPool: dbPool, DeletedRetention: settings.DeletedRetention, Log: testLog(), OldNameReservation: settings.OldNameReservation, QueryTimeout: 10 * time.Second}
+	})
+}
+
+// TestSQLiteStore runs against a new database file, migrated with the embedded migrations
+func TestSQLiteStore(t *testing.T) {
+	sqlDB, err := SQLiteOpen("sqlite:" + filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("Could not open SQLite database: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	_, err = SQLite{DB: sqlDB, Log: testLog()}.MigrateUp(context.Background())
+	if err != nil {
+		t.Fatalf("Could not migrate SQLite database: %v", err)
+	}
+
+	testStore(t, func(t *testing.T, settings storeSettings) Store {
+		return SQLite{DB: sqlDB, DeletedRetention: settings.DeletedRetention, Log: testLog(), OldNameReservation: settings.OldNameReservation, QueryTimeout: 10 * time.Second}
+	})
+}
+
+// TestSQLiteQueryTimeout checks that a statement that runs out of the query timeout fails with context.DeadlineExceeded
+func TestSQLiteQueryTimeout(t *testing.T) {
+	sqlDB, err := SQLiteOpen("sqlite:" + filepath.Join(t.TempDir(), "auth.db"))
+	if err != nil {
+		t.Fatalf("Could not open SQLite database: %v", err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	_, err = SQLite{DB: sqlDB, Log: testLog()}.MigrateUp(context.Background())
+	if err != nil {
+		t.Fatalf("Could not migrate SQLite database: %v", err)
+	}
+
+	store := SQLite{DB: sqlDB, Log: testLog(), QueryTimeout: time.Nanosecond}
+	_, err = store.AccountGet(context.Background(), uuid.NewString(), "", "")
+	expectErr(t, err, context.DeadlineExceeded)
+}
+
+func testLog() go_log.Log {
+	log := go_log.GetLog()
+	log.MinLogLvl = go_log.LogLvlFromStr("Error")
+	return log
+}
+
+// testName returns a name no other test run uses. Only lower case letters, so the sort order is the same everywhere.
+func testName(suffix string) string {
+	return "conformance-" + strings.ToLower(utils.RandString(10)) + "-" + suffix
+}
+
+func testAccountCreate(t *testing.T, store Store, name string, fields []AccountCreateInputFields) CreatedAccount {
+	t.Helper()
+
+	apiKeyHash := utils.HashAPIKey(utils.RandString(60))
+	createdAccount, err := store.AccountCreate(context.Background(), AccountCreateInput{
+		ID:         uuid.New(),
+		Name:       name,
+		APIKeyHash: apiKeyHash,
+		Fields:     fields,
+		Password:   "hashed",
+	})
+	if err != nil {
+		t.Fatalf("AccountCreate(%q) failed: %v", name, err)
+	}
+
+	// The stores only get the hash, the tests look accounts up by it
+	createdAccount.APIKey = apiKeyHash
+
+	return createdAccount
+}
+
+func testAccountGet(t *testing.T, store Store, accountID string) Account {
+	t.Helper()
+
+	account, err := store.AccountGet(context.Background(), accountID, "", "")
+	if err != nil {
+		t.Fatalf("AccountGet(%q) failed: %v", accountID, err)
+	}
+
+	return account
+}
+
+func expectErr(t *testing.T, err error, target error) {
+	t.Helper()
+
+	if !errors.Is(err, target) {
+		t.Fatalf("Expected error %q, got %v", target, err)
+	}
+}
+
+func expectValues(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("Expected values %q, got %q", want, got)
+	}
+}
+
+// testStore is the conformance suite all Store implementations must pass
+func testStore(t *testing.T, newStore func(t *testing.T, settings storeSettings) Store) {
+	ctx := context.Background()
+
+	t.Run("create and get", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		name := testName("a")
+
+		createdAccount := testAccountCreate(t, store, name, []AccountCreateInputFields{{Name: "role", Values: []string{"user"}}, {Name: "empty"}})
+
+		for _, get := range []func() (Account, error){
+			func() (Account, error) { return store.AccountGet(ctx, createdAccount.ID.String(), "", "") },
+			func() (Account, error) { return store.AccountGet(ctx, "", createdAccount.APIKey, "") },
+			func() (Account, error) { return store.AccountGet(ctx, "", "", name) },
+		} {
+			account, err := get()
+			if err != nil {
+				t.Fatalf("AccountGet failed: %v", err)
+			}
+			if account.ID != createdAccount.ID || account.Name != name || account.Password != "hashed" || account.Version != 1 {
+				t.Fatalf("Unexpected account: %+v", account)
+			}
+			expectValues(t, account.Fields["role"], "user")
+			if values, ok := account.Fields["empty"]; !ok || len(values) != 0 {
+				t.Fatalf("Expected the field \"empty\" with no values, got %q", values)
+			}
+		}
+
+		_, err := store.AccountGet(ctx, "", "", "")
+		expectErr(t, err, ErrNotFound)
+
+		_, err = store.AccountGet(ctx, uuid.NewString(), "", "")
+		expectErr(t, err, ErrNotFound)
+
+		generation, err := store.AccountTokenGeneration(ctx, createdAccount.ID.String())
+		if err != nil || generation != 0 {
+			t.Fatalf("AccountTokenGeneration() = %v, %v, expected 0", generation, err)
+		}
+
+		values, err := store.AccountFieldGet(ctx, createdAccount.ID.String(), "role")
+		if err != nil {
+			t.Fatalf("AccountFieldGet failed: %v", err)
+		}
+		expectValues(t, values, "user")
+
+		_, err = store.AccountFieldGet(ctx, createdAccount.ID.String(), "missing")
+		expectErr(t, err, ErrNotFound)
+	})
+
+	t.Run("create conflicts and validation", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		name := testName("a")
+		testAccountCreate(t, store, name, nil)
+
+		_, err := store.AccountCreate(ctx, AccountCreateInput{ID: uuid.New(), Name: name})
+		expectErr(t, err, ErrConflict)
+		var conflictErr ConflictError
+		if !errors.As(err, &conflictErr) || conflictErr.Field != "name" {
+			t.Fatalf("Expected a conflict on name, got %v", err)
+		}
+
+		_, err = store.AccountCreate(ctx, AccountCreateInput{ID: uuid.New(), Name: testName("b"), Fields: []AccountCreateInputFields{{Name: "x"}, {Name: "x"}}})
+		expectErr(t, err, ErrValidation)
+
+		_, err = store.AccountCreate(ctx, AccountCreateInput{ID: uuid.New(), Name: testName("c"), Fields: []AccountCreateInputFields{{Name: ""}}})
+		expectErr(t, err, ErrValidation)
+	})
+
+	t.Run("fields and versions", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		accountID := testAccountCreate(t, store, testName("a"), []AccountCreateInputFields{{Name: "role", Values: []string{"user"}}}).ID.String()
+
+		account, err := store.AccountUpdateFields(ctx, accountID, []AccountCreateInputFields{{Name: "color", Values: []string{"red", "blue"}}}, 1)
+		if err != nil {
+			t.Fatalf("AccountUpdateFields failed: %v", err)
+		}
+		if account.Version != 2 || account.Fields["role"] != nil {
+			t.Fatalf("Unexpected account after update: %+v", account)
+		}
+		expectValues(t, account.Fields["color"], "red", "blue")
+
+		_, err = store.AccountUpdateFields(ctx, accountID, nil, 1)
+		expectErr(t, err, ErrVersionMismatch)
+
+		account, err = store.AccountPatchFields(ctx, accountID, []AccountFieldsPatchOp{
+			{Op: AccountFieldsPatchOpAddValues, Name: "color", Values: []string{"blue", "green", "green"}},
+			{Op: AccountFieldsPatchOpRemoveValues, Name: "color", Values: []string{"red"}},
+			{Op: AccountFieldsPatchOpSet, Name: "size", Values: []string{"l", "l"}},
+			{Op: AccountFieldsPatchOpAddValues, Name: "tags", Values: []string{"a"}},
+		}, 2)
+		if err != nil {
+			t.Fatalf("AccountPatchFields failed: %v", err)
+		}
+		if account.Version != 3 {
+			t.Fatalf("Expected version 3, got %d", account.Version)
+		}
+		expectValues(t, account.Fields["color"], "blue", "green")
+		expectValues(t, account.Fields["size"], "l")
+		expectValues(t, account.Fields["tags"], "a")
+
+		// A failing operation must not leave the ones before it applied
+		_, err = store.AccountPatchFields(ctx, accountID, []AccountFieldsPatchOp{
+			{Op: AccountFieldsPatchOpRemove, Name: "size"},
+			{Op: AccountFieldsPatchOpRemove, Name: "missing"},
+		}, 0)
+		expectErr(t, err, ErrNotFound)
+
+		_, err = store.AccountPatchFields(ctx, accountID, []AccountFieldsPatchOp{{Op: "bogus", Name: "size"}}, 0)
+		expectErr(t, err, ErrValidation)
+
+		// Removing no values must be refused, not empty the field
+		_, err = store.AccountPatchFields(ctx, accountID, []AccountFieldsPatchOp{{Op: AccountFieldsPatchOpRemoveValues, Name: "color"}}, 0)
+		expectErr(t, err, ErrValidation)
+
+		_, err = store.AccountPatchFields(ctx, accountID, []AccountFieldsPatchOp{{Op: AccountFieldsPatchOpAddValues, Name: "color", Values: []string{}}}, 0)
+		expectErr(t, err, ErrValidation)
+
+		account = testAccountGet(t, store, accountID)
+		if account.Version != 3 {
+			t.Fatalf("Failed patches should not bump the version, got %d", account.Version)
+		}
+		expectValues(t, account.Fields["size"], "l")
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		oldName := testName("a")
+		newName := testName("b")
+		accountID := testAccountCreate(t, store, oldName, nil).ID.String()
+		otherAccountID := testAccountCreate(t, store, testName("c"), nil).ID.String()
+
+		account, err := store.AccountRename(ctx, accountID, newName, 1)
+		if err != nil {
+			t.Fatalf("AccountRename failed: %v", err)
+		}
+		if account.Name != newName || account.Version != 2 {
+			t.Fatalf("Unexpected account after rename: %+v", account)
+		}
+
+		_, err = store.AccountCreate(ctx, AccountCreateInput{ID: uuid.New(), Name: oldName})
+		expectErr(t, err, ErrConflict)
+
+		_, err = store.AccountRename(ctx, otherAccountID, oldName, 0)
+		expectErr(t, err, ErrConflict)
+
+		_, err = store.AccountRename(ctx, otherAccountID, newName, 0)
+		expectErr(t, err, ErrConflict)
+
+		account, err = store.AccountRename(ctx, accountID, oldName, 0)
+		if err != nil {
+			t.Fatalf("Taking back the old name failed: %v", err)
+		}
+		if account.Name != oldName {
+			t.Fatalf("Expected name %q, got %q", oldName, account.Name)
+		}
+	})
+
+	t.Run("delete, restore and purge", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		accountID := testAccountCreate(t, store, testName("a"), nil).ID.String()
+
+		// With a session, so purging has to remove it too
+		session, err := store.SessionCreate(ctx, Session{AccountID: uuid.MustParse(accountID), Method: SessionMethodPassword})
+		if err != nil {
+			t.Fatalf("SessionCreate failed: %v", err)
+		}
+		token, err := store.RenewalTokenCreate(ctx, accountID, session.ID.String())
+		if err != nil {
+			t.Fatalf("RenewalTokenCreate failed: %v", err)
+		}
+
+		expectErr(t, store.AccountDel(ctx, accountID, 5), ErrVersionMismatch)
+
+		err = store.AccountDel(ctx, accountID, 1)
+		if err != nil {
+			t.Fatalf("AccountDel failed: %v", err)
+		}
+
+		_, err = store.AccountGet(ctx, accountID, "", "")
+		expectErr(t, err, ErrNotFound)
+
+		_, err = store.RenewalTokenGet(ctx, token)
+		expectErr(t, err, ErrNotFound)
+
+		expectErr(t, store.AccountDel(ctx, accountID, 0), ErrNotFound)
+
+		_, err = store.AccountTokenGeneration(ctx, accountID)
+		expectErr(t, err, ErrNotFound)
+		_, err = store.AccountLogoutAll(ctx, accountID, 0)
+		expectErr(t, err, ErrNotFound)
+
+		account, err := store.AccountGetIncludingDeleted(ctx, accountID)
+		if err != nil || account.Deleted == nil {
+			t.Fatalf("AccountGetIncludingDeleted() = %+v, %v, expected a deleted account", account, err)
+		}
+
+		_, err = store.AccountsPurge(ctx)
+		if err != nil {
+			t.Fatalf("AccountsPurge failed: %v", err)
+		}
+
+		_, err = store.AccountRestore(ctx, accountID, account.Version-1)
+		expectErr(t, err, ErrVersionMismatch)
+
+		account, err = store.AccountRestore(ctx, accountID, account.Version)
+		if err != nil {
+			t.Fatalf("AccountRestore failed: %v", err)
+		}
+		if account.Deleted != nil || account.Version != 3 {
+			t.Fatalf("Unexpected account after restore: %+v", account)
+		}
+
+		_, err = store.AccountRestore(ctx, accountID, 0)
+		expectErr(t, err, ErrNotFound)
+
+		purgingStore := newStore(t, storeSettings{DeletedRetention: 0, OldNameReservation: time.Hour})
+		purgedAccountID := testAccountCreate(t, purgingStore, testName("b"), []AccountCreateInputFields{{Name: "role"}}).ID.String()
+		_, err = purgingStore.AccountRename(ctx, purgedAccountID, testName("c"), 0)
+		if err != nil {
+			t.Fatalf("AccountRename failed: %v", err)
+		}
+		if err := purgingStore.AccountDel(ctx, purgedAccountID, 0); err != nil {
+			t.Fatalf("AccountDel failed: %v", err)
+		}
+
+		purged, err := purgingStore.AccountsPurge(ctx)
+		if err != nil || purged < 1 {
+			t.Fatalf("AccountsPurge() = %d, %v, expected at least one purged account", purged, err)
+		}
+
+		_, err = purgingStore.AccountGetIncludingDeleted(ctx, purgedAccountID)
+		expectErr(t, err, ErrNotFound)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		prefix := testName("")
+		var accountIDs []string
+		for i, suffix := range []string{"d", "b", "e", "a", "c"} {
+			role := "user"
+			if i%2 == 0 {
+				role = "admin"
+			}
+			accountIDs = append(accountIDs, testAccountCreate(t, store, prefix+suffix, []AccountCreateInputFields{{Name: "role", Values: []string{role, "any"}}}).ID.String())
+		}
+		if err := store.AccountDel(ctx, accountIDs[4], 0); err != nil {
+			t.Fatalf("AccountDel failed: %v", err)
+		}
+
+		listAll := func(input AccountsGetInput) []string {
+			t.Helper()
+
+			var names []string
+			for page := 0; page < 10; page++ {
+				list, err := store.AccountsGet(ctx, input)
+				if err != nil {
+					t.Fatalf("AccountsGet failed: %v", err)
+				}
+				for _, account := range list.Accounts {
+					names = append(names, strings.TrimPrefix(account.Name, prefix))
+				}
+				if list.NextCursor == "" {
+					return names
+				}
+				input.Cursor = list.NextCursor
+			}
+
+			t.Fatalf("AccountsGet never stopped returning a next cursor")
+			return nil
+		}
+
+		if got := strings.Join(listAll(AccountsGetInput{Limit: 2, NamePrefix: prefix, SortBy: "name"}), ""); got != "abde" {
+			t.Fatalf("Expected names abde, got %s", got)
+		}
+		if got := strings.Join(listAll(AccountsGetInput{Limit: 3, NamePrefix: prefix, SortBy: "name", SortDesc: true, IncludeDeleted: true}), ""); got != "edcba" {
+			t.Fatalf("Expected names edcba, got %s", got)
+		}
+		if got := listAll(AccountsGetInput{Limit: 1, NamePrefix: prefix}); len(got) != 4 {
+			t.Fatalf("Expected 4 accounts sorted by created, got %v", got)
+		}
+		if got := strings.Join(listAll(AccountsGetInput{NamePrefix: prefix, SortBy: "name", FieldFilters: map[string][]string{"role": {"any", "admin"}}}), ""); got != "de" {
+			t.Fatalf("Expected names de, got %s", got)
+		}
+
+		list, err := store.AccountsGet(ctx, AccountsGetInput{Limit: 1, NamePrefix: prefix, WithTotal: true})
+		if err != nil {
+			t.Fatalf("AccountsGet failed: %v", err)
+		}
+		if list.Total == nil || *list.Total != 4 {
+			t.Fatalf("Expected a total of 4, got %v", list.Total)
+		}
+		expectValues(t, list.Accounts[0].Fields["role"], "admin", "any")
+
+		_, err = store.AccountsGet(ctx, AccountsGetInput{SortBy: "password"})
+		expectErr(t, err, ErrValidation)
+
+		_, err = store.AccountsGet(ctx, AccountsGetInput{SortBy: "created", Cursor: list.NextCursor, SortDesc: true})
+		expectErr(t, err, ErrValidation)
+	})
+
+	t.Run("renewal tokens", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		accountID := testAccountCreate(t, store, testName("a"), nil).ID.String()
+
+		countBefore, err := store.RenewalTokensCount(ctx)
+		if err != nil {
+			t.Fatalf("RenewalTokensCount failed: %v", err)
+		}
+
+		token, err := store.RenewalTokenCreate(ctx, accountID, "")
+		if err != nil {
+			t.Fatalf("RenewalTokenCreate failed: %v", err)
+		}
+
+		found, err := store.RenewalTokenGet(ctx, token)
+		if err != nil || found.AccountID != accountID || found.SessionID != "" {
+			t.Fatalf("RenewalTokenGet() = %+v, %v, expected %q without a session", found, err, accountID)
+		}
+
+		count, err := store.RenewalTokensCount(ctx)
+		if err != nil || count != countBefore+1 {
+			t.Fatalf("RenewalTokensCount() = %d, %v, expected %d", count, err, countBefore+1)
+		}
+
+		if err := store.RenewalTokenRm(ctx, token); err != nil {
+			t.Fatalf("RenewalTokenRm failed: %v", err)
+		}
+
+		_, err = store.RenewalTokenGet(ctx, token)
+		expectErr(t, err, ErrNotFound)
+		expectErr(t, store.RenewalTokenRm(ctx, token), ErrNotFound)
+	})
+
+	t.Run("using renewal tokens", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		account := testAccountCreate(t, store, testName("a"), nil)
+		accountID := account.ID.String()
+
+		// A token from before sessions were recorded starts the given session
+		token, err := store.RenewalTokenCreate(ctx, accountID, "")
+		if err != nil {
+			t.Fatalf("RenewalTokenCreate failed: %v", err)
+		}
+		renewal, err := store.RenewalTokenUse(ctx, token, Session{Method: SessionMethodRenew, IP: "10.0.0.2"})
+		if err != nil || renewal.AccountID != accountID || renewal.SessionID == "" || renewal.RenewalToken == "" || renewal.Generation != 0 {
+			t.Fatalf("RenewalTokenUse() = %+v, %v, expected a new token in a new session", renewal, err)
+		}
+		sessions, err := store.SessionsGet(ctx, accountID)
+		if err != nil || len(sessions) != 1 || sessions[0].ID.String() != renewal.SessionID || sessions[0].Method != SessionMethodRenew || sessions[0].IP != "10.0.0.2" || !sessions[0].Active {
+			t.Fatalf("Expected the started session, got %+v, %v", sessions, err)
+		}
+
+		// A token can only be used once, the new one stays in the session
+		_, err = store.RenewalTokenUse(ctx, token, Session{Method: SessionMethodRenew})
+		expectErr(t, err, ErrNotFound)
+		next, err := store.RenewalTokenUse(ctx, renewal.RenewalToken, Session{Method: SessionMethodRenew})
+		if err != nil || next.SessionID != renewal.SessionID || next.RenewalToken == renewal.RenewalToken {
+			t.Fatalf("RenewalTokenUse() = %+v, %v, expected a new token in session %s", next, err, renewal.SessionID)
+		}
+
+		// Logging out everywhere removes the token and bumps the generation new tokens get
+		if _, err := store.AccountLogoutAll(ctx, accountID, 0); err != nil {
+			t.Fatalf("AccountLogoutAll failed: %v", err)
+		}
+		_, err = store.RenewalTokenUse(ctx, next.RenewalToken, Session{Method: SessionMethodRenew})
+		expectErr(t, err, ErrNotFound)
+
+		token, err = store.RenewalTokenCreate(ctx, accountID, next.SessionID)
+		if err != nil {
+			t.Fatalf("RenewalTokenCreate failed: %v", err)
+		}
+		renewal, err = store.RenewalTokenUse(ctx, token, Session{Method: SessionMethodRenew})
+		if err != nil || renewal.Generation != 1 {
+			t.Fatalf("RenewalTokenUse() = %+v, %v, expected generation 1", renewal, err)
+		}
+
+		// Of renewals of the same token at the same time only one gets a new token
+		var wg sync.WaitGroup
+		results := make(chan error, 4)
+		for i := 0; i < cap(results); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := store.RenewalTokenUse(ctx, renewal.RenewalToken, Session{Method: SessionMethodRenew})
+				results <- err
+			}()
+		}
+		wg.Wait()
+		close(results)
+		renewed := 0
+		for err := range results {
+			if err == nil {
+				renewed++
+			} else if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("RenewalTokenUse failed: %v", err)
+			}
+		}
+		if renewed != 1 {
+			t.Fatalf("Expected one renewal of the token, got %d", renewed)
+		}
+
+		_, err = store.RenewalTokenUse(ctx, utils.RandString(60), Session{Method: SessionMethodRenew})
+		expectErr(t, err, ErrNotFound)
+	})
+
+	t.Run("sessions", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		account := testAccountCreate(t, store, testName("a"), nil)
+		accountID := account.ID.String()
+
+		first, err := store.SessionCreate(ctx, Session{AccountID: account.ID, Method: SessionMethodPassword, IP: "10.0.0.1", UserAgent: "curl/8.0"})
+		if err != nil || first.ID == uuid.Nil || first.Created.IsZero() || !first.Renewed.Equal(first.Created) {
+			t.Fatalf("Expected a session with an id and times, got %+v, %v", first, err)
+		}
+		firstToken, err := store.RenewalTokenCreate(ctx, accountID, first.ID.String())
+		if err != nil {
+			t.Fatalf("RenewalTokenCreate failed: %v", err)
+		}
+		found, err := store.RenewalTokenGet(ctx, firstToken)
+		if err != nil || found.AccountID != accountID || found.SessionID != first.ID.String() {
+			t.Fatalf("RenewalTokenGet() = %+v, %v, expected session %s", found, err, first.ID)
+		}
+
+		time.Sleep(2 * time.Millisecond) // So the sessions are ordered by their time
+		second, err := store.SessionCreate(ctx, Session{AccountID: account.ID, Method: SessionMethodAPIKey})
+		if err != nil {
+			t.Fatalf("SessionCreate failed: %v", err)
+		}
+		if _, err := store.RenewalTokenCreate(ctx, accountID, second.ID.String()); err != nil {
+			t.Fatalf("RenewalTokenCreate failed: %v", err)
+		}
+
+		time.Sleep(2 * time.Millisecond)
+		renewal, err := store.RenewalTokenUse(ctx, firstToken, Session{Method: SessionMethodRenew})
+		if err != nil || renewal.SessionID != first.ID.String() {
+			t.Fatalf("RenewalTokenUse() = %+v, %v, expected session %s", renewal, err, first.ID)
+		}
+
+		// Revoking removes the renewal tokens, the session is kept as history
+		expectErr(t, store.SessionRm(ctx, uuid.NewString(), first.ID.String()), ErrNotFound)
+		if err := store.SessionRm(ctx, accountID, first.ID.String()); err != nil {
+			t.Fatalf("SessionRm failed: %v", err)
+		}
+		_, err = store.RenewalTokenUse(ctx, renewal.RenewalToken, Session{Method: SessionMethodRenew})
+		expectErr(t, err, ErrNotFound)
+
+		sessions, err := store.SessionsGet(ctx, accountID)
+		if err != nil || len(sessions) != 2 {
+			t.Fatalf("Expected two sessions, got %+v, %v", sessions, err)
+		}
+		if sessions[0].ID != second.ID || !sessions[0].Active || sessions[0].Method != SessionMethodAPIKey {
+			t.Fatalf("Expected the second session first and active, got %+v", sessions[0])
+		}
+		if sessions[1].ID != first.ID || sessions[1].Active || sessions[1].IP != "10.0.0.1" || sessions[1].UserAgent != "curl/8.0" || !sessions[1].Renewed.After(first.Created) {
+			t.Fatalf("Expected the first session revoked and renewed, got %+v", sessions[1])
+		}
+
+		// Revoking all renewal tokens ends all sessions
+		if _, err := store.RenewalTokensRm(ctx, accountID); err != nil {
+			t.Fatalf("RenewalTokensRm failed: %v", err)
+		}
+		sessions, err = store.SessionsGet(ctx, accountID)
+		if err != nil || len(sessions) != 2 || sessions[0].Active {
+			t.Fatalf("Expected no active sessions, got %+v, %v", sessions, err)
+		}
+
+		_, err = store.SessionCreate(ctx, Session{AccountID: uuid.New(), Method: SessionMethodPassword})
+		expectErr(t, err, ErrNotFound)
+	})
+
+	t.Run("logout everywhere", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		account := testAccountCreate(t, store, testName("a"), nil)
+		accountID := account.ID.String()
+		other := testAccountCreate(t, store, testName("b"), nil)
+
+		for _, id := range []string{accountID, accountID, other.ID.String()} {
+			if _, err := store.RenewalTokenCreate(ctx, id, ""); err != nil {
+				t.Fatalf("RenewalTokenCreate failed: %v", err)
+			}
+		}
+
+		current, err := store.AccountGet(ctx, accountID, "", "")
+		if err != nil {
+			t.Fatalf("AccountGet failed: %v", err)
+		}
+		removed, err := store.AccountLogoutAll(ctx, accountID, current.Version)
+		if err != nil || removed != 2 {
+			t.Fatalf("AccountLogoutAll() = %d, %v, expected 2", removed, err)
+		}
+		generation, err := store.AccountTokenGeneration(ctx, accountID)
+		if err != nil || generation != 1 {
+			t.Fatalf("AccountTokenGeneration() = %d, %v, expected 1", generation, err)
+		}
+
+		// It is a change of the account, so the version is bumped and a stale version is refused
+		got, err := store.AccountGet(ctx, accountID, "", "")
+		if err != nil || got.Version != current.Version+1 {
+			t.Fatalf("Expected version %d after AccountLogoutAll, got %+v, %v", current.Version+1, got, err)
+		}
+		_, err = store.AccountLogoutAll(ctx, accountID, current.Version)
+		expectErr(t, err, ErrVersionMismatch)
+
+		// Only the given account is logged out
+		generation, err = store.AccountTokenGeneration(ctx, other.ID.String())
+		if err != nil || generation != 0 {
+			t.Fatalf("AccountTokenGeneration() = %d, %v, expected 0 for the other account", generation, err)
+		}
+		if count, err := store.RenewalTokensRm(ctx, other.ID.String()); err != nil || count != 1 {
+			t.Fatalf("Expected the other account to keep its renewal token, got %d, %v", count, err)
+		}
+
+		removed, err = store.AccountLogoutAll(ctx, accountID, 0)
+		if err != nil || removed != 0 {
+			t.Fatalf("AccountLogoutAll() = %d, %v, expected 0", removed, err)
+		}
+		generation, err = store.AccountTokenGeneration(ctx, accountID)
+		if err != nil || generation != 2 {
+			t.Fatalf("AccountTokenGeneration() = %d, %v, expected 2", generation, err)
+		}
+
+		_, err = store.AccountTokenGeneration(ctx, uuid.NewString())
+		expectErr(t, err, ErrNotFound)
+		_, err = store.AccountLogoutAll(ctx, uuid.NewString(), 0)
+		expectErr(t, err, ErrNotFound)
+	})
+
+	t.Run("audit events", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		// Fresh ids, so events left in the database by earlier runs are filtered out
+		actorID := uuid.NewString()
+		targetID := uuid.NewString()
+
+		var created []AuditEvent
+		for _, event := range []AuditEvent{
+			{Action: AuditAuthPassword, ActorID: strings.ToUpper(actorID), TargetID: actorID, IP: "10.0.0.1", Outcome: AuditOutcomeSuccess, Diff: []byte(`{"name": "a"}`)},
+			{Action: AuditFieldsUpdate, ActorID: actorID, TargetID: targetID, Outcome: AuditOutcomeDenied, UserAgent: "curl/8.0"},
+			{Action: AuditAccountDelete, ActorID: actorID, TargetID: targetID, Outcome: AuditOutcomeSuccess},
+		} {
+			createdEvent, err := store.AuditEventCreate(ctx, event)
+			if err != nil {
+				t.Fatalf("AuditEventCreate failed: %v", err)
+			}
+			if len(created) != 0 && createdEvent.ID <= created[len(created)-1].ID {
+				t.Fatalf("Expected ids to increase, got %d after %d", createdEvent.ID, created[len(created)-1].ID)
+			}
+			created = append(created, createdEvent)
+		}
+		if created[0].ActorID != actorID || created[0].Created.IsZero() {
+			t.Fatalf("Expected the actor id to be normalized and the time to be set, got %+v", created[0])
+		}
+
+		page, err := store.AuditEventsGet(ctx, AuditEventsGetInput{AccountID: actorID, Limit: 2})
+		if err != nil || len(page.Events) != 2 || page.Events[0].ID != created[2].ID || page.Events[1].ID != created[1].ID || page.NextCursor == "" {
+			t.Fatalf("Expected the two newest events and a cursor, got %+v, %v", page, err)
+		}
+		page, err = store.AuditEventsGet(ctx, AuditEventsGetInput{AccountID: actorID, Limit: 2, Cursor: page.NextCursor})
+		if err != nil || len(page.Events) != 1 || page.NextCursor != "" {
+			t.Fatalf("Expected the last event and no cursor, got %+v, %v", page, err)
+		}
+		first := page.Events[0]
+		if first.ID != created[0].ID || string(first.Diff) != `{"name": "a"}` || first.IP != "10.0.0.1" || first.TargetID != actorID || !first.Created.Equal(created[0].Created) {
+			t.Fatalf("Expected the first event as it was written, got %+v", first)
+		}
+
+		for name, test := range map[string]struct {
+			input    AuditEventsGetInput
+			expected int
+		}{
+			"action and outcome": {AuditEventsGetInput{ActorID: actorID, Action: AuditFieldsUpdate, Outcome: AuditOutcomeDenied}, 1},
+			"target":             {AuditEventsGetInput{TargetID: targetID}, 2},
+			"since":              {AuditEventsGetInput{ActorID: actorID, Since: time.Now().Add(time.Hour)}, 0},
+			"until":              {AuditEventsGetInput{ActorID: actorID, Until: time.Now().Add(time.Hour)}, 3},
+		} {
+			list, err := store.AuditEventsGet(ctx, test.input)
+			if err != nil || len(list.Events) != test.expected {
+				t.Errorf("%s: expected %d events, got %+v, %v", name, test.expected, list, err)
+			}
+		}
+
+		_, err = store.AuditEventCreate(ctx, AuditEvent{Outcome: AuditOutcomeSuccess})
+		expectErr(t, err, ErrValidation)
+		_, err = store.AuditEventCreate(ctx, AuditEvent{Action: AuditAccountCreate, ActorID: "x", Outcome: AuditOutcomeSuccess})
+		expectErr(t, err, ErrValidation)
+		_, err = store.AuditEventsGet(ctx, AuditEventsGetInput{Cursor: "x"})
+		expectErr(t, err, ErrValidation)
+		_, err = store.AuditEventsGet(ctx, AuditEventsGetInput{TargetID: "x"})
+		expectErr(t, err, ErrValidation)
+	})
+
+	t.Run("audit chain", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		secret := []byte("first-secret")
+
+		var last AuditEvent
+		for i := 0; i < 3; i++ {
+			event, err := store.AuditEventCreate(ctx, AuditEvent{Action: AuditAuthAPIKey, TargetID: uuid.NewString(), Outcome: AuditOutcomeDenied, Diff: []byte(`{"b": 1, "a": [2]}`)})
+			if err != nil {
+				t.Fatalf("AuditEventCreate failed: %v", err)
+			}
+			if event.Hash != AuditEventHash(event.PrevHash, event) || (last.ID != 0 && event.PrevHash != last.Hash) {
+				t.Fatalf("Expected event to be chained to %+v, got %+v", last, event)
+			}
+			last = event
+		}
+
+		checkpoint, signed, err := AuditSign(ctx, store, secret)
+		if err != nil || !signed || checkpoint.EventID != last.ID || checkpoint.EventHash != last.Hash || checkpoint.ID == 0 {
+			t.Fatalf("Expected a checkpoint of the last event, got %+v, %v, %v", checkpoint, signed, err)
+		}
+		_, signed, err = AuditSign(ctx, store, secret)
+		if err != nil || signed {
+			t.Fatalf("Expected no new checkpoint without new events, got %v, %v", signed, err)
+		}
+
+		// One more event after the checkpoint, the hashes must survive the round trip through the database
+		_, err = store.AuditEventCreate(ctx, AuditEvent{Action: AuditAccountCreate, IP: "::1", Outcome: AuditOutcomeSuccess})
+		if err != nil {
+			t.Fatalf("AuditEventCreate failed: %v", err)
+		}
+		result, err := AuditVerify(ctx, store, [][]byte{[]byte("second-secret"), secret})
+		if err != nil || result.Broken != "" || result.Events < 4 || result.Checkpoints < 1 || result.Unsigned != 1 {
+			t.Fatalf("Expected an intact chain with one unsigned event, got %+v, %v", result, err)
+		}
+
+		result, err = AuditVerify(ctx, store, [][]byte{[]byte("second-secret")})
+		if err != nil || result.BrokenEventID != checkpoint.EventID || !strings.Contains(result.Broken, "was not given") {
+			t.Fatalf("Expected the checkpoint to fail without its key, got %+v, %v", result, err)
+		}
+	})
+
+	t.Run("credentials and revoking renewal tokens", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		createdAccount := testAccountCreate(t, store, testName("a"), nil)
+		accountID := createdAccount.ID.String()
+
+		account, err := store.AccountGet(ctx, accountID, "", "")
+		if err != nil || account.APIKeyHash != createdAccount.APIKey || account.Password != "hashed" {
+			t.Fatalf("Expected AccountGet to include the API key and password, got %+v, %v", account, err)
+		}
+
+		newAPIKeyHash := utils.HashAPIKey(utils.RandString(60))
+		if err := store.AccountAPIKeySet(ctx, accountID, newAPIKeyHash); err != nil {
+			t.Fatalf("AccountAPIKeySet failed: %v", err)
+		}
+		if err := store.AccountPasswordSet(ctx, accountID, "rehashed"); err != nil {
+			t.Fatalf("AccountPasswordSet failed: %v", err)
+		}
+
+		_, err = store.AccountGet(ctx, "", createdAccount.APIKey, "")
+		expectErr(t, err, ErrNotFound)
+
+		account, err = store.AccountGet(ctx, "", newAPIKeyHash, "")
+		if err != nil || account.ID != createdAccount.ID || account.Password != "rehashed" || account.Version != 3 {
+			t.Fatalf("Expected the new API key and password with version 3, got %+v, %v", account, err)
+		}
+
+		for i := 0; i < 2; i++ {
+			if _, err := store.RenewalTokenCreate(ctx, accountID, ""); err != nil {
+				t.Fatalf("RenewalTokenCreate failed: %v", err)
+			}
+		}
+		removed, err := store.RenewalTokensRm(ctx, accountID)
+		if err != nil || removed != 2 {
+			t.Fatalf("RenewalTokensRm() = %d, %v, expected 2", removed, err)
+		}
+
+		err = store.AccountPasswordSet(ctx, uuid.New().String(), "hashed")
+		expectErr(t, err, ErrNotFound)
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := store.AccountGet(canceledCtx, uuid.NewString(), "", "")
+		expectErr(t, err, context.Canceled)
+
+		_, err = store.AccountCreate(canceledCtx, AccountCreateInput{ID: uuid.New(), Name: testName("a")})
+		expectErr(t, err, context.Canceled)
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		store := newStore(t, defaultStoreSettings)
+		canceledCtx, cancel := context.WithCancel(ctx)
+		cancel()
+
+		if err := store.Ping(ctx); err != nil {
+			t.Fatalf("Ping failed: %v", err)
+		}
+		if err := store.Ping(canceledCtx); err == nil {
+			t.Fatalf("Expected Ping with a canceled context to fail")
+		}
+	})
+}
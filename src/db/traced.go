@@ -0,0 +1,277 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Database systems for Traced.System, as named by the OpenTelemetry conventions
+var (
+	TracedSystemMemory     = semconv.DBSystemKey.String("memory")
+	TracedSystemPostgreSQL = semconv.DBSystemPostgreSQL
+	TracedSystemSQLite     = semconv.DBSystemSqlite
+)
+
+// Traced is a Store that wraps each call of another Store in a span
+// Spans get the method and the kind of SQL statement it runs, never the arguments, they can be API key hashes, passwords or renewal tokens.
+type Traced struct {
+	Store
+	System attribute.KeyValue // Like TracedSystemPostgreSQL
+}
+
+var _ Store = Traced{}
+
+// Unwrap returns the wrapped Store, to get to the interfaces it implements besides Store, like Migrator
+func (t Traced) Unwrap() Store {
+	return t.Store
+}
+
+func (t Traced) start(ctx context.Context, method string, operation string) (context.Context, trace.Span) {
+	return tracing.Tracer.Start(ctx, "db."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(t.System, semconv.DBOperation(operation)),
+	)
+}
+
+// tracedEnd ends the span, errors the callers expect, like ErrNotFound for a wrong account name, are not marked as failures
+func tracedEnd(span trace.Span, err error) {
+	if err != nil {
+		errorType := tracedErrorType(err)
+		span.SetAttributes(attribute.String("error.type", errorType))
+		if errorType == "unexpected" {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "database call failed")
+		}
+	}
+
+	span.End()
+}
+
+func tracedErrorType(err error) string {
+	for _, expected := range []error{ErrConflict, ErrNotFound, ErrSchemaMismatch, ErrValidation, ErrVersionMismatch} {
+		if errors.Is(err, expected) {
+			return expected.Error()
+		}
+	}
+
+	return "unexpected"
+}
+
+func (t Traced) AccountAPIKeySet(ctx context.Context, accountID string, APIKeyHash string) error {
+	ctx, span := t.start(ctx, "AccountAPIKeySet", "UPDATE")
+	err := t.Store.AccountAPIKeySet(ctx, accountID, APIKeyHash)
+	tracedEnd(span, err)
+	return err
+}
+
+func (t Traced) AccountCreate(ctx context.Context, input AccountCreateInput) (CreatedAccount, error) {
+	ctx, span := t.start(ctx, "AccountCreate", "INSERT")
+	createdAccount, err := t.Store.AccountCreate(ctx, input)
+	tracedEnd(span, err)
+	return createdAccount, err
+}
+
+func (t Traced) AccountDel(ctx context.Context, accountID string, ifVersion int64) error {
+	ctx, span := t.start(ctx, "AccountDel", "UPDATE")
+	err := t.Store.AccountDel(ctx, accountID, ifVersion)
+	tracedEnd(span, err)
+	return err
+}
+
+func (t Traced) AccountFieldGet(ctx context.Context, accountID string, fieldName string) ([]string, error) {
+	ctx, span := t.start(ctx, "AccountFieldGet", "SELECT")
+	values, err := t.Store.AccountFieldGet(ctx, accountID, fieldName)
+	tracedEnd(span, err)
+	return values, err
+}
+
+func (t Traced) AccountGet(ctx context.Context, accountID string, APIKeyHash string, name string) (Account, error) {
+	ctx, span := t.start(ctx, "AccountGet", "SELECT")
+	account, err := t.Store.AccountGet(ctx, accountID, APIKeyHash, name)
+	tracedEnd(span, err)
+	return account, err
+}
+
+func (t Traced) AccountGetIncludingDeleted(ctx context.Context, accountID string) (Account, error) {
+	ctx, span := t.start(ctx, "AccountGetIncludingDeleted", "SELECT")
+	account, err := t.Store.AccountGetIncludingDeleted(ctx, accountID)
+	tracedEnd(span, err)
+	return account, err
+}
+
+func (t Traced) AccountLogoutAll(ctx context.Context, accountID string, ifVersion int64) (int, error) {
+	ctx, span := t.start(ctx, "AccountLogoutAll", "UPDATE")
+	removed, err := t.Store.AccountLogoutAll(ctx, accountID, ifVersion)
+	span.SetAttributes(attribute.Int("db.rows_affected", removed))
+	tracedEnd(span, err)
+	return removed, err
+}
+
+func (t Traced) AccountPasswordSet(ctx context.Context, accountID string, password string) error {
+	ctx, span := t.start(ctx, "AccountPasswordSet", "UPDATE")
+	err := t.Store.AccountPasswordSet(ctx, accountID, password)
+	tracedEnd(span, err)
+	return err
+}
+
+func (t Traced) AccountPatchFields(ctx context.Context, accountID string, ops []AccountFieldsPatchOp, ifVersion int64) (Account, error) {
+	ctx, span := t.start(ctx, "AccountPatchFields", "UPDATE")
+	account, err := t.Store.AccountPatchFields(ctx, accountID, ops, ifVersion)
+	tracedEnd(span, err)
+	return account, err
+}
+
+func (t Traced) AccountRename(ctx context.Context, accountID string, newName string, ifVersion int64) (Account, error) {
+	ctx, span := t.start(ctx, "AccountRename", "UPDATE")
+	account, err := t.Store.AccountRename(ctx, accountID, newName, ifVersion)
+	tracedEnd(span, err)
+	return account, err
+}
+
+func (t Traced) AccountRestore(ctx context.Context, accountID string, ifVersion int64) (Account, error) {
+	ctx, span := t.start(ctx, "AccountRestore", "UPDATE")
+	account, err := t.Store.AccountRestore(ctx, accountID, ifVersion)
+	tracedEnd(span, err)
+	return account, err
+}
+
+func (t Traced) AccountTokenGeneration(ctx context.Context, accountID string) (int64, error) {
+	ctx, span := t.start(ctx, "AccountTokenGeneration", "SELECT")
+	generation, err := t.Store.AccountTokenGeneration(ctx, accountID)
+	tracedEnd(span, err)
+	return generation, err
+}
+
+func (t Traced) AccountUpdateFields(ctx context.Context, accountID string, fields []AccountCreateInputFields, ifVersion int64) (Account, error) {
+	ctx, span := t.start(ctx, "AccountUpdateFields", "UPDATE")
+	account, err := t.Store.AccountUpdateFields(ctx, accountID, fields, ifVersion)
+	tracedEnd(span, err)
+	return account, err
+}
+
+func (t Traced) AccountsGet(ctx context.Context, input AccountsGetInput) (AccountsList, error) {
+	ctx, span := t.start(ctx, "AccountsGet", "SELECT")
+	accounts, err := t.Store.AccountsGet(ctx, input)
+	tracedEnd(span, err)
+	return accounts, err
+}
+
+func (t Traced) AccountsPurge(ctx context.Context) (int, error) {
+	ctx, span := t.start(ctx, "AccountsPurge", "DELETE")
+	purged, err := t.Store.AccountsPurge(ctx)
+	span.SetAttributes(attribute.Int("db.rows_affected", purged))
+	tracedEnd(span, err)
+	return purged, err
+}
+
+func (t Traced) AuditChainGet(ctx context.Context, afterID int64, limit int) ([]AuditEvent, error) {
+	ctx, span := t.start(ctx, "AuditChainGet", "SELECT")
+	events, err := t.Store.AuditChainGet(ctx, afterID, limit)
+	tracedEnd(span, err)
+	return events, err
+}
+
+func (t Traced) AuditCheckpointCreate(ctx context.Context, checkpoint AuditCheckpoint) (AuditCheckpoint, error) {
+	ctx, span := t.start(ctx, "AuditCheckpointCreate", "INSERT")
+	createdCheckpoint, err := t.Store.AuditCheckpointCreate(ctx, checkpoint)
+	tracedEnd(span, err)
+	return createdCheckpoint, err
+}
+
+func (t Traced) AuditCheckpointsGet(ctx context.Context) ([]AuditCheckpoint, error) {
+	ctx, span := t.start(ctx, "AuditCheckpointsGet", "SELECT")
+	checkpoints, err := t.Store.AuditCheckpointsGet(ctx)
+	tracedEnd(span, err)
+	return checkpoints, err
+}
+
+func (t Traced) AuditEventCreate(ctx context.Context, event AuditEvent) (AuditEvent, error) {
+	ctx, span := t.start(ctx, "AuditEventCreate", "INSERT")
+	createdEvent, err := t.Store.AuditEventCreate(ctx, event)
+	tracedEnd(span, err)
+	return createdEvent, err
+}
+
+func (t Traced) AuditEventsGet(ctx context.Context, input AuditEventsGetInput) (AuditEventsList, error) {
+	ctx, span := t.start(ctx, "AuditEventsGet", "SELECT")
+	events, err := t.Store.AuditEventsGet(ctx, input)
+	tracedEnd(span, err)
+	return events, err
+}
+
+func (t Traced) Ping(ctx context.Context) error {
+	ctx, span := t.start(ctx, "Ping", "SELECT")
+	err := t.Store.Ping(ctx)
+	tracedEnd(span, err)
+	return err
+}
+
+func (t Traced) RenewalTokenCreate(ctx context.Context, accountID string, sessionID string) (string, error) {
+	ctx, span := t.start(ctx, "RenewalTokenCreate", "INSERT")
+	token, err := t.Store.RenewalTokenCreate(ctx, accountID, sessionID)
+	tracedEnd(span, err)
+	return token, err
+}
+
+func (t Traced) RenewalTokenGet(ctx context.Context, token string) (RenewalToken, error) {
+	ctx, span := t.start(ctx, "RenewalTokenGet", "SELECT")
+	renewalToken, err := t.Store.RenewalTokenGet(ctx, token)
+	tracedEnd(span, err)
+	return renewalToken, err
+}
+
+func (t Traced) RenewalTokenRm(ctx context.Context, token string) error {
+	ctx, span := t.start(ctx, "RenewalTokenRm", "DELETE")
+	err := t.Store.RenewalTokenRm(ctx, token)
+	tracedEnd(span, err)
+	return err
+}
+
+func (t Traced) RenewalTokenUse(ctx context.Context, token string, newSession Session) (Renewal, error) {
+	ctx, span := t.start(ctx, "RenewalTokenUse", "DELETE")
+	renewal, err := t.Store.RenewalTokenUse(ctx, token, newSession)
+	tracedEnd(span, err)
+	return renewal, err
+}
+
+func (t Traced) RenewalTokensCount(ctx context.Context) (int, error) {
+	ctx, span := t.start(ctx, "RenewalTokensCount", "SELECT")
+	count, err := t.Store.RenewalTokensCount(ctx)
+	tracedEnd(span, err)
+	return count, err
+}
+
+func (t Traced) RenewalTokensRm(ctx context.Context, accountID string) (int, error) {
+	ctx, span := t.start(ctx, "RenewalTokensRm", "DELETE")
+	removed, err := t.Store.RenewalTokensRm(ctx, accountID)
+	span.SetAttributes(attribute.Int("db.rows_affected", removed))
+	tracedEnd(span, err)
+	return removed, err
+}
+
+func (t Traced) SessionCreate(ctx context.Context, session Session) (Session, error) {
+	ctx, span := t.start(ctx, "SessionCreate", "INSERT")
+	createdSession, err := t.Store.SessionCreate(ctx, session)
+	tracedEnd(span, err)
+	return createdSession, err
+}
+
+func (t Traced) SessionRm(ctx context.Context, accountID string, sessionID string) error {
+	ctx, span := t.start(ctx, "SessionRm", "DELETE")
+	err := t.Store.SessionRm(ctx, accountID, sessionID)
+	tracedEnd(span, err)
+	return err
+}
+
+func (t Traced) SessionsGet(ctx context.Context, accountID string) ([]Session, error) {
+	ctx, span := t.start(ctx, "SessionsGet", "SELECT")
+	sessions, err := t.Store.SessionsGet(ctx, accountID)
+	tracedEnd(span, err)
+	return sessions, err
+}
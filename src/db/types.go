@@ -1,6 +1,7 @@
 package db
 
 import (
+	"encoding/json"
 	"time"
 
 	"gitea.larvit.se/pwrpln/go_log"
@@ -10,18 +11,21 @@ import (
 
 // Account is an account as represented in the database
 type Account struct {
-	ID       uuid.UUID           `json:"id"`
-	Created  time.Time           `json:"created"`
-	Fields   map[string][]string `json:"fields"`
-	Name     string              `json:"name"`
-	Password string              `json:"-"`
+	APIKeyHash string              `json:"-"` // Like Password, only set when getting a single account
+	ID         uuid.UUID           `json:"id"`
+	Created    time.Time           `json:"created"`
+	Deleted    *time.Time          `json:"deleted,omitempty"`
+	Fields     map[string][]string `json:"fields"`
+	Name       string              `json:"name"`
+	Password   string              `json:"-"`
+	Version    int64               `json:"version"` // Bumped on every change, used as ETag
 }
 
 // CreatedAccount is a newly created account in the system
 type CreatedAccount struct {
 	ID     uuid.UUID `json:"id"`
 	Name   string    `json:"name"`
-	APIKey string    `json:"apiKey"`
+	APIKey string    `json:"apiKey"` // Only the hash is stored, so this is set by the caller that generated the key
 }
 
 // AccountCreateInputFields yes
@@ -32,15 +36,164 @@ type AccountCreateInputFields struct {
 
 // AccountCreateInput is used as input struct for database creation of account
 type AccountCreateInput struct {
-	ID       uuid.UUID
-	Name     string
-	APIKey   string
-	Fields   []AccountCreateInputFields
-	Password string
+	ID         uuid.UUID
+	Name       string
+	APIKeyHash string // See utils.HashAPIKey(), empty means the account can not auth by API key
+	Fields     []AccountCreateInputFields
+	Password   string
+}
+
+// Operations that can be used when patching account fields
+const (
+	AccountFieldsPatchOpSet          = "set"          // Set the field to exactly the given values
+	AccountFieldsPatchOpRemove       = "remove"       // Remove the field completely, fails if it does not exist
+	AccountFieldsPatchOpAddValues    = "addValues"    // Add the given values to the field, creating it if needed
+	AccountFieldsPatchOpRemoveValues = "removeValues" // Remove the given values from the field, fails if it does not exist
+)
+
+// AccountFieldsPatchOp is one operation in a patch of account fields
+type AccountFieldsPatchOp struct {
+	Op     string   `json:"op"`
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// AccountsDefaultLimit is the page size used when listing accounts without a limit
+const AccountsDefaultLimit = 50
+
+// AccountsGetInput is used as input struct for listing accounts
+type AccountsGetInput struct {
+	Cursor         string
+	FieldFilters   map[string][]string // Only include accounts that have all these values in the given fields
+	IncludeDeleted bool
+	Limit          int
+	NamePrefix     string
+	SortBy         string // "created" or "name"
+	SortDesc       bool
+	WithTotal      bool
+}
+
+// AccountsList is a page of accounts
+type AccountsList struct {
+	Accounts   []Account `json:"accounts"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+	Total      *int      `json:"total,omitempty"`
+}
+
+// Actions of audit events
+const (
+	AuditAccountCreate  = "account.create"
+	AuditAccountDelete  = "account.delete"
+	AuditAccountRename  = "account.rename"
+	AuditAccountRestore = "account.restore"
+	AuditAPIKeySet      = "apiKey.set"
+	AuditAuthAPIKey     = "auth.apiKey"
+	AuditAuthPassword   = "auth.password"
+	AuditAuthLogout     = "auth.logout"
+	AuditAuthLogoutAll  = "auth.logoutAll"
+	AuditFieldsUpdate   = "fields.update"
+	AuditPasswordSet    = "password.set"
+	AuditSessionRevoke  = "session.revoke"
+	AuditTokenRenew     = "token.renew"
+	AuditTokensRevoke   = "tokens.revoke"
+)
+
+// Outcomes of audit events
+const (
+	AuditOutcomeDenied  = "denied"  // Wrong credentials or missing role
+	AuditOutcomeError   = "error"   // Failed on the server side, like a database error
+	AuditOutcomeInvalid = "invalid" // Rejected input, like a malformed body or an account that does not exist
+	AuditOutcomeSuccess = "success"
+)
+
+// AuditEvent is a security relevant event, like an auth attempt or a change to an account
+type AuditEvent struct {
+	ID        int64           `json:"id"` // Set by the store, increases with every event
+	Action    string          `json:"action"`
+	ActorID   string          `json:"actorId,omitempty"`                   // Account that did it, empty for anonymous requests, the command line and startup
+	Created   time.Time       `json:"created"`                             // Set by the store
+	Diff      json.RawMessage `json:"diff,omitempty" swaggertype:"object"` // What was asked for, never with passwords, API keys or tokens
+	Hash      string          `json:"hash,omitempty"`                      // Set by the store, see AuditEventHash(), empty for events written before the chain started
+	IP        string          `json:"ip,omitempty"`
+	Outcome   string          `json:"outcome"`
+	PrevHash  string          `json:"prevHash,omitempty"` // Set by the store, the hash of the event before, empty for the first one
+	TargetID  string          `json:"targetId,omitempty"` // Account it was done to
+	UserAgent string          `json:"userAgent,omitempty"`
+}
+
+// AuditEventsDefaultLimit is the page size used when listing audit events without a limit
+const AuditEventsDefaultLimit = 50
+
+// AuditEventsGetInput is used as input struct for listing audit events, empty filters match all events
+type AuditEventsGetInput struct {
+	AccountID string // Events where the account is the actor or the target
+	Action    string
+	ActorID   string
+	Cursor    string
+	Limit     int
+	Outcome   string
+	Since     time.Time // Events created at or after this
+	TargetID  string
+	Until     time.Time // Events created before this
+}
+
+// AuditEventsList is a page of audit events, newest first
+type AuditEventsList struct {
+	Events     []AuditEvent `json:"events"`
+	NextCursor string       `json:"nextCursor,omitempty"`
 }
 
 // Db struct
 type Db struct {
-	DbPool *pgxpool.Pool
-	Log    go_log.Log
+	DbPool             *pgxpool.Pool
+	DeletedRetention   time.Duration // How long deleted accounts can be restored before they are purged
+	Log                go_log.Log
+	OldNameReservation time.Duration // How long the old name of a renamed account is kept from others
+	QueryTimeout       time.Duration // Max time for each SQL statement, 0 means no limit besides the one on ctx
+}
+
+// AuditCheckpoint is a signed hash of an event in the audit chain, events up to it can not be changed without the signing key
+type AuditCheckpoint struct {
+	ID        int64     `json:"id"` // Set by the store
+	Created   time.Time `json:"created"`
+	EventID   int64     `json:"eventId"`
+	EventHash string    `json:"eventHash"`
+	KeyID     string    `json:"keyId"` // Tells which key signed it, see AuditKeyID()
+	Signature string    `json:"signature"`
+}
+
+// Methods a session can be started with, the same as the methods of the auth metrics
+const (
+	SessionMethodAPIKey   = "api-key"
+	SessionMethodPassword = "password"
+	SessionMethodRenew    = "renew" // A renewal token from before sessions were recorded was renewed
+)
+
+// SessionsLimit is how many sessions of an account are listed, the newest ones
+const SessionsLimit = 100
+
+// Session is a sign in of an account, it lasts as long as its renewal token is renewed
+type Session struct {
+	ID        uuid.UUID `json:"id"`
+	AccountID uuid.UUID `json:"accountId"`
+	Active    bool      `json:"active"` // It has a renewal token that has not expired, ended sessions are kept as login history
+	Created   time.Time `json:"created"`
+	IP        string    `json:"ip"`
+	Method    string    `json:"method"`  // Like SessionMethodPassword
+	Renewed   time.Time `json:"renewed"` // The last time its renewal token was renewed, same as Created until then
+	UserAgent string    `json:"userAgent"`
+}
+
+// RenewalToken is what a renewal token belongs to
+type RenewalToken struct {
+	AccountID string
+	SessionID string // Empty for tokens from before sessions were recorded
+}
+
+// Renewal is what using a renewal token gives, a new renewal token in the same session and the token generation for the new JWT
+type Renewal struct {
+	AccountID    string
+	Generation   int64
+	RenewalToken string
+	SessionID    string
 }
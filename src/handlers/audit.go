@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// auditEvent starts the audit event of a request, write it with a deferred h.audit() so every way out of the handler is recorded
+// targetID is left out if it is not a valid uuid, the request is then recorded as invalid anyway.
+func (h Handlers) auditEvent(c *fiber.Ctx, action string, targetID string) *db.AuditEvent {
+	if _, err := uuid.Parse(targetID); err != nil {
+		targetID = ""
+	}
+
+	// Fiber reuses the memory of the request for the next one, Memory keeps the strings
+	return &db.AuditEvent{
+		Action:    action,
+		IP:        strings.Clone(c.IP()),
+		TargetID:  targetID,
+		UserAgent: strings.Clone(c.Get("User-Agent")),
+	}
+}
+
+// audit writes the event with the outcome from the status code of the response
+// The actor is the account of the JWT, if the handler got that far. A failed write is logged, the response is already decided.
+func (h Handlers) audit(c *fiber.Ctx, event *db.AuditEvent) {
+	event.Outcome = auditOutcome(c.Response().StatusCode())
+	if accountID, ok := c.Locals("accountId").(string); ok && event.ActorID == "" {
+		event.ActorID = accountID
+	}
+
+	// A request that timed out is recorded too
+	ctx := c.UserContext()
+	if ctx.Err() != nil {
+		ctx = context.Background()
+	}
+
+	_, err := h.Db.AuditEventCreate(ctx, *event)
+	if err != nil {
+		h.log(c).Error("Could not write audit event", "err", err.Error(), "action", event.Action, "outcome", event.Outcome, "targetId", event.TargetID)
+	}
+}
+
+// auditOutcome tells how a request went by its status code
+func auditOutcome(status int) string {
+	switch {
+	case status < 400:
+		return db.AuditOutcomeSuccess
+	case status == 401 || status == 403:
+		return db.AuditOutcomeDenied
+	case status < 500:
+		return db.AuditOutcomeInvalid
+	}
+
+	return db.AuditOutcomeError
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
@@ -10,21 +11,29 @@ import (
 // @Description Requires Authorization-header with role "admin" or a matching account id
 // @Description Example: Authorization: bearer xxx
 // @Description Where "xxx" is a valid JWT token
+// @Description The account is marked as deleted and can no longer be used, but an admin can restore it until it is purged.
 // @ID account-del
 // @Accept  json
 // @Produce  json
 // @Param id path string true "Account ID"
+// @Param If-Match header string false "ETag from a previous response, the change is only made if the account is still at that version"
 // @Success 204 {string} string ""
 // @Failure 400 {object} []ResJSONError
 // @Failure 401 {object} []ResJSONError
 // @Failure 403 {object} []ResJSONError
 // @Failure 404 {object} []ResJSONError
+// @Failure 412 {object} []ResJSONError
 // @Failure 415 {object} []ResJSONError
 // @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
 // @Router /accounts/:id [delete]
 func (h Handlers) AccountDel(c *fiber.Ctx) error {
 	accountID := c.Params("accountID")
 
+	event := h.auditEvent(c, db.AuditAccountDelete, accountID)
+	defer h.audit(c, event)
+
 	_, uuidErr := uuid.Parse(accountID)
 	if uuidErr != nil {
 		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
@@ -35,14 +44,165 @@ func (h Handlers) AccountDel(c *fiber.Ctx) error {
 		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
 	}
 
-	err := h.Db.AccountDel(accountID)
+	ifVersion, ifMatchErr := h.ifMatchVersion(c)
+	if ifMatchErr != nil {
+		return c.Status(412).JSON([]ResJSONError{{Error: ifMatchErr.Error()}})
+	}
+
+	err := h.Db.AccountDel(c.UserContext(), accountID, ifVersion)
+	if err != nil {
+		return h.dbErrRes(c, err)
+	}
+
+	return c.Status(204).Send(nil)
+}
+
+// AccountFieldDel godoc
+// @Summary Delete a single account field
+// @Description Requires Authorization-header with role "admin".
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @ID account-field-del
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param fieldName path string true "Field name"
+// @Param If-Match header string false "ETag from a previous response, the change is only made if the account is still at that version"
+// @Success 200 {object} db.Account
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 404 {object} []ResJSONError
+// @Failure 412 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /accounts/{id}/fields/{fieldName} [delete]
+func (h Handlers) AccountFieldDel(c *fiber.Ctx) error {
+	accountID := c.Params("accountID")
+
+	event := h.auditEvent(c, db.AuditFieldsUpdate, accountID)
+	defer h.audit(c, event)
+
+	_, uuidErr := uuid.Parse(accountID)
+	if uuidErr != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+
+	fieldName, err := h.pathParam(c, "fieldName")
+	if err != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid field name encoding"}})
+	}
+
+	authErr := h.RequireAdminRole(c)
+	if authErr != nil {
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	return h.patchAccountFields(c, event, accountID, []db.AccountFieldsPatchOp{{Op: db.AccountFieldsPatchOpRemove, Name: fieldName}})
+}
+
+// AccountFieldValueDel godoc
+// @Summary Remove a single value from an account field
+// @Description Requires Authorization-header with role "admin".
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @Description The field is kept, even if this was its last value.
+// @ID account-field-value-del
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param fieldName path string true "Field name"
+// @Param value path string true "Value to remove"
+// @Param If-Match header string false "ETag from a previous response, the change is only made if the account is still at that version"
+// @Success 200 {object} db.Account
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 404 {object} []ResJSONError
+// @Failure 412 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /accounts/{id}/fields/{fieldName}/values/{value} [delete]
+func (h Handlers) AccountFieldValueDel(c *fiber.Ctx) error {
+	accountID := c.Params("accountID")
+
+	event := h.auditEvent(c, db.AuditFieldsUpdate, accountID)
+	defer h.audit(c, event)
+
+	_, uuidErr := uuid.Parse(accountID)
+	if uuidErr != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+
+	fieldName, err := h.pathParam(c, "fieldName")
+	if err != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid field name encoding"}})
+	}
+
+	value, err := h.pathParam(c, "value")
+	if err != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid value encoding"}})
+	}
+
+	authErr := h.RequireAdminRole(c)
+	if authErr != nil {
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	return h.patchAccountFields(c, event, accountID, []db.AccountFieldsPatchOp{{Op: db.AccountFieldsPatchOpRemoveValues, Name: fieldName, Values: []string{value}}})
+}
+
+// AccountSessionDel godoc
+// @Summary Revoke a session of an account
+// @Description Requires Authorization-header with either role "admin" or with a matching account id.
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @Description The session can no longer be renewed, JWTs already handed out in it stay valid until they expire. It is kept in the login history.
+// @ID account-session-del
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param sessionID path string true "Session ID"
+// @Success 204 {string} string ""
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 404 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /accounts/{id}/sessions/{sessionID} [delete]
+func (h Handlers) AccountSessionDel(c *fiber.Ctx) error {
+	accountID := c.Params("accountID")
+
+	event := h.auditEvent(c, db.AuditSessionRevoke, accountID)
+	defer h.audit(c, event)
+
+	_, uuidErr := uuid.Parse(accountID)
+	if uuidErr != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+
+	sessionUUID, uuidErr := uuid.Parse(c.Params("sessionID"))
+	if uuidErr != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+	sessionID := sessionUUID.String()
+	event.Diff = db.AuditDiff(map[string]interface{}{"sessionId": sessionID})
+
+	authErr := h.RequireAdminRoleOrAccountID(c, accountID)
+	if authErr != nil {
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	err := h.Db.SessionRm(c.UserContext(), accountID, sessionID)
 	if err != nil {
-		if err.Error() == "no account found for given accountID" {
-			return c.Status(404).JSON([]ResJSONError{{Error: err.Error()}})
-		} else {
-			h.Log.Error("Database error when trying to remove account", "err", err.Error())
-			return c.Status(500).JSON([]ResJSONError{{Error: "Database error when trying to remove account"}})
-		}
+		return h.dbErrRes(c, err)
 	}
 
 	return c.Status(204).Send(nil)
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"github.com/gofiber/fiber/v2"
+)
+
+// dbErrRes responds with the HTTP status code matching an error from the db package
+func (h Handlers) dbErrRes(c *fiber.Ctx, err error) error {
+	var conflictErr db.ConflictError
+	var notFoundErr db.NotFoundError
+	var validationErr db.ValidationError
+
+	switch {
+	case errors.As(err, &validationErr):
+		return c.Status(400).JSON([]ResJSONError{{Error: upperFirst(validationErr.Msg), Field: validationErr.Field}})
+	case errors.As(err, &notFoundErr):
+		return c.Status(404).JSON([]ResJSONError{{Error: upperFirst(notFoundErr.Msg)}})
+	case errors.As(err, &conflictErr):
+		return c.Status(409).JSON([]ResJSONError{{Error: upperFirst(conflictErr.Msg), Field: conflictErr.Field}})
+	case errors.Is(err, db.ErrVersionMismatch):
+		return c.Status(412).JSON([]ResJSONError{{Error: "If-Match does not match the current account version"}})
+	case errors.Is(err, context.DeadlineExceeded):
+		h.log(c).Warn("Database timeout", "err", err.Error(), "url", c.OriginalURL())
+		return c.Status(504).JSON([]ResJSONError{{Error: "Timed out waiting for the database"}})
+	case errors.Is(err, context.Canceled):
+		h.log(c).Verbose("Database call canceled", "err", err.Error(), "url", c.OriginalURL())
+		return c.Status(503).JSON([]ResJSONError{{Error: "Request was canceled, try again"}})
+	}
+
+	h.log(c).Error("Database error", "err", err.Error(), "url", c.OriginalURL())
+	return c.Status(500).JSON([]ResJSONError{{Error: "Internal server error"}})
+}
+
+func upperFirst(str string) string {
+	if str == "" {
+		return str
+	}
+
+	return strings.ToUpper(str[:1]) + str[1:]
+}
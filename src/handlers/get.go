@@ -1,6 +1,11 @@
 package handlers
 
 import (
+	"strconv"
+	"strings"
+	"time"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 )
@@ -14,11 +19,15 @@ import (
 // @Accept  json
 // @Produce  json
 // @Param id path string true "Account ID"
+// @Param includeDeleted query bool false "Also find the account if it is deleted"
 // @Success 200 {object} db.Account
+// @Header 200 {string} ETag "Current account version, use with If-Match on changes"
 // @Failure 401 {object} []ResJSONError
 // @Failure 403 {object} []ResJSONError
 // @Failure 415 {object} []ResJSONError
 // @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
 // @Router /accounts/{id} [get]
 func (h Handlers) AccountGet(c *fiber.Ctx) error {
 	accountID := c.Params("accountID")
@@ -33,47 +42,287 @@ func (h Handlers) AccountGet(c *fiber.Ctx) error {
 		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
 	}
 
-	account, accountErr := h.Db.AccountGet(accountID, "", "")
+	var account db.Account
+	var accountErr error
+	if c.Query("includeDeleted") == "true" {
+		account, accountErr = h.Db.AccountGetIncludingDeleted(c.UserContext(), accountID)
+	} else {
+		account, accountErr = h.Db.AccountGet(c.UserContext(), accountID, "", "")
+	}
 	if accountErr != nil {
-		if accountErr.Error() == "no rows in result set" {
-			return c.Status(404).JSON([]ResJSONError{{Error: "No account found for given accountID"}})
-		} else {
-			return c.Status(500).JSON([]ResJSONError{{Error: accountErr.Error()}})
-		}
+		return h.dbErrRes(c, accountErr)
 	}
 
+	c.Set("ETag", accountETag(account))
 	return c.JSON(account)
 }
 
-// AccountGet godoc
+// AccountFieldGet godoc
+// @Summary Get the values of a single account field
+// @Description Requires Authorization-header with either role "admin" or with a matching account id.
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @ID get-account-field
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param fieldName path string true "Field name"
+// @Success 200 {object} []string
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 404 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /accounts/{id}/fields/{fieldName} [get]
+func (h Handlers) AccountFieldGet(c *fiber.Ctx) error {
+	accountID := c.Params("accountID")
+
+	_, uuidErr := uuid.Parse(accountID)
+	if uuidErr != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+
+	fieldName, err := h.pathParam(c, "fieldName")
+	if err != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid field name encoding"}})
+	}
+
+	authErr := h.RequireAdminRoleOrAccountID(c, accountID)
+	if authErr != nil {
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	values, err := h.Db.AccountFieldGet(c.UserContext(), accountID, fieldName)
+	if err != nil {
+		return h.dbErrRes(c, err)
+	}
+
+	return c.JSON(values)
+}
+
+// AccountSessionsGet godoc
+// @Summary Get the sessions of an account
+// @Description Requires Authorization-header with either role "admin" or with a matching account id.
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @Description Every login is a session, newest first. Sessions that can no longer be renewed are kept as login history with active set to false.
+// @ID get-account-sessions
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Success 200 {object} []db.Session
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /accounts/{id}/sessions [get]
+func (h Handlers) AccountSessionsGet(c *fiber.Ctx) error {
+	accountID := c.Params("accountID")
+
+	_, uuidErr := uuid.Parse(accountID)
+	if uuidErr != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+
+	authErr := h.RequireAdminRoleOrAccountID(c, accountID)
+	if authErr != nil {
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	sessions, err := h.Db.SessionsGet(c.UserContext(), accountID)
+	if err != nil {
+		return h.dbErrRes(c, err)
+	}
+
+	return c.JSON(sessions)
+}
+
+// AccountsGet godoc
 // @Summary Get accounts
 // @Description Requires Authorization-header with role "admin".
 // @Description Example: Authorization: bearer xxx
 // @Description Where "xxx" is a valid JWT token
+// @Description Filter on field values with fields[fieldName]=value, for example fields[role]=admin
+// @Description Give the same field several times to require all the values
+// @ID get-accounts
 // @Accept  json
 // @Produce  json
-// @Success 200 {object} []db.Account
+// @Param limit query int false "Max number of accounts to return, 1-500, defaults to 50"
+// @Param cursor query string false "nextCursor from the previous page"
+// @Param sort query string false "Sort by \"created\" (default) or \"name\""
+// @Param order query string false "\"asc\" (default) or \"desc\""
+// @Param namePrefix query string false "Only include accounts with a name starting with this"
+// @Param total query bool false "Include the total number of matching accounts"
+// @Param includeDeleted query bool false "Also include deleted accounts"
+// @Success 200 {object} db.AccountsList
+// @Failure 400 {object} []ResJSONError
 // @Failure 401 {object} []ResJSONError
 // @Failure 403 {object} []ResJSONError
 // @Failure 415 {object} []ResJSONError
 // @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
 // @Router /accounts [get]
 func (h Handlers) AccountsGet(c *fiber.Ctx) error {
-	accountID := c.Params("accountID")
+	authErr := h.RequireAdminRole(c)
+	if authErr != nil {
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	input := db.AccountsGetInput{
+		Cursor:       c.Query("cursor"),
+		FieldFilters: make(map[string][]string),
+		Limit:        db.AccountsDefaultLimit,
+		NamePrefix:   c.Query("namePrefix"),
+		SortBy:       c.Query("sort", "created"),
+	}
+
+	var errors []ResJSONError
+
+	if c.Query("limit") != "" {
+		limit, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 || limit > 500 {
+			errors = append(errors, ResJSONError{Error: "Must be an integer between 1 and 500", Field: "limit"})
+		}
+		input.Limit = limit
+	}
+
+	if input.SortBy != "created" && input.SortBy != "name" {
+		errors = append(errors, ResJSONError{Error: "Must be \"created\" or \"name\"", Field: "sort"})
+	}
+
+	switch c.Query("order", "asc") {
+	case "asc":
+	case "desc":
+		input.SortDesc = true
+	default:
+		errors = append(errors, ResJSONError{Error: "Must be \"asc\" or \"desc\"", Field: "order"})
+	}
+
+	if c.Query("includeDeleted") != "" {
+		includeDeleted, err := strconv.ParseBool(c.Query("includeDeleted"))
+		if err != nil {
+			errors = append(errors, ResJSONError{Error: "Must be a boolean", Field: "includeDeleted"})
+		}
+		input.IncludeDeleted = includeDeleted
+	}
+
+	if c.Query("total") != "" {
+		withTotal, err := strconv.ParseBool(c.Query("total"))
+		if err != nil {
+			errors = append(errors, ResJSONError{Error: "Must be a boolean", Field: "total"})
+		}
+		input.WithTotal = withTotal
+	}
+
+	c.Context().QueryArgs().VisitAll(func(key, value []byte) {
+		keyStr := string(key)
+		if strings.HasPrefix(keyStr, "fields[") && strings.HasSuffix(keyStr, "]") {
+			fieldName := keyStr[len("fields[") : len(keyStr)-1]
+			input.FieldFilters[fieldName] = append(input.FieldFilters[fieldName], string(value))
+		}
+	})
+
+	if len(errors) != 0 {
+		return c.Status(400).JSON(errors)
+	}
+
+	accounts, err := h.Db.AccountsGet(c.UserContext(), input)
+	if err != nil {
+		return h.dbErrRes(c, err)
+	}
+
+	return c.JSON(accounts)
+}
 
+// AuditEventsGet godoc
+// @Summary Get audit events
+// @Description Requires Authorization-header with role "admin".
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @Description Auth attempts, token renewals and changes to accounts, newest first. Passwords, API keys and tokens are never in the diff.
+// @ID get-audit-events
+// @Accept  json
+// @Produce  json
+// @Param limit query int false "Max number of events to return, 1-500, defaults to 50"
+// @Param cursor query string false "nextCursor from the previous page"
+// @Param accountId query string false "Only include events where this account is the actor or the target"
+// @Param actorId query string false "Only include events done by this account"
+// @Param targetId query string false "Only include events done to this account"
+// @Param action query string false "Only include events with this action, like \"auth.password\" or \"fields.update\""
+// @Param outcome query string false "Only include events with this outcome, \"success\", \"denied\", \"invalid\" or \"error\""
+// @Param since query string false "Only include events at or after this time, RFC 3339 like 2026-10-19T12:00:00Z"
+// @Param until query string false "Only include events before this time, RFC 3339"
+// @Success 200 {object} db.AuditEventsList
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /audit-events [get]
+func (h Handlers) AuditEventsGet(c *fiber.Ctx) error {
 	authErr := h.RequireAdminRole(c)
 	if authErr != nil {
 		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
 	}
 
-	account, accountErr := h.Db.AccountGet(accountID, "", "")
-	if accountErr != nil {
-		if accountErr.Error() == "no rows in result set" {
-			return c.Status(404).JSON([]ResJSONError{{Error: "No account found for given accountID"}})
+	input := db.AuditEventsGetInput{
+		AccountID: c.Query("accountId"),
+		Action:    c.Query("action"),
+		ActorID:   c.Query("actorId"),
+		Cursor:    c.Query("cursor"),
+		Limit:     db.AuditEventsDefaultLimit,
+		Outcome:   c.Query("outcome"),
+		TargetID:  c.Query("targetId"),
+	}
+
+	var errors []ResJSONError
+
+	if c.Query("limit") != "" {
+		limit, err := strconv.Atoi(c.Query("limit"))
+		if err != nil || limit < 1 || limit > 500 {
+			errors = append(errors, ResJSONError{Error: "Must be an integer between 1 and 500", Field: "limit"})
+		}
+		input.Limit = limit
+	}
+
+	switch input.Outcome {
+	case "", db.AuditOutcomeDenied, db.AuditOutcomeError, db.AuditOutcomeInvalid, db.AuditOutcomeSuccess:
+	default:
+		errors = append(errors, ResJSONError{Error: "Must be \"success\", \"denied\", \"invalid\" or \"error\"", Field: "outcome"})
+	}
+
+	for _, field := range []string{"since", "until"} {
+		if c.Query(field) == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, c.Query(field))
+		if err != nil {
+			errors = append(errors, ResJSONError{Error: "Must be a time like 2026-10-19T12:00:00Z", Field: field})
+		}
+		if field == "since" {
+			input.Since = parsed
 		} else {
-			return c.Status(500).JSON([]ResJSONError{{Error: accountErr.Error()}})
+			input.Until = parsed
 		}
 	}
 
-	return c.JSON(account)
+	if len(errors) != 0 {
+		return c.Status(400).JSON(errors)
+	}
+
+	events, err := h.Db.AuditEventsGet(c.UserContext(), input)
+	if err != nil {
+		return h.dbErrRes(c, err)
+	}
+
+	return c.JSON(events)
 }
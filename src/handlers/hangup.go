@@ -0,0 +1,50 @@
+//go:build unix
+
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// watchHangup calls cancel when the client closes the connection while the request is handled
+// The socket is only peeked at, so the bytes of a pipelined request are left for fasthttp. Watching stops once
+// such bytes show up. The returned func stops watching and must be called before the handler returns.
+func watchHangup(conn net.Conn, cancel context.CancelFunc) func() {
+	sysConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return func() {} // Like the connections of app.Test(), there is no socket to peek at
+	}
+	rawConn, err := sysConn.SyscallConn()
+	if err != nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		buf := make([]byte, 1)
+		_ = rawConn.Read(func(fd uintptr) bool {
+			n, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+			if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+				return false // Nothing to read, wait until the socket is readable or the deadline below passes
+			}
+			if n == 0 || err != nil {
+				cancel() // Closed or reset by the client
+			}
+
+			return true
+		})
+	}()
+
+	return func() {
+		// A deadline in the past wakes the watcher up, fasthttp sets its own deadlines before it reads the next request
+		_ = conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
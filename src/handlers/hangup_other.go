@@ -0,0 +1,13 @@
+//go:build !unix
+
+package handlers
+
+import (
+	"context"
+	"net"
+)
+
+// watchHangup does nothing where sockets can not be peeked at, requests are then only stopped by the request timeout
+func watchHangup(conn net.Conn, cancel context.CancelFunc) func() {
+	return func() {}
+}
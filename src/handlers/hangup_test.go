@@ -0,0 +1,72 @@
+//go:build unix
+
+package handlers
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestReqTimeoutHangup checks that the request context is canceled when the client hangs up, and only then
+func TestReqTimeoutHangup(t *testing.T) {
+	app := fiber.New(fiber.Config{DisableStartupMessage: true})
+	app.Use(Handlers{RequestTimeout: 10 * time.Second}.ReqTimeout)
+
+	results := make(chan error, 1)
+	app.Get("/slow", func(c *fiber.Ctx) error {
+		select {
+		case <-c.UserContext().Done():
+			results <- c.UserContext().Err()
+		case <-time.After(time.Second):
+			results <- nil
+		}
+		return c.SendString("slow")
+	})
+	app.Get("/fast", func(c *fiber.Ctx) error {
+		return c.SendString("fast")
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	go app.Listener(listener)
+	t.Cleanup(func() { app.Shutdown() })
+
+	// Pipelined requests are left for fasthttp, and the connection is kept alive after them
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	conn.Write([]byte("GET /fast HTTP/1.1\r\nHost: test\r\n\r\nGET /fast HTTP/1.1\r\nHost: test\r\n\r\n"))
+	conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: test\r\n\r\n"))
+	for i := 0; i < 3; i++ {
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil || res.StatusCode != 200 {
+			t.Fatalf("Expected response %d to be 200, got %+v, %v", i, res, err)
+		}
+		res.Body.Close()
+	}
+	if err := <-results; err != nil {
+		t.Fatalf("Expected the request of an open connection to finish, got %v", err)
+	}
+
+	// A hang up cancels the request
+	conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: test\r\n\r\n"))
+	time.Sleep(100 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-results:
+		if err == nil {
+			t.Fatalf("Expected the request to be canceled when the client hung up")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("The request was not done")
+	}
+}
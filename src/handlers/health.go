@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"gitea.larvit.se/pwrpln/auth-api/src/metrics"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// readyCheckTimeout is the max time for each readiness check, so probes get an answer before they time out
+const readyCheckTimeout = 2 * time.Second
+
+// ResStatus is the status of the server, or of one of its components
+type ResStatus struct {
+	Status string `json:"status"`          // "ok", "fail" or "shuttingDown"
+	Error  string `json:"error,omitempty"` // Why a component failed
+}
+
+// ResReady is the response of the readiness check
+type ResReady struct {
+	Status     string               `json:"status"`
+	Components map[string]ResStatus `json:"components,omitempty"`
+}
+
+// Healthz godoc
+// @Summary Liveness
+// @Description Always succeeds while the process is running, nothing else is checked
+// @ID healthz
+// @Produce  json
+// @Success 200 {object} ResStatus
+// @Router /healthz [get]
+func (h Handlers) Healthz(c *fiber.Ctx) error {
+	return c.Status(200).JSON(ResStatus{Status: "ok"})
+}
+
+// metricsHandler serves the Prometheus metrics, promhttp is a net/http handler
+var metricsHandler = fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+
+// MetricsGet godoc
+// @Summary Prometheus metrics
+// @Description Requests, auth attempts, issued tokens, password hashing, database connections and renewal tokens in the Prometheus text format
+// @ID metrics
+// @Produce  plain
+// @Success 200 {string} string
+// @Router /metrics [get]
+func (h Handlers) MetricsGet(c *fiber.Ctx) error {
+	metricsHandler(c.Context())
+	return nil
+}
+
+// Ready godoc
+// @Summary Readiness
+// @Description Checks that the database can be reached, that its schema matches the migrations and that there is a key to sign JWTs with.
+// @Description Fails with 503 as soon as the server starts shutting down, so load balancers stop sending new requests before the connections are closed
+// @ID ready
+// @Produce  json
+// @Success 200 {object} ResReady
+// @Failure 503 {object} ResReady
+// @Router /readyz [get]
+func (h Handlers) Ready(c *fiber.Ctx) error {
+	if h.ShuttingDown != nil && h.ShuttingDown.Load() {
+		return c.Status(503).JSON(ResReady{Status: "shuttingDown"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.UserContext(), readyCheckTimeout)
+	defer cancel()
+
+	res := ResReady{
+		Status: "ok",
+		Components: map[string]ResStatus{
+			"database":   h.readyCheck("database", h.databaseCheck(ctx)),
+			"migrations": h.readyCheck("migrations", h.migrationsCheck(ctx)),
+			"signingKey": h.readyCheck("signingKey", h.signingKeyCheck()),
+		},
+	}
+
+	for _, component := range res.Components {
+		if component.Status != "ok" {
+			res.Status = "fail"
+			return c.Status(503).JSON(res)
+		}
+	}
+
+	return c.Status(200).JSON(res)
+}
+
+// readyCheck turns the result of a check into a component status, and logs why it failed
+func (h Handlers) readyCheck(component string, err error) ResStatus {
+	if err == nil {
+		return ResStatus{Status: "ok"}
+	}
+
+	h.Log.Warn("Readiness check failed", "component", component, "err", err.Error())
+
+	// Database errors can contain host names and such, only schema mismatches are shown as they are
+	if errors.Is(err, db.ErrSchemaMismatch) || errors.Is(err, errNoSigningKey) {
+		return ResStatus{Status: "fail", Error: err.Error()}
+	}
+
+	return ResStatus{Status: "fail", Error: "check failed, see the log"}
+}
+
+// untracedDb is the store without the tracing, probes run every few seconds and would fill the traces
+func (h Handlers) untracedDb() db.Store {
+	if traced, ok := h.Db.(db.Traced); ok {
+		return traced.Unwrap()
+	}
+
+	return h.Db
+}
+
+func (h Handlers) databaseCheck(ctx context.Context) error {
+	return h.untracedDb().Ping(ctx)
+}
+
+// migrationsCheck checks that the schema matches the migrations in the binary, Memory has no schema
+func (h Handlers) migrationsCheck(ctx context.Context) error {
+	migrator, ok := h.untracedDb().(db.Migrator)
+	if !ok {
+		return nil
+	}
+
+	return db.MigrationsCheck(ctx, migrator)
+}
+
+var errNoSigningKey = errors.New("JWT_SHARED_SECRET is not set")
+
+func (h Handlers) signingKeyCheck() error {
+	if len(h.JwtKey) == 0 {
+		return errNoSigningKey
+	}
+
+	return nil
+}
@@ -1,22 +1,47 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"gitea.larvit.se/pwrpln/auth-api/src/metrics"
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"gitea.larvit.se/pwrpln/go_log"
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 )
 
-func (h Handlers) returnTokens(account db.Account, c *fiber.Ctx) error {
+func (h Handlers) returnTokens(account db.Account, sessionID string, c *fiber.Ctx) error {
+	generation, err := h.Db.AccountTokenGeneration(c.UserContext(), account.ID.String())
+	if err != nil {
+		return h.dbErrRes(c, err)
+	}
+
+	renewalToken, renewalTokenErr := h.Db.RenewalTokenCreate(c.UserContext(), account.ID.String(), sessionID)
+	if renewalTokenErr != nil {
+		return h.dbErrRes(c, renewalTokenErr)
+	}
+
+	return h.tokensRes(c, account, sessionID, generation, renewalToken)
+}
+
+// tokensRes responds with a new JWT of the given token generation and the renewal token that goes with it
+func (h Handlers) tokensRes(c *fiber.Ctx, account db.Account, sessionID string, generation int64, renewalToken string) error {
 	expirationTime := time.Now().Add(15 * time.Minute)
 
 	claims := &Claims{
 		AccountID:     account.ID.String(),
 		AccountName:   account.Name,
 		AccountFields: account.Fields,
+		SessionID:     sessionID,
+		Generation:    generation,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: expirationTime.Unix(),
 		},
@@ -25,15 +50,11 @@ func (h Handlers) returnTokens(account db.Account, c *fiber.Ctx) error {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	tokenString, err := token.SignedString(h.JwtKey)
 	if err != nil {
-		h.Log.Error("Could not create token string", "err", err.Error())
+		h.log(c).Error("Could not create token string", "err", err.Error())
 		return c.Status(500).JSON([]ResJSONError{{Error: "Could not create JWT token string"}})
 	}
 
-	renewalToken, renewalTokenErr := h.Db.RenewalTokenCreate(account.ID.String())
-	if renewalTokenErr != nil {
-		h.Log.Error("Could not create renewal token", "err", renewalTokenErr.Error())
-		return c.Status(500).JSON([]ResJSONError{{Error: "Could not create renewal token"}})
-	}
+	metrics.TokensIssued.Inc()
 
 	return c.Status(200).JSON(ResToken{
 		JWT:          tokenString,
@@ -41,11 +62,105 @@ func (h Handlers) returnTokens(account db.Account, c *fiber.Ctx) error {
 	})
 }
 
-func (h Handlers) parseJWT(JWT string) (Claims, error) {
-	h.Log.Debug("Parsing JWT", "JWT", JWT)
+// sessionStart records a new session of the account from the request, IP and user agent are kept for the login history
+func (h Handlers) sessionStart(c *fiber.Ctx, accountID string, method string) (string, error) {
+	session := requestSession(c, method)
+	session.AccountID = uuid.MustParse(accountID)
+
+	session, err := h.Db.SessionCreate(c.UserContext(), session)
+	if err != nil {
+		return "", err
+	}
+
+	return session.ID.String(), nil
+}
+
+// requestSession is a session of the request, without an account
+func requestSession(c *fiber.Ctx, method string) db.Session {
+	return db.Session{
+		IP:        strings.Clone(c.IP()),
+		Method:    method,
+		UserAgent: strings.Clone(c.Get("User-Agent")),
+	}
+}
+
+// authAttemptCount counts an auth attempt by the status code of the response, call it deferred in the auth handlers
+func authAttemptCount(c *fiber.Ctx, method string) {
+	metrics.AuthAttempts.WithLabelValues(method, auditOutcome(c.Response().StatusCode())).Inc()
+}
+
+// patchAccountFields applies the field operations and responds with the updated account, the operations are the diff of the audit event
+func (h Handlers) patchAccountFields(c *fiber.Ctx, event *db.AuditEvent, accountID string, ops []db.AccountFieldsPatchOp) error {
+	event.Diff = db.AuditDiff(map[string]interface{}{"ops": ops})
+
+	ifVersion, ifMatchErr := h.ifMatchVersion(c)
+	if ifMatchErr != nil {
+		return c.Status(412).JSON([]ResJSONError{{Error: ifMatchErr.Error()}})
+	}
+
+	updatedAccount, err := h.Db.AccountPatchFields(c.UserContext(), accountID, ops, ifVersion)
+	if err != nil {
+		return h.dbErrRes(c, err)
+	}
+
+	c.Set("ETag", accountETag(updatedAccount))
+	return c.Status(200).JSON(updatedAccount)
+}
+
+// accountETag returns the ETag header value for an account
+func accountETag(account db.Account) string {
+	return "\"" + strconv.FormatInt(account.Version, 10) + "\""
+}
+
+// ifMatchVersion returns the account version from the If-Match header, 0 if the header is missing or "*"
+func (h Handlers) ifMatchVersion(c *fiber.Ctx) (int64, error) {
+	ifMatch := strings.TrimSpace(c.Get("If-Match"))
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, nil
+	}
+
+	// Only a single strong ETag as returned by accountETag() can ever match
+	if len(ifMatch) < 3 || ifMatch[0] != '"' || ifMatch[len(ifMatch)-1] != '"' {
+		h.log(c).Debug("Malformed If-Match header", "If-Match", ifMatch)
+		return 0, errors.New("If-Match does not match the current account version")
+	}
+
+	version, err := strconv.ParseInt(ifMatch[1:len(ifMatch)-1], 10, 64)
+	if err != nil || version < 1 {
+		h.log(c).Debug("Malformed If-Match header", "If-Match", ifMatch)
+		return 0, errors.New("If-Match does not match the current account version")
+	}
+
+	return version, nil
+}
+
+// log returns the request logger with the given fields added
+func (h Handlers) log(c *fiber.Ctx, fields ...interface{}) go_log.Log {
+	return utils.LogFromCtx(c.UserContext(), h.Log, fields...)
+}
+
+// stringBody parses a request body that is a single JSON string, like an API key or a renewal token
+func stringBody(c *fiber.Ctx) (string, error) {
+	var value string
+	err := json.Unmarshal(c.Body(), &value)
+	if err != nil {
+		return "", errors.New("body must be a JSON string")
+	}
+
+	return value, nil
+}
+
+// pathParam returns an URL decoded path parameter
+func (h Handlers) pathParam(c *fiber.Ctx, key string) (string, error) {
+	return url.PathUnescape(c.Params(key))
+}
+
+func (h Handlers) parseJWT(ctx context.Context, JWT string) (Claims, error) {
+	log := utils.LogFromCtx(ctx, h.Log)
+	log.Debug("Parsing JWT", "JWT", JWT)
 
 	trimmedJWT := strings.TrimPrefix(JWT, "bearer ") // Since the Authorization header should always start with "bearer "
-	h.Log.Debug("JWT trimmed", "JWT", JWT, "trimmedJWT", trimmedJWT)
+	log.Debug("JWT trimmed", "JWT", JWT, "trimmedJWT", trimmedJWT)
 
 	claims := &Claims{}
 
@@ -60,6 +175,18 @@ func (h Handlers) parseJWT(JWT string) (Claims, error) {
 		return Claims{}, err
 	}
 
+	// Tokens for deleted accounts, or issued before the account logged out everywhere, must stop working right away, not when they expire
+	generation, err := h.Db.AccountTokenGeneration(ctx, claims.AccountID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return Claims{}, errors.New("account is deleted")
+		}
+		return Claims{}, err
+	}
+	if claims.Generation < generation {
+		return Claims{}, errors.New("token is revoked")
+	}
+
 	return *claims, nil
 }
 
@@ -74,7 +201,7 @@ func (h Handlers) parseHeaders(c *fiber.Ctx) map[string]string {
 
 		if len(lineParts) == 1 {
 			if len(line) != 0 {
-				h.Log.Debug("Ignoring header line", "line", line)
+				h.log(c).Debug("Ignoring header line", "line", line)
 			}
 		} else {
 			headersMap[lineParts[0]] = lineParts[1]
@@ -92,10 +219,11 @@ func (h Handlers) RequireAdminRole(c *fiber.Ctx) error {
 		return errors.New("authorization header is missing")
 	}
 
-	claims, claimsErr := h.parseJWT(headers["Authorization"])
+	claims, claimsErr := h.parseJWT(c.UserContext(), headers["Authorization"])
 	if claimsErr != nil {
 		return claimsErr
 	}
+	c.Locals("accountId", claims.AccountID)
 
 	if claims.AccountFields == nil {
 		return errors.New("account have no fields at all")
@@ -122,10 +250,11 @@ func (h Handlers) RequireAdminRoleOrAccountID(c *fiber.Ctx, accountID string) er
 		return errors.New("authorization header is missing")
 	}
 
-	claims, claimsErr := h.parseJWT(headers["Authorization"])
+	claims, claimsErr := h.parseJWT(c.UserContext(), headers["Authorization"])
 	if claimsErr != nil {
 		return claimsErr
 	}
+	c.Locals("accountId", claims.AccountID)
 
 	if claims.AccountID == accountID {
 		return nil
@@ -1,15 +1,127 @@
 package handlers
 
 import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/metrics"
+	"gitea.larvit.se/pwrpln/auth-api/src/tracing"
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"gitea.larvit.se/pwrpln/go_log"
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// Log all requests
+// LogReq gives each request an id, returned in the X-Request-ID header, and a logger that adds the request id, route, account id and latency to every line
 func (h Handlers) LogReq(c *fiber.Ctx) error {
-	h.Log.Debug("http request", "method", c.Method(), "url", c.OriginalURL())
+	start := time.Now()
+	requestID := uuid.NewString()
+	c.Set("X-Request-ID", requestID)
+
+	c.SetUserContext(utils.CtxWithLog(c.UserContext(), func() go_log.Log {
+		log := h.Log
+		log.Context = append(append([]interface{}{}, h.Log.Context...),
+			"requestId", requestID,
+			"route", c.Method()+" "+c.Route().Path,
+			"latency", time.Since(start).String(),
+		)
+		if spanContext := trace.SpanContextFromContext(c.UserContext()); spanContext.IsValid() {
+			log.Context = append(log.Context, "traceId", spanContext.TraceID().String())
+		}
+		if accountID, ok := c.Locals("accountId").(string); ok {
+			log.Context = append(log.Context, "accountId", accountID)
+		}
+
+		return log
+	}))
+
+	// Errors, like fiber.ErrNotFound for unknown routes, get their response here so the status is known when it is logged
+	err := c.Next()
+	if err != nil {
+		err = c.App().Config().ErrorHandler(c, err)
+	}
+
+	h.log(c).Debug("http request", "status", c.Response().StatusCode(), "url", c.OriginalURL())
+	return err
+}
+
+// Metrics counts the requests and how long they take, by route and status code
+func (h Handlers) Metrics(c *fiber.Ctx) error {
+	start := time.Now()
+
+	err := c.Next()
+
+	// Fiber reuses the memory of c.Method() for the next request, the labels are kept
+	method := strings.Clone(c.Method())
+	route := routeName(c)
+	metrics.HTTPRequests.WithLabelValues(method, route, strconv.Itoa(c.Response().StatusCode())).Inc()
+	metrics.HTTPRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+
+	return err
+}
+
+// Trace starts a span for each request, continuing the trace in the traceparent header if there is one
+func (h Handlers) Trace(c *fiber.Ctx) error {
+	ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), headerCarrier{c})
+	ctx, span := tracing.Tracer.Start(ctx, "HTTP "+c.Method(), trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+
+	c.SetUserContext(ctx)
+
+	err := c.Next()
+	if err != nil {
+		err = c.App().Config().ErrorHandler(c, err)
+	}
+
+	// Spans are exported after the request, when fiber has reused the memory of c.Method()
+	method := strings.Clone(c.Method())
+	route := routeName(c)
+	status := c.Response().StatusCode()
+	span.SetName(method + " " + route)
+	span.SetAttributes(semconv.HTTPMethod(method), semconv.HTTPRoute(route), semconv.HTTPStatusCode(status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, "")
+	}
 
-	c.Next()
-	return nil
+	return err
+}
+
+// headerCarrier lets the propagator read and write the headers of a fiber request
+type headerCarrier struct {
+	c *fiber.Ctx
+}
+
+func (hc headerCarrier) Get(key string) string {
+	return strings.Clone(hc.c.Get(key)) // The trace state is kept in the span
+}
+
+func (hc headerCarrier) Set(key string, value string) {
+	hc.c.Request().Header.Set(key, value)
+}
+
+func (hc headerCarrier) Keys() []string {
+	var keys []string
+	hc.c.Request().Header.VisitAll(func(key []byte, _ []byte) {
+		keys = append(keys, string(key))
+	})
+
+	return keys
+}
+
+// routeName is the pattern of the route, like "/accounts/:accountID", to keep the number of metric labels and span names down
+func routeName(c *fiber.Ctx) string {
+	route := c.Route().Path
+	if route == "/" && c.Path() != "/" {
+		return "unmatched" // Stopped by a middleware, which are all on "/", before a route matched, or no route matched
+	}
+
+	return route
 }
 
 // RequireJSON is a middleware that makes sure the request content-type always is application/json (or nothing, defaulting to application/json)
@@ -18,10 +130,28 @@ func (h Handlers) RequireJSON(c *fiber.Ctx) error {
 	contentType := string(c.Request().Header.ContentType())
 
 	if contentType != "application/json" && contentType != "" {
-		h.Log.Debug("Invalid content-type in request", "content-type", contentType)
+		h.log(c).Debug("Invalid content-type in request", "content-type", contentType)
 		return c.Status(415).JSON([]ResJSONError{{Error: "Invalid content-type"}})
 	}
 
-	c.Next()
-	return nil
+	return c.Next()
+}
+
+// ReqTimeout is a middleware that gives the request context a deadline and cancels it if the client hangs up
+// All database calls are canceled when either happens.
+func (h Handlers) ReqTimeout(c *fiber.Ctx) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if h.RequestTimeout > 0 {
+		ctx, cancel = context.WithTimeout(c.UserContext(), h.RequestTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(c.UserContext())
+	}
+	defer cancel()
+
+	stopWatching := watchHangup(c.Context().Conn(), cancel)
+	defer stopWatching()
+
+	c.SetUserContext(ctx)
+	return c.Next()
 }
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"strconv"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// AccountPatchFields godoc
+// @Summary Patch account fields
+// @Description Requires Authorization-header with role "admin".
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @Description All operations are applied in order in one transaction, if one fails nothing is changed.
+// @Description Operations ("op"):
+// @Description "set" sets the field to exactly the given values, creating it if needed
+// @Description "remove" removes the field completely, values are ignored. Gives 404 if the field does not exist
+// @Description "addValues" adds the given values to the field if they are not already there, creating it if needed
+// @Description "removeValues" removes the given values from the field. Gives 404 if the field does not exist
+// @ID account-patch-fields
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param body body []db.AccountFieldsPatchOp true "Operations to apply to the account fields"
+// @Param If-Match header string false "ETag from a previous response, the change is only made if the account is still at that version"
+// @Success 200 {object} db.Account
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 404 {object} []ResJSONError
+// @Failure 412 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /accounts/{id}/fields [patch]
+func (h Handlers) AccountPatchFields(c *fiber.Ctx) error {
+	accountID := c.Params("accountID")
+
+	event := h.auditEvent(c, db.AuditFieldsUpdate, accountID)
+	defer h.audit(c, event)
+
+	log := h.log(c,
+		"accountID", accountID,
+	)
+
+	_, uuidErr := uuid.Parse(accountID)
+	if uuidErr != nil {
+		log.Debug("client supplied invalid uuid format")
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+
+	authErr := h.RequireAdminRole(c)
+	if authErr != nil {
+		log.Debug("client does not have admin role")
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	ops := new([]db.AccountFieldsPatchOp)
+
+	if err := c.BodyParser(ops); err != nil {
+		return c.Status(400).JSON([]ResJSONError{
+			{Error: err.Error()},
+		})
+	}
+
+	var errors []ResJSONError
+
+	for i, op := range *ops {
+		fieldPrefix := "[" + strconv.Itoa(i) + "]."
+
+		if op.Name == "" {
+			errors = append(errors, ResJSONError{Error: "Can not be empty", Field: fieldPrefix + "name"})
+		}
+
+		switch op.Op {
+		case db.AccountFieldsPatchOpSet, db.AccountFieldsPatchOpRemove:
+		case db.AccountFieldsPatchOpAddValues, db.AccountFieldsPatchOpRemoveValues:
+			if len(op.Values) == 0 {
+				errors = append(errors, ResJSONError{Error: "Can not be empty", Field: fieldPrefix + "values"})
+			}
+		default:
+			errors = append(errors, ResJSONError{Error: "Must be \"set\", \"remove\", \"addValues\" or \"removeValues\"", Field: fieldPrefix + "op"})
+		}
+	}
+
+	if len(errors) != 0 {
+		return c.Status(400).JSON(errors)
+	}
+
+	return h.patchAccountFields(c, event, accountID, *ops)
+}
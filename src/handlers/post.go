@@ -1,7 +1,7 @@
 package handlers
 
 import (
-	"strings"
+	"errors"
 
 	"gitea.larvit.se/pwrpln/auth-api/src/db"
 	"gitea.larvit.se/pwrpln/auth-api/src/utils"
@@ -36,8 +36,13 @@ type AuthInput struct {
 // @Failure 409 {object} []ResJSONError
 // @Failure 415 {object} []ResJSONError
 // @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
 // @Router /accounts [post]
 func (h Handlers) AccountCreate(c *fiber.Ctx) error {
+	event := h.auditEvent(c, db.AuditAccountCreate, "")
+	defer h.audit(c, event)
+
 	authErr := h.RequireAdminRole(c)
 	if authErr != nil {
 		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
@@ -63,34 +68,199 @@ func (h Handlers) AccountCreate(c *fiber.Ctx) error {
 
 	newAccountID, uuidErr := uuid.NewRandom()
 	if uuidErr != nil {
-		h.Log.Error("Could not create new Uuid", "err", uuidErr.Error())
+		h.log(c).Error("Could not create new Uuid", "err", uuidErr.Error())
 		return c.Status(500).JSON([]ResJSONError{{Error: "Could not create new account UUID"}})
 	}
 
-	hashedPwd, pwdErr := utils.HashPassword(accountInput.Password)
+	event.TargetID = newAccountID.String()
+	diff := map[string]interface{}{"name": accountInput.Name, "fields": db.AuditFields(accountInput.Fields)}
+	if accountInput.Password != "" {
+		diff["password"] = db.AuditRedacted
+	}
+	event.Diff = db.AuditDiff(diff)
+
+	hashedPwd, pwdErr := utils.HashPassword(c.UserContext(), accountInput.Password)
 	if pwdErr != nil {
-		h.Log.Error("Could not hash password", "err", pwdErr.Error())
+		h.log(c).Error("Could not hash password", "err", pwdErr.Error())
 		return c.Status(500).JSON([]ResJSONError{{Error: "Could not hash password: \"" + pwdErr.Error() + "\""}})
 	}
 
-	createdAccount, err := h.Db.AccountCreate(db.AccountCreateInput{
-		ID:       newAccountID,
-		Name:     accountInput.Name,
-		APIKey:   utils.RandString(60),
-		Fields:   accountInput.Fields,
-		Password: hashedPwd,
+	apiKey := utils.RandString(60)
+	createdAccount, err := h.Db.AccountCreate(c.UserContext(), db.AccountCreateInput{
+		ID:         newAccountID,
+		Name:       accountInput.Name,
+		APIKeyHash: utils.HashAPIKey(apiKey),
+		Fields:     accountInput.Fields,
+		Password:   hashedPwd,
 	})
 
 	if err != nil {
-		if strings.HasPrefix(err.Error(), "ERROR: duplicate key") {
-			return c.Status(409).JSON([]ResJSONError{{Error: "Name is already taken", Field: "name"}})
-		}
-		return c.Status(500).JSON([]ResJSONError{{Error: err.Error()}})
+		return h.dbErrRes(c, err)
 	}
+	createdAccount.APIKey = apiKey
 
 	return c.Status(201).JSON(createdAccount)
 }
 
+// AccountFieldValueAdd godoc
+// @Summary Add a single value to an account field
+// @Description Requires Authorization-header with role "admin".
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @Description The field is created if it does not exist. Nothing happens if the value is already there.
+// @ID account-field-value-add
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param fieldName path string true "Field name"
+// @Param body body string true "Value as a string in JSON format (just encapsulate the string with \" and you're fine)"
+// @Param If-Match header string false "ETag from a previous response, the change is only made if the account is still at that version"
+// @Success 200 {object} db.Account
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 404 {object} []ResJSONError
+// @Failure 412 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /accounts/{id}/fields/{fieldName}/values [post]
+func (h Handlers) AccountFieldValueAdd(c *fiber.Ctx) error {
+	accountID := c.Params("accountID")
+
+	event := h.auditEvent(c, db.AuditFieldsUpdate, accountID)
+	defer h.audit(c, event)
+
+	_, uuidErr := uuid.Parse(accountID)
+	if uuidErr != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+
+	fieldName, err := h.pathParam(c, "fieldName")
+	if err != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid field name encoding"}})
+	}
+
+	authErr := h.RequireAdminRole(c)
+	if authErr != nil {
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	value := new(string)
+
+	if err := c.BodyParser(value); err != nil {
+		return c.Status(400).JSON([]ResJSONError{
+			{Error: err.Error()},
+		})
+	}
+
+	return h.patchAccountFields(c, event, accountID, []db.AccountFieldsPatchOp{{Op: db.AccountFieldsPatchOpAddValues, Name: fieldName, Values: []string{*value}}})
+}
+
+// AccountLogoutAll godoc
+// @Summary Log out an account everywhere
+// @Description Requires Authorization-header with either role "admin" or with a matching account id.
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @Description Removes all renewal tokens of the account and makes all its JWTs stop working right away, including the one used for this request.
+// @ID account-logout-all
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param If-Match header string false "ETag from a previous response, the change is only made if the account is still at that version"
+// @Success 204 {string} string ""
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 404 {object} []ResJSONError
+// @Failure 412 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /accounts/{id}/logout-all [post]
+func (h Handlers) AccountLogoutAll(c *fiber.Ctx) error {
+	accountID := c.Params("accountID")
+
+	event := h.auditEvent(c, db.AuditAuthLogoutAll, accountID)
+	defer h.audit(c, event)
+
+	_, uuidErr := uuid.Parse(accountID)
+	if uuidErr != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+
+	authErr := h.RequireAdminRoleOrAccountID(c, accountID)
+	if authErr != nil {
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	ifVersion, ifMatchErr := h.ifMatchVersion(c)
+	if ifMatchErr != nil {
+		return c.Status(412).JSON([]ResJSONError{{Error: ifMatchErr.Error()}})
+	}
+
+	_, err := h.Db.AccountLogoutAll(c.UserContext(), accountID, ifVersion)
+	if err != nil {
+		return h.dbErrRes(c, err)
+	}
+
+	return c.Status(204).Send(nil)
+}
+
+// AccountRestore godoc
+// @Summary Restore a deleted account
+// @Description Requires Authorization-header with role "admin".
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @Description Only works until the deleted account is purged.
+// @ID account-restore
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param If-Match header string false "ETag from a previous response, the change is only made if the account is still at that version"
+// @Success 200 {object} db.Account
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 404 {object} []ResJSONError
+// @Failure 412 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /accounts/{id}/restore [post]
+func (h Handlers) AccountRestore(c *fiber.Ctx) error {
+	accountID := c.Params("accountID")
+
+	event := h.auditEvent(c, db.AuditAccountRestore, accountID)
+	defer h.audit(c, event)
+
+	_, uuidErr := uuid.Parse(accountID)
+	if uuidErr != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+
+	authErr := h.RequireAdminRole(c)
+	if authErr != nil {
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	ifVersion, ifMatchErr := h.ifMatchVersion(c)
+	if ifMatchErr != nil {
+		return c.Status(412).JSON([]ResJSONError{{Error: ifMatchErr.Error()}})
+	}
+
+	restoredAccount, err := h.Db.AccountRestore(c.UserContext(), accountID, ifVersion)
+	if err != nil {
+		return h.dbErrRes(c, err)
+	}
+
+	c.Set("ETag", accountETag(restoredAccount))
+	return c.Status(200).JSON(restoredAccount)
+}
+
 // AccountAuthAPIKey godoc
 // @Summary Authenticate account by API Key
 // @Description Authenticate account by API Key
@@ -99,25 +269,45 @@ func (h Handlers) AccountCreate(c *fiber.Ctx) error {
 // @Produce  json
 // @Param body body string true "API Key as a string in JSON format (just encapsulate the string with \" and you're fine)"
 // @Success 200 {object} ResToken
+// @Failure 400 {object} []ResJSONError
 // @Failure 401 {object} []ResJSONError
 // @Failure 403 {object} []ResJSONError
 // @Failure 415 {object} []ResJSONError
 // @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
 // @Router /auth/api-key [post]
 func (h Handlers) AccountAuthAPIKey(c *fiber.Ctx) error {
-	inputAPIKey := string(c.Request().Body())
-	inputAPIKey = inputAPIKey[1 : len(inputAPIKey)-1]
+	defer authAttemptCount(c, "api-key")
+
+	event := h.auditEvent(c, db.AuditAuthAPIKey, "")
+	defer h.audit(c, event)
+
+	inputAPIKey, err := stringBody(c)
+	if err != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: err.Error()}})
+	}
+	if inputAPIKey == "" {
+		return c.Status(400).JSON([]ResJSONError{{Error: "API key is empty"}}) // The hash of an empty key must never be looked up
+	}
 
-	resolvedAccount, accountErr := h.Db.AccountGet("", inputAPIKey, "")
+	resolvedAccount, accountErr := h.Db.AccountGet(c.UserContext(), "", utils.HashAPIKey(inputAPIKey), "")
 	if accountErr != nil {
-		if accountErr.Error() == "no rows in result set" {
+		if errors.Is(accountErr, db.ErrNotFound) {
 			return c.Status(403).JSON([]ResJSONError{{Error: "Invalid credentials"}})
 		}
-		h.Log.Error("Something went wrong when trying to fetch account", "err", accountErr.Error())
-		return c.Status(500).JSON([]ResJSONError{{Error: "Something went wrong when trying to fetch account"}})
+
+		return h.dbErrRes(c, accountErr)
+	}
+	event.ActorID = resolvedAccount.ID.String()
+	event.TargetID = event.ActorID
+
+	sessionID, err := h.sessionStart(c, event.ActorID, db.SessionMethodAPIKey)
+	if err != nil {
+		return h.dbErrRes(c, err)
 	}
 
-	return h.returnTokens(resolvedAccount, c)
+	return h.returnTokens(resolvedAccount, sessionID, c)
 }
 
 // AccountAuthPassword godoc
@@ -132,29 +322,42 @@ func (h Handlers) AccountAuthAPIKey(c *fiber.Ctx) error {
 // @Failure 403 {object} []ResJSONError
 // @Failure 415 {object} []ResJSONError
 // @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
 // @Router /auth/password [post]
 func (h Handlers) AccountAuthPassword(c *fiber.Ctx) error {
+	defer authAttemptCount(c, "password")
+
+	event := h.auditEvent(c, db.AuditAuthPassword, "")
+	defer h.audit(c, event)
+
 	authInput := new(AuthInput)
 	if err := c.BodyParser(authInput); err != nil {
 		return c.Status(400).JSON([]ResJSONError{{Error: err.Error()}})
 	}
+	event.Diff = db.AuditDiff(map[string]interface{}{"name": authInput.Name}) // Failed attempts on names that do not exist show up too
 
-	resolvedAccount, err := h.Db.AccountGet("", "", authInput.Name)
+	resolvedAccount, err := h.Db.AccountGet(c.UserContext(), "", "", authInput.Name)
 	if err != nil {
-		if err.Error() == "no rows in result set" {
+		if errors.Is(err, db.ErrNotFound) {
 			return c.Status(403).JSON([]ResJSONError{{Error: "Invalid name or password"}})
-		} else {
-			h.Log.Error("unknown error when resolving account", "err", err.Error())
 		}
 
-		return c.Status(500).JSON([]ResJSONError{{Error: err.Error()}})
+		return h.dbErrRes(c, err)
 	}
+	event.TargetID = resolvedAccount.ID.String()
 
-	if !utils.CheckPasswordHash(authInput.Password, resolvedAccount.Password) {
+	if !utils.CheckPasswordHash(c.UserContext(), authInput.Password, resolvedAccount.Password) {
 		return c.Status(403).JSON([]ResJSONError{{Error: "Invalid name or password"}})
 	}
+	event.ActorID = event.TargetID
+
+	sessionID, err := h.sessionStart(c, event.ActorID, db.SessionMethodPassword)
+	if err != nil {
+		return h.dbErrRes(c, err)
+	}
 
-	return h.returnTokens(resolvedAccount, c)
+	return h.returnTokens(resolvedAccount, sessionID, c)
 }
 
 // RenewToken godoc
@@ -165,36 +368,90 @@ func (h Handlers) AccountAuthPassword(c *fiber.Ctx) error {
 // @Produce  json
 // @Param body body string true "Renewal token as a string in JSON format (just encapsulate the string with \" and you're fine)"
 // @Success 200 {object} ResToken
+// @Failure 400 {object} []ResJSONError
 // @Failure 401 {object} []ResJSONError
 // @Failure 403 {object} []ResJSONError
 // @Failure 415 {object} []ResJSONError
 // @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
 // @Router /renew-token [post]
 func (h Handlers) RenewToken(c *fiber.Ctx) error {
-	inputToken := string(c.Request().Body())
-	inputToken = inputToken[1 : len(inputToken)-1]
+	defer authAttemptCount(c, "renew")
+
+	event := h.auditEvent(c, db.AuditTokenRenew, "")
+	defer h.audit(c, event)
+
+	inputToken, err := stringBody(c)
+	if err != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: err.Error()}})
+	}
 
-	foundAccountID, err := h.Db.RenewalTokenGet(inputToken)
+	// Tokens from before sessions were recorded start a session of their own
+	renewal, err := h.Db.RenewalTokenUse(c.UserContext(), inputToken, requestSession(c, db.SessionMethodRenew))
 	if err != nil {
-		return c.Status(500).JSON([]ResJSONError{{Error: err.Error()}})
-	} else if foundAccountID == "" {
-		return c.Status(403).JSON([]ResJSONError{{Error: "Invalid token"}})
+		if errors.Is(err, db.ErrNotFound) {
+			return c.Status(403).JSON([]ResJSONError{{Error: "Invalid token"}})
+		}
+		return h.dbErrRes(c, err)
 	}
+	event.TargetID = renewal.AccountID
 
-	resolvedAccount, accountErr := h.Db.AccountGet(foundAccountID, "", "")
+	resolvedAccount, accountErr := h.Db.AccountGet(c.UserContext(), renewal.AccountID, "", "")
 	if accountErr != nil {
-		if accountErr.Error() == "no rows in result set" {
+		if errors.Is(accountErr, db.ErrNotFound) {
 			return c.Status(500).JSON([]ResJSONError{{Error: "Database missmatch. Token found, but account is missing."}})
 		}
-		h.Log.Error("Something went wrong when trying to fetch account", "err", accountErr.Error())
-		return c.Status(500).JSON([]ResJSONError{{Error: "Something went wrong when trying to fetch account"}})
+
+		return h.dbErrRes(c, accountErr)
+	}
+	event.ActorID = renewal.AccountID
+
+	return h.tokensRes(c, resolvedAccount, renewal.SessionID, renewal.Generation, renewal.RenewalToken)
+}
+
+// Logout godoc
+// @Summary Log out
+// @Description Revokes the given renewal token, so its session can no longer be renewed. JWTs already handed out stay valid until they expire.
+// @ID logout
+// @Accept  json
+// @Produce  json
+// @Param body body string true "Renewal token as a string in JSON format (just encapsulate the string with \" and you're fine)"
+// @Success 204 {string} string ""
+// @Failure 400 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /logout [post]
+func (h Handlers) Logout(c *fiber.Ctx) error {
+	event := h.auditEvent(c, db.AuditAuthLogout, "")
+	defer h.audit(c, event)
+
+	inputToken, err := stringBody(c)
+	if err != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: err.Error()}})
+	}
+
+	found, err := h.Db.RenewalTokenGet(c.UserContext(), inputToken)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return c.Status(403).JSON([]ResJSONError{{Error: "Invalid token"}})
+		}
+		return h.dbErrRes(c, err)
 	}
+	event.ActorID = found.AccountID
+	event.TargetID = found.AccountID
 
-	rmErr := h.Db.RenewalTokenRm(inputToken)
+	// A logout of the same token that finished in between removed it already
+	rmErr := h.Db.RenewalTokenRm(c.UserContext(), inputToken)
 	if rmErr != nil {
-		h.Log.Error("Something went wrong when trying to fetch account", "err", rmErr.Error())
-		return c.Status(500).JSON([]ResJSONError{{Error: "Could not remove old token"}})
+		if errors.Is(rmErr, db.ErrNotFound) {
+			return c.Status(403).JSON([]ResJSONError{{Error: "Invalid token"}})
+		}
+		return h.dbErrRes(c, rmErr)
 	}
 
-	return h.returnTokens(resolvedAccount, c)
+	return c.Status(204).Send(nil)
 }
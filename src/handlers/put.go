@@ -15,29 +15,37 @@ import (
 // @Accept  json
 // @Produce  json
 // @Param body body []db.AccountCreateInputFields true "Fields array with objects to be written to database"
+// @Param If-Match header string false "ETag from a previous response, the change is only made if the account is still at that version"
 // @Success 200 {object} db.Account
 // @Failure 400 {object} []ResJSONError
 // @Failure 401 {object} []ResJSONError
 // @Failure 403 {object} []ResJSONError
+// @Failure 404 {object} []ResJSONError
+// @Failure 412 {object} []ResJSONError
 // @Failure 415 {object} []ResJSONError
 // @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
 // @Router /accounts/{id}/fields [put]
 func (h Handlers) AccountUpdateFields(c *fiber.Ctx) error {
 	accountID := c.Params("accountID")
 
-	h.Log.Context = []interface{}{
+	event := h.auditEvent(c, db.AuditFieldsUpdate, accountID)
+	defer h.audit(c, event)
+
+	log := h.log(c,
 		"accountID", accountID,
-	}
+	)
 
 	_, uuidErr := uuid.Parse(accountID)
 	if uuidErr != nil {
-		h.Log.Debug("client supplied invalid uuid format")
+		log.Debug("client supplied invalid uuid format")
 		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
 	}
 
 	authErr := h.RequireAdminRole(c)
 	if authErr != nil {
-		h.Log.Debug("client does not have admin role")
+		log.Debug("client does not have admin role")
 		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
 	}
 
@@ -48,11 +56,141 @@ func (h Handlers) AccountUpdateFields(c *fiber.Ctx) error {
 			{Error: err.Error()},
 		})
 	}
+	event.Diff = db.AuditDiff(map[string]interface{}{"fields": db.AuditFields(*fieldsInput)})
+
+	ifVersion, ifMatchErr := h.ifMatchVersion(c)
+	if ifMatchErr != nil {
+		return c.Status(412).JSON([]ResJSONError{{Error: ifMatchErr.Error()}})
+	}
+
+	updatedAccount, err := h.Db.AccountUpdateFields(c.UserContext(), accountID, *fieldsInput, ifVersion)
+	if err != nil {
+		return h.dbErrRes(c, err)
+	}
+
+	c.Set("ETag", accountETag(updatedAccount))
+	return c.Status(200).JSON(updatedAccount)
+}
+
+// AccountFieldSet godoc
+// @Summary Set the values of a single account field
+// @Description Requires Authorization-header with role "admin".
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @Description The field is created if it does not exist, other fields are left untouched.
+// @ID account-field-set
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param fieldName path string true "Field name"
+// @Param body body []string true "All values of the field"
+// @Param If-Match header string false "ETag from a previous response, the change is only made if the account is still at that version"
+// @Success 200 {object} db.Account
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 404 {object} []ResJSONError
+// @Failure 412 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /accounts/{id}/fields/{fieldName} [put]
+func (h Handlers) AccountFieldSet(c *fiber.Ctx) error {
+	accountID := c.Params("accountID")
+
+	event := h.auditEvent(c, db.AuditFieldsUpdate, accountID)
+	defer h.audit(c, event)
+
+	_, uuidErr := uuid.Parse(accountID)
+	if uuidErr != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+
+	fieldName, err := h.pathParam(c, "fieldName")
+	if err != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid field name encoding"}})
+	}
+
+	authErr := h.RequireAdminRole(c)
+	if authErr != nil {
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	values := new([]string)
+
+	if err := c.BodyParser(values); err != nil {
+		return c.Status(400).JSON([]ResJSONError{
+			{Error: err.Error()},
+		})
+	}
+
+	return h.patchAccountFields(c, event, accountID, []db.AccountFieldsPatchOp{{Op: db.AccountFieldsPatchOpSet, Name: fieldName, Values: *values}})
+}
+
+// AccountRename godoc
+// @Summary Rename an account
+// @Description Requires Authorization-header with role "admin".
+// @Description Example: Authorization: bearer xxx
+// @Description Where "xxx" is a valid JWT token
+// @Description The id, fields and API key of the account are kept. The old name is reserved for this account for a while, so nobody else can register it.
+// @ID account-rename
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Account ID"
+// @Param body body string true "New name as a string in JSON format (just encapsulate the string with \" and you're fine)"
+// @Param If-Match header string false "ETag from a previous response, the change is only made if the account is still at that version"
+// @Success 200 {object} db.Account
+// @Failure 400 {object} []ResJSONError
+// @Failure 401 {object} []ResJSONError
+// @Failure 403 {object} []ResJSONError
+// @Failure 404 {object} []ResJSONError
+// @Failure 409 {object} []ResJSONError
+// @Failure 412 {object} []ResJSONError
+// @Failure 415 {object} []ResJSONError
+// @Failure 500 {object} []ResJSONError
+// @Failure 503 {object} []ResJSONError
+// @Failure 504 {object} []ResJSONError
+// @Router /accounts/{id}/name [put]
+func (h Handlers) AccountRename(c *fiber.Ctx) error {
+	accountID := c.Params("accountID")
+
+	event := h.auditEvent(c, db.AuditAccountRename, accountID)
+	defer h.audit(c, event)
+
+	_, uuidErr := uuid.Parse(accountID)
+	if uuidErr != nil {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Invalid uuid format"}})
+	}
+
+	authErr := h.RequireAdminRole(c)
+	if authErr != nil {
+		return c.Status(403).JSON([]ResJSONError{{Error: authErr.Error()}})
+	}
+
+	newName := new(string)
+
+	if err := c.BodyParser(newName); err != nil {
+		return c.Status(400).JSON([]ResJSONError{
+			{Error: err.Error()},
+		})
+	}
+
+	if *newName == "" {
+		return c.Status(400).JSON([]ResJSONError{{Error: "Can not be empty", Field: "name"}})
+	}
+	event.Diff = db.AuditDiff(map[string]interface{}{"name": *newName})
+
+	ifVersion, ifMatchErr := h.ifMatchVersion(c)
+	if ifMatchErr != nil {
+		return c.Status(412).JSON([]ResJSONError{{Error: ifMatchErr.Error()}})
+	}
 
-	updatedAccount, err := h.Db.AccountUpdateFields(accountID, *fieldsInput)
+	updatedAccount, err := h.Db.AccountRename(c.UserContext(), accountID, *newName, ifVersion)
 	if err != nil {
-		return c.Status(500).JSON([]ResJSONError{{Error: "Internal server error"}})
+		return h.dbErrRes(c, err)
 	}
 
+	c.Set("ETag", accountETag(updatedAccount))
 	return c.Status(200).JSON(updatedAccount)
 }
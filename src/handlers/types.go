@@ -1,6 +1,9 @@
 package handlers
 
 import (
+	"sync/atomic"
+	"time"
+
 	"gitea.larvit.se/pwrpln/auth-api/src/db"
 	"gitea.larvit.se/pwrpln/go_log"
 	jwt "github.com/dgrijalva/jwt-go"
@@ -11,14 +14,18 @@ type Claims struct {
 	AccountID     string              `json:"accountId"`
 	AccountFields map[string][]string `json:"accountFields"`
 	AccountName   string              `json:"accountName"`
+	SessionID     string              `json:"sid,omitempty"`
+	Generation    int64               `json:"gen,omitempty"` // Token generation of the account when the JWT was issued
 	jwt.StandardClaims
 }
 
 // Handlers is the overall struct for all http request handlers
 type Handlers struct {
-	Db     db.Db
-	JwtKey []byte
-	Log    go_log.Log
+	Db             db.Store
+	JwtKey         []byte
+	Log            go_log.Log
+	RequestTimeout time.Duration // Max time for a request to finish its database work, 0 means no limit
+	ShuttingDown   *atomic.Bool  // Set when the server starts shutting down, readiness fails from then on
 }
 
 // ResJSONError is an error field that is used in JSON error responses
@@ -2,42 +2,76 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"gitea.larvit.se/pwrpln/auth-api/src/config"
 	"gitea.larvit.se/pwrpln/auth-api/src/db"
 	h "gitea.larvit.se/pwrpln/auth-api/src/handlers"
+	"gitea.larvit.se/pwrpln/auth-api/src/metrics"
+	"gitea.larvit.se/pwrpln/auth-api/src/tracing"
 	"gitea.larvit.se/pwrpln/go_log"
 	swagger "github.com/arsmn/fiber-swagger/v2"
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"go.opentelemetry.io/otel/attribute"
 
 	// docs are generated by Swag CLI, you have to import them.
 	_ "gitea.larvit.se/pwrpln/auth-api/src/docs"
 )
 
-// Don't put in utils, because it creates import cycle with db... just left it here for now
-func createAdminAccount(Db db.Db, log go_log.Log, ADMIN_API_KEY string) {
-	adminAccountID, uuidErr := uuid.NewRandom()
-	if uuidErr != nil {
-		log.Error("Could not create new Uuid", "err", uuidErr.Error())
-		os.Exit(1)
+// openStore connects to the database in DATABASE_URL, the returned close func must be called when done
+func openStore(cfg config.Config, log go_log.Log) (db.Store, func()) {
+	DATABASE_URL := cfg.DatabaseURL
+
+	if strings.HasPrefix(DATABASE_URL, "memory:") {
+		log.Warn("DATABASE_URL is \"memory://\", all data is kept in memory and lost on restart")
+		return &db.Memory{DeletedRetention: cfg.DeletedRetention, Log: log, OldNameReservation: cfg.OldNameReservation}, func() {}
+	}
+
+	if strings.HasPrefix(DATABASE_URL, "sqlite:") {
+		sqlDB, err := db.SQLiteOpen(DATABASE_URL)
+		if err != nil {
+			log.Error("Could not open SQLite database", "err", err.Error())
+			os.Exit(1)
+		}
+		log.Verbose("Opened SQLite database")
+
+		metrics.SQLiteRegister(sqlDB)
+
+		return db.SQLite{DB: sqlDB, DeletedRetention: cfg.DeletedRetention, Log: log, OldNameReservation: cfg.OldNameReservation, QueryTimeout: cfg.DBQueryTimeout}, func() { sqlDB.Close() }
+	}
+
+	dbPool, err := pgxpool.Connect(context.Background(), DATABASE_URL)
+	for err != nil {
+		log.Warn("Failed to open connection to PostgreSQL database, retrying in 1 second", "err", err.Error())
+		time.Sleep(1 * time.Second)
+		dbPool, err = pgxpool.Connect(context.Background(), DATABASE_URL)
 	}
-	_, adminAccountErr := Db.AccountCreate(db.AccountCreateInput{
-		ID:       adminAccountID,
-		Name:     "admin",
-		APIKey:   ADMIN_API_KEY,
-		Password: "",
-		Fields:   []db.AccountCreateInputFields{{Name: "role", Values: []string{"admin"}}},
-	})
-	if adminAccountErr != nil && strings.HasPrefix(adminAccountErr.Error(), "ERROR: duplicate key") {
-		log.Verbose("Admin account already created, nothing written to database")
-	} else if adminAccountErr != nil {
-		log.Error("Could not create admin account", "err", adminAccountErr.Error())
-		os.Exit(1)
+	log.Verbose("Connected to PostgreSQL database")
+
+	metrics.PgxPoolRegister(dbPool)
+
+	return db.Db{DbPool: dbPool, DeletedRetention: cfg.DeletedRetention, Log: log, OldNameReservation: cfg.OldNameReservation, QueryTimeout: cfg.DBQueryTimeout}, dbPool.Close
+}
+
+// tracedSystem is the database system that spans of database calls are tagged with
+func tracedSystem(databaseURL string) attribute.KeyValue {
+	switch {
+	case strings.HasPrefix(databaseURL, "memory:"):
+		return db.TracedSystemMemory
+	case strings.HasPrefix(databaseURL, "sqlite:"):
+		return db.TracedSystemSQLite
 	}
+
+	return db.TracedSystemPostgreSQL
 }
 
 // @title JWT Auth API
@@ -54,47 +88,128 @@ func createAdminAccount(Db db.Db, log go_log.Log, ADMIN_API_KEY string) {
 func main() {
 	log := go_log.GetLog()
 
-	if os.Getenv("JWT_SHARED_SECRET") == "changeMe" {
-		log.Warn("JWT_SHARED_SECRET ENV is not set, using very insecure \"changeMe\"")
+	cfg, args, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Print(usage)
+		os.Exit(0)
+	} else if err != nil {
+		log.Error("Could not load config", "err", err.Error())
+		os.Exit(2)
 	}
-	if os.Getenv("ADMIN_API_KEY") == "changeMe" {
-		log.Warn("ADMIN_API_KEY ENV is not set, using very insecure \"changeMe\"")
+
+	cmd := "serve"
+	if len(args) != 0 {
+		cmd, args = args[0], args[1:]
 	}
-	if os.Getenv("LOG_MIN_LVL") == "" {
-		log.Info("LOG_MIN_LVL ENV is not set, using default \"Info\"")
-		log.MinLogLvl = go_log.LogLvlFromStr("Info")
-	} else {
-		minLogLvl := go_log.LogLvlFromStr(os.Getenv("LOG_MIN_LVL"))
-
-		if minLogLvl == 0 {
-			log.Warn("Invalid LOG_MIN_LVL ENV, using default \"Info\"")
-			log.MinLogLvl = go_log.LogLvlFromStr("Info")
-		} else {
-			log.MinLogLvl = minLogLvl
-		}
+
+	// Keep the output of the other commands clean, unless a log level is asked for
+	if cfg.LogMinLvl == "" && cmd == "serve" {
+		log.Info("LOG_MIN_LVL is not set, using default \"Info\"")
+		cfg.LogMinLvl = "Info"
+	} else if cfg.LogMinLvl == "" || go_log.LogLvlFromStr(cfg.LogMinLvl) == 0 {
+		cfg.LogMinLvl = "Warn"
 	}
+	log.MinLogLvl = go_log.LogLvlFromStr(cfg.LogMinLvl)
 
-	ADMIN_API_KEY := os.Getenv("ADMIN_API_KEY")
-	WEB_BIND_HOST := os.Getenv("WEB_BIND_HOST")
-	DATABASE_URL := os.Getenv("DATABASE_URL")
+	os.Exit(runCmd(cfg, log, cmd, args))
+}
 
-	jwtKey := []byte(os.Getenv("JWT_SHARED_SECRET"))
+// serve runs the web server until it is closed
+func serve(cfg config.Config, log go_log.Log, args []string) int {
+	if len(args) != 0 {
+		log.Error("serve takes no arguments")
+		return 2
+	}
 
-	dbPool, err := pgxpool.Connect(context.Background(), DATABASE_URL)
-	for err != nil {
-		log.Warn("Failed to open connection to PostgreSQL database, retrying in 1 second", "err", err.Error())
-		time.Sleep(1 * time.Second)
-		dbPool, err = pgxpool.Connect(context.Background(), DATABASE_URL)
+	if !configValidate(cfg, log, true) {
+		return 1
 	}
-	log.Verbose("Connected to PostgreSQL database")
-	defer dbPool.Close()
+
+	WEB_BIND_HOST := cfg.WebBindHost
+
+	jwtKey := []byte(cfg.JWTSharedSecret)
+
+	store, closeStore := openStore(cfg, log)
+	defer closeStore()
+
+	migrationsEnsure(store, log, cfg.DBAutoMigrate)
+
+	stopTracing, err := tracing.Start(context.Background(), cfg.TracesExporter)
+	if err != nil {
+		log.Error("Could not start tracing", "err", err.Error(), "TRACES_EXPORTER", cfg.TracesExporter)
+		return 1
+	}
+	defer func() {
+		// Send the spans that are left, without holding up the exit for long if the collector is gone
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := stopTracing(ctx)
+		if err != nil {
+			log.Warn("Could not send the last spans", "err", err.Error())
+		}
+	}()
 
 	app := fiber.New()
 
-	Db := db.Db{DbPool: dbPool, Log: log}
-	handlers := h.Handlers{Db: Db, JwtKey: jwtKey, Log: log}
+	shuttingDown := &atomic.Bool{}
+	handlers := h.Handlers{Db: db.Traced{Store: store, System: tracedSystem(cfg.DatabaseURL)}, JwtKey: jwtKey, Log: log, RequestTimeout: cfg.RequestTimeout, ShuttingDown: shuttingDown}
+
+	err = adminReconcile(context.Background(), store, log, cfg)
+	if err != nil {
+		log.Error("Could not reconcile admin account", "err", err.Error())
+		return 1
+	}
+
+	if cfg.SeedFile != "" {
+		err = seedRun(context.Background(), store, log, cfg)
+		if err != nil {
+			log.Error("Could not apply seed file", "err", err.Error(), "SEED_FILE", cfg.SeedFile)
+			return 1
+		}
+	}
+
+	// Stopped on shutdown, before the database connections are closed
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// Permanently remove accounts that have been deleted for longer than the retention period
+	go func() {
+		for {
+			store.AccountsPurge(backgroundCtx)
+			select {
+			case <-backgroundCtx.Done():
+				return
+			case <-time.After(1 * time.Hour):
+			}
+		}
+	}()
+
+	// Sign the end of the audit chain, so it can not be cut off or rewritten without JWT_SHARED_SECRET
+	if cfg.AuditCheckpoints != 0 {
+		go func() {
+			for {
+				auditSign(backgroundCtx, store, log, jwtKey)
+				select {
+				case <-backgroundCtx.Done():
+					return
+				case <-time.After(cfg.AuditCheckpoints):
+				}
+			}
+		}()
+	}
+
+	metrics.RenewalTokensRegister(store.RenewalTokensCount, log)
+
+	// Health checks and metrics come before the middlewares, so probes and scrapes are not logged or counted and need no content-type
+	app.Get("/healthz", handlers.Healthz)
+	app.Get("/metrics", handlers.MetricsGet)
+	app.Get("/readyz", handlers.Ready)
 
-	createAdminAccount(Db, log, ADMIN_API_KEY)
+	// Count all requests and how long they take
+	app.Use(handlers.Metrics)
+
+	// Trace all requests, continuing the trace of the caller
+	app.Use(handlers.Trace)
 
 	// Log all requests
 	app.Use(handlers.LogReq)
@@ -102,27 +217,55 @@ func main() {
 	// Always require application/json
 	app.Use(handlers.RequireJSON)
 
+	// Cancel database calls for requests that take too long or whose client hung up
+	app.Use(handlers.ReqTimeout)
+
 	app.Get("/", func(c *fiber.Ctx) error { return c.Redirect("/swagger/index.html") })
 	app.Get("/swagger", func(c *fiber.Ctx) error { return c.Redirect("/swagger/index.html") })
 	app.Get("/swagger/*", swagger.HandlerDefault)
 
 	app.Delete("/accounts/:accountID", handlers.AccountDel)
+	app.Get("/accounts", handlers.AccountsGet)
 	app.Get("/accounts/:accountID", handlers.AccountGet)
 	app.Post("/accounts", handlers.AccountCreate)
-	// app.Get("/accounts", handlers.AccountsGet)
+	app.Post("/accounts/:accountID/restore", handlers.AccountRestore)
+	app.Get("/audit-events", handlers.AuditEventsGet)
 	app.Post("/auth/api-key", handlers.AccountAuthAPIKey)
 	app.Post("/auth/password", handlers.AccountAuthPassword)
 	app.Post("/renew-token", handlers.RenewToken)
+	app.Post("/logout", handlers.Logout)
+	app.Post("/accounts/:accountID/logout-all", handlers.AccountLogoutAll)
+	app.Patch("/accounts/:accountID/fields", handlers.AccountPatchFields)
 	app.Put("/accounts/:accountID/fields", handlers.AccountUpdateFields)
+	app.Put("/accounts/:accountID/name", handlers.AccountRename)
+	app.Delete("/accounts/:accountID/fields/:fieldName", handlers.AccountFieldDel)
+	app.Get("/accounts/:accountID/fields/:fieldName", handlers.AccountFieldGet)
+	app.Put("/accounts/:accountID/fields/:fieldName", handlers.AccountFieldSet)
+	app.Post("/accounts/:accountID/fields/:fieldName/values", handlers.AccountFieldValueAdd)
+	app.Delete("/accounts/:accountID/fields/:fieldName/values/:value", handlers.AccountFieldValueDel)
+	app.Get("/accounts/:accountID/sessions", handlers.AccountSessionsGet)
+	app.Delete("/accounts/:accountID/sessions/:sessionID", handlers.AccountSessionDel)
+
+	// The first SIGINT or SIGTERM starts a graceful shutdown, a second one exits right away
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
 
 	log.Info("Starting web server", "WEB_BIND_HOST", WEB_BIND_HOST)
 
-	err = app.Listen(WEB_BIND_HOST)
-	for err != nil {
-		log.Warn("Could not start web server", "err", err.Error(), "WEB_BIND_HOST", WEB_BIND_HOST)
-		time.Sleep(1 * time.Second)
-		err = app.Listen(WEB_BIND_HOST)
-	}
+	serverClosed := make(chan struct{})
+	go func() {
+		listen(app, log, shuttingDown, WEB_BIND_HOST)
+		close(serverClosed)
+	}()
 
-	log.Info("Web server closed, shutting down")
+	select {
+	case sig := <-signals:
+		exitCode := shutdown(app, log, cfg, shuttingDown, signals, sig)
+		log.Info("Web server closed", "exitCode", exitCode)
+		return exitCode
+	case <-serverClosed:
+		log.Error("Web server closed without a signal, shutting down")
+		return 1
+	}
 }
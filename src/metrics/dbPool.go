@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"database/sql"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// pgxPoolCollector reads the statistics of a pgxpool on every scrape
+type pgxPoolCollector struct {
+	pool *pgxpool.Pool
+
+	acquireCount         *prometheus.Desc
+	acquireDuration      *prometheus.Desc
+	acquiredConns        *prometheus.Desc
+	canceledAcquireCount *prometheus.Desc
+	constructingConns    *prometheus.Desc
+	emptyAcquireCount    *prometheus.Desc
+	idleConns            *prometheus.Desc
+	maxConns             *prometheus.Desc
+	totalConns           *prometheus.Desc
+}
+
+// PgxPoolRegister adds the statistics of the PostgreSQL connection pool
+func PgxPoolRegister(pool *pgxpool.Pool) {
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+	}
+
+	Registry.MustRegister(pgxPoolCollector{
+		pool: pool,
+
+		acquireCount:         desc("acquires_total", "Connections acquired from the pool."),
+		acquireDuration:      desc("acquire_duration_seconds_total", "Time spent waiting for connections from the pool."),
+		acquiredConns:        desc("acquired_conns", "Connections in use."),
+		canceledAcquireCount: desc("canceled_acquires_total", "Acquires canceled by their context."),
+		constructingConns:    desc("constructing_conns", "Connections being opened."),
+		emptyAcquireCount:    desc("empty_acquires_total", "Acquires that had to wait because the pool was empty."),
+		idleConns:            desc("idle_conns", "Idle connections."),
+		maxConns:             desc("max_conns", "Max connections in the pool."),
+		totalConns:           desc("total_conns", "All connections in the pool."),
+	})
+}
+
+// SQLiteRegister adds the statistics of the SQLite connection pool of database/sql
+func SQLiteRegister(db *sql.DB) {
+	Registry.MustRegister(collectors.NewDBStatsCollector(db, "sqlite"))
+}
+
+func (c pgxPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+func (c pgxPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+
+	ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.acquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.canceledAcquireCount, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.constructingConns, prometheus.GaugeValue, float64(stat.ConstructingConns()))
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquireCount, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+}
@@ -0,0 +1,91 @@
+// Package metrics has the Prometheus metrics of auth-api, they are served on /metrics
+package metrics
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"gitea.larvit.se/pwrpln/go_log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// namespace is the prefix of all metric names
+const namespace = "auth_api"
+
+// Registry has all metrics of auth-api, with the Go runtime and process metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// AuthAttempts counts auth attempts by method ("api-key", "password" or "renew") and outcome
+	AuthAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_attempts_total",
+		Help:      "Auth attempts by method and outcome.",
+	}, []string{"method", "outcome"})
+
+	// HTTPRequestDuration is the time it takes to respond, by method and route
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time to respond to HTTP requests by method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// HTTPRequests counts the HTTP requests by method, route and status code
+	// The route is the pattern, like "/accounts/:accountID", to keep the number of label values down.
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	// PasswordHashDuration is the time bcrypt takes, by operation ("hash" or "check")
+	PasswordHashDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "password_hash_duration_seconds",
+		Help:      "Time to hash or check a password by operation.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 1.5, 2, 3, 5},
+	}, []string{"operation"})
+
+	// TokensIssued counts the issued JWTs, each comes with a renewal token
+	TokensIssued = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tokens_issued_total",
+		Help:      "JWTs issued, each with a renewal token.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		AuthAttempts,
+		HTTPRequestDuration,
+		HTTPRequests,
+		PasswordHashDuration,
+		TokensIssued,
+	)
+}
+
+// RenewalTokensRegister adds a gauge of the renewal tokens that have not expired, count is called on every scrape
+// A failed count is logged and reported as NaN, so it shows up as a gap instead of a drop to zero.
+func RenewalTokensRegister(count func(ctx context.Context) (int, error), log go_log.Log) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "renewal_tokens_active",
+		Help:      "Renewal tokens that have not expired.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		active, err := count(ctx)
+		if err != nil {
+			log.Warn("Could not count renewal tokens for metrics", "err", err.Error())
+			return math.NaN()
+		}
+
+		return float64(active)
+	}))
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"gitea.larvit.se/pwrpln/go_log"
+)
+
+// migrateCmd runs "migrate up", "migrate down" or "migrate status" and returns the exit code
+func migrateCmd(store db.Store, log go_log.Log, args []string) int {
+	migrator, ok := store.(db.Migrator)
+	if !ok {
+		log.Error("DATABASE_URL has no schema to migrate")
+		return 1
+	}
+
+	if len(args) != 1 {
+		log.Error("Usage: migrate up|down|status")
+		return 1
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.MigrateUp(ctx)
+		if err != nil {
+			log.Error("Could not migrate up", "err", err.Error())
+			return 1
+		}
+		log.Info("Database schema is up to date", "applied", len(applied))
+	case "down":
+		migration, err := migrator.MigrateDown(ctx)
+		if err != nil {
+			log.Error("Could not migrate down", "err", err.Error())
+			return 1
+		}
+		log.Info("Rolled back migration", "migration", migration.Name)
+	case "status":
+		statuses, err := migrator.MigrateStatus(ctx)
+		if err != nil {
+			log.Error("Could not get migration status", "err", err.Error())
+			return 1
+		}
+
+		// Exit with 1 if the schema does not match, so scripts can check it
+		exitCode := 0
+		for _, status := range statuses {
+			if status.Name == "" {
+				fmt.Println("[?] " + status.Version + " (applied by a newer version)")
+				exitCode = 1
+			} else if status.Applied {
+				fmt.Println("[X] " + status.Name)
+			} else {
+				fmt.Println("[ ] " + status.Name)
+				exitCode = 1
+			}
+		}
+
+		return exitCode
+	default:
+		log.Error("Unknown migrate command \"" + args[0] + "\", must be up, down or status")
+		return 1
+	}
+
+	return 0
+}
+
+// migrationsEnsure migrates the database if DB_AUTO_MIGRATE is set and exits if the schema does not match the binary
+func migrationsEnsure(store db.Store, log go_log.Log, autoMigrate bool) {
+	migrator, ok := store.(db.Migrator)
+	if !ok {
+		return
+	}
+
+	ctx := context.Background()
+
+	if autoMigrate {
+		applied, err := migrator.MigrateUp(ctx)
+		if err != nil {
+			log.Error("Could not auto migrate database", "err", err.Error())
+			os.Exit(1)
+		}
+		if len(applied) != 0 {
+			log.Info("Auto migrated database", "applied", len(applied))
+		}
+	}
+
+	err := db.MigrationsCheck(ctx, migrator)
+	if err != nil {
+		log.Error("Database schema does not match this version of auth-api, refusing to start", "err", err.Error())
+		os.Exit(1)
+	}
+}
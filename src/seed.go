@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/config"
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"gitea.larvit.se/pwrpln/go_log"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// seedFile is the format of SEED_FILE, YAML or JSON
+type seedFile struct {
+	Accounts []seedAccount `yaml:"accounts"`
+}
+
+// seedAccount is an account declared in the seed file, it is matched with the existing accounts by name
+// Fields that are not declared, and the API key and password when their hashes are empty, are left as they are.
+type seedAccount struct {
+	APIKeyHash   string              `yaml:"apiKeyHash"` // SHA-256 of the API key, hex encoded, like from "printf %s KEY | sha256sum"
+	Fields       map[string][]string `yaml:"fields"`
+	ID           string              `yaml:"id"` // Only used when the account is created, random if empty
+	Name         string              `yaml:"name"`
+	PasswordHash string              `yaml:"passwordHash"` // bcrypt hash
+}
+
+// seedChange is what has to be done to make one account match the seed file
+type seedChange struct {
+	account    seedAccount
+	accountID  string // Empty if the account is created
+	apiKeyHash bool
+	fieldOps   []db.AccountFieldsPatchOp
+	fieldsWas  map[string][]string
+	password   bool
+}
+
+// diff describes the change, one line per changed thing, without the hashes
+func (c seedChange) diff() []string {
+	if c.accountID == "" {
+		return []string{"+ " + c.account.Name}
+	}
+
+	var lines []string
+	if c.apiKeyHash {
+		lines = append(lines, "~ "+c.account.Name+" apiKeyHash")
+	}
+	if c.password {
+		lines = append(lines, "~ "+c.account.Name+" passwordHash")
+	}
+	for _, op := range c.fieldOps {
+		lines = append(lines, fmt.Sprintf("~ %s fields.%s: %q -> %q", c.account.Name, op.Name, c.fieldsWas[op.Name], op.Values))
+	}
+
+	return lines
+}
+
+// seedRead reads and validates a seed file
+// The admin account can not be declared while it is managed by ADMIN_BOOTSTRAP, they would undo each other on every start.
+func seedRead(cfg config.Config, fileName string) (seedFile, error) {
+	var seed seedFile
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return seed, errors.New("could not read seed file: " + err.Error())
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	err = decoder.Decode(&seed)
+	if err != nil && !errors.Is(err, io.EOF) { // An empty file declares no accounts
+		return seed, errors.New("invalid seed file " + fileName + ": " + err.Error())
+	}
+
+	names := map[string]bool{}
+	for i, account := range seed.Accounts {
+		switch {
+		case account.Name == "":
+			return seed, db.ValidationError{Field: "name", Msg: "every account in the seed file needs a name"}
+		case names[account.Name]:
+			return seed, db.ValidationError{Field: "name", Msg: "account " + account.Name + " is in the seed file more than once"}
+		case account.Name == adminAccountName && cfg.AdminBootstrap:
+			return seed, db.ValidationError{Field: "name", Msg: "the admin account is managed by ADMIN_BOOTSTRAP, set ADMIN_BOOTSTRAP=false to declare it in the seed file"}
+		}
+		names[account.Name] = true
+
+		if account.ID != "" {
+			_, err := uuid.Parse(account.ID)
+			if err != nil {
+				return seed, db.ValidationError{Field: "id", Msg: "invalid id of account " + account.Name}
+			}
+		}
+
+		if account.APIKeyHash != "" {
+			decoded, err := hex.DecodeString(account.APIKeyHash)
+			if err != nil || len(decoded) != 32 || strings.ToLower(account.APIKeyHash) != account.APIKeyHash {
+				return seed, db.ValidationError{Field: "apiKeyHash", Msg: "apiKeyHash of account " + account.Name + " must be a SHA-256 as 64 lower case hex characters"}
+			}
+		}
+
+		if account.PasswordHash != "" {
+			_, err := bcrypt.Cost([]byte(account.PasswordHash))
+			if err != nil {
+				return seed, db.ValidationError{Field: "passwordHash", Msg: "passwordHash of account " + account.Name + " must be a bcrypt hash"}
+			}
+		}
+
+		for fieldName, values := range account.Fields {
+			if fieldName == "" {
+				return seed, db.ValidationError{Field: "fields", Msg: "empty field name in account " + account.Name}
+			}
+			if values == nil {
+				seed.Accounts[i].Fields[fieldName] = []string{} // "fieldName:" with no values in YAML
+			}
+		}
+	}
+
+	return seed, nil
+}
+
+// seedPlan compares the seed file with the accounts in the store, accounts that match it are left out
+func seedPlan(ctx context.Context, store db.Store, seed seedFile) ([]seedChange, error) {
+	var changes []seedChange
+
+	for _, declared := range seed.Accounts {
+		account, err := store.AccountGet(ctx, "", "", declared.Name)
+		if errors.Is(err, db.ErrNotFound) {
+			changes = append(changes, seedChange{account: declared})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		change := seedChange{
+			account:    declared,
+			accountID:  account.ID.String(),
+			apiKeyHash: declared.APIKeyHash != "" && declared.APIKeyHash != account.APIKeyHash,
+			fieldsWas:  account.Fields,
+			password:   declared.PasswordHash != "" && declared.PasswordHash != account.Password,
+		}
+
+		for _, fieldName := range seedFieldNames(declared) {
+			values := declared.Fields[fieldName]
+			if !valuesEqual(account.Fields[fieldName], values) {
+				change.fieldOps = append(change.fieldOps, db.AccountFieldsPatchOp{Op: db.AccountFieldsPatchOpSet, Name: fieldName, Values: values})
+			}
+		}
+
+		if change.apiKeyHash || change.password || len(change.fieldOps) != 0 {
+			changes = append(changes, change)
+		}
+	}
+
+	return changes, nil
+}
+
+// seedApply makes the changes from seedPlan()
+func seedApply(ctx context.Context, store db.Store, log go_log.Log, changes []seedChange) error {
+	for _, change := range changes {
+		declared := change.account
+
+		if change.accountID == "" {
+			err := seedAccountCreate(ctx, store, log, declared)
+			if err != nil {
+				return err
+			}
+			log.Info("Created account from seed file", "name", declared.Name)
+			continue
+		}
+
+		if change.apiKeyHash {
+			err := store.AccountAPIKeySet(ctx, change.accountID, declared.APIKeyHash)
+			audit(ctx, store, log, auditSourceSeed, db.AuditEvent{Action: db.AuditAPIKeySet, TargetID: change.accountID, Diff: db.AuditDiff(map[string]interface{}{"apiKey": db.AuditRedacted})}, err)
+			if err != nil {
+				return err
+			}
+		}
+
+		if change.password {
+			err := store.AccountPasswordSet(ctx, change.accountID, declared.PasswordHash)
+			audit(ctx, store, log, auditSourceSeed, db.AuditEvent{Action: db.AuditPasswordSet, TargetID: change.accountID, Diff: db.AuditDiff(map[string]interface{}{"password": db.AuditRedacted})}, err)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(change.fieldOps) != 0 {
+			_, err := store.AccountPatchFields(ctx, change.accountID, change.fieldOps, 0)
+			audit(ctx, store, log, auditSourceSeed, db.AuditEvent{Action: db.AuditFieldsUpdate, TargetID: change.accountID, Diff: db.AuditDiff(map[string]interface{}{"ops": change.fieldOps})}, err)
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Info("Updated account from seed file", "name", declared.Name, "accountID", change.accountID, "changes", change.diff())
+	}
+
+	return nil
+}
+
+func seedAccountCreate(ctx context.Context, store db.Store, log go_log.Log, declared seedAccount) error {
+	accountID := uuid.New()
+	if declared.ID != "" {
+		accountID = uuid.MustParse(declared.ID) // Checked by seedRead()
+	}
+
+	fields := make([]db.AccountCreateInputFields, 0, len(declared.Fields))
+	for _, fieldName := range seedFieldNames(declared) {
+		fields = append(fields, db.AccountCreateInputFields{Name: fieldName, Values: declared.Fields[fieldName]})
+	}
+
+	input := db.AccountCreateInput{
+		ID:         accountID,
+		Name:       declared.Name,
+		APIKeyHash: declared.APIKeyHash,
+		Fields:     fields,
+		Password:   declared.PasswordHash,
+	}
+	_, err := store.AccountCreate(ctx, input)
+	audit(ctx, store, log, auditSourceSeed, accountCreateAuditEvent(input), err)
+	if errors.Is(err, db.ErrConflict) {
+		// The name, or the id, is taken by a deleted or renamed account
+		return errors.New("could not create account " + declared.Name + " from seed file: " + err.Error())
+	}
+
+	return err
+}
+
+// seedRun applies the seed file at startup
+func seedRun(ctx context.Context, store db.Store, log go_log.Log, cfg config.Config) error {
+	seed, err := seedRead(cfg, cfg.SeedFile)
+	if err != nil {
+		return err
+	}
+
+	changes, err := seedPlan(ctx, store, seed)
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		log.Verbose("All accounts match the seed file", "SEED_FILE", cfg.SeedFile)
+		return nil
+	}
+
+	return seedApply(ctx, store, log, changes)
+}
+
+// seedCmd runs "seed", it shows the changes and makes them unless --dry-run is given
+func seedCmd(ctx context.Context, store db.Store, log go_log.Log, cfg config.Config, args []string) int {
+	flags := newFlagSet("seed")
+	dryRun := flags.Bool("dry-run", false, "Only show what would change")
+	fileName := flags.String("file", cfg.SeedFile, "Seed file, defaults to SEED_FILE")
+	if flags.Parse(args) != nil {
+		return 2
+	}
+
+	if *fileName == "" {
+		log.Error("--file or SEED_FILE is required")
+		return 2
+	}
+
+	seed, err := seedRead(cfg, *fileName)
+	if err != nil {
+		log.Error("Could not read seed file", "err", err.Error())
+		return 1
+	}
+
+	changes, err := seedPlan(ctx, store, seed)
+	if err != nil {
+		log.Error("Could not compare seed file with the accounts", "err", err.Error())
+		return 1
+	}
+
+	for _, change := range changes {
+		for _, line := range change.diff() {
+			fmt.Println(line)
+		}
+	}
+
+	if *dryRun {
+		fmt.Fprintf(os.Stderr, "%d accounts would change\n", len(changes))
+		return 0
+	}
+
+	err = seedApply(ctx, store, log, changes)
+	if err != nil {
+		log.Error("Could not apply seed file", "err", err.Error())
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "%d accounts changed\n", len(changes))
+
+	return 0
+}
+
+// seedFieldNames returns the declared field names in order, so the changes are the same every time
+func seedFieldNames(declared seedAccount) []string {
+	fieldNames := make([]string, 0, len(declared.Fields))
+	for fieldName := range declared.Fields {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+
+	return fieldNames
+}
+
+func valuesEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
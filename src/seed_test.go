@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/config"
+	"gitea.larvit.se/pwrpln/auth-api/src/db"
+	"gitea.larvit.se/pwrpln/auth-api/src/utils"
+	"gitea.larvit.se/pwrpln/go_log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSeed(t *testing.T) {
+	ctx := context.Background()
+	log := go_log.GetLog()
+	log.MinLogLvl = go_log.LogLvlFromStr("Error")
+	store := &db.Memory{DeletedRetention: time.Hour, Log: log, OldNameReservation: time.Hour}
+	cfg := config.Default()
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Could not hash password: %v", err)
+	}
+
+	seedFile := filepath.Join(t.TempDir(), "seed.yaml")
+	seedWrite(t, seedFile, `accounts:
+  - name: billing
+    id: 5b1a3a44-5c37-4b54-9a55-7c1b4a3cf1a1
+    apiKeyHash: `+utils.HashAPIKey("billing-key")+`
+    passwordHash: "`+string(passwordHash)+`"
+    fields:
+      role: [service]
+      teams: [a, b]
+  - name: ci
+    fields:
+      role: [service]
+`)
+
+	seed, err := seedRead(cfg, seedFile)
+	if err != nil {
+		t.Fatalf("seedRead failed: %v", err)
+	}
+
+	changes, err := seedPlan(ctx, store, seed)
+	if err != nil || len(changes) != 2 || changes[0].diff()[0] != "+ billing" {
+		t.Fatalf("Expected both accounts to be created, got %+v, %v", changes, err)
+	}
+
+	err = seedApply(ctx, store, log, changes)
+	if err != nil {
+		t.Fatalf("seedApply failed: %v", err)
+	}
+
+	billing, err := store.AccountGet(ctx, "", utils.HashAPIKey("billing-key"), "")
+	if err != nil || billing.ID.String() != "5b1a3a44-5c37-4b54-9a55-7c1b4a3cf1a1" || !utils.CheckPasswordHash(ctx, "secret", billing.Password) {
+		t.Fatalf("Expected billing to be created with the declared id and credentials, got %+v, %v", billing, err)
+	}
+	if strings.Join(billing.Fields["teams"], ",") != "a,b" {
+		t.Fatalf("Expected the declared fields, got %v", billing.Fields)
+	}
+
+	// Applying it again changes nothing
+	changes, err = seedPlan(ctx, store, seed)
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("Expected no changes the second time, got %+v, %v", changes, err)
+	}
+
+	// Changed fields and credentials are put back, other fields are kept
+	_, err = store.AccountPatchFields(ctx, billing.ID.String(), []db.AccountFieldsPatchOp{
+		{Op: db.AccountFieldsPatchOpSet, Name: "role", Values: []string{"admin"}},
+		{Op: db.AccountFieldsPatchOpSet, Name: "extra", Values: []string{"x"}},
+	}, 0)
+	if err != nil {
+		t.Fatalf("Could not patch fields: %v", err)
+	}
+	err = store.AccountAPIKeySet(ctx, billing.ID.String(), utils.HashAPIKey("other-key"))
+	if err != nil {
+		t.Fatalf("Could not set API key: %v", err)
+	}
+
+	changes, err = seedPlan(ctx, store, seed)
+	if err != nil || len(changes) != 1 {
+		t.Fatalf("Expected billing to change, got %+v, %v", changes, err)
+	}
+	diff := strings.Join(changes[0].diff(), "\n")
+	if diff != "~ billing apiKeyHash\n~ billing fields.role: [\"admin\"] -> [\"service\"]" {
+		t.Fatalf("Unexpected diff: %s", diff)
+	}
+
+	err = seedApply(ctx, store, log, changes)
+	if err != nil {
+		t.Fatalf("seedApply failed: %v", err)
+	}
+	billing, err = store.AccountGet(ctx, billing.ID.String(), "", "")
+	if err != nil || billing.APIKeyHash != utils.HashAPIKey("billing-key") || strings.Join(billing.Fields["role"], ",") != "service" || len(billing.Fields["extra"]) != 1 {
+		t.Fatalf("Expected billing to match the seed file again and keep the extra field, got %+v, %v", billing, err)
+	}
+}
+
+func TestSeedReadErrors(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+
+	for name, content := range map[string]string{
+		"unknown key":     "accounts:\n  - name: a\n    apiKey: x\n",
+		"no name":         "accounts:\n  - fields: {role: [a]}\n",
+		"duplicate name":  "accounts:\n  - name: a\n  - name: a\n",
+		"admin":           "accounts:\n  - name: admin\n",
+		"invalid id":      "accounts:\n  - name: a\n    id: x\n",
+		"plain API key":   "accounts:\n  - name: a\n    apiKeyHash: not-a-hash\n",
+		"plain password":  "accounts:\n  - name: a\n    passwordHash: secret\n",
+		"not a seed file": "- a\n- b\n",
+	} {
+		seedFile := filepath.Join(dir, strings.ReplaceAll(name, " ", "-")+".yaml")
+		seedWrite(t, seedFile, content)
+
+		_, err := seedRead(cfg, seedFile)
+		if err == nil {
+			t.Errorf("%s: expected seedRead to fail", name)
+		}
+	}
+}
+
+func seedWrite(t *testing.T, name string, content string) {
+	t.Helper()
+
+	err := os.WriteFile(name, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("Could not write %s: %v", name, err)
+	}
+}
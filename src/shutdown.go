@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+
+	"gitea.larvit.se/pwrpln/auth-api/src/config"
+	"gitea.larvit.se/pwrpln/go_log"
+	"github.com/gofiber/fiber/v2"
+)
+
+// listen runs the web server until it is shut down, retrying every second while the address can not be bound
+func listen(app *fiber.App, log go_log.Log, shuttingDown *atomic.Bool, webBindHost string) {
+	err := app.Listen(webBindHost)
+	for err != nil && !shuttingDown.Load() {
+		log.Warn("Could not start web server", "err", err.Error(), "WEB_BIND_HOST", webBindHost)
+		time.Sleep(1 * time.Second)
+		err = app.Listen(webBindHost)
+	}
+}
+
+// shutdown stops the web server after the first signal and returns the exit code
+// Readiness fails for SHUTDOWN_DRAIN_DELAY first, so load balancers can stop sending requests, then new connections are refused
+// and requests still running get SHUTDOWN_GRACE_PERIOD to finish. A second signal exits right away.
+func shutdown(app *fiber.App, log go_log.Log, cfg config.Config, shuttingDown *atomic.Bool, signals <-chan os.Signal, sig os.Signal) int {
+	shuttingDown.Store(true)
+	log.Info("Shutting down, readiness fails from now on", "signal", sig.String(), "SHUTDOWN_DRAIN_DELAY", cfg.ShutdownDrainDelay.String())
+
+	select {
+	case <-time.After(cfg.ShutdownDrainDelay):
+	case sig := <-signals:
+		log.Warn("Got a second signal, exiting without waiting for requests", "signal", sig.String())
+		return 1
+	}
+
+	log.Info("Refusing new connections, waiting for requests to finish", "SHUTDOWN_GRACE_PERIOD", cfg.ShutdownGrace.String())
+
+	done := make(chan error, 1)
+	go func() {
+		if cfg.ShutdownGrace <= 0 {
+			done <- app.Shutdown()
+		} else {
+			done <- app.ShutdownWithTimeout(cfg.ShutdownGrace)
+		}
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Error("Requests still running after SHUTDOWN_GRACE_PERIOD, they are cut off", "err", err.Error())
+			return 1
+		}
+	case sig := <-signals:
+		log.Warn("Got a second signal, exiting without waiting for requests", "signal", sig.String())
+		return 1
+	}
+
+	log.Info("All requests finished, closing database connections")
+
+	return 0
+}
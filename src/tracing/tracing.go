@@ -0,0 +1,64 @@
+// Package tracing sets up the OpenTelemetry spans of auth-api, for requests, database calls and password hashing
+package tracing
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+// Exporters that TRACES_EXPORTER can be set to
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"   // OTLP over HTTP, the endpoint is set with the standard OTEL_EXPORTER_OTLP_ENDPOINT ENV
+	ExporterStdout = "stdout" // One JSON object per span, for testing locally
+)
+
+// Tracer starts all spans of auth-api
+// It uses the global provider, so it can be created before Start() sets it up.
+var Tracer = otel.Tracer("gitea.larvit.se/pwrpln/auth-api")
+
+// Start sets up the global tracer provider with the exporter, the returned func flushes the spans left and must be called on exit
+// With ExporterNone no spans are recorded, but the trace context in incoming headers is still passed on.
+func Start(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		spanExporter, err = otlptracehttp.New(ctx)
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, errors.New("unknown exporter \"" + exporter + "\"")
+	}
+	if err != nil {
+		return nil, errors.New("could not create " + exporter + " exporter: " + err.Error())
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("auth-api")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, errors.New("could not create trace resource: " + err.Error())
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"context"
+
+	"gitea.larvit.se/pwrpln/go_log"
+)
+
+type logCtxKey struct{}
+
+// CtxWithLog returns a copy of ctx that carries a logger. getLog is called for every log line, so fields that are set later in the request are included.
+func CtxWithLog(ctx context.Context, getLog func() go_log.Log) context.Context {
+	return context.WithValue(ctx, logCtxKey{}, getLog)
+}
+
+// LogFromCtx returns the logger carried by ctx, or fallback if there is none, with the given fields added
+func LogFromCtx(ctx context.Context, fallback go_log.Log, fields ...interface{}) go_log.Log {
+	log := fallback
+	if getLog, ok := ctx.Value(logCtxKey{}).(func() go_log.Log); ok {
+		log = getLog()
+	}
+
+	log.Context = append(append([]interface{}{}, log.Context...), fields...)
+	return log
+}
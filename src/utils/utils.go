@@ -1,10 +1,15 @@
 package utils
 
 import (
-	"math/rand"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"strings"
 	"time"
 
+	"gitea.larvit.se/pwrpln/auth-api/src/metrics"
+	"gitea.larvit.se/pwrpln/auth-api/src/tracing"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -12,38 +17,67 @@ const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 const (
 	letterIdxBits = 6                    // 6 bits to represent a letter index
 	letterIdxMask = 1<<letterIdxBits - 1 // All 1-bits, as many as letterIdxBits
-	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
-var src = rand.NewSource(time.Now().UnixNano())
-
 // CheckPasswordHash checks a password hash
-func CheckPasswordHash(password, hash string) bool {
+func CheckPasswordHash(ctx context.Context, password, hash string) bool {
+	_, span := tracing.Tracer.Start(ctx, "bcrypt.check")
+	defer span.End()
+
+	start := time.Now()
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	metrics.PasswordHashDuration.WithLabelValues("check").Observe(time.Since(start).Seconds())
 	return err == nil
 }
 
+// Contains tells if value is one of values
+func Contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HashAPIKey hashes an API key, the hash is what is stored in the database
+// API keys are 60 letters from RandString(), or an ADMIN_API_KEY of at least 32 characters in production, too many to guess.
+// So a fast hash is enough, and it lets accounts be looked up by it.
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
 // HashPassword hashes a password
-func HashPassword(password string) (string, error) {
+func HashPassword(ctx context.Context, password string) (string, error) {
+	_, span := tracing.Tracer.Start(ctx, "bcrypt.hash")
+	defer span.End()
+
+	start := time.Now()
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 14)
+	metrics.PasswordHashDuration.WithLabelValues("hash").Observe(time.Since(start).Seconds())
 	return string(bytes), err
 }
 
-// RandString generates a random string. Taken from https://stackoverflow.com/questions/22892120/how-to-generate-a-random-string-of-a-fixed-length-in-go (RandStringBytesMaskImprSrcSB())
+// RandString generates a random string of letters from crypto/rand, so it can be used for API keys and renewal tokens
+// It panics if the operating system can not give random bytes, no key or token can be made safely then.
 func RandString(n int) string {
 	sb := strings.Builder{}
 	sb.Grow(n)
-	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, src.Int63(), letterIdxMax; i >= 0; {
-		if remain == 0 {
-			cache, remain = src.Int63(), letterIdxMax
+	buf := make([]byte, n)
+	for sb.Len() < n {
+		_, err := rand.Read(buf)
+		if err != nil {
+			panic("could not read random bytes: " + err.Error())
 		}
-		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
-			sb.WriteByte(letterBytes[idx])
-			i--
+
+		// Bytes that do not map to a letter are skipped, so every letter is equally likely
+		for _, b := range buf {
+			if idx := int(b & letterIdxMask); idx < len(letterBytes) && sb.Len() < n {
+				sb.WriteByte(letterBytes[idx])
+			}
 		}
-		cache >>= letterIdxBits
-		remain--
 	}
 
 	return sb.String()
@@ -94,6 +94,37 @@ test('test-cases/01basic.js: Creating a new account', async t => {
 	}
 });
 
+test('test-cases/01basic.js: Creating an account with duplicate field names', async t => {
+	const name = 'test-halfcreated-tomte';
+
+	try {
+		await got.post(`${process.env.AUTH_URL}/accounts`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			json: {
+				fields: [{ name: 'role', values: ['user'] }, { name: 'role', values: ['admin'] }],
+				name,
+				password,
+			},
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Creating an account with duplicate field names should fail with a 400');
+	} catch(err) {
+		t.equal(err.message, 'Response code 400 (Bad Request)', 'Creating an account with duplicate field names should fail with a 400');
+	}
+
+	try {
+		await got.post(`${process.env.AUTH_URL}/auth/password`, {
+			json: { name, password },
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('The failed account should not have been created at all');
+	} catch(err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'The failed account should not have been created at all');
+	}
+});
+
 test('test-cases/01basic.js: Auth by username and password', async t => {
 	const authRes = await got.post(`${process.env.AUTH_URL}/auth/password`, {
 		json: {
@@ -0,0 +1,110 @@
+import got from 'got';
+import test from 'tape';
+
+let adminJWTString;
+const accountIDs = [];
+const namePrefix = 'test-list-tomte ';
+
+test('test-cases/02accountsList.js: Auth and create some accounts to list', async t => {
+	const authRes = await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+	adminJWTString = authRes.body.jwt;
+
+	for (let i = 0; i < 3; i++) {
+		const res = await got.post(`${process.env.AUTH_URL}/accounts`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			json: {
+				fields: [{ name: 'role', values: i === 0 ? ['user', 'listtester'] : ['user'] }],
+				name: `${namePrefix}${i}`,
+				password: 'whatever',
+			},
+			responseType: 'json',
+		});
+		accountIDs.push(res.body.id);
+	}
+
+	t.equal(accountIDs.length, 3, 'Three accounts should have been created');
+});
+
+test('test-cases/02accountsList.js: GET /accounts requires admin', async t => {
+	try {
+		await got(`${process.env.AUTH_URL}/accounts`, { retry: { limit: 0 } });
+		t.fail('Calling GET /accounts without an admin token should give 403');
+	} catch (err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'Calling GET /accounts without an admin token should give 403');
+	}
+});
+
+test('test-cases/02accountsList.js: Paginate accounts by name prefix', async t => {
+	const firstRes = await got(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		searchParams: { limit: 2, namePrefix, sort: 'name', total: true },
+		responseType: 'json',
+	});
+
+	t.equal(firstRes.body.total, 3, 'The total should be 3');
+	t.equal(firstRes.body.accounts.length, 2, 'The first page should have 2 accounts');
+	t.equal(firstRes.body.accounts[0].name, `${namePrefix}0`, 'The first account should be the first one created');
+	t.equal(JSON.stringify(firstRes.body.accounts[0].fields.role), '["user","listtester"]', 'The fields should be included');
+	t.notEqual(firstRes.body.nextCursor, undefined, 'There should be a next cursor');
+
+	const secondRes = await got(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		searchParams: { cursor: firstRes.body.nextCursor, limit: 2, namePrefix, sort: 'name' },
+		responseType: 'json',
+	});
+
+	t.equal(secondRes.body.accounts.length, 1, 'The second page should have 1 account');
+	t.equal(secondRes.body.accounts[0].name, `${namePrefix}2`, 'The last account should be on the second page');
+	t.equal(secondRes.body.nextCursor, undefined, 'There should be no next cursor on the last page');
+	t.equal(secondRes.body.total, undefined, 'The total should only be included when asked for');
+});
+
+test('test-cases/02accountsList.js: Filter accounts by field value', async t => {
+	const res = await got(`${process.env.AUTH_URL}/accounts?fields[role]=listtester`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		responseType: 'json',
+	});
+
+	t.equal(res.body.accounts.length, 1, 'Only one account should have the role "listtester"');
+	t.equal(res.body.accounts[0].id, accountIDs[0], 'The account with the role "listtester" should be returned');
+});
+
+test('test-cases/02accountsList.js: Invalid list parameters', async t => {
+	try {
+		await got(`${process.env.AUTH_URL}/accounts`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			searchParams: { limit: 0, sort: 'password' },
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Invalid limit and sort should give 400');
+	} catch (err) {
+		t.equal(err.message, 'Response code 400 (Bad Request)', 'Invalid limit and sort should give 400');
+		t.equal(err.response.body.length, 2, 'There should be one error per invalid parameter');
+	}
+
+	try {
+		await got(`${process.env.AUTH_URL}/accounts`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			searchParams: { cursor: 'nope' },
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('An invalid cursor should give 400');
+	} catch (err) {
+		t.equal(err.message, 'Response code 400 (Bad Request)', 'An invalid cursor should give 400');
+	}
+});
+
+test('test-cases/02accountsList.js: Clean up', async t => {
+	for (const accountID of accountIDs) {
+		await got.delete(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+		});
+	}
+
+	t.pass('Created accounts removed');
+});
@@ -0,0 +1,79 @@
+import got from 'got';
+import test from 'tape';
+
+let adminJWTString;
+let accountID;
+
+test('test-cases/03accountFieldsPatch.js: Auth and create an account to patch', async t => {
+	const authRes = await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+	adminJWTString = authRes.body.jwt;
+
+	const res = await got.post(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: {
+			fields: [
+				{ name: 'role', values: ['user'] },
+				{ name: 'hobby', values: ['tåg'] },
+			],
+			name: 'test-patch-tomte',
+			password: 'whatever',
+		},
+		responseType: 'json',
+	});
+	accountID = res.body.id;
+
+	t.notEqual(accountID, undefined, 'The new account should have an id');
+});
+
+test('test-cases/03accountFieldsPatch.js: PATCH /accounts/{id}/fields', async t => {
+	const res = await got.patch(`${process.env.AUTH_URL}/accounts/${accountID}/fields`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: [
+			{ op: 'addValues', name: 'role', values: ['editor', 'user'] },
+			{ op: 'remove', name: 'hobby' },
+			{ op: 'set', name: 'color', values: ['blå', 'gul'] },
+			{ op: 'removeValues', name: 'color', values: ['gul'] },
+		],
+		responseType: 'json',
+	});
+
+	t.equal(Object.keys(res.body.fields).length, 2, 'There should be two fields in total');
+	t.equal(JSON.stringify(res.body.fields.role), '["user","editor"]', 'The role field should have the added value once');
+	t.equal(JSON.stringify(res.body.fields.color), '["blå"]', 'The color field should be set and then have a value removed');
+	t.equal(res.body.fields.hobby, undefined, 'The hobby field should be removed');
+});
+
+test('test-cases/03accountFieldsPatch.js: PATCH with an invalid operation changes nothing', async t => {
+	try {
+		await got.patch(`${process.env.AUTH_URL}/accounts/${accountID}/fields`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			json: [
+				{ op: 'remove', name: 'role' },
+				{ op: 'explode', name: 'color' },
+			],
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('An invalid op should give 400');
+	} catch (err) {
+		t.equal(err.message, 'Response code 400 (Bad Request)', 'An invalid op should give 400');
+		t.equal(err.response.body[0].field, '[1].op', 'The error should point out the invalid op');
+	}
+
+	const res = await got(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		responseType: 'json',
+	});
+	t.equal(JSON.stringify(res.body.fields.role), '["user","editor"]', 'The role field should be untouched');
+});
+
+test('test-cases/03accountFieldsPatch.js: Clean up', async t => {
+	const delRes = await got.delete(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+	});
+
+	t.equal(delRes.statusCode, 204, 'The account should be removed');
+});
@@ -0,0 +1,95 @@
+import got from 'got';
+import test from 'tape';
+
+let adminJWTString;
+let accountID;
+const fieldURL = () => `${process.env.AUTH_URL}/accounts/${accountID}/fields/${encodeURIComponent('nördområde')}`;
+
+test('test-cases/04accountField.js: Auth and create an account', async t => {
+	const authRes = await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+	adminJWTString = authRes.body.jwt;
+
+	const res = await got.post(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: {
+			fields: [{ name: 'role', values: ['user'] }],
+			name: 'test-field-tomte',
+			password: 'whatever',
+		},
+		responseType: 'json',
+	});
+	accountID = res.body.id;
+
+	t.notEqual(accountID, undefined, 'The new account should have an id');
+});
+
+test('test-cases/04accountField.js: PUT, GET and add/remove values on a single field', async t => {
+	const putRes = await got.put(fieldURL(), {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: ['tåg'],
+		responseType: 'json',
+	});
+	t.equal(JSON.stringify(putRes.body.fields['nördområde']), '["tåg"]', 'The field should be set');
+	t.equal(JSON.stringify(putRes.body.fields.role), '["user"]', 'Other fields should be untouched');
+
+	const postRes = await got.post(`${fieldURL()}/values`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: 'trädgårdstomtar',
+		responseType: 'json',
+	});
+	t.equal(JSON.stringify(postRes.body.fields['nördområde']), '["tåg","trädgårdstomtar"]', 'The value should be added');
+
+	const delValueRes = await got.delete(`${fieldURL()}/values/${encodeURIComponent('tåg')}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		responseType: 'json',
+	});
+	t.equal(JSON.stringify(delValueRes.body.fields['nördområde']), '["trädgårdstomtar"]', 'The value should be removed');
+
+	const getRes = await got(fieldURL(), {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		responseType: 'json',
+	});
+	t.equal(JSON.stringify(getRes.body), '["trädgårdstomtar"]', 'GET should return the field values');
+});
+
+test('test-cases/04accountField.js: DELETE a single field', async t => {
+	const delRes = await got.delete(fieldURL(), {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		responseType: 'json',
+	});
+	t.equal(delRes.body.fields['nördområde'], undefined, 'The field should be removed');
+	t.equal(JSON.stringify(delRes.body.fields.role), '["user"]', 'Other fields should be untouched');
+
+	try {
+		await got(fieldURL(), {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('GETting a removed field should give 404');
+	} catch (err) {
+		t.equal(err.message, 'Response code 404 (Not Found)', 'GETting a removed field should give 404');
+	}
+
+	try {
+		await got.delete(fieldURL(), {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('DELETEing a removed field should give 404');
+	} catch (err) {
+		t.equal(err.message, 'Response code 404 (Not Found)', 'DELETEing a removed field should give 404');
+	}
+});
+
+test('test-cases/04accountField.js: Clean up', async t => {
+	const delRes = await got.delete(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+	});
+
+	t.equal(delRes.statusCode, 204, 'The account should be removed');
+});
@@ -0,0 +1,84 @@
+import got from 'got';
+import test from 'tape';
+
+let adminJWTString;
+let accountID;
+let etag;
+
+test('test-cases/05accountVersion.js: Auth and create an account', async t => {
+	const authRes = await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+	adminJWTString = authRes.body.jwt;
+
+	const res = await got.post(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: {
+			fields: [{ name: 'role', values: ['user'] }],
+			name: 'test-version-tomte',
+			password: 'whatever',
+		},
+		responseType: 'json',
+	});
+	accountID = res.body.id;
+
+	const getRes = await got(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		responseType: 'json',
+	});
+	etag = getRes.headers.etag;
+
+	t.equal(etag, '"1"', 'A new account should have ETag "1"');
+	t.equal(getRes.body.version, 1, 'A new account should have version 1');
+});
+
+test('test-cases/05accountVersion.js: Changes with a matching If-Match', async t => {
+	const res = await got.put(`${process.env.AUTH_URL}/accounts/${accountID}/fields/role`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`, 'If-Match': etag },
+		json: ['editor'],
+		responseType: 'json',
+	});
+
+	t.equal(res.headers.etag, '"2"', 'The ETag should be bumped');
+	t.equal(res.body.version, 2, 'The version should be bumped');
+});
+
+test('test-cases/05accountVersion.js: Changes with a stale If-Match', async t => {
+	try {
+		await got.patch(`${process.env.AUTH_URL}/accounts/${accountID}/fields`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`, 'If-Match': etag },
+			json: [{ op: 'set', name: 'role', values: ['admin'] }],
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('A stale If-Match should give 412');
+	} catch (err) {
+		t.equal(err.message, 'Response code 412 (Precondition Failed)', 'A stale If-Match should give 412');
+	}
+
+	try {
+		await got.delete(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`, 'If-Match': etag },
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Deleting with a stale If-Match should give 412');
+	} catch (err) {
+		t.equal(err.message, 'Response code 412 (Precondition Failed)', 'Deleting with a stale If-Match should give 412');
+	}
+
+	const res = await got(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		responseType: 'json',
+	});
+	t.equal(JSON.stringify(res.body.fields.role), '["editor"]', 'The role should be untouched by the stale changes');
+});
+
+test('test-cases/05accountVersion.js: Clean up', async t => {
+	const delRes = await got.delete(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`, 'If-Match': '"2"' },
+	});
+
+	t.equal(delRes.statusCode, 204, 'The account should be removed with a matching If-Match');
+});
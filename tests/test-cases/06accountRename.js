@@ -0,0 +1,94 @@
+import got from 'got';
+import test from 'tape';
+
+let adminJWTString;
+let accountID;
+let otherAccountID;
+const oldName = 'test-rename-tomte';
+const newName = 'test-renamed-tomte';
+const password = 'whatever';
+
+test('test-cases/06accountRename.js: Auth and create accounts', async t => {
+	const authRes = await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+	adminJWTString = authRes.body.jwt;
+
+	const res = await got.post(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: { fields: [{ name: 'role', values: ['user'] }], name: oldName, password },
+		responseType: 'json',
+	});
+	accountID = res.body.id;
+
+	const otherRes = await got.post(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: { fields: [], name: 'test-rename-other-tomte', password },
+		responseType: 'json',
+	});
+	otherAccountID = otherRes.body.id;
+
+	t.notEqual(accountID, undefined, 'The new account should have an id');
+});
+
+test('test-cases/06accountRename.js: Rename an account', async t => {
+	const res = await got.put(`${process.env.AUTH_URL}/accounts/${accountID}/name`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: newName,
+		responseType: 'json',
+	});
+
+	t.equal(res.body.id, accountID, 'The account id should be kept');
+	t.equal(res.body.name, newName, 'The account should have the new name');
+	t.equal(JSON.stringify(res.body.fields.role), '["user"]', 'The fields should be kept');
+
+	const authRes = await got.post(`${process.env.AUTH_URL}/auth/password`, {
+		json: { name: newName, password },
+		responseType: 'json',
+	});
+	t.notEqual(authRes.body.jwt, undefined, 'It should be possible to log in with the new name');
+});
+
+test('test-cases/06accountRename.js: Old and taken names can not be used', async t => {
+	try {
+		await got.post(`${process.env.AUTH_URL}/accounts`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			json: { fields: [], name: oldName, password },
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Registering the old name should give 409');
+	} catch (err) {
+		t.equal(err.message, 'Response code 409 (Conflict)', 'Registering the old name should give 409');
+	}
+
+	try {
+		await got.put(`${process.env.AUTH_URL}/accounts/${otherAccountID}/name`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			json: newName,
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Renaming to a taken name should give 409');
+	} catch (err) {
+		t.equal(err.message, 'Response code 409 (Conflict)', 'Renaming to a taken name should give 409');
+	}
+
+	const res = await got.put(`${process.env.AUTH_URL}/accounts/${accountID}/name`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: oldName,
+		responseType: 'json',
+	});
+	t.equal(res.body.name, oldName, 'The account should be able to take back its old name');
+});
+
+test('test-cases/06accountRename.js: Clean up', async t => {
+	for (const id of [accountID, otherAccountID]) {
+		await got.delete(`${process.env.AUTH_URL}/accounts/${id}`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+		});
+	}
+
+	t.pass('Created accounts removed');
+});
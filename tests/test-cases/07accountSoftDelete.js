@@ -0,0 +1,108 @@
+import got from 'got';
+import test from 'tape';
+
+let adminJWTString;
+let accountID;
+let userJWTString;
+const name = 'test-softdelete-tomte';
+const password = 'whatever';
+
+test('test-cases/07accountSoftDelete.js: Auth and create an account', async t => {
+	const authRes = await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+	adminJWTString = authRes.body.jwt;
+
+	const res = await got.post(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: { fields: [{ name: 'role', values: ['user'] }], name, password },
+		responseType: 'json',
+	});
+	accountID = res.body.id;
+
+	const userAuthRes = await got.post(`${process.env.AUTH_URL}/auth/password`, {
+		json: { name, password },
+		responseType: 'json',
+	});
+	userJWTString = userAuthRes.body.jwt;
+
+	t.notEqual(userJWTString, undefined, 'The new account should be able to log in');
+});
+
+test('test-cases/07accountSoftDelete.js: A deleted account can not be used', async t => {
+	const delRes = await got.delete(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+	});
+	t.equal(delRes.statusCode, 204, 'Response status for DELETE should be 204');
+
+	try {
+		await got(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+			headers: { 'Authorization': `bearer ${userJWTString}`},
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('A JWT for a deleted account should give 403');
+	} catch (err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'A JWT for a deleted account should give 403');
+	}
+
+	try {
+		await got.post(`${process.env.AUTH_URL}/auth/password`, {
+			json: { name, password },
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Logging in to a deleted account should give 403');
+	} catch (err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'Logging in to a deleted account should give 403');
+	}
+
+	const listRes = await got(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		searchParams: { namePrefix: name },
+		responseType: 'json',
+	});
+	t.equal(listRes.body.accounts.length, 0, 'A deleted account should not be listed by default');
+
+	const getRes = await got(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		searchParams: { includeDeleted: true },
+		responseType: 'json',
+	});
+	t.notEqual(getRes.body.deleted, undefined, 'The account should be found as deleted when asked for');
+});
+
+test('test-cases/07accountSoftDelete.js: Restore a deleted account', async t => {
+	const res = await got.post(`${process.env.AUTH_URL}/accounts/${accountID}/restore`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		responseType: 'json',
+	});
+	t.equal(res.body.deleted, undefined, 'The account should no longer be deleted');
+	t.equal(JSON.stringify(res.body.fields.role), '["user"]', 'The fields should be kept');
+
+	const authRes = await got.post(`${process.env.AUTH_URL}/auth/password`, {
+		json: { name, password },
+		responseType: 'json',
+	});
+	t.notEqual(authRes.body.jwt, undefined, 'The restored account should be able to log in again');
+
+	try {
+		await got.post(`${process.env.AUTH_URL}/accounts/${accountID}/restore`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Restoring an account that is not deleted should give 404');
+	} catch (err) {
+		t.equal(err.message, 'Response code 404 (Not Found)', 'Restoring an account that is not deleted should give 404');
+	}
+});
+
+test('test-cases/07accountSoftDelete.js: Clean up', async t => {
+	const delRes = await got.delete(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+	});
+
+	t.equal(delRes.statusCode, 204, 'The account should be removed');
+});
@@ -0,0 +1,16 @@
+import got from 'got';
+import test from 'tape';
+
+test('test-cases/08requestId.js: Every response has its own X-Request-ID', async t => {
+	const firstRes = await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+	const secondRes = await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+
+	t.notEqual(firstRes.headers['x-request-id'], undefined, 'The response should have an X-Request-ID header');
+	t.notEqual(firstRes.headers['x-request-id'], secondRes.headers['x-request-id'], 'Each request should get a new id');
+});
@@ -0,0 +1,29 @@
+import got from 'got';
+import test from 'tape';
+
+test('test-cases/09health.js: /healthz is always ok', async t => {
+	const res = await got(`${process.env.AUTH_URL}/healthz`, { responseType: 'json' });
+
+	t.equal(res.statusCode, 200, 'The status code should be 200');
+	t.equal(res.body.status, 'ok', 'The status should be "ok"');
+});
+
+test('test-cases/09health.js: /readyz shows the status of each component', async t => {
+	const res = await got(`${process.env.AUTH_URL}/readyz`, { responseType: 'json' });
+
+	t.equal(res.statusCode, 200, 'The status code should be 200');
+	t.equal(res.body.status, 'ok', 'The status should be "ok"');
+	for (const component of ['database', 'migrations', 'signingKey']) {
+		t.equal(res.body.components[component].status, 'ok', `The ${component} component should be "ok"`);
+	}
+});
+
+test('test-cases/09health.js: Health checks do not need a JSON content-type or get a request id', async t => {
+	const res = await got(`${process.env.AUTH_URL}/readyz`, {
+		headers: { 'content-type': 'text/plain' },
+		responseType: 'json',
+	});
+
+	t.equal(res.statusCode, 200, 'The status code should be 200 with content-type text/plain');
+	t.equal(res.headers['x-request-id'], undefined, 'Health checks are not logged, so they get no X-Request-ID');
+});
@@ -0,0 +1,26 @@
+import got from 'got';
+import test from 'tape';
+
+test('test-cases/10metrics.js: Auth attempts and requests show up in /metrics', async t => {
+	await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+
+	const res = await got(`${process.env.AUTH_URL}/metrics`);
+
+	t.equal(res.statusCode, 200, 'The status code should be 200');
+	t.ok(res.body.includes('auth_api_auth_attempts_total{method="api-key",outcome="success"}'), 'Successful API key auths should be counted');
+	t.ok(res.body.includes('auth_api_http_requests_total{method="POST",route="/auth/api-key",status="200"}'), 'Requests should be counted by route and status');
+	t.ok(res.body.includes('auth_api_tokens_issued_total'), 'Issued tokens should be counted');
+	t.ok(res.body.includes('auth_api_renewal_tokens_active'), 'Active renewal tokens should be shown');
+});
+
+test('test-cases/10metrics.js: Unknown routes get a 404', async t => {
+	try {
+		await got(`${process.env.AUTH_URL}/not-a-route`);
+		t.fail('GETting an unknown route should result in a 404');
+	} catch (err) {
+		t.equal(err.message, 'Response code 404 (Not Found)', 'GETting an unknown route should result in a 404');
+	}
+});
@@ -0,0 +1,147 @@
+import got from 'got';
+import test from 'tape';
+
+let adminJWTString;
+let accountID;
+let firstLogin;
+let secondLogin;
+const name = 'test-logout-tomte';
+const password = 'whatever';
+
+async function login() {
+	const res = await got.post(`${process.env.AUTH_URL}/auth/password`, {
+		json: { name, password },
+		responseType: 'json',
+	});
+
+	return res.body;
+}
+
+test('test-cases/11logout.js: Auth, create an account and log in twice', async t => {
+	const authRes = await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+	adminJWTString = authRes.body.jwt;
+
+	const res = await got.post(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: { fields: [{ name: 'role', values: ['user'] }], name, password },
+		responseType: 'json',
+	});
+	accountID = res.body.id;
+
+	firstLogin = await login();
+	secondLogin = await login();
+
+	t.notEqual(firstLogin.renewalToken, secondLogin.renewalToken, 'Each login should get a renewal token of its own');
+});
+
+test('test-cases/11logout.js: Log out', async t => {
+	const res = await got.post(`${process.env.AUTH_URL}/logout`, {
+		json: firstLogin.renewalToken,
+	});
+	t.equal(res.statusCode, 204, 'Logging out should give 204');
+
+	try {
+		await got.post(`${process.env.AUTH_URL}/logout`, {
+			json: firstLogin.renewalToken,
+			retry: { limit: 0 },
+		});
+		t.fail('Logging out with the same token again should give 403');
+	} catch (err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'Logging out with the same token again should give 403');
+	}
+
+	try {
+		await got.post(`${process.env.AUTH_URL}/renew-token`, {
+			json: firstLogin.renewalToken,
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Renewing a logged out token should give 403');
+	} catch (err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'Renewing a logged out token should give 403');
+	}
+
+	const accountRes = await got(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${firstLogin.jwt}`},
+		responseType: 'json',
+	});
+	t.equal(accountRes.body.id, accountID, 'The JWT of the logged out session should stay valid until it expires');
+});
+
+test('test-cases/11logout.js: Log out everywhere with a stale If-Match', async t => {
+	try {
+		await got.post(`${process.env.AUTH_URL}/accounts/${accountID}/logout-all`, {
+			headers: { 'Authorization': `bearer ${secondLogin.jwt}`, 'If-Match': '"999"' },
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Logging out everywhere with a stale If-Match should give 412');
+	} catch (err) {
+		t.equal(err.message, 'Response code 412 (Precondition Failed)', 'Logging out everywhere with a stale If-Match should give 412');
+	}
+
+	const renewRes = await got.post(`${process.env.AUTH_URL}/renew-token`, {
+		json: secondLogin.renewalToken,
+		responseType: 'json',
+	});
+	secondLogin = renewRes.body;
+	t.notEqual(secondLogin.jwt, undefined, 'The renewal token should still work after the refused logout');
+});
+
+test('test-cases/11logout.js: Log out everywhere', async t => {
+	const getRes = await got(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${secondLogin.jwt}`},
+		responseType: 'json',
+	});
+	const etag = getRes.headers.etag;
+
+	const thirdLogin = await login();
+
+	const res = await got.post(`${process.env.AUTH_URL}/accounts/${accountID}/logout-all`, {
+		headers: { 'Authorization': `bearer ${secondLogin.jwt}`, 'If-Match': etag },
+	});
+	t.equal(res.statusCode, 204, 'Logging out everywhere should give 204');
+
+	for (const jwt of [secondLogin.jwt, thirdLogin.jwt, firstLogin.jwt]) {
+		try {
+			await got(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+				headers: { 'Authorization': `bearer ${jwt}`},
+				retry: { limit: 0 },
+			});
+			t.fail('JWTs issued before logging out everywhere, the one used for it too, should give 403');
+		} catch (err) {
+			t.equal(err.message, 'Response code 403 (Forbidden)', 'JWTs issued before logging out everywhere, the one used for it too, should give 403');
+		}
+	}
+
+	for (const renewalToken of [secondLogin.renewalToken, thirdLogin.renewalToken]) {
+		try {
+			await got.post(`${process.env.AUTH_URL}/renew-token`, {
+				json: renewalToken,
+				retry: { limit: 0 },
+			});
+			t.fail('Renewal tokens should be removed by logging out everywhere');
+		} catch (err) {
+			t.equal(err.message, 'Response code 403 (Forbidden)', 'Renewal tokens should be removed by logging out everywhere');
+		}
+	}
+
+	const newLogin = await login();
+	const accountRes = await got(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${newLogin.jwt}`},
+		responseType: 'json',
+	});
+	t.notEqual(accountRes.headers.etag, etag, 'Logging out everywhere should bump the ETag');
+	t.equal(accountRes.body.id, accountID, 'A new login should work after logging out everywhere');
+});
+
+test('test-cases/11logout.js: Clean up', async t => {
+	await got.delete(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+	});
+
+	t.pass('Created account removed');
+});
@@ -0,0 +1,157 @@
+import got from 'got';
+import jwt from 'jsonwebtoken';
+import test from 'tape';
+
+let adminJWTString;
+let accountID;
+let otherAccountID;
+let login;
+let loginJWT;
+const name = 'test-sessions-tomte';
+const otherName = 'test-sessions-other-tomte';
+const password = 'whatever';
+
+test('test-cases/12sessions.js: Auth, create accounts and log in', async t => {
+	const authRes = await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+	adminJWTString = authRes.body.jwt;
+
+	const res = await got.post(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: { fields: [{ name: 'role', values: ['user'] }], name, password },
+		responseType: 'json',
+	});
+	accountID = res.body.id;
+
+	const otherRes = await got.post(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: { fields: [{ name: 'role', values: ['user'] }], name: otherName, password },
+		responseType: 'json',
+	});
+	otherAccountID = otherRes.body.id;
+
+	const loginRes = await got.post(`${process.env.AUTH_URL}/auth/password`, {
+		json: { name, password },
+		responseType: 'json',
+	});
+	login = loginRes.body;
+	loginJWT = jwt.verify(login.jwt, process.env.JWT_SHARED_SECRET);
+
+	t.notEqual(loginJWT.sid, undefined, 'The JWT should have the session id in "sid"');
+});
+
+test('test-cases/12sessions.js: List sessions', async t => {
+	const res = await got(`${process.env.AUTH_URL}/accounts/${accountID}/sessions`, {
+		headers: { 'Authorization': `bearer ${login.jwt}`},
+		responseType: 'json',
+	});
+
+	t.equal(res.body.length, 1, 'There should be one session');
+	t.equal(res.body[0].id, loginJWT.sid, 'The session should be the one in the JWT');
+	t.equal(res.body[0].method, 'password', 'The session should be started by a password login');
+	t.equal(res.body[0].active, true, 'The session should be active');
+
+	try {
+		await got(`${process.env.AUTH_URL}/accounts/${otherAccountID}/sessions`, {
+			headers: { 'Authorization': `bearer ${login.jwt}`},
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Listing the sessions of another account without the admin role should give 403');
+	} catch (err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'Listing the sessions of another account without the admin role should give 403');
+	}
+
+	const adminRes = await got(`${process.env.AUTH_URL}/accounts/${accountID}/sessions`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		responseType: 'json',
+	});
+	t.equal(adminRes.body.length, 1, 'An admin should be able to list the sessions of any account');
+});
+
+test('test-cases/12sessions.js: A renewed JWT keeps its session', async t => {
+	const res = await got.post(`${process.env.AUTH_URL}/renew-token`, {
+		json: login.renewalToken,
+		responseType: 'json',
+	});
+	login = res.body;
+
+	const renewedJWT = jwt.verify(login.jwt, process.env.JWT_SHARED_SECRET);
+	t.equal(renewedJWT.sid, loginJWT.sid, 'The renewed JWT should have the same "sid"');
+
+	const sessionsRes = await got(`${process.env.AUTH_URL}/accounts/${accountID}/sessions`, {
+		headers: { 'Authorization': `bearer ${login.jwt}`},
+		responseType: 'json',
+	});
+	t.equal(sessionsRes.body.length, 1, 'Renewing should not start a new session');
+});
+
+test('test-cases/12sessions.js: Revoke a session', async t => {
+	try {
+		await got.delete(`${process.env.AUTH_URL}/accounts/${otherAccountID}/sessions/${loginJWT.sid}`, {
+			headers: { 'Authorization': `bearer ${login.jwt}`},
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Revoking a session of another account without the admin role should give 403');
+	} catch (err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'Revoking a session of another account without the admin role should give 403');
+	}
+
+	try {
+		await got.delete(`${process.env.AUTH_URL}/accounts/${accountID}/sessions/nope`, {
+			headers: { 'Authorization': `bearer ${login.jwt}`},
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Revoking a session with an invalid id should give 400');
+	} catch (err) {
+		t.equal(err.message, 'Response code 400 (Bad Request)', 'Revoking a session with an invalid id should give 400');
+	}
+
+	try {
+		await got.delete(`${process.env.AUTH_URL}/accounts/${otherAccountID}/sessions/${loginJWT.sid}`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Revoking a session through another account should give 404');
+	} catch (err) {
+		t.equal(err.message, 'Response code 404 (Not Found)', 'Revoking a session through another account should give 404');
+	}
+
+	const res = await got.delete(`${process.env.AUTH_URL}/accounts/${accountID}/sessions/${loginJWT.sid}`, {
+		headers: { 'Authorization': `bearer ${login.jwt}`},
+	});
+	t.equal(res.statusCode, 204, 'Revoking an own session should give 204');
+
+	try {
+		await got.post(`${process.env.AUTH_URL}/renew-token`, {
+			json: login.renewalToken,
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Renewing in a revoked session should give 403');
+	} catch (err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'Renewing in a revoked session should give 403');
+	}
+
+	const sessionsRes = await got(`${process.env.AUTH_URL}/accounts/${accountID}/sessions`, {
+		headers: { 'Authorization': `bearer ${login.jwt}`},
+		responseType: 'json',
+	});
+	t.equal(sessionsRes.body[0].id, loginJWT.sid, 'The revoked session should be kept as login history');
+	t.equal(sessionsRes.body[0].active, false, 'The revoked session should not be active');
+});
+
+test('test-cases/12sessions.js: Clean up', async t => {
+	for (const id of [accountID, otherAccountID]) {
+		await got.delete(`${process.env.AUTH_URL}/accounts/${id}`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+		});
+	}
+
+	t.pass('Created accounts removed');
+});
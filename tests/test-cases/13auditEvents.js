@@ -0,0 +1,149 @@
+import got from 'got';
+import jwt from 'jsonwebtoken';
+import test from 'tape';
+
+let adminJWT;
+let adminJWTString;
+let accountID;
+let userJWTString;
+const name = 'test-audit-tomte';
+const password = 'whatever';
+
+test('test-cases/13auditEvents.js: Auth, create an account and log in', async t => {
+	const authRes = await got.post(`${process.env.AUTH_URL}/auth/api-key`, {
+		json: process.env.ADMIN_API_KEY,
+		responseType: 'json',
+	});
+	adminJWTString = authRes.body.jwt;
+	adminJWT = jwt.verify(adminJWTString, process.env.JWT_SHARED_SECRET);
+
+	const res = await got.post(`${process.env.AUTH_URL}/accounts`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		json: { fields: [{ name: 'role', values: ['user'] }], name, password },
+		responseType: 'json',
+	});
+	accountID = res.body.id;
+
+	try {
+		await got.post(`${process.env.AUTH_URL}/auth/password`, {
+			json: { name, password: 'wrong' },
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Logging in with a wrong password should give 403');
+	} catch (err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'Logging in with a wrong password should give 403');
+	}
+
+	const loginRes = await got.post(`${process.env.AUTH_URL}/auth/password`, {
+		json: { name, password },
+		responseType: 'json',
+	});
+	userJWTString = loginRes.body.jwt;
+});
+
+test('test-cases/13auditEvents.js: Only admins can list audit events', async t => {
+	try {
+		await got(`${process.env.AUTH_URL}/audit-events`, {
+			headers: { 'Authorization': `bearer ${userJWTString}`},
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Listing audit events without the admin role should give 403');
+	} catch (err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'Listing audit events without the admin role should give 403');
+	}
+
+	try {
+		await got(`${process.env.AUTH_URL}/audit-events`, {
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('Listing audit events without a JWT should give 403');
+	} catch (err) {
+		t.equal(err.message, 'Response code 403 (Forbidden)', 'Listing audit events without a JWT should give 403');
+	}
+});
+
+test('test-cases/13auditEvents.js: Filter audit events', async t => {
+	const createRes = await got(`${process.env.AUTH_URL}/audit-events`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		searchParams: { action: 'account.create', targetId: accountID },
+		responseType: 'json',
+	});
+	t.equal(createRes.body.events.length, 1, 'There should be one account.create event for the account');
+	t.equal(createRes.body.events[0].actorId, adminJWT.accountId, 'The admin should be the actor of account.create');
+	t.equal(createRes.body.events[0].outcome, 'success', 'account.create should be a success');
+
+	const deniedRes = await got(`${process.env.AUTH_URL}/audit-events`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		searchParams: { action: 'auth.password', outcome: 'denied', targetId: accountID },
+		responseType: 'json',
+	});
+	t.equal(deniedRes.body.events.length, 1, 'The failed login should be recorded as denied');
+	t.equal(deniedRes.body.events[0].actorId, undefined, 'The failed login should have no actor');
+	t.equal(deniedRes.body.events[0].diff.name, name, 'The failed login should have the name in the diff');
+
+	const successRes = await got(`${process.env.AUTH_URL}/audit-events`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		searchParams: { action: 'auth.password', actorId: accountID, outcome: 'success' },
+		responseType: 'json',
+	});
+	t.equal(successRes.body.events.length, 1, 'The login should be recorded as a success');
+	t.equal(successRes.body.events[0].targetId, accountID, 'The login should have the account as target');
+});
+
+test('test-cases/13auditEvents.js: Paginate audit events', async t => {
+	const firstRes = await got(`${process.env.AUTH_URL}/audit-events`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		searchParams: { accountId: accountID, limit: 2 },
+		responseType: 'json',
+	});
+	t.equal(firstRes.body.events.length, 2, 'The first page should have 2 events');
+	t.equal(firstRes.body.events[0].action, 'auth.password', 'The newest event should be first');
+	t.notEqual(firstRes.body.nextCursor, undefined, 'There should be a next cursor');
+
+	const secondRes = await got(`${process.env.AUTH_URL}/audit-events`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+		searchParams: { accountId: accountID, cursor: firstRes.body.nextCursor, limit: 2 },
+		responseType: 'json',
+	});
+	t.equal(secondRes.body.events.length, 1, 'The second page should have the last event');
+	t.equal(secondRes.body.events[0].action, 'account.create', 'The oldest event should be last');
+	t.equal(secondRes.body.nextCursor, undefined, 'There should be no next cursor after the last page');
+});
+
+test('test-cases/13auditEvents.js: Invalid audit event parameters', async t => {
+	try {
+		await got(`${process.env.AUTH_URL}/audit-events`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			searchParams: { limit: 0, outcome: 'maybe' },
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('An invalid limit and outcome should give 400');
+	} catch (err) {
+		t.equal(err.message, 'Response code 400 (Bad Request)', 'An invalid limit and outcome should give 400');
+		t.equal(err.response.body.length, 2, 'There should be one error for each invalid parameter');
+	}
+
+	try {
+		await got(`${process.env.AUTH_URL}/audit-events`, {
+			headers: { 'Authorization': `bearer ${adminJWTString}`},
+			searchParams: { cursor: 'nope' },
+			responseType: 'json',
+			retry: { limit: 0 },
+		});
+		t.fail('An invalid cursor should give 400');
+	} catch (err) {
+		t.equal(err.message, 'Response code 400 (Bad Request)', 'An invalid cursor should give 400');
+	}
+});
+
+test('test-cases/13auditEvents.js: Clean up', async t => {
+	await got.delete(`${process.env.AUTH_URL}/accounts/${accountID}`, {
+		headers: { 'Authorization': `bearer ${adminJWTString}`},
+	});
+
+	t.pass('Created account removed');
+});